@@ -27,5 +27,6 @@ import (
 func CreateCmd() *cobra.Command {
 	cmd := create.Cmd()
 	cmd.AddCommand(create.HTTPProxyCmd())
+	cmd.AddCommand(create.ProviderProxyCmd())
 	return cmd
 }
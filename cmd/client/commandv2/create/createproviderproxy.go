@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package create
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/megaease/easegress/v2/cmd/client/commandv2/specs"
+	"github.com/megaease/easegress/v2/cmd/client/general"
+	"github.com/megaease/easegress/v2/cmd/client/resources"
+	"github.com/megaease/easegress/v2/pkg/filters"
+	"github.com/megaease/easegress/v2/pkg/filters/proxies/providerproxy"
+	"github.com/megaease/easegress/v2/pkg/object/httpserver/routers"
+	"github.com/megaease/easegress/v2/pkg/util/pathadaptor"
+	"github.com/spf13/cobra"
+)
+
+// ProviderProxyOptions are the options to create a ProviderProxy.
+type ProviderProxyOptions struct {
+	Name      string
+	Port      int
+	Path      string
+	Providers []string
+	Chains    []string
+	Policy    string
+	Lag       uint64
+	ProbeType string
+	Interval  string
+
+	chains []*providerproxy.ChainSpec
+}
+
+var providerProxyOptions = &ProviderProxyOptions{}
+
+var providerProxyExamples = `# General case
+egctl create providerproxy NAME --port PORT \
+	[--path PATH] \
+	[--provider URL] \
+	[--chain CHAIN=URL1,URL2] \
+	[--policy POLICY] \
+	[--lag LAG] \
+	[--probe-type PROBE_TYPE] \
+	[--interval INTERVAL]
+
+# Create a HTTPServer (with port 10080) and a Pipeline to proxy JSON-RPC
+# requests to the provider with the most recent block.
+egctl create providerproxy eth --port 10080 \
+	--provider https://rpc.ankr.com/eth \
+	--provider https://eth.llamarpc.com \
+	--policy blockLag --lag 10
+
+# Create a HTTPServer (with port 10081) and a Pipeline serving requests to
+# "/rpc/eth" with Ethereum providers and requests to "/rpc/sol" with Solana
+# providers.
+egctl create providerproxy multichain --port 10081 --path /rpc \
+	--chain eth=https://rpc.ankr.com/eth,https://eth.llamarpc.com \
+	--chain sol=https://api.mainnet-beta.solana.com \
+	--policy blockLag
+`
+
+// ProviderProxyCmd returns create command of ProviderProxy.
+func ProviderProxyCmd() *cobra.Command {
+	o := providerProxyOptions
+
+	cmd := &cobra.Command{
+		Use:     "providerproxy NAME",
+		Short:   "Create a HTTPServer and a Pipeline with ProviderProxy to proxy blockchain RPC requests",
+		Args:    providerProxyArgs,
+		Example: general.CreateMultiLineExample(providerProxyExamples),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := providerProxyRun(cmd, args)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+		},
+	}
+
+	cmd.Flags().IntVar(&o.Port, "port", -1, "Port of HTTPServer")
+	cmd.Flags().StringVar(&o.Path, "path", "/", "Path prefix of HTTPServer routed to the ProviderProxy")
+	cmd.Flags().StringArrayVar(&o.Providers, "provider", []string{}, "URL of provider of the default chain")
+	cmd.Flags().StringArrayVar(&o.Chains, "chain", []string{}, "Chain in format name=url1,url2, which serves requests to path PATH/name")
+	cmd.Flags().StringVar(&o.Policy, "policy", "roundRobin", "Policy to select provider, roundRobin, blockLag or cost")
+	cmd.Flags().Uint64Var(&o.Lag, "lag", 0, "Max block lag of providers for policy blockLag and cost")
+	cmd.Flags().StringVar(&o.ProbeType, "probe-type", "", "Way to probe the head of providers, evm or solana")
+	cmd.Flags().StringVar(&o.Interval, "interval", "", "Interval to probe providers")
+	return cmd
+}
+
+func providerProxyArgs(_ *cobra.Command, args []string) error {
+	o := providerProxyOptions
+	if len(args) != 1 {
+		return fmt.Errorf("create providerproxy requires a name")
+	}
+	if o.Port < 0 || o.Port > 65535 {
+		return fmt.Errorf("port %d is invalid", o.Port)
+	}
+	if len(o.Providers) == 0 && len(o.Chains) == 0 {
+		return fmt.Errorf("provider or chain is required")
+	}
+	if !strings.HasPrefix(o.Path, "/") {
+		return fmt.Errorf("path %s should start with /", o.Path)
+	}
+	return nil
+}
+
+func providerProxyRun(cmd *cobra.Command, args []string) error {
+	o := providerProxyOptions
+	o.Complete(args)
+	if err := o.Parse(); err != nil {
+		return err
+	}
+	hs, pl := o.Translate()
+	for _, s := range []interface{}{hs, pl} {
+		spec, err := toGeneralSpec(s)
+		if err != nil {
+			return err
+		}
+		if err := resources.CreateObject(cmd, spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Complete completes all the required options.
+func (o *ProviderProxyOptions) Complete(args []string) {
+	o.Name = args[0]
+}
+
+// Parse parses all the optional options.
+func (o *ProviderProxyOptions) Parse() error {
+	chains := []*providerproxy.ChainSpec{}
+	for _, c := range o.Chains {
+		parts := strings.SplitN(c, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("chain %s should in format 'name=url1,url2', invalid format", c)
+		}
+		urls := general.Filter(strings.Split(parts[1], ","), func(s string) bool {
+			return s != ""
+		})
+		chain := &providerproxy.ChainSpec{
+			Name:       parts[0],
+			PathPrefix: "/" + parts[0],
+			Urls:       urls,
+		}
+		if err := chain.Validate(); err != nil {
+			return err
+		}
+		chains = append(chains, chain)
+	}
+	o.chains = chains
+	return nil
+}
+
+func (o *ProviderProxyOptions) getServerName() string {
+	return o.Name
+}
+
+func (o *ProviderProxyOptions) getPipelineName() string {
+	return fmt.Sprintf("%s-0", o.Name)
+}
+
+// Translate translates ProviderProxyOptions to HTTPServerSpec and PipelineSpec.
+func (o *ProviderProxyOptions) Translate() (*specs.HTTPServerSpec, *specs.PipelineSpec) {
+	pipelineName := o.getPipelineName()
+
+	hs := specs.NewHTTPServerSpec(o.getServerName())
+	hs.Port = uint16(o.Port)
+	hs.Rules = routers.Rules{{
+		Paths: []*routers.Path{{
+			PathPrefix: o.Path,
+			Backend:    pipelineName,
+		}},
+	}}
+
+	proxy := specs.NewProviderProxyFilterSpec("proxy")
+	proxy.Urls = o.Providers
+	proxy.Chains = o.chains
+	proxy.Policy = o.Policy
+	proxy.Lag = o.Lag
+	proxy.ProbeType = o.ProbeType
+	if o.Interval != "" {
+		proxy.Interval = o.Interval
+	}
+
+	filterSpecs := []filters.Spec{}
+	if path := strings.TrimSuffix(o.Path, "/"); path != "" {
+		adaptor := specs.NewRequestAdaptorFilterSpec("trimPath")
+		adaptor.Path = &pathadaptor.Spec{TrimPrefix: path}
+		filterSpecs = append(filterSpecs, adaptor)
+	}
+	filterSpecs = append(filterSpecs, proxy)
+
+	pl := specs.NewPipelineSpec(pipelineName)
+	pl.SetFilters(filterSpecs)
+	return hs, pl
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package create
+
+import (
+	"testing"
+
+	"github.com/megaease/easegress/v2/cmd/client/commandv2/specs"
+	"github.com/megaease/easegress/v2/pkg/filters/proxies/providerproxy"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviderProxyArgs(t *testing.T) {
+	assert := assert.New(t)
+
+	o := providerProxyOptions
+	defer func() { *providerProxyOptions = ProviderProxyOptions{} }()
+
+	*o = ProviderProxyOptions{Port: 10080, Path: "/", Providers: []string{"http://127.0.0.1:8545"}}
+	assert.NoError(providerProxyArgs(nil, []string{"demo"}))
+	assert.Error(providerProxyArgs(nil, []string{}))
+
+	*o = ProviderProxyOptions{Port: 10080, Path: "/"}
+	assert.Error(providerProxyArgs(nil, []string{"demo"}))
+
+	*o = ProviderProxyOptions{Port: 100000, Path: "/", Providers: []string{"http://127.0.0.1:8545"}}
+	assert.Error(providerProxyArgs(nil, []string{"demo"}))
+
+	*o = ProviderProxyOptions{Port: 10080, Path: "rpc", Providers: []string{"http://127.0.0.1:8545"}}
+	assert.Error(providerProxyArgs(nil, []string{"demo"}))
+}
+
+func TestProviderProxyTranslate(t *testing.T) {
+	assert := assert.New(t)
+
+	o := &ProviderProxyOptions{
+		Port:   10080,
+		Path:   "/rpc",
+		Chains: []string{"eth=http://127.0.0.1:8545,http://127.0.0.1:8546", "sol=http://127.0.0.1:8899"},
+		Policy: "blockLag",
+		Lag:    10,
+	}
+	o.Complete([]string{"demo"})
+	assert.NoError(o.Parse())
+
+	hs, pl := o.Translate()
+	assert.Equal("demo", hs.Name)
+	assert.Equal(uint16(10080), hs.Port)
+	assert.Len(hs.Rules, 1)
+	assert.Equal("/rpc", hs.Rules[0].Paths[0].PathPrefix)
+	assert.Equal("demo-0", hs.Rules[0].Paths[0].Backend)
+
+	assert.Equal("demo-0", pl.Name)
+	assert.Len(pl.Filters, 2)
+	assert.Equal("RequestAdaptor", pl.Filters[0]["kind"])
+
+	proxy := specs.NewProviderProxyFilterSpec("proxy")
+	assert.NoError(codectool.UnmarshalYAML(codectool.MustMarshalYAML(pl.Filters[1]), proxy))
+	assert.Equal(providerproxy.Kind, proxy.Kind())
+	assert.Equal("blockLag", proxy.Policy)
+	assert.Equal(uint64(10), proxy.Lag)
+	assert.Len(proxy.Chains, 2)
+	assert.Equal("/eth", proxy.Chains[0].PathPrefix)
+	assert.Equal([]string{"http://127.0.0.1:8545", "http://127.0.0.1:8546"}, proxy.Chains[0].Urls)
+	assert.NoError(proxy.Validate())
+
+	// no path adaptor for the root path.
+	o = &ProviderProxyOptions{Port: 10080, Path: "/", Providers: []string{"http://127.0.0.1:8545"}}
+	o.Complete([]string{"demo"})
+	assert.NoError(o.Parse())
+	_, pl = o.Translate()
+	assert.Len(pl.Filters, 1)
+	assert.Equal(providerproxy.Kind, pl.Filters[0]["kind"])
+
+	o = &ProviderProxyOptions{Chains: []string{"eth"}}
+	assert.Error(o.Parse())
+	o = &ProviderProxyOptions{Chains: []string{"eth="}}
+	assert.Error(o.Parse())
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package commandv2 provides the new version of commands.
+package commandv2
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/megaease/easegress/v2/cmd/client/general"
+	"github.com/megaease/easegress/v2/pkg/filters/proxies/providerproxy"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+	"github.com/spf13/cobra"
+)
+
+// ScorecardCmd returns scorecard command.
+func ScorecardCmd() *cobra.Command {
+	var window string
+	var csv bool
+	examples := []general.Example{
+		{Desc: "Show the provider scorecards of all ProviderProxies.", Command: "egctl scorecard"},
+		{Desc: "Show the provider scorecard of a ProviderProxy over the last hour.", Command: "egctl scorecard <pipeline>/<filter> --window 1h"},
+		{Desc: "Export the provider scorecards as JSON.", Command: "egctl scorecard -o json > scorecards.json"},
+		{Desc: "Export the provider scorecards as CSV.", Command: "egctl scorecard --csv > scorecards.csv"},
+	}
+
+	cmd := &cobra.Command{
+		Use:     "scorecard [PIPELINE/FILTER]",
+		Short:   "Show the provider scorecards of ProviderProxies",
+		Args:    cobra.MaximumNArgs(1),
+		Example: createMultiExample(examples),
+		Run: func(cmd *cobra.Command, args []string) {
+			p := makePath(general.ScorecardsURL)
+			if len(args) == 1 {
+				pipeline, filter, ok := strings.Cut(args[0], "/")
+				if !ok || pipeline == "" || filter == "" {
+					general.ExitWithError(errors.New("scorecard name should be in the form of PIPELINE/FILTER"))
+				}
+				p = makePath(general.ScorecardItemURL, url.PathEscape(pipeline), url.PathEscape(filter))
+			}
+
+			query := url.Values{}
+			if window != "" {
+				query.Set("window", window)
+			}
+			if csv {
+				query.Set("format", "csv")
+			}
+			if len(query) > 0 {
+				p += "?" + query.Encode()
+			}
+
+			body, err := handleReq(http.MethodGet, p, nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			if csv {
+				fmt.Print(string(body))
+				return
+			}
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			cards := []*providerproxy.Scorecard{}
+			if err = codectool.Unmarshal(body, &cards); err != nil {
+				general.ExitWithErrorf("unmarshal scorecards failed: %v", err)
+			}
+			printScorecards(cards)
+		},
+	}
+	cmd.Flags().StringVar(&window, "window", "", "Comma separated windows of the scorecards, defaults to all windows configured in the ProviderProxy.")
+	cmd.Flags().BoolVar(&csv, "csv", false, "Print the scorecards in CSV format.")
+	return cmd
+}
+
+func printScorecards(cards []*providerproxy.Scorecard) {
+	formatFloat := func(f float64, prec int) string {
+		return strconv.FormatFloat(f, 'f', prec, 64)
+	}
+
+	table := [][]string{{"NAME", "WINDOW", "CHAIN", "PROVIDER", "REQUESTS", "AVAILABILITY",
+		"ERROR-RATE", "P50", "P95", "P99", "AVG-LAG", "EJECTED"}}
+	for _, card := range cards {
+		for _, p := range card.Providers {
+			table = append(table, []string{
+				card.Name,
+				card.Window,
+				p.Chain,
+				p.Provider,
+				strconv.FormatInt(p.Requests, 10),
+				formatFloat(p.Availability*100, 2) + "%",
+				formatFloat(p.ErrorRate*100, 2) + "%",
+				formatFloat(p.P50, 1) + "ms",
+				formatFloat(p.P95, 1) + "ms",
+				formatFloat(p.P99, 1) + "ms",
+				formatFloat(p.AvgBlockLag, 1),
+				formatFloat(p.EjectedSeconds, 0) + "s",
+			})
+		}
+	}
+	general.PrintTable(table)
+}
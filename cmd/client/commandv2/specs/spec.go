@@ -22,6 +22,7 @@ import (
 	"github.com/megaease/easegress/v2/pkg/filters"
 	"github.com/megaease/easegress/v2/pkg/filters/builder"
 	"github.com/megaease/easegress/v2/pkg/filters/proxies/httpproxy"
+	"github.com/megaease/easegress/v2/pkg/filters/proxies/providerproxy"
 	"github.com/megaease/easegress/v2/pkg/object/autocertmanager"
 	"github.com/megaease/easegress/v2/pkg/object/httpserver"
 	"github.com/megaease/easegress/v2/pkg/object/pipeline"
@@ -92,6 +93,14 @@ func NewProxyFilterSpec(name string) *httpproxy.Spec {
 	return spec
 }
 
+// NewProviderProxyFilterSpec returns a new ProviderProxyFilterSpec.
+func NewProviderProxyFilterSpec(name string) *providerproxy.Spec {
+	spec := GetDefaultFilterSpec(providerproxy.Kind).(*providerproxy.Spec)
+	spec.BaseSpec.MetaSpec.Name = name
+	spec.BaseSpec.MetaSpec.Kind = providerproxy.Kind
+	return spec
+}
+
 // NewWebsocketFilterSpec returns a new WebsocketFilterSpec.
 func NewWebsocketFilterSpec(name string) *httpproxy.WebSocketProxySpec {
 	spec := GetDefaultFilterSpec(httpproxy.WebSocketProxyKind).(*httpproxy.WebSocketProxySpec)
@@ -75,6 +75,11 @@ const (
 	// MetricsURL is the URL of metrics.
 	MetricsURL = APIURL + "/metrics"
 
+	// ScorecardsURL is the URL of the provider scorecards of ProviderProxies.
+	ScorecardsURL = APIURL + "/providerproxy/scorecards"
+	// ScorecardItemURL is the URL of the provider scorecard of a ProviderProxy.
+	ScorecardItemURL = APIURL + "/providerproxy/scorecards/%s/%s"
+
 	// HTTPProtocol is prefix for HTTP protocol
 	HTTPProtocol = "http://"
 	// HTTPSProtocol is prefix for HTTPS protocol
@@ -423,6 +423,9 @@ func DescribeObject(cmd *cobra.Command, args *general.ArgInfo, kind string, flag
 	if len(specs) > 0 {
 		printNamespace(DefaultNamespace)
 		general.PrintMapInterface(specs, specials, []string{objectStatusKeyInSpec})
+		if kind == "Pipeline" {
+			printProviderProxyStatus(specs)
+		}
 		printSpace = true
 	}
 	for k, v := range namespaceSpecs {
@@ -438,6 +441,9 @@ func DescribeObject(cmd *cobra.Command, args *general.ArgInfo, kind string, flag
 		}
 		printNamespace(k)
 		general.PrintMapInterface(v, specials, []string{objectStatusKeyInSpec})
+		if kind == "Pipeline" {
+			printProviderProxyStatus(v)
+		}
 		printSpace = true
 	}
 	return nil
@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package resources
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/megaease/easegress/v2/cmd/client/general"
+	"github.com/megaease/easegress/v2/pkg/filters/proxies/providerproxy"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+// printProviderProxyStatus prints the provider status of the ProviderProxy
+// filters in the pipelines.
+func printProviderProxyStatus(specs []map[string]interface{}) {
+	// Output table:
+	// PIPELINE  FILTER  NODE  CHAIN  PROVIDER  HEIGHT  LAG  HEALTHY  REQUESTS  ERROR-RATE  P50  P99
+	table := [][]string{{"PIPELINE", "FILTER", "NODE", "CHAIN", "PROVIDER", "HEIGHT", "LAG", "HEALTHY", "REQUESTS", "ERROR-RATE", "P50", "P99"}}
+	for _, spec := range specs {
+		name, _ := spec["name"].(string)
+		nodes, _ := spec[objectStatusKeyInSpec].([]*NodeStatus)
+		for _, filter := range providerProxyFilters(spec) {
+			for _, node := range nodes {
+				status := providerProxyStatus(node, filter)
+				if status == nil {
+					continue
+				}
+				for _, c := range status.Chains {
+					for _, p := range c.Providers {
+						height := "-"
+						if p.Height != 0 {
+							height = strconv.FormatUint(p.Height, 10)
+						}
+						table = append(table, []string{
+							name, filter, node.Node, c.Name, p.Provider, height,
+							strconv.FormatUint(p.Lag, 10),
+							strconv.FormatBool(p.Healthy),
+							strconv.FormatInt(p.Requests, 10),
+							fmt.Sprintf("%.2f%%", p.ErrorRate*100),
+							fmt.Sprintf("%.0fms", p.P50),
+							fmt.Sprintf("%.0fms", p.P99),
+						})
+					}
+				}
+			}
+		}
+	}
+
+	if len(table) == 1 {
+		return
+	}
+	fmt.Println()
+	fmt.Println("ProviderProxy:")
+	fmt.Println("==============")
+	general.PrintTableWithPrefix(table, "  ")
+}
+
+// providerProxyFilters returns the names of the ProviderProxy filters in
+// the pipeline spec.
+func providerProxyFilters(spec map[string]interface{}) []string {
+	filters, _ := spec["filters"].([]interface{})
+	names := []string{}
+	for _, f := range filters {
+		m, ok := f.(map[string]interface{})
+		if !ok || m["kind"] != providerproxy.Kind {
+			continue
+		}
+		if name, ok := m["name"].(string); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// providerProxyStatus returns the status of the ProviderProxy filter on
+// the node, or nil if it is not available.
+func providerProxyStatus(node *NodeStatus, filter string) *providerproxy.Status {
+	filters, _ := node.Status["filters"].(map[string]interface{})
+	data, err := codectool.MarshalJSON(filters[filter])
+	if err != nil {
+		return nil
+	}
+	status := &providerproxy.Status{}
+	if err = codectool.Unmarshal(data, status); err != nil || len(status.Chains) == 0 {
+		return nil
+	}
+	return status
+}
@@ -41,7 +41,8 @@ const (
 	configObjectFormat        = "/config/objects/%s" // +objectName
 	configVersion             = "/config/version"
 	wasmCodeEvent             = "/wasm/code"
-	wasmDataPrefixFormat      = "/wasm/data/%s/%s/" // + pipelineName + filterName
+	wasmDataPrefixFormat      = "/wasm/data/%s/%s/"   // + pipelineName + filterName
+	rateLimiterPrefixFormat   = "/ratelimiter/%s/%s/" // + pipelineName + filterName
 	customDataKindPrefix      = "/custom-data-kinds/"
 	customDataPrefix          = "/custom-data/"
 
@@ -148,6 +149,16 @@ func (l *Layout) WasmDataPrefix(pipeline string, name string) string {
 	return fmt.Sprintf(wasmDataPrefixFormat, pipeline, name)
 }
 
+// RateLimiterPrefix returns the prefix of the counters of a rate limiter
+func (l *Layout) RateLimiterPrefix(pipeline string, name string) string {
+	return fmt.Sprintf(rateLimiterPrefixFormat, pipeline, name)
+}
+
+// RateLimiterKey returns the key of the counters of a rate limiter in current member
+func (l *Layout) RateLimiterKey(pipeline string, name string) string {
+	return l.RateLimiterPrefix(pipeline, name) + l.memberName
+}
+
 // CustomDataPrefix returns the prefix of all custom data
 func (l *Layout) CustomDataPrefix() string {
 	return customDataPrefix
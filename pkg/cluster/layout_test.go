@@ -67,6 +67,10 @@ func TestLayout(t *testing.T) {
 		t.Error("WasmDataPrefix empty")
 	}
 
+	l.memberName = "member-1"
+	assert.Equal("/ratelimiter/pipeline/ratelimiter/", l.RateLimiterPrefix("pipeline", "ratelimiter"))
+	assert.Equal("/ratelimiter/pipeline/ratelimiter/member-1", l.RateLimiterKey("pipeline", "ratelimiter"))
+
 	assert.Equal(customDataPrefix, l.CustomDataPrefix())
 	assert.Equal(customDataKindPrefix, l.CustomDataKindPrefix())
 
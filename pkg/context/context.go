@@ -21,6 +21,7 @@ package context
 import (
 	"bytes"
 	"runtime/debug"
+	"time"
 
 	"github.com/megaease/easegress/v2/pkg/logger"
 	"github.com/megaease/easegress/v2/pkg/protocols"
@@ -65,11 +66,18 @@ func (rr *responseRef) release() {
 	}
 }
 
+// UpstreamTiming is the time a filter spent on an upstream call.
+type UpstreamTiming struct {
+	Filter   string
+	Duration time.Duration
+}
+
 // Context holds requests, responses and other data that need to be passed
 // through the pipeline.
 type Context struct {
-	span     *tracing.Span
-	lazyTags []func() string
+	span            *tracing.Span
+	lazyTags        []func() string
+	upstreamTimings []UpstreamTiming
 
 	activeNs string
 
@@ -122,6 +130,16 @@ func (ctx *Context) LazyAddTag(lazyTagFunc func() string) {
 	ctx.lazyTags = append(ctx.lazyTags, lazyTagFunc)
 }
 
+// AddUpstreamTiming records the time the filter spent on an upstream call.
+func (ctx *Context) AddUpstreamTiming(filter string, d time.Duration) {
+	ctx.upstreamTimings = append(ctx.upstreamTimings, UpstreamTiming{Filter: filter, Duration: d})
+}
+
+// UpstreamTimings returns the upstream timings recorded by filters.
+func (ctx *Context) UpstreamTimings() []UpstreamTiming {
+	return ctx.upstreamTimings
+}
+
 // UseNamespace sets the active namespace.
 func (ctx *Context) UseNamespace(ns string) {
 	if ns == "" {
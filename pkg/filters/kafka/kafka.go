@@ -26,6 +26,7 @@ import (
 	"github.com/megaease/easegress/v2/pkg/filters"
 	"github.com/megaease/easegress/v2/pkg/logger"
 	"github.com/megaease/easegress/v2/pkg/protocols/mqttprot"
+	"github.com/megaease/easegress/v2/pkg/util/kafkatool"
 )
 
 const (
@@ -56,6 +57,7 @@ type (
 	Kafka struct {
 		spec     *Spec
 		producer sarama.AsyncProducer
+		metrics  *kafkatool.ProducerMetrics
 		done     chan struct{}
 
 		defaultTopic string
@@ -100,11 +102,20 @@ func (k *Kafka) setProducer() {
 	config := sarama.NewConfig()
 	config.ClientID = k.spec.Name()
 	config.Version = sarama.V1_0_0_0
+	config.Producer.Return.Successes = true
+	if err := kafkatool.ApplySecurity(config, k.spec.TLS, k.spec.SASL); err != nil {
+		panic(fmt.Errorf("invalid kafka security settings: %v", err))
+	}
+	if k.spec.Producer != nil {
+		k.spec.Producer.Apply(config)
+	}
+
 	producer, err := newAsyncProducer(k.spec.Backend, config)
 	if err != nil {
 		panic(fmt.Errorf("start sarama producer with address %v failed: %v", k.spec.Backend, err))
 	}
 	k.producer = producer
+	k.metrics = kafkatool.NewProducerMetrics(Kind, k.spec.Pipeline(), k.spec.Name())
 
 	go func() {
 		for {
@@ -119,7 +130,13 @@ func (k *Kafka) setProducer() {
 				if !ok {
 					return
 				}
+				k.metrics.Observe(err.Msg, err.Err)
 				logger.SpanErrorf(nil, "sarama producer failed: %v", err)
+			case msg, ok := <-producer.Successes():
+				if !ok {
+					return
+				}
+				k.metrics.Observe(msg, nil)
 			}
 		}
 	}()
@@ -211,6 +228,7 @@ func (k *Kafka) Handle(ctx *context.Context) string {
 		Headers: kafkaHeaders,
 		Value:   sarama.ByteEncoder(payload),
 	}
+	kafkatool.Start(msg)
 	k.producer.Input() <- msg
 	return ""
 }
@@ -17,7 +17,10 @@
 
 package kafka
 
-import "github.com/megaease/easegress/v2/pkg/filters"
+import (
+	"github.com/megaease/easegress/v2/pkg/filters"
+	"github.com/megaease/easegress/v2/pkg/util/kafkatool"
+)
 
 type (
 	// Spec is spec of Kafka
@@ -27,6 +30,10 @@ type (
 		Backend []string `json:"backend" jsonschema:"required,uniqueItems=true"`
 		Topic   *Topic   `json:"topic" jsonschema:"required"`
 		KVMap   *KVMap   `json:"mqtt" jsonschema:"required"`
+
+		TLS      *kafkatool.TLSSpec      `json:"tls,omitempty"`
+		SASL     *kafkatool.SASLSpec     `json:"sasl,omitempty"`
+		Producer *kafkatool.ProducerSpec `json:"producer,omitempty"`
 	}
 
 	// Topic defined ways to get Kafka topic
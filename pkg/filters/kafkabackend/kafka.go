@@ -29,6 +29,7 @@ import (
 	"github.com/megaease/easegress/v2/pkg/logger"
 	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
 	"github.com/megaease/easegress/v2/pkg/util/codectool"
+	"github.com/megaease/easegress/v2/pkg/util/kafkatool"
 )
 
 const (
@@ -60,6 +61,7 @@ type (
 		spec          *Spec
 		asyncProducer sarama.AsyncProducer
 		syncProcuder  sarama.SyncProducer
+		metrics       *kafkatool.ProducerMetrics
 
 		headerTopic string
 		headerKey   string
@@ -114,8 +116,16 @@ func (k *Kafka) Init() {
 	config := sarama.NewConfig()
 	config.ClientID = spec.Name()
 	config.Version = sarama.V1_0_0_0
+	config.Producer.Return.Successes = true
+	if err := kafkatool.ApplySecurity(config, spec.TLS, spec.SASL); err != nil {
+		panic(fmt.Errorf("invalid kafka security settings: %v", err))
+	}
+	if spec.Producer != nil {
+		spec.Producer.Apply(config)
+	}
+	k.metrics = kafkatool.NewProducerMetrics(Kind, spec.Pipeline(), spec.Name())
+
 	if spec.Sync {
-		config.Producer.Return.Successes = true
 		producer, err := sarama.NewSyncProducer(k.spec.Backend, config)
 		if err != nil {
 			panic(fmt.Errorf("start sarama sync producer with address %v failed: %v", spec.Backend, err))
@@ -145,7 +155,13 @@ func (k *Kafka) checkProduceError() {
 			if !ok {
 				return
 			}
+			k.metrics.Observe(err.Msg, err.Err)
 			logger.Errorf("sarama producer failed: %v", err)
+		case msg, ok := <-k.asyncProducer.Successes():
+			if !ok {
+				return
+			}
+			k.metrics.Observe(msg, nil)
 		}
 	}
 }
@@ -206,8 +222,10 @@ func (k *Kafka) Handle(ctx *context.Context) (result string) {
 		msg.Key = sarama.StringEncoder(key)
 	}
 
+	kafkatool.Start(msg)
 	if k.spec.Sync {
 		_, _, err = k.syncProcuder.SendMessage(msg)
+		k.metrics.Observe(msg, err)
 		if err != nil {
 			logger.Errorf("send message to kafka failed: %v", err)
 			setErrResponse(ctx, err)
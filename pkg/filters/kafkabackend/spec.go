@@ -17,7 +17,10 @@
 
 package kafka
 
-import "github.com/megaease/easegress/v2/pkg/filters"
+import (
+	"github.com/megaease/easegress/v2/pkg/filters"
+	"github.com/megaease/easegress/v2/pkg/util/kafkatool"
+)
 
 type (
 	// Spec is spec of Kafka
@@ -29,6 +32,10 @@ type (
 
 		Topic *Topic `json:"topic" jsonschema:"required"`
 		Key   Key    `json:"key,omitempty"`
+
+		TLS      *kafkatool.TLSSpec      `json:"tls,omitempty"`
+		SASL     *kafkatool.SASLSpec     `json:"sasl,omitempty"`
+		Producer *kafkatool.ProducerSpec `json:"producer,omitempty"`
 	}
 
 	// Topic defined ways to get Kafka topic
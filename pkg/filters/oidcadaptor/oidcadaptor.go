@@ -19,6 +19,7 @@
 package oidcadaptor
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -31,7 +32,9 @@ import (
 	"github.com/MicahParks/keyfunc"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
+	"golang.org/x/sync/singleflight"
 
+	"github.com/megaease/easegress/v2/pkg/cluster"
 	"github.com/megaease/easegress/v2/pkg/context"
 	"github.com/megaease/easegress/v2/pkg/filters"
 	"github.com/megaease/easegress/v2/pkg/logger"
@@ -82,6 +85,9 @@ type OIDCAdaptor struct {
 	redirectPath string
 	oidcConfig   *oidcConfig
 	jwks         *keyfunc.JWKS
+
+	sessions     sessionStore
+	refreshGroup singleflight.Group
 }
 
 // Spec defines the spec of OIDCAdaptor.
@@ -99,8 +105,24 @@ type Spec struct {
 	AuthorizationEndpoint string `json:"authorizationEndpoint"`
 	TokenEndpoint         string `json:"tokenEndpoint"`
 	UserInfoEndpoint      string `json:"userinfoEndpoint"`
+	// RevocationEndpoint and EndSessionEndpoint override the ones from
+	// Discovery if configured.
+	RevocationEndpoint string `json:"revocationEndpoint,omitempty"`
+	EndSessionEndpoint string `json:"endSessionEndpoint,omitempty"`
 
 	RedirectURI string `json:"redirectURI" jsonschema:"required"`
+
+	// PKCE enables Proof Key for Code Exchange with the S256 method.
+	PKCE bool `json:"pkce,omitempty"`
+
+	// LogoutPath is the path to log out, requests to it end the session
+	// and are redirected to the end session endpoint of the provider.
+	LogoutPath            string `json:"logoutPath,omitempty"`
+	PostLogoutRedirectURI string `json:"postLogoutRedirectURI,omitempty"`
+
+	// Session enables sessions, the tokens are kept in the sessions and
+	// the access tokens are refreshed before they expire.
+	Session *SessionSpec `json:"session,omitempty"`
 }
 
 type oidcConfig struct {
@@ -110,6 +132,7 @@ type oidcConfig struct {
 	TokenEndpoint                     string   `json:"token_endpoint"`
 	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
 	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	EndSessionEndpoint                string   `json:"end_session_endpoint"`
 	JwksURI                           string   `json:"jwks_uri"`
 	ResponseTypesSupported            []string `json:"response_types_supported"`
 	SubjectTypesSupported             []string `json:"subject_types_supported"`
@@ -161,6 +184,27 @@ func (o *OIDCAdaptor) Init() {
 			UserInfoEndpoint:      o.spec.UserInfoEndpoint,
 		}
 	}
+	if o.spec.RevocationEndpoint != "" {
+		o.oidcConfig.RevocationEndpoint = o.spec.RevocationEndpoint
+	}
+	if o.spec.EndSessionEndpoint != "" {
+		o.oidcConfig.EndSessionEndpoint = o.spec.EndSessionEndpoint
+	}
+	if ss := o.spec.Session; ss != nil {
+		if ss.Store == sessionStoreCustomData {
+			var cls cluster.Cluster
+			if super := o.spec.Super(); super != nil {
+				cls = super.Cluster()
+			}
+			o.sessions = newCustomDataSessionStore(cls, ss.CustomDataKind)
+		} else {
+			secret := ss.Secret
+			if secret == "" {
+				secret = o.spec.ClientSecret
+			}
+			o.sessions = newCookieSessionStore(secret)
+		}
+	}
 	o.setAccessTokenHeader = true
 	o.setIDTokenHeader = true
 	o.setUserInfoHeader = true
@@ -187,6 +231,13 @@ func (o *OIDCAdaptor) Handle(ctx *context.Context) (result string) {
 	}
 	spec := o.spec
 
+	if spec.LogoutPath != "" && req.Path() == spec.LogoutPath {
+		return o.handleLogout(ctx)
+	}
+	if o.sessions != nil {
+		return o.handleSession(ctx)
+	}
+
 	if len(spec.CookieName) != 0 {
 		if _, e := req.Cookie(spec.CookieName); e == nil {
 			return ""
@@ -201,6 +252,10 @@ func (o *OIDCAdaptor) Handle(ctx *context.Context) (result string) {
 	if req.Path() == o.redirectPath {
 		return o.handleOIDCCallback(ctx)
 	}
+	return o.redirectToAuthorize(req, rw)
+}
+
+func (o *OIDCAdaptor) redirectToAuthorize(req *httpprot.Request, rw *httpprot.Response) string {
 	authorizeURL := o.buildAuthorizeURL(req)
 	rw.SetStatusCode(http.StatusFound)
 	rw.Header().Set("Location", authorizeURL)
@@ -283,6 +338,14 @@ func (o *OIDCAdaptor) handleOIDCCallback(ctx *context.Context) string {
 			return errorResp(rw, "fetch OAuth2 userinfo error: "+err.Error())
 		}
 	}
+	if o.sessions != nil {
+		return o.startSession(rw, reqURL, oidcToken, userInfo)
+	}
+	o.setUserInfo(req, userInfo)
+	return ""
+}
+
+func (o *OIDCAdaptor) setUserInfo(req *httpprot.Request, userInfo map[string]any) {
 	if o.setUserInfoHeader {
 		jsonBytes, err := json.Marshal(userInfo)
 		if err != nil {
@@ -290,7 +353,6 @@ func (o *OIDCAdaptor) handleOIDCCallback(ctx *context.Context) string {
 		}
 		req.Header().Set("X-User-Info", base64.StdEncoding.EncodeToString(jsonBytes))
 	}
-	return ""
 }
 
 func (o *OIDCAdaptor) fetchOIDCToken(authCode string, state string, spec *Spec, rw *httpprot.Response, req *httpprot.Request) (*oidcIDToken, error) {
@@ -303,16 +365,44 @@ func (o *OIDCAdaptor) fetchOIDCToken(authCode string, state string, spec *Spec,
 		"state":         {state},
 		"redirect_uri":  {spec.RedirectURI},
 	}
+	if spec.PKCE {
+		// https://datatracker.ietf.org/doc/html/rfc7636#section-4.5
+		tokenFormData.Set("code_verifier", o.store.get(clusterCacheKey("code_verifier", state)))
+	}
+	return o.requestToken(tokenFormData)
+}
+
+// refreshToken gets new tokens with the refresh token.
+// https://openid.net/specs/openid-connect-core-1_0.html#RefreshTokens
+func (o *OIDCAdaptor) refreshToken(refreshToken string) (*oidcIDToken, error) {
+	tokenFormData := url.Values{
+		"client_id":     {o.spec.ClientID},
+		"client_secret": {o.spec.ClientSecret},
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	}
+	return o.requestToken(tokenFormData)
+}
+
+func (o *OIDCAdaptor) newClientRequest(endpoint string, form url.Values) *http.Request {
+	req, _ := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	authBasic := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", o.spec.ClientID, o.spec.ClientSecret)))
+	req.Header.Set("Authorization", "Basic "+authBasic)
+	req.Header.Set("Accept", "application/json")
+	return req
+}
+
+func (o *OIDCAdaptor) requestToken(form url.Values) (*oidcIDToken, error) {
 	// https://openid.net/specs/openid-connect-core-1_0.html#TokenRequest
-	tokenReq, _ := http.NewRequest(http.MethodPost, o.oidcConfig.TokenEndpoint, strings.NewReader(tokenFormData.Encode()))
-	tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	authBasic := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", spec.ClientID, spec.ClientSecret)))
-	tokenReq.Header.Set("Authorization", "Basic "+authBasic)
-	tokenReq.Header.Set("Accept", "application/json")
+	tokenReq := o.newClientRequest(o.oidcConfig.TokenEndpoint, form)
 
 	resp, err := httpCli.Do(tokenReq)
 	var oidcToken oidcIDToken
 	err = readResp(resp, err, &oidcToken)
+	if err == nil && oidcToken.AccessToken == "" {
+		err = fmt.Errorf("no access token in response")
+	}
 	if err != nil {
 		logger.Errorf("handle oidc tokenRequest['%s'] error: %s", o.oidcConfig.TokenEndpoint, err)
 		return nil, err
@@ -393,6 +483,17 @@ func (o *OIDCAdaptor) buildAuthorizeURL(req *httpprot.Request) string {
 	if err != nil {
 		logger.Errorf("put origin request url error: %s", err)
 	}
+	if o.spec.PKCE {
+		// https://datatracker.ietf.org/doc/html/rfc7636#section-4.2
+		verifier := randomString(32)
+		err = o.store.put(clusterCacheKey("code_verifier", state), verifier, 10*time.Minute)
+		if err != nil {
+			logger.Errorf("put oidc code verifier error: %s", err)
+		}
+		challenge := sha256.Sum256([]byte(verifier))
+		authURLBuilder.WriteString("&code_challenge=" + base64.RawURLEncoding.EncodeToString(challenge[:]))
+		authURLBuilder.WriteString("&code_challenge_method=S256")
+	}
 	// nonce is optional
 	nonce := strings.ReplaceAll(uuid.New().String(), "-", "")
 	authURLBuilder.WriteString("&nonce=" + nonce)
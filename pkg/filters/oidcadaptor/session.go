@@ -0,0 +1,477 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oidcadaptor
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"github.com/megaease/easegress/v2/pkg/cluster"
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+)
+
+const (
+	sessionStoreCookie     = "cookie"
+	sessionStoreCustomData = "customData"
+
+	defaultSessionCookieName = "eg_oidc_session"
+	defaultSessionMaxAge     = 24 * time.Hour
+
+	// access tokens are refreshed if they expire in refreshSkew
+	refreshSkew = 30 * time.Second
+
+	// browsers limit the size of a cookie to about 4KB including its name
+	// and attributes, so sessions stored in cookies can't be larger.
+	maxCookieSessionSize = 3800
+)
+
+type (
+	// SessionSpec defines the session of the authenticated user agents.
+	SessionSpec struct {
+		// Store is where the sessions are stored, cookie or customData,
+		// default is cookie.
+		Store string `json:"store,omitempty" jsonschema:"enum=,enum=cookie,enum=customData"`
+		// CustomDataKind is the custom data kind to store the sessions,
+		// required if Store is customData.
+		CustomDataKind string `json:"customDataKind,omitempty"`
+		CookieName     string `json:"cookieName,omitempty"`
+		MaxAge         string `json:"maxAge,omitempty" jsonschema:"format=duration"`
+		Secure         bool   `json:"secure,omitempty"`
+		// Secret is used to encrypt the sessions stored in cookies, the
+		// client secret is used if it is empty.
+		Secret string `json:"secret,omitempty"`
+	}
+
+	// session is the session of an authenticated user agent, ID is named
+	// "name" to be the ID field of custom data.
+	session struct {
+		ID           string         `json:"name,omitempty"`
+		AccessToken  string         `json:"accessToken"`
+		RefreshToken string         `json:"refreshToken,omitempty"`
+		IDToken      string         `json:"idToken,omitempty"`
+		TokenExpiry  int64          `json:"tokenExpiry,omitempty"`
+		Expiry       int64          `json:"expiry"`
+		UserInfo     map[string]any `json:"userInfo,omitempty"`
+	}
+
+	// sessionStore stores the sessions, the value in the session cookie is
+	// the encoded session or its ID depending on the implementation.
+	sessionStore interface {
+		load(value string) (*session, error)
+		save(s *session) (string, error)
+		delete(s *session)
+	}
+
+	cookieSessionStore struct {
+		aead cipher.AEAD
+	}
+
+	customDataSessionStore struct {
+		cls    cluster.Cluster
+		prefix string
+	}
+)
+
+var errNoCluster = fmt.Errorf("cluster is not available")
+
+// Validate validates SessionSpec.
+func (spec *SessionSpec) Validate() error {
+	if spec.Store == sessionStoreCustomData && spec.CustomDataKind == "" {
+		return fmt.Errorf("customDataKind is required if store is customData")
+	}
+	return nil
+}
+
+func (spec *SessionSpec) cookieName() string {
+	if spec.CookieName != "" {
+		return spec.CookieName
+	}
+	return defaultSessionCookieName
+}
+
+func (spec *SessionSpec) maxAge() time.Duration {
+	if d, err := time.ParseDuration(spec.MaxAge); err == nil && d > 0 {
+		return d
+	}
+	return defaultSessionMaxAge
+}
+
+func (s *session) expired() bool {
+	return time.Now().Unix() >= s.Expiry
+}
+
+// needRefresh returns true if the access token is expiring, and false if
+// the expiration time of the access token is unknown.
+func (s *session) needRefresh() bool {
+	if s.TokenExpiry == 0 {
+		return false
+	}
+	return time.Now().Add(refreshSkew).Unix() >= s.TokenExpiry
+}
+
+// updateTokens updates the tokens of the session with the token response.
+func (s *session) updateTokens(token *oidcIDToken) {
+	s.AccessToken = token.AccessToken
+	// the provider may not rotate refresh tokens
+	if token.RefreshToken != "" {
+		s.RefreshToken = token.RefreshToken
+	}
+	if token.IDToken != "" {
+		s.IDToken = token.IDToken
+	}
+	s.TokenExpiry = 0
+	if token.ExpiresIn > 0 {
+		s.TokenExpiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second).Unix()
+	}
+}
+
+func randomString(n int) string {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		panic(fmt.Errorf("read random bytes failed: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func newCookieSessionStore(secret string) sessionStore {
+	key := sha256.Sum256([]byte(secret))
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+	return &cookieSessionStore{aead: aead}
+}
+
+func (cs *cookieSessionStore) load(value string) (*session, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	size := cs.aead.NonceSize()
+	if len(data) < size {
+		return nil, fmt.Errorf("invalid session cookie")
+	}
+	data, err = cs.aead.Open(nil, data[:size], data[size:], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{}
+	if err = json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (cs *cookieSessionStore) save(s *session) (string, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, cs.aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	data = cs.aead.Seal(nonce, nonce, data, nil)
+	value := base64.RawURLEncoding.EncodeToString(data)
+	if len(value) > maxCookieSessionSize {
+		return "", fmt.Errorf("session is too large (%d bytes) to be stored in a cookie, please store sessions in custom data", len(value))
+	}
+	return value, nil
+}
+
+func (cs *cookieSessionStore) delete(s *session) {}
+
+// newCustomDataSessionStore creates a session store with the custom data of
+// the cluster, cls may be nil, and all operations of the store fail then.
+func newCustomDataSessionStore(cls cluster.Cluster, kind string) sessionStore {
+	if cls == nil {
+		logger.Errorf("cluster is not available, OIDC sessions can't be stored in custom data")
+		return &customDataSessionStore{}
+	}
+	return &customDataSessionStore{
+		cls:    cls,
+		prefix: cls.Layout().CustomDataPrefix() + kind + "/",
+	}
+}
+
+func (cds *customDataSessionStore) load(value string) (*session, error) {
+	if cds.cls == nil {
+		return nil, errNoCluster
+	}
+	data, err := cds.cls.Get(cds.prefix + value)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("session not found")
+	}
+
+	s := &session{}
+	if err = json.Unmarshal([]byte(*data), s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (cds *customDataSessionStore) save(s *session) (string, error) {
+	if cds.cls == nil {
+		return "", errNoCluster
+	}
+	if s.ID == "" {
+		s.ID = randomString(32)
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+
+	// the session is removed by etcd when it expires
+	ttl := time.Until(time.Unix(s.Expiry, 0))
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	err = cds.cls.PutUnderTimeout(cds.prefix+s.ID, string(data), ttl)
+	if err != nil {
+		return "", err
+	}
+	return s.ID, nil
+}
+
+func (cds *customDataSessionStore) delete(s *session) {
+	if cds.cls != nil && s.ID != "" {
+		cds.cls.Delete(cds.prefix + s.ID)
+	}
+}
+
+func (o *OIDCAdaptor) sessionCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     o.spec.Session.cookieName(),
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   o.spec.Session.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (o *OIDCAdaptor) loadSession(req *httpprot.Request) *session {
+	c, err := req.Cookie(o.spec.Session.cookieName())
+	if err != nil || c.Value == "" {
+		return nil
+	}
+
+	s, err := o.sessions.load(c.Value)
+	if err != nil {
+		logger.Debugf("load oidc session error: %s", err)
+		return nil
+	}
+	if s.expired() {
+		o.sessions.delete(s)
+		return nil
+	}
+	return s
+}
+
+// startSession creates a session after the user agent is authenticated, and
+// redirects it to the original request URL.
+func (o *OIDCAdaptor) startSession(rw *httpprot.Response, reqURL string, token *oidcIDToken, userInfo map[string]any) string {
+	maxAge := o.spec.Session.maxAge()
+	s := &session{
+		Expiry:   time.Now().Add(maxAge).Unix(),
+		UserInfo: userInfo,
+	}
+	s.updateTokens(token)
+
+	value, err := o.sessions.save(s)
+	if err != nil {
+		return errorResp(rw, "save OIDC session error: "+err.Error())
+	}
+
+	if reqURL == "" {
+		reqURL = "/"
+	}
+	rw.Std().Header.Add("Set-Cookie", o.sessionCookie(value, int(maxAge.Seconds())).String())
+	rw.SetStatusCode(http.StatusFound)
+	rw.Header().Set("Location", reqURL)
+	return resultFiltered
+}
+
+// refreshSession refreshes the tokens of the session, concurrent requests of
+// the same session share one refresh, because the refresh token may be
+// invalidated after it is used.
+func (o *OIDCAdaptor) refreshSession(key string, s *session) (*session, error) {
+	v, err, _ := o.refreshGroup.Do(key, func() (interface{}, error) {
+		token, err := o.refreshToken(s.RefreshToken)
+		if err != nil {
+			return nil, err
+		}
+
+		ns := *s
+		ns.updateTokens(token)
+		if token.IDToken != "" {
+			parsed, err := o.validateIDToken(token.IDToken)
+			if err != nil {
+				return nil, err
+			}
+			if claims, ok := parsed.Claims.(jwt.MapClaims); ok {
+				ns.UserInfo = claims
+			}
+		}
+		return &ns, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*session), nil
+}
+
+func (o *OIDCAdaptor) handleSession(ctx *context.Context) string {
+	req := ctx.GetInputRequest().(*httpprot.Request)
+	rw := ctx.GetOutputResponse().(*httpprot.Response)
+
+	if req.Path() == o.redirectPath {
+		return o.handleOIDCCallback(ctx)
+	}
+
+	s := o.loadSession(req)
+	if s == nil {
+		return o.redirectToAuthorize(req, rw)
+	}
+
+	if s.needRefresh() {
+		if s.RefreshToken == "" {
+			o.sessions.delete(s)
+			return o.redirectToAuthorize(req, rw)
+		}
+
+		c, _ := req.Cookie(o.spec.Session.cookieName())
+		ns, err := o.refreshSession(c.Value, s)
+		if err != nil {
+			logger.Warnf("refresh oidc session error: %s", err)
+			o.sessions.delete(s)
+			return o.redirectToAuthorize(req, rw)
+		}
+		s = ns
+
+		value, err := o.sessions.save(s)
+		if err != nil {
+			return errorResp(rw, "save OIDC session error: "+err.Error())
+		}
+
+		// the cookie must be updated if the session is stored in it.
+		if value != c.Value {
+			maxAge := int(time.Until(time.Unix(s.Expiry, 0)).Seconds())
+			// the output response of the pipeline is reused by the proxy,
+			// so the cookie is sent with the final response.
+			rw.Std().Header.Add("Set-Cookie", o.sessionCookie(value, maxAge).String())
+		}
+	}
+
+	if o.setAccessTokenHeader {
+		req.Header().Set("X-Access-Token", s.AccessToken)
+	}
+	if o.setIDTokenHeader && s.IDToken != "" {
+		req.Header().Set("X-ID-Token", s.IDToken)
+	}
+	o.setUserInfo(req, s.UserInfo)
+	return ""
+}
+
+// revokeToken revokes the token at the revocation endpoint.
+// https://datatracker.ietf.org/doc/html/rfc7009
+func (o *OIDCAdaptor) revokeToken(token, hint string) {
+	form := url.Values{
+		"token":           {token},
+		"token_type_hint": {hint},
+	}
+	resp, err := httpCli.Do(o.newClientRequest(o.oidcConfig.RevocationEndpoint, form))
+	if err != nil {
+		logger.Errorf("revoke oidc token error: %s", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		logger.Errorf("revoke oidc token error: status code %d", resp.StatusCode)
+	}
+}
+
+// handleLogout ends the session, revokes its tokens and redirects the user
+// agent to the end session endpoint of the provider.
+// https://openid.net/specs/openid-connect-rpinitiated-1_0.html
+func (o *OIDCAdaptor) handleLogout(ctx *context.Context) string {
+	req := ctx.GetInputRequest().(*httpprot.Request)
+	rw := ctx.GetOutputResponse().(*httpprot.Response)
+
+	var idToken string
+	if o.sessions != nil {
+		if s := o.loadSession(req); s != nil {
+			o.sessions.delete(s)
+			idToken = s.IDToken
+			if o.oidcConfig.RevocationEndpoint != "" {
+				if s.RefreshToken != "" {
+					o.revokeToken(s.RefreshToken, "refresh_token")
+				}
+				o.revokeToken(s.AccessToken, "access_token")
+			}
+		}
+		rw.Std().Header.Add("Set-Cookie", o.sessionCookie("", -1).String())
+	} else if o.spec.CookieName != "" {
+		c := &http.Cookie{Name: o.spec.CookieName, Path: "/", MaxAge: -1}
+		rw.Std().Header.Add("Set-Cookie", c.String())
+	}
+
+	location := o.spec.PostLogoutRedirectURI
+	if endpoint := o.oidcConfig.EndSessionEndpoint; endpoint != "" {
+		query := url.Values{"client_id": {o.spec.ClientID}}
+		if idToken != "" {
+			query.Set("id_token_hint", idToken)
+		}
+		if o.spec.PostLogoutRedirectURI != "" {
+			query.Set("post_logout_redirect_uri", o.spec.PostLogoutRedirectURI)
+		}
+		sep := "?"
+		if strings.Contains(endpoint, "?") {
+			sep = "&"
+		}
+		location = endpoint + sep + query.Encode()
+	}
+
+	if location == "" {
+		return filterResp(rw, http.StatusOK, "logged out")
+	}
+	rw.SetStatusCode(http.StatusFound)
+	rw.Header().Set("Location", location)
+	return resultFiltered
+}
@@ -0,0 +1,385 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oidcadaptor
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/cluster"
+	"github.com/megaease/easegress/v2/pkg/cluster/clustertest"
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/filters"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+type memStore map[string]string
+
+func (ms memStore) put(key, value string, timeout time.Duration) error {
+	ms[key] = value
+	return nil
+}
+
+func (ms memStore) get(key string) string {
+	return ms[key]
+}
+
+// fakeProvider is a fake identity provider.
+type fakeProvider struct {
+	*httptest.Server
+	lock       sync.Mutex
+	expiresIn  int
+	verifier   string
+	refreshes  int
+	refreshErr bool
+	revoked    []string
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	p := &fakeProvider{expiresIn: 3600}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/token":
+			var access, refresh string
+			switch r.Form.Get("grant_type") {
+			case "authorization_code":
+				if r.Form.Get("code") != "code" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				p.verifier = r.Form.Get("code_verifier")
+				access, refresh = "access-1", "refresh-1"
+			case "refresh_token":
+				if p.refreshErr || r.Form.Get("refresh_token") != "refresh-1" {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(`{"error":"invalid_grant"}`))
+					return
+				}
+				p.refreshes++
+				access = "access-2"
+			}
+
+			idToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+				"sub": "alice",
+				"exp": time.Now().Add(time.Hour).Unix(),
+			}).SignedString([]byte("secret"))
+			json.NewEncoder(w).Encode(map[string]any{
+				"access_token":  access,
+				"refresh_token": refresh,
+				"expires_in":    p.expiresIn,
+				"id_token":      idToken,
+			})
+		case "/revoke":
+			p.revoked = append(p.revoked, r.Form.Get("token"))
+		}
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func newTestAdaptor(t *testing.T, p *fakeProvider, store string, cls cluster.Cluster) *OIDCAdaptor {
+	yamlConfig := `
+kind: OIDCAdaptor
+name: oidc
+clientId: client
+clientSecret: secret
+authorizationEndpoint: ` + p.URL + `/authorize
+tokenEndpoint: ` + p.URL + `/token
+revocationEndpoint: ` + p.URL + `/revoke
+endSessionEndpoint: ` + p.URL + `/logout
+redirectURI: /oidc/callback
+pkce: true
+logoutPath: /oidc/logout
+session:
+  store: ` + store + `
+  customDataKind: oidc-sessions
+`
+	rawSpec := map[string]interface{}{}
+	codectool.MustUnmarshal([]byte(yamlConfig), &rawSpec)
+	spec, err := filters.NewSpec(nil, "pipeline", rawSpec)
+	assert.NoError(t, err)
+
+	o := kind.CreateInstance(spec).(*OIDCAdaptor)
+	o.Init()
+	o.store = memStore{}
+	if store == sessionStoreCustomData {
+		o.sessions = newCustomDataSessionStore(cls, "oidc-sessions")
+	}
+	return o
+}
+
+func newMemCluster() (*clustertest.MockedCluster, map[string]string) {
+	var lock sync.Mutex
+	kvs := map[string]string{}
+	cls := clustertest.NewMockedCluster()
+	cls.MockedLayout = func() *cluster.Layout { return &cluster.Layout{} }
+	cls.MockedGet = func(key string) (*string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if v, ok := kvs[key]; ok {
+			return &v, nil
+		}
+		return nil, nil
+	}
+	cls.MockedPutUnderTimeout = func(key, value string, timeout time.Duration) error {
+		lock.Lock()
+		defer lock.Unlock()
+		kvs[key] = value
+		return nil
+	}
+	cls.MockedDelete = func(key string) error {
+		lock.Lock()
+		defer lock.Unlock()
+		delete(kvs, key)
+		return nil
+	}
+	return cls, kvs
+}
+
+func newTestContext(method, target string, cookie *http.Cookie) *context.Context {
+	stdr, _ := http.NewRequest(method, target, nil)
+	if cookie != nil {
+		stdr.AddCookie(cookie)
+	}
+	req, _ := httpprot.NewRequest(stdr)
+	ctx := context.New(nil)
+	ctx.SetInputRequest(req)
+	return ctx
+}
+
+func responseCookie(h http.Header, name string) *http.Cookie {
+	for _, c := range (&http.Response{Header: h}).Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// login runs the authorization code flow and returns the session cookie.
+func login(t *testing.T, o *OIDCAdaptor, p *fakeProvider) *http.Cookie {
+	assert := assert.New(t)
+
+	ctx := newTestContext(http.MethodGet, "http://example.com/orders?id=1", nil)
+	assert.Equal(resultFiltered, o.Handle(ctx))
+	resp := ctx.GetOutputResponse().(*httpprot.Response)
+	assert.Equal(http.StatusFound, resp.StatusCode())
+
+	location, err := url.Parse(resp.HTTPHeader().Get("Location"))
+	assert.NoError(err)
+	assert.Equal("/authorize", location.Path)
+	query := location.Query()
+	assert.Equal("S256", query.Get("code_challenge_method"))
+	challenge := query.Get("code_challenge")
+	state := query.Get("state")
+
+	ctx = newTestContext(http.MethodGet, "http://example.com/oidc/callback?code=code&state="+state, nil)
+	assert.Equal(resultFiltered, o.Handle(ctx))
+	resp = ctx.GetOutputResponse().(*httpprot.Response)
+	assert.Equal(http.StatusFound, resp.StatusCode())
+	assert.Equal("http://example.com/orders?id=1", resp.HTTPHeader().Get("Location"))
+
+	// the code verifier sent to the token endpoint matches the challenge
+	sum := sha256.Sum256([]byte(p.verifier))
+	assert.Equal(challenge, base64.RawURLEncoding.EncodeToString(sum[:]))
+
+	cookie := responseCookie(resp.HTTPHeader(), defaultSessionCookieName)
+	assert.NotNil(cookie)
+	assert.True(cookie.HttpOnly)
+	return cookie
+}
+
+func TestSessionLogin(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, store := range []string{sessionStoreCookie, sessionStoreCustomData} {
+		p := newFakeProvider(t)
+		cls, kvs := newMemCluster()
+		o := newTestAdaptor(t, p, store, cls)
+		cookie := login(t, o, p)
+
+		if store == sessionStoreCustomData {
+			assert.Len(kvs, 1)
+			assert.NotNil(kvs["/custom-data/oidc-sessions/"+cookie.Value])
+		}
+
+		ctx := newTestContext(http.MethodGet, "http://example.com/orders", cookie)
+		assert.Equal("", o.Handle(ctx))
+		req := ctx.GetInputRequest().(*httpprot.Request)
+		assert.Equal("access-1", req.HTTPHeader().Get("X-Access-Token"))
+		assert.NotEmpty(req.HTTPHeader().Get("X-ID-Token"))
+		info, _ := base64.StdEncoding.DecodeString(req.HTTPHeader().Get("X-User-Info"))
+		assert.Contains(string(info), `"sub":"alice"`)
+
+		// invalid session
+		cookie.Value = "invalid"
+		ctx = newTestContext(http.MethodGet, "http://example.com/orders", cookie)
+		assert.Equal(resultFiltered, o.Handle(ctx))
+		resp := ctx.GetOutputResponse().(*httpprot.Response)
+		assert.Equal(http.StatusFound, resp.StatusCode())
+	}
+}
+
+func TestSessionRefresh(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, store := range []string{sessionStoreCookie, sessionStoreCustomData} {
+		p := newFakeProvider(t)
+		p.expiresIn = 10
+		cls, _ := newMemCluster()
+		o := newTestAdaptor(t, p, store, cls)
+		cookie := login(t, o, p)
+
+		// the refreshed cookie is added to the output response of the
+		// pipeline for requests of any method.
+		ctx := newTestContext(http.MethodPost, "http://example.com/orders", cookie)
+		assert.Equal("", o.Handle(ctx))
+		req := ctx.GetInputRequest().(*httpprot.Request)
+		assert.Equal("access-2", req.HTTPHeader().Get("X-Access-Token"))
+		assert.Equal(1, p.refreshes)
+
+		w := ctx.GetOutputResponse().(*httpprot.Response)
+		newCookie := responseCookie(w.HTTPHeader(), defaultSessionCookieName)
+		if store == sessionStoreCookie {
+			assert.NotNil(newCookie)
+			assert.NotEqual(cookie.Value, newCookie.Value)
+			s, err := o.sessions.load(newCookie.Value)
+			assert.NoError(err)
+			assert.Equal("access-2", s.AccessToken)
+			assert.Equal("refresh-1", s.RefreshToken)
+		} else {
+			// the session ID is not changed
+			assert.Nil(newCookie)
+			s, err := o.sessions.load(cookie.Value)
+			assert.NoError(err)
+			assert.Equal("access-2", s.AccessToken)
+		}
+
+		// failed to refresh
+		p.refreshErr = true
+		ctx = newTestContext(http.MethodGet, "http://example.com/orders", cookie)
+		assert.Equal(resultFiltered, o.Handle(ctx))
+		resp := ctx.GetOutputResponse().(*httpprot.Response)
+		assert.Equal(http.StatusFound, resp.StatusCode())
+		assert.True(strings.HasPrefix(resp.HTTPHeader().Get("Location"), p.URL+"/authorize"))
+	}
+}
+
+func TestSessionLogout(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, store := range []string{sessionStoreCookie, sessionStoreCustomData} {
+		p := newFakeProvider(t)
+		cls, kvs := newMemCluster()
+		o := newTestAdaptor(t, p, store, cls)
+		cookie := login(t, o, p)
+
+		ctx := newTestContext(http.MethodGet, "http://example.com/oidc/logout", cookie)
+		assert.Equal(resultFiltered, o.Handle(ctx))
+		resp := ctx.GetOutputResponse().(*httpprot.Response)
+		assert.Equal(http.StatusFound, resp.StatusCode())
+
+		location, err := url.Parse(resp.HTTPHeader().Get("Location"))
+		assert.NoError(err)
+		assert.Equal("/logout", location.Path)
+		assert.Equal("client", location.Query().Get("client_id"))
+		assert.NotEmpty(location.Query().Get("id_token_hint"))
+
+		assert.Equal([]string{"refresh-1", "access-1"}, p.revoked)
+		c := responseCookie(resp.HTTPHeader(), defaultSessionCookieName)
+		assert.NotNil(c)
+		assert.True(c.MaxAge < 0)
+
+		if store == sessionStoreCustomData {
+			assert.Empty(kvs)
+		}
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	assert := assert.New(t)
+
+	s := &session{
+		AccessToken: "access",
+		Expiry:      time.Now().Add(time.Hour).Unix(),
+	}
+
+	cs := newCookieSessionStore("secret")
+	value, err := cs.save(s)
+	assert.NoError(err)
+	loaded, err := cs.load(value)
+	assert.NoError(err)
+	assert.Equal("access", loaded.AccessToken)
+
+	// the secret is different
+	_, err = newCookieSessionStore("other").load(value)
+	assert.Error(err)
+	_, err = cs.load("invalid")
+	assert.Error(err)
+
+	// the session is too large to be stored in a cookie
+	s.UserInfo = map[string]any{"data": strings.Repeat("a", maxCookieSessionSize)}
+	_, err = cs.save(s)
+	assert.Error(err)
+
+	// the cluster is not available
+	cds := newCustomDataSessionStore(nil, "oidc-sessions")
+	_, err = cds.save(s)
+	assert.Error(err)
+	_, err = cds.load("id")
+	assert.Error(err)
+	cds.delete(s)
+
+	cls, kvs := newMemCluster()
+	cds = newCustomDataSessionStore(cls, "oidc-sessions")
+	s.ID = ""
+	value, err = cds.save(s)
+	assert.NoError(err)
+	assert.Equal(s.ID, value)
+	loaded, err = cds.load(value)
+	assert.NoError(err)
+	assert.Equal("access", loaded.AccessToken)
+	cds.delete(s)
+	assert.Empty(kvs)
+	_, err = cds.load(value)
+	assert.Error(err)
+}
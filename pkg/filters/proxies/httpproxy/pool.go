@@ -328,6 +328,7 @@ func (sp *ServerPool) collectMetrics(spCtx *serverPoolContext) {
 		spCtx.LazyAddTag(func() string {
 			return sp.Name + "#duration: " + metric.Duration.String()
 		})
+		spCtx.AddUpstreamTiming(sp.Name, metric.Duration)
 	}
 
 	// Collect all metrics directly if not a stream.
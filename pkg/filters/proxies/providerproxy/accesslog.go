@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providerproxy
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/util/fasttime"
+	"github.com/megaease/easegress/v2/pkg/util/sampler"
+)
+
+type (
+	// AccessLogSpec describes the structured access log of ProviderProxy.
+	AccessLogSpec struct {
+		// SampleRate is the fraction of requests to be logged, requests are
+		// all logged if it is not set.
+		SampleRate float64 `json:"sampleRate,omitempty" jsonschema:"minimum=0,maximum=1"`
+		// ClientIDHeader is the request header which identifies the client,
+		// for example, an API key header set by a validator.
+		ClientIDHeader string `json:"clientIDHeader,omitempty"`
+	}
+
+	// AccessLogEntry is a JSON line of the ProviderProxy access log.
+	AccessLogEntry struct {
+		Time            string   `json:"time"`
+		Pipeline        string   `json:"pipeline"`
+		ClientIP        string   `json:"clientIP"`
+		ClientID        string   `json:"clientID,omitempty"`
+		Chain           string   `json:"chain,omitempty"`
+		Methods         []string `json:"methods"`
+		Provider        string   `json:"provider,omitempty"`
+		Attempts        int      `json:"attempts"`
+		UpstreamLatency float64  `json:"upstreamLatencyMs"`
+		StatusCode      int      `json:"statusCode"`
+		RPCErrorCode    int      `json:"rpcErrorCode,omitempty"`
+		ResponseSize    int64    `json:"responseSize"`
+		Error           string   `json:"error,omitempty"`
+	}
+
+	accessLogger struct {
+		spec    *AccessLogSpec
+		sampler *sampler.RateSampler
+	}
+)
+
+func newAccessLogger(spec *AccessLogSpec) *accessLogger {
+	if spec == nil {
+		return nil
+	}
+
+	rate := spec.SampleRate
+	if rate <= 0 {
+		rate = 1
+	}
+	return &accessLogger{
+		spec:    spec,
+		sampler: sampler.NewRateSampler(rate),
+	}
+}
+
+// newEntry creates an access log entry for the request, it returns nil if
+// the access log is disabled or the request is not sampled.
+func (al *accessLogger) newEntry(pipeline string, req *httpprot.Request) *AccessLogEntry {
+	if al == nil || !al.sampler.Sample() {
+		return nil
+	}
+
+	entry := &AccessLogEntry{
+		Time:     fasttime.Format(fasttime.Now(), fasttime.RFC3339Milli),
+		Pipeline: pipeline,
+		ClientIP: req.RealIP(),
+	}
+	if al.spec.ClientIDHeader != "" {
+		entry.ClientID = req.HTTPHeader().Get(al.spec.ClientIDHeader)
+	}
+	return entry
+}
+
+func (al *accessLogger) write(entry *AccessLogEntry) {
+	if entry == nil {
+		return
+	}
+
+	logger.LazyHTTPAccess(func() string {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err.Error()
+		}
+		return string(data)
+	})
+}
+
+func (entry *AccessLogEntry) setRequest(chain, provider string, methods []string) {
+	if entry == nil {
+		return
+	}
+	entry.Chain = chain
+	entry.Provider = provider
+	entry.Methods = methods
+	entry.Attempts++
+}
+
+func (entry *AccessLogEntry) setResponse(statusCode int, size int64, rpcErrorCode int) {
+	if entry == nil {
+		return
+	}
+	entry.StatusCode = statusCode
+	entry.ResponseSize = size
+	entry.RPCErrorCode = rpcErrorCode
+}
+
+func (entry *AccessLogEntry) setFailure(err error, f *rpcFailure) {
+	if entry == nil {
+		return
+	}
+	entry.Error = err.Error()
+	entry.StatusCode = f.statusCode
+	entry.RPCErrorCode = f.code
+}
+
+func (entry *AccessLogEntry) setUpstreamLatency(d time.Duration) {
+	if entry == nil {
+		return
+	}
+	entry.UpstreamLatency = float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providerproxy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	var al *accessLogger
+	stdr, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1/", strings.NewReader("{}"))
+	stdr.Header.Set("X-Api-Key", "client-1")
+	stdr.Header.Set("X-Real-Ip", "10.0.0.1")
+	req, _ := httpprot.NewRequest(stdr)
+
+	// disabled access log never creates entries, and nil entries are safe.
+	entry := al.newEntry("pipeline", req)
+	assert.Nil(entry)
+	entry.setRequest(defaultChainName, "http://provider", []string{"eth_blockNumber"})
+	entry.setFailure(errors.New("error"), newRPCFailure(resultNoProvider))
+	al.write(entry)
+
+	al = newAccessLogger(&AccessLogSpec{ClientIDHeader: "X-Api-Key"})
+	entry = al.newEntry("pipeline", req)
+	assert.NotNil(entry)
+	assert.Equal("pipeline", entry.Pipeline)
+	assert.Equal("client-1", entry.ClientID)
+	assert.Equal("10.0.0.1", entry.ClientIP)
+
+	entry.setRequest(defaultChainName, "http://provider", []string{"eth_blockNumber", "eth_chainId"})
+	assert.Equal(1, entry.Attempts)
+	assert.Equal([]string{"eth_blockNumber", "eth_chainId"}, entry.Methods)
+	al.write(entry)
+
+	al = newAccessLogger(&AccessLogSpec{SampleRate: 0.5})
+	sampled := 0
+	for i := 0; i < 10; i++ {
+		if al.newEntry("pipeline", req) != nil {
+			sampled++
+		}
+	}
+	assert.Equal(5, sampled)
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providerproxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/megaease/easegress/v2/pkg/api"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+const (
+	apiGroupName = "providerproxy_admin"
+
+	// ScorecardsAPIPath is the admin API path of the scorecards of all
+	// ProviderProxies.
+	ScorecardsAPIPath = "/providerproxy/scorecards"
+)
+
+var (
+	registerAPIsOnce sync.Once
+
+	scorecardsLock sync.Mutex
+	// scorecards are the scorecards of ProviderProxies by "pipeline/filter".
+	scorecards = map[string]*scorecard{}
+)
+
+// registerScorecard makes the scorecard available from the admin API, the
+// API group is registered on the first call.
+func registerScorecard(sc *scorecard) {
+	registerAPIsOnce.Do(func() {
+		api.RegisterAPIs(&api.Group{
+			Group: apiGroupName,
+			Entries: []*api.Entry{
+				{Path: ScorecardsAPIPath, Method: http.MethodGet, Handler: listScorecards},
+				{Path: ScorecardsAPIPath + "/{pipeline}/{filter}", Method: http.MethodGet, Handler: getScorecard},
+			},
+		})
+	})
+
+	scorecardsLock.Lock()
+	scorecards[sc.name] = sc
+	scorecardsLock.Unlock()
+}
+
+// unregisterScorecard removes the scorecard, unless it has been replaced by
+// the scorecard of a newer generation of the ProviderProxy.
+func unregisterScorecard(sc *scorecard) {
+	scorecardsLock.Lock()
+	if scorecards[sc.name] == sc {
+		delete(scorecards, sc.name)
+	}
+	scorecardsLock.Unlock()
+}
+
+// listScorecards serves the scorecards of all ProviderProxies.
+func listScorecards(w http.ResponseWriter, r *http.Request) {
+	scorecardsLock.Lock()
+	all := make([]*scorecard, 0, len(scorecards))
+	for _, sc := range scorecards {
+		all = append(all, sc)
+	}
+	scorecardsLock.Unlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+
+	writeScorecards(w, r, all)
+}
+
+// getScorecard serves the scorecard of a ProviderProxy.
+func getScorecard(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "pipeline") + "/" + chi.URLParam(r, "filter")
+
+	scorecardsLock.Lock()
+	sc := scorecards[name]
+	scorecardsLock.Unlock()
+	if sc == nil {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("scorecard of %s not found", name))
+		return
+	}
+
+	writeScorecards(w, r, []*scorecard{sc})
+}
+
+// writeScorecards writes the scorecards over the windows in the query, or
+// all windows of the scorecards if there is none, in JSON or CSV format.
+func writeScorecards(w http.ResponseWriter, r *http.Request, all []*scorecard) {
+	var windows []string
+	if s := r.URL.Query().Get("window"); s != "" {
+		windows = strings.Split(s, ",")
+	}
+
+	cards := []*Scorecard{}
+	for _, sc := range all {
+		c, err := sc.scorecards(windows)
+		if err != nil {
+			api.HandleAPIError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		cards = append(cards, c...)
+	}
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		writeScorecardsCSV(w, cards)
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(codectool.MustMarshalJSON(cards))
+	default:
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("unsupported format %q", format))
+	}
+}
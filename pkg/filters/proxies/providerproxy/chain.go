@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providerproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/filters/proxies/providerproxy/selector"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+)
+
+// defaultChainName is the name of the chain built from the top level
+// providers of the spec.
+const defaultChainName = "default"
+
+type (
+	// ChainSpec describes a group of providers serving the same chain.
+	ChainSpec struct {
+		Name string `json:"name" jsonschema:"required"`
+		// PathPrefix selects the chain by the prefix of the request path,
+		// the prefix is removed before the request is sent to a provider.
+		PathPrefix string `json:"pathPrefix,omitempty"`
+		// Hosts selects the chain by the host of the request.
+		Hosts []string `json:"hosts,omitempty"`
+
+		Urls      []string `json:"urls" jsonschema:"required"`
+		Interval  string   `json:"interval,omitempty" jsonschema:"format=duration"`
+		Lag       uint64   `json:"lag,omitempty"`
+		Policy    string   `json:"policy,omitempty"`
+		ProbeType string   `json:"probeType,omitempty" jsonschema:"enum=,enum=evm,enum=solana"`
+		// Costs are the costs and capacities of the providers, used by the
+		// cost policy.
+		Costs []*selector.ProviderCostSpec `json:"costs,omitempty"`
+		// Shadow mirrors sampled requests to candidate providers of the
+		// chain for comparison.
+		Shadow *ShadowSpec `json:"shadow,omitempty"`
+	}
+
+	// chain is a group of providers and the selector choosing from them.
+	chain struct {
+		spec     *ChainSpec
+		selector selector.ProviderSelector
+		shadow   *shadow
+	}
+)
+
+// Validate validates ChainSpec.
+func (spec *ChainSpec) Validate() error {
+	if spec.Name == defaultChainName {
+		return fmt.Errorf("chain name %q is reserved", defaultChainName)
+	}
+	if len(spec.Urls) == 0 {
+		return fmt.Errorf("chain %s: node address not provided", spec.Name)
+	}
+	if spec.PathPrefix != "" && !strings.HasPrefix(spec.PathPrefix, "/") {
+		return fmt.Errorf("chain %s: pathPrefix must start with /", spec.Name)
+	}
+	urls := map[string]bool{}
+	for _, u := range spec.Urls {
+		urls[u] = true
+	}
+	for _, c := range spec.Costs {
+		if err := c.Validate(); err != nil {
+			return fmt.Errorf("chain %s: %v", spec.Name, err)
+		}
+		if !urls[c.Url] {
+			return fmt.Errorf("chain %s: provider cost of %s: not a provider url", spec.Name, c.Url)
+		}
+	}
+	if spec.Shadow != nil {
+		if err := spec.Shadow.Validate(); err != nil {
+			return fmt.Errorf("chain %s: %v", spec.Name, err)
+		}
+	}
+	return nil
+}
+
+// newChain creates a chain, fields not set in the chain spec are inherited
+// from the ProviderProxy spec.
+func (m *ProviderProxy) newChain(chainSpec *ChainSpec) *chain {
+	spec := *chainSpec
+	if spec.Interval == "" {
+		spec.Interval = m.spec.Interval
+	}
+	if spec.Lag == 0 {
+		spec.Lag = m.spec.Lag
+	}
+	if spec.Policy == "" {
+		spec.Policy = m.spec.Policy
+	}
+	if spec.ProbeType == "" {
+		spec.ProbeType = m.spec.ProbeType
+	}
+	if len(spec.Costs) == 0 {
+		spec.Costs = m.spec.Costs
+	}
+
+	transports := map[string]http.RoundTripper{}
+	for _, u := range spec.Urls {
+		transports[u] = m.providerClient(u).transport
+	}
+
+	selectorSpec := selector.ProviderSelectorSpec{
+		Name:       m.Name(),
+		Chain:      spec.Name,
+		Urls:       spec.Urls,
+		Interval:   spec.Interval,
+		Lag:        spec.Lag,
+		ProbeType:  spec.ProbeType,
+		Costs:      spec.Costs,
+		Transports: transports,
+	}
+	return &chain{
+		spec:     &spec,
+		selector: selector.CreateProviderSelectorByPolicy(spec.Policy, selectorSpec),
+		shadow:   newShadow(spec.Shadow),
+	}
+}
+
+// selectNode chooses a provider of the chain for a request calling the
+// methods.
+func (c *chain) selectNode(methods []string) (*url.URL, error) {
+	var rpcUrl string
+	var err error
+	if s, ok := c.selector.(selector.MethodAwareProviderSelector); ok {
+		rpcUrl, err = s.ChooseServerForMethods(methods)
+	} else {
+		rpcUrl, err = c.selector.ChooseServer()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return url.Parse(rpcUrl)
+}
+
+// reportResult reports the result of a request to the provider to the
+// selector, if the selector learns from results.
+func (c *chain) reportResult(provider *url.URL, methods []string, success bool) {
+	if s, ok := c.selector.(selector.MethodAwareProviderSelector); ok {
+		s.ReportResult(provider.String(), methods, success)
+	}
+}
+
+func (c *chain) close() {
+	c.selector.Close()
+}
+
+// selectChain selects the chain of the request, it returns the chain and
+// the request path to be sent to the provider. The chain is selected by
+// the chain header, the host, and the path prefix of the request in order,
+// and falls back to the default chain.
+func (m *ProviderProxy) selectChain(req *httpprot.Request) (*chain, string, error) {
+	path := req.URL().Path
+
+	if m.spec.ChainHeader != "" {
+		if name := req.HTTPHeader().Get(m.spec.ChainHeader); name != "" {
+			for _, c := range m.chains {
+				if c.spec.Name == name {
+					return c, path, nil
+				}
+			}
+			return nil, path, fmt.Errorf("unknown chain %q in header %s", name, m.spec.ChainHeader)
+		}
+	}
+
+	host := req.Host()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, c := range m.chains {
+		for _, h := range c.spec.Hosts {
+			if strings.EqualFold(h, host) {
+				return c, path, nil
+			}
+		}
+	}
+
+	var matched *chain
+	for _, c := range m.chains {
+		prefix := strings.TrimSuffix(c.spec.PathPrefix, "/")
+		if prefix == "" || !hasPathPrefix(path, prefix) {
+			continue
+		}
+		if matched == nil || len(prefix) > len(strings.TrimSuffix(matched.spec.PathPrefix, "/")) {
+			matched = c
+		}
+	}
+	if matched != nil {
+		prefix := strings.TrimSuffix(matched.spec.PathPrefix, "/")
+		return matched, path[len(prefix):], nil
+	}
+
+	if m.defaultChain != nil {
+		return m.defaultChain, path, nil
+	}
+	return nil, path, fmt.Errorf("no chain matches request %s%s", req.Host(), path)
+}
+
+// hasPathPrefix checks whether prefix is a prefix of path at a path
+// segment boundary, that's "/eth" matches "/eth" and "/eth/x", but not
+// "/ethereum".
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || path[len(prefix)] == '/'
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providerproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/filters/proxies/providerproxy/selector"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainSpecValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &Spec{}
+	assert.Error(spec.Validate())
+
+	spec.Chains = []*ChainSpec{{Name: "eth", Urls: []string{"http://127.0.0.1:8545"}}}
+	assert.NoError(spec.Validate())
+
+	spec.Chains = append(spec.Chains, &ChainSpec{Name: "eth", Urls: []string{"http://127.0.0.1:8546"}})
+	assert.Error(spec.Validate())
+
+	spec.Chains = []*ChainSpec{{Name: defaultChainName, Urls: []string{"http://127.0.0.1:8545"}}}
+	assert.Error(spec.Validate())
+
+	spec.Chains = []*ChainSpec{{Name: "eth"}}
+	assert.Error(spec.Validate())
+
+	spec.Chains = []*ChainSpec{{Name: "eth", PathPrefix: "eth", Urls: []string{"http://127.0.0.1:8545"}}}
+	assert.Error(spec.Validate())
+
+	// costs must be of the providers of the chain.
+	cost := &selector.ProviderCostSpec{Url: "http://127.0.0.1:8545"}
+	spec.Chains = []*ChainSpec{{Name: "eth", Urls: []string{"http://127.0.0.1:8545"}, Costs: []*selector.ProviderCostSpec{cost}}}
+	assert.NoError(spec.Validate())
+	spec.Chains[0].Urls = []string{"http://127.0.0.1:8546"}
+	assert.Error(spec.Validate())
+
+	// top level costs are inherited by chains without costs.
+	spec.Chains = []*ChainSpec{{Name: "eth", Urls: []string{"http://127.0.0.1:8545"}}}
+	spec.Costs = []*selector.ProviderCostSpec{cost}
+	assert.NoError(spec.Validate())
+	spec.Costs = []*selector.ProviderCostSpec{{Url: "http://127.0.0.1:8546"}}
+	assert.Error(spec.Validate())
+}
+
+func TestHasPathPrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(hasPathPrefix("/eth", "/eth"))
+	assert.True(hasPathPrefix("/eth/wallet", "/eth"))
+	assert.False(hasPathPrefix("/ethereum", "/eth"))
+	assert.False(hasPathPrefix("/polygon", "/eth"))
+}
+
+func TestSelectChain(t *testing.T) {
+	assert := assert.New(t)
+
+	proxy := newTestProviderProxy(`
+name: providerProxy
+kind: ProviderProxy
+chainHeader: X-Chain
+urls:
+  - http://127.0.0.1:8545
+chains:
+  - name: eth-mainnet
+    pathPrefix: /eth-mainnet
+    urls:
+      - http://127.0.0.1:8546
+  - name: eth-mainnet-archive
+    pathPrefix: /eth-mainnet/archive/
+    urls:
+      - http://127.0.0.1:8547
+  - name: polygon
+    pathPrefix: /polygon
+    hosts:
+      - polygon.example.com
+    policy: roundRobin
+    urls:
+      - http://127.0.0.1:8548
+`, assert)
+	defer proxy.Close()
+
+	selectChain := func(url string, header string) (string, string, error) {
+		stdr, _ := http.NewRequest(http.MethodPost, url, http.NoBody)
+		if header != "" {
+			stdr.Header.Set("X-Chain", header)
+		}
+		req, _ := httpprot.NewRequest(stdr)
+		c, path, err := proxy.selectChain(req)
+		if err != nil {
+			return "", path, err
+		}
+		return c.spec.Name, path, nil
+	}
+
+	name, path, err := selectChain("http://127.0.0.1/eth-mainnet", "")
+	assert.NoError(err)
+	assert.Equal("eth-mainnet", name)
+	assert.Equal("", path)
+
+	name, path, err = selectChain("http://127.0.0.1/eth-mainnet/archive/wallet", "")
+	assert.NoError(err)
+	assert.Equal("eth-mainnet-archive", name)
+	assert.Equal("/wallet", path)
+
+	name, path, err = selectChain("http://polygon.example.com:8080/", "")
+	assert.NoError(err)
+	assert.Equal("polygon", name)
+	assert.Equal("/", path)
+
+	name, path, err = selectChain("http://127.0.0.1/eth-mainnet", "polygon")
+	assert.NoError(err)
+	assert.Equal("polygon", name)
+	assert.Equal("/eth-mainnet", path)
+
+	_, _, err = selectChain("http://127.0.0.1/", "unknown")
+	assert.Error(err)
+
+	name, path, err = selectChain("http://127.0.0.1/ethereum", "")
+	assert.NoError(err)
+	assert.Equal(defaultChainName, name)
+	assert.Equal("/ethereum", path)
+
+	// the inherited fields are filled.
+	assert.Equal("roundRobin", proxy.chains[0].spec.Policy)
+	assert.Equal("1s", proxy.chains[0].spec.Interval)
+}
+
+func TestMultiChainHandle(t *testing.T) {
+	assert := assert.New(t)
+
+	newServer := func(name string) (*httptest.Server, chan string) {
+		paths := make(chan string, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths <- r.URL.Path
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"` + name + `"}`))
+		}))
+		return server, paths
+	}
+	eth, ethPaths := newServer("eth")
+	defer eth.Close()
+	tron, tronPaths := newServer("tron")
+	defer tron.Close()
+
+	proxy := newTestProviderProxy(`
+name: providerProxy
+kind: ProviderProxy
+chains:
+  - name: eth
+    pathPrefix: /eth
+    urls:
+      - `+eth.URL+`/v2/key
+  - name: tron
+    pathPrefix: /tron
+    urls:
+      - `+tron.URL, assert)
+	defer proxy.Close()
+
+	stdr, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1/eth", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`))
+	ctx := getCtx(stdr)
+	assert.Equal("", proxy.Handle(ctx))
+	assert.Equal("/v2/key", <-ethPaths)
+
+	stdr, _ = http.NewRequest(http.MethodPost, "http://127.0.0.1/tron/wallet/getblock", strings.NewReader(`{"id_or_num":"66484052"}`))
+	ctx = getCtx(stdr)
+	assert.Equal("", proxy.Handle(ctx))
+	assert.Equal("/wallet/getblock", <-tronPaths)
+
+	stdr, _ = http.NewRequest(http.MethodPost, "http://127.0.0.1/solana", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"getSlot"}`))
+	ctx = getCtx(stdr)
+	assert.Equal(resultUnknownChain, proxy.Handle(ctx))
+	resp := ctx.GetResponse(context.DefaultNamespace).(*httpprot.Response)
+	assert.Equal(http.StatusNotFound, resp.StatusCode())
+}
@@ -0,0 +1,340 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providerproxy
+
+import (
+	"bytes"
+	stdcontext "context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/util/fasttime"
+	"golang.org/x/sync/errgroup"
+)
+
+const methodGetLogs = "eth_getLogs"
+
+// tooManyResultsMessages are the error messages providers use to reject an
+// eth_getLogs query because the range or the result is too large, a query
+// rejected by one of them is split and retried.
+var tooManyResultsMessages = []string{
+	"query returned more than",
+	"response size exceeded",
+	"response size should not greater than",
+	"range is too large",
+	"range too large",
+	"too many blocks",
+	"exceed maximum block range",
+}
+
+type (
+	// GetLogsSpec describes how ProviderProxy splits an eth_getLogs query
+	// over a large block range into queries over smaller ranges.
+	GetLogsSpec struct {
+		// MaxBlockRange is the max block range of a query sent to providers.
+		MaxBlockRange uint64 `json:"maxBlockRange,omitempty" jsonschema:"default=2000"`
+		// MinBlockRange is the min block range a query could be split to
+		// when a provider reports there are too many results.
+		MinBlockRange uint64 `json:"minBlockRange,omitempty" jsonschema:"default=1"`
+		// Parallelism is the max number of concurrent queries.
+		Parallelism int `json:"parallelism,omitempty" jsonschema:"default=4"`
+		// MaxTotalRange is the max block range of a client query, queries
+		// over larger ranges are rejected instead of being split.
+		MaxTotalRange uint64 `json:"maxTotalRange,omitempty" jsonschema:"default=100000"`
+		// MaxQueries is the max number of queries sent to providers for a
+		// client query, including the ones split from rejected queries.
+		MaxQueries int `json:"maxQueries,omitempty" jsonschema:"default=1000"`
+	}
+
+	getLogsRequest struct {
+		id     json.RawMessage
+		filter map[string]json.RawMessage
+		from   uint64
+		to     uint64
+	}
+
+	// getLogsError is the JSON-RPC error returned by a provider.
+	getLogsError struct {
+		*jsonrpcError
+		statusCode int
+	}
+)
+
+func (e *getLogsError) Error() string {
+	return fmt.Sprintf("provider responded with JSON-RPC error %d: %s", e.Code, e.Message)
+}
+
+func (e *getLogsError) tooManyResults() bool {
+	msg := strings.ToLower(e.Message)
+	for _, m := range tooManyResultsMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+func (spec *GetLogsSpec) maxBlockRange() uint64 {
+	if spec.MaxBlockRange == 0 {
+		return 2000
+	}
+	return spec.MaxBlockRange
+}
+
+func (spec *GetLogsSpec) minBlockRange() uint64 {
+	if spec.MinBlockRange == 0 {
+		return 1
+	}
+	return spec.MinBlockRange
+}
+
+func (spec *GetLogsSpec) maxTotalRange() uint64 {
+	if spec.MaxTotalRange == 0 {
+		return 100000
+	}
+	return spec.MaxTotalRange
+}
+
+func (spec *GetLogsSpec) maxQueries() int {
+	if spec.MaxQueries <= 0 {
+		return 1000
+	}
+	return spec.MaxQueries
+}
+
+func (spec *GetLogsSpec) parallelism() int {
+	if spec.Parallelism <= 0 {
+		return 4
+	}
+	return spec.Parallelism
+}
+
+// parseGetLogsRequest parses the payload as an eth_getLogs request, it
+// returns nil if the payload is not an eth_getLogs request over a block
+// range which exceeds maxRange. Only ranges of explicit block numbers are
+// split, as block tags like "latest" change between queries.
+func parseGetLogsRequest(payload []byte, maxRange uint64) *getLogsRequest {
+	payload = bytes.TrimSpace(payload)
+	if len(payload) == 0 || payload[0] != '{' {
+		return nil
+	}
+
+	msg := struct {
+		ID     json.RawMessage              `json:"id"`
+		Method string                       `json:"method"`
+		Params []map[string]json.RawMessage `json:"params"`
+	}{}
+	if json.Unmarshal(payload, &msg) != nil || msg.Method != methodGetLogs || len(msg.Params) != 1 {
+		return nil
+	}
+
+	filter := msg.Params[0]
+	if _, ok := filter["blockHash"]; ok {
+		return nil
+	}
+	from, ok := parseBlockNumber(filter["fromBlock"])
+	if !ok {
+		return nil
+	}
+	to, ok := parseBlockNumber(filter["toBlock"])
+	if !ok || to < from || to-from < maxRange {
+		return nil
+	}
+
+	return &getLogsRequest{id: idOrNull(msg.ID), filter: filter, from: from, to: to}
+}
+
+func parseBlockNumber(raw json.RawMessage) (uint64, bool) {
+	var s string
+	if json.Unmarshal(raw, &s) != nil {
+		return 0, false
+	}
+	if s == "earliest" {
+		return 0, true
+	}
+	if !strings.HasPrefix(s, "0x") {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(s[2:], 16, 64)
+	return n, err == nil
+}
+
+// payload builds the payload of the query over blocks [from, to].
+func (r *getLogsRequest) payload(id int64, from, to uint64) []byte {
+	filter := make(map[string]json.RawMessage, len(r.filter))
+	for k, v := range r.filter {
+		filter[k] = v
+	}
+	filter["fromBlock"] = json.RawMessage(strconv.Quote("0x" + strconv.FormatUint(from, 16)))
+	filter["toBlock"] = json.RawMessage(strconv.Quote("0x" + strconv.FormatUint(to, 16)))
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"method":  methodGetLogs,
+		"params":  []interface{}{filter},
+	})
+	return data
+}
+
+// handleGetLogs splits the eth_getLogs query into queries over smaller
+// block ranges, runs them with bounded parallelism, and merges the logs
+// into one response in block order.
+func (m *ProviderProxy) handleGetLogs(ctx *context.Context, req *httpprot.Request, c *chain,
+	glr *getLogsRequest, entry *AccessLogEntry) string {
+	spec := m.spec.GetLogs
+	entry.setRequest(c.spec.Name, "", []string{methodGetLogs})
+
+	// the number of queries is bounded by rejecting large ranges.
+	if maxRange := spec.maxTotalRange(); glr.to-glr.from >= maxRange {
+		data, _ := json.Marshal(&jsonrpcErrorResponse{
+			Version: "2.0",
+			ID:      glr.id,
+			Error: &jsonrpcError{
+				Code:    ErrCodeLimitExceeded,
+				Message: fmt.Sprintf("block range exceeds the limit of %d blocks", maxRange),
+			},
+		})
+		m.setGetLogsResponse(ctx, entry, data, ErrCodeLimitExceeded)
+		return ""
+	}
+
+	startTime := fasttime.Now()
+	chunkSize := spec.maxBlockRange()
+	numChunks := int((glr.to-glr.from)/chunkSize) + 1
+	results := make([][]json.RawMessage, numChunks)
+
+	// the other queries are canceled once a query fails, as the response
+	// is an error anyway.
+	var attempts int32
+	eg, egctx := errgroup.WithContext(req.Context())
+	eg.SetLimit(spec.parallelism())
+	for i := 0; i < numChunks; i++ {
+		from := glr.from + uint64(i)*chunkSize
+		to := from + chunkSize - 1
+		if to > glr.to {
+			to = glr.to
+		}
+		eg.Go(func() error {
+			logs, err := m.fetchLogs(ctx, egctx, c, glr, from, to, &attempts)
+			results[i] = logs
+			return err
+		})
+	}
+	err := eg.Wait()
+
+	elapsed := fasttime.Since(startTime)
+	entry.setUpstreamLatency(elapsed)
+	ctx.AddUpstreamTiming(m.Name(), elapsed)
+	if entry != nil {
+		entry.Attempts = int(atomic.LoadInt32(&attempts))
+		if entry.Attempts > spec.maxQueries() {
+			entry.Attempts = spec.maxQueries()
+		}
+	}
+
+	if err != nil {
+		gle, ok := err.(*getLogsError)
+		if !ok {
+			return m.handleFailure(ctx, req, entry, resultUpstreamError, err)
+		}
+		// pass through the JSON-RPC error of the provider.
+		data, _ := json.Marshal(&jsonrpcErrorResponse{Version: "2.0", ID: glr.id, Error: gle.jsonrpcError})
+		m.setGetLogsResponse(ctx, entry, data, gle.Code)
+		return ""
+	}
+
+	logs := make([]json.RawMessage, 0)
+	for _, r := range results {
+		logs = append(logs, r...)
+	}
+	data, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      glr.id,
+		"result":  logs,
+	})
+	m.setGetLogsResponse(ctx, entry, data, 0)
+	return ""
+}
+
+func (m *ProviderProxy) setGetLogsResponse(ctx *context.Context, entry *AccessLogEntry, data []byte, rpcErrorCode int) {
+	resp, _ := httpprot.NewResponse(nil)
+	resp.SetStatusCode(http.StatusOK)
+	resp.HTTPHeader().Set("Content-Type", "application/json")
+	resp.SetPayload(data)
+	ctx.SetResponse(context.DefaultNamespace, resp)
+	entry.setResponse(http.StatusOK, int64(len(data)), rpcErrorCode)
+	m.accessLogger.write(entry)
+}
+
+// fetchLogs queries the logs of blocks [from, to], the range is split into
+// two halves if the provider reports there are too many results.
+func (m *ProviderProxy) fetchLogs(ctx *context.Context, stdctx stdcontext.Context, c *chain, glr *getLogsRequest,
+	from, to uint64, attempts *int32) ([]json.RawMessage, error) {
+	if err := stdctx.Err(); err != nil {
+		return nil, err
+	}
+	attempt := atomic.AddInt32(attempts, 1)
+	if int(attempt) > m.spec.GetLogs.maxQueries() {
+		return nil, &getLogsError{jsonrpcError: &jsonrpcError{
+			Code:    ErrCodeLimitExceeded,
+			Message: "block range requires too many queries",
+		}}
+	}
+	resp, err := m.callUpstream(ctx, stdctx, c, glr.payload(int64(attempt), from, to), methodGetLogs, int(attempt))
+	if err != nil {
+		return nil, err
+	}
+
+	msg := struct {
+		Result []json.RawMessage `json:"result"`
+		Error  *jsonrpcError     `json:"error"`
+	}{}
+	if err = json.Unmarshal(resp.body, &msg); err != nil {
+		return nil, fmt.Errorf("provider %s responded with status code %d and invalid body: %v", resp.provider, resp.statusCode, err)
+	}
+
+	if msg.Error == nil {
+		if resp.statusCode != http.StatusOK {
+			return nil, fmt.Errorf("provider %s responded with status code %d", resp.provider, resp.statusCode)
+		}
+		return msg.Result, nil
+	}
+
+	gle := &getLogsError{jsonrpcError: msg.Error, statusCode: resp.statusCode}
+	if !gle.tooManyResults() || to-from+1 <= m.spec.GetLogs.minBlockRange() {
+		return nil, gle
+	}
+
+	mid := from + (to-from)/2
+	logs, err := m.fetchLogs(ctx, stdctx, c, glr, from, mid, attempts)
+	if err != nil {
+		return nil, err
+	}
+	more, err := m.fetchLogs(ctx, stdctx, c, glr, mid+1, to, attempts)
+	if err != nil {
+		return nil, err
+	}
+	return append(logs, more...), nil
+}
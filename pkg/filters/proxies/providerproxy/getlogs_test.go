@@ -0,0 +1,238 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providerproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/filters/proxies/providerproxy/mockprovider"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGetLogsRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	glr := parseGetLogsRequest([]byte(`{"jsonrpc":"2.0","id":7,"method":"eth_getLogs","params":[{"fromBlock":"0x0","toBlock":"0x1000","address":"0x1"}]}`), 100)
+	assert.NotNil(glr)
+	assert.Equal(uint64(0), glr.from)
+	assert.Equal(uint64(0x1000), glr.to)
+	assert.Equal(`7`, string(glr.id))
+
+	payload := map[string]interface{}{}
+	assert.NoError(json.Unmarshal(glr.payload(1, 10, 20), &payload))
+	filter := payload["params"].([]interface{})[0].(map[string]interface{})
+	assert.Equal("0xa", filter["fromBlock"])
+	assert.Equal("0x14", filter["toBlock"])
+	assert.Equal("0x1", filter["address"])
+
+	glr = parseGetLogsRequest([]byte(`{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"earliest","toBlock":"0x1000"}]}`), 100)
+	assert.NotNil(glr)
+
+	// requests which are not split.
+	for _, payload := range []string{
+		`{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x0","toBlock":"0x10"}]}`,
+		`{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x0","toBlock":"latest"}]}`,
+		`{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x1000","toBlock":"0x0"}]}`,
+		`{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"blockHash":"0x1","fromBlock":"0x0","toBlock":"0x1000"}]}`,
+		`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`,
+		`[{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x0","toBlock":"0x1000"}]}]`,
+		`not json`,
+	} {
+		assert.Nil(parseGetLogsRequest([]byte(payload), 100), payload)
+	}
+}
+
+func TestGetLogsSplitting(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := mockprovider.New(&mockprovider.ProviderSpec{StartHeight: 10000, LogsPerBlock: 1, MaxLogs: 50})
+	assert.NoError(err)
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		p.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	proxy := newTestProviderProxy(`
+name: providerProxy
+kind: ProviderProxy
+urls:
+  - `+server.URL+`
+getLogs:
+  maxBlockRange: 100
+  parallelism: 2`, assert)
+	defer proxy.Close()
+
+	handle := func(payload string) map[string]json.RawMessage {
+		stdr, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1/", strings.NewReader(payload))
+		ctx := getCtx(stdr)
+		assert.Equal("", proxy.Handle(ctx))
+		resp := ctx.GetResponse(context.DefaultNamespace)
+		assert.Equal(http.StatusOK, resp.(interface{ StatusCode() int }).StatusCode())
+		data, _ := io.ReadAll(resp.GetPayload())
+		body := map[string]json.RawMessage{}
+		assert.NoError(json.Unmarshal(data, &body))
+		return body
+	}
+
+	// 300 blocks are split into 3 queries of 100 blocks, and each of them is
+	// split again into 2 queries of 50 blocks, as the provider returns at
+	// most 50 logs.
+	body := handle(`{"jsonrpc":"2.0","id":"a","method":"eth_getLogs","params":[{"fromBlock":"0x64","toBlock":"0x18f"}]}`)
+	assert.Equal(`"a"`, string(body["id"]))
+	var logs []map[string]interface{}
+	assert.NoError(json.Unmarshal(body["result"], &logs))
+	assert.Len(logs, 300)
+	for i, log := range logs {
+		assert.Equal("0x"+strconv.FormatUint(uint64(100+i), 16), log["blockNumber"])
+	}
+	assert.Equal(int32(9), atomic.LoadInt32(&calls))
+
+	// ranges over maxTotalRange are rejected without querying providers.
+	atomic.StoreInt32(&calls, 0)
+	body = handle(`{"jsonrpc":"2.0","id":2,"method":"eth_getLogs","params":[{"fromBlock":"0x0","toBlock":"0xffffffffffffffff"}]}`)
+	assert.JSONEq(`{"code":-32005,"message":"block range exceeds the limit of 100000 blocks"}`, string(body["error"]))
+	assert.Equal(int32(0), atomic.LoadInt32(&calls))
+
+	// small ranges are forwarded as they are.
+	atomic.StoreInt32(&calls, 0)
+	body = handle(`{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x64","toBlock":"0x6d"}]}`)
+	assert.NoError(json.Unmarshal(body["result"], &logs))
+	assert.Len(logs, 10)
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestGetLogsError(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := mockprovider.New(&mockprovider.ProviderSpec{StartHeight: 10000, LogsPerBlock: 10, MaxLogs: 5})
+	assert.NoError(err)
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	proxy := newTestProviderProxy(`
+name: providerProxy
+kind: ProviderProxy
+urls:
+  - `+server.URL+`
+getLogs:
+  maxBlockRange: 4
+  minBlockRange: 2`, assert)
+	defer proxy.Close()
+
+	// the provider rejects even the min block range, the error is passed
+	// through with the id of the client request.
+	stdr, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1/", strings.NewReader(`{"jsonrpc":"2.0","id":3,"method":"eth_getLogs","params":[{"fromBlock":"0x0","toBlock":"0x10"}]}`))
+	ctx := getCtx(stdr)
+	assert.Equal("", proxy.Handle(ctx))
+	data, _ := io.ReadAll(ctx.GetResponse(context.DefaultNamespace).GetPayload())
+	assert.JSONEq(`{"jsonrpc":"2.0","id":3,"error":{"code":-32005,"message":"query returned more than 5 results"}}`, string(data))
+
+	// the number of queries is limited.
+	limited := newTestProviderProxy(`
+name: providerProxy
+kind: ProviderProxy
+urls:
+  - `+server.URL+`
+getLogs:
+  maxBlockRange: 4
+  maxQueries: 2
+  parallelism: 1`, assert)
+	defer limited.Close()
+	stdr, _ = http.NewRequest(http.MethodPost, "http://127.0.0.1/", strings.NewReader(`{"jsonrpc":"2.0","id":5,"method":"eth_getLogs","params":[{"fromBlock":"0x0","toBlock":"0x10"}]}`))
+	ctx = getCtx(stdr)
+	assert.Equal("", limited.Handle(ctx))
+	data, _ = io.ReadAll(ctx.GetResponse(context.DefaultNamespace).GetPayload())
+	assert.JSONEq(`{"jsonrpc":"2.0","id":5,"error":{"code":-32005,"message":"block range requires too many queries"}}`, string(data))
+
+	// the provider is unreachable.
+	server.Close()
+	stdr, _ = http.NewRequest(http.MethodPost, "http://127.0.0.1/", strings.NewReader(`{"jsonrpc":"2.0","id":4,"method":"eth_getLogs","params":[{"fromBlock":"0x0","toBlock":"0x10"}]}`))
+	ctx = getCtx(stdr)
+	assert.Equal(resultUpstreamError, proxy.Handle(ctx))
+	data, _ = io.ReadAll(ctx.GetResponse(context.DefaultNamespace).GetPayload())
+	assert.Contains(string(data), `"id":4`)
+	assert.NotContains(string(data), server.URL)
+}
+
+func TestGetLogsCancel(t *testing.T) {
+	assert := assert.New(t)
+
+	var canceled int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), `"fromBlock":"0x0"`) {
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"internal error"}}`))
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			atomic.AddInt32(&canceled, 1)
+		case <-time.After(5 * time.Second):
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":[]}`))
+		}
+	}))
+	defer server.Close()
+
+	proxy := newTestProviderProxy(`
+name: providerProxy
+kind: ProviderProxy
+urls:
+  - `+server.URL+`
+getLogs:
+  maxBlockRange: 4
+  parallelism: 3`, assert)
+	defer proxy.Close()
+
+	// the other queries are canceled once a query fails.
+	start := time.Now()
+	stdr, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1/", strings.NewReader(`{"jsonrpc":"2.0","id":6,"method":"eth_getLogs","params":[{"fromBlock":"0x0","toBlock":"0xb"}]}`))
+	ctx := getCtx(stdr)
+	assert.Equal("", proxy.Handle(ctx))
+	data, _ := io.ReadAll(ctx.GetResponse(context.DefaultNamespace).GetPayload())
+	assert.JSONEq(`{"jsonrpc":"2.0","id":6,"error":{"code":-32000,"message":"internal error"}}`, string(data))
+	assert.Less(time.Since(start), 5*time.Second)
+	assert.Eventually(func() bool {
+		return atomic.LoadInt32(&canceled) == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestGetLogsTooManyResults(t *testing.T) {
+	assert := assert.New(t)
+
+	for msg, expected := range map[string]bool{
+		"query returned more than 10000 results": true,
+		"Log response size exceeded.":            true,
+		"exceed maximum block range: 5000":       true,
+		"invalid block range params":             false,
+		"header not found":                       false,
+	} {
+		gle := &getLogsError{jsonrpcError: &jsonrpcError{Code: -32000, Message: msg}}
+		assert.Equal(expected, gle.tooManyResults(), msg)
+	}
+}
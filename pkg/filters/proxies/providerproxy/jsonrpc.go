@@ -0,0 +1,276 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providerproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/util/readers"
+)
+
+// JSON-RPC error codes used by ProviderProxy when it builds an error
+// response on behalf of the providers. The standard codes are defined by
+// JSON-RPC 2.0, and the server error codes follow EIP-1474.
+const (
+	// ErrCodeInternal is used when the upstream call fails, or the
+	// upstream response cannot be read.
+	ErrCodeInternal = -32603
+	// ErrCodeResourceUnavailable is used when there is no provider
+	// available to serve the request.
+	ErrCodeResourceUnavailable = -32002
+	// ErrCodeLimitExceeded is used when the provider rate limits the
+	// request.
+	ErrCodeLimitExceeded = -32005
+)
+
+const (
+	resultInternalError = "internalError"
+	resultUnknownChain  = "unknownChain"
+	resultNoProvider    = "noProvider"
+	resultUpstreamError = "upstreamError"
+	resultServerError   = "serverError"
+	resultRateLimited   = "rateLimited"
+)
+
+type (
+	jsonrpcError struct {
+		Code    int         `json:"code"`
+		Message string      `json:"message"`
+		Data    interface{} `json:"data,omitempty"`
+	}
+
+	jsonrpcErrorResponse struct {
+		Version string          `json:"jsonrpc"`
+		ID      json.RawMessage `json:"id"`
+		Error   *jsonrpcError   `json:"error"`
+	}
+
+	// rpcFailure describes a failure of ProviderProxy, it maps to a
+	// filter result, an HTTP status code and a JSON-RPC error.
+	rpcFailure struct {
+		result     string
+		statusCode int
+		code       int
+		message    string
+	}
+)
+
+var nullID = json.RawMessage("null")
+
+// newRPCFailure creates the failure of the result. The error message sent
+// to the client is generic, as the detailed error could contain the URL of
+// the provider, which usually carries an API key.
+func newRPCFailure(result string) *rpcFailure {
+	f := &rpcFailure{result: result}
+	switch result {
+	case resultUnknownChain:
+		f.statusCode, f.code, f.message = http.StatusNotFound, ErrCodeResourceUnavailable, "unknown chain"
+	case resultNoProvider:
+		f.statusCode, f.code, f.message = http.StatusServiceUnavailable, ErrCodeResourceUnavailable, "no provider available"
+	case resultRateLimited:
+		f.statusCode, f.code, f.message = http.StatusTooManyRequests, ErrCodeLimitExceeded, "request rate limited by provider"
+	case resultUpstreamError, resultServerError:
+		f.statusCode, f.code, f.message = http.StatusBadGateway, ErrCodeInternal, "provider request failed"
+	default:
+		f.statusCode, f.code, f.message = http.StatusInternalServerError, ErrCodeInternal, "internal error"
+	}
+	return f
+}
+
+// parseRequestIDs returns the ids of the JSON-RPC request payload, and
+// whether the payload is a batch request. The id of a request which is not
+// valid JSON-RPC, or which has no id, is null.
+func parseRequestIDs(payload []byte) (ids []json.RawMessage, batch bool) {
+	type rpcRequest struct {
+		ID json.RawMessage `json:"id"`
+	}
+
+	payload = bytes.TrimSpace(payload)
+	if len(payload) > 0 && payload[0] == '[' {
+		var reqs []rpcRequest
+		if json.Unmarshal(payload, &reqs) == nil && len(reqs) > 0 {
+			for _, req := range reqs {
+				ids = append(ids, idOrNull(req.ID))
+			}
+			return ids, true
+		}
+		return []json.RawMessage{nullID}, false
+	}
+
+	var req rpcRequest
+	if json.Unmarshal(payload, &req) != nil {
+		return []json.RawMessage{nullID}, false
+	}
+	return []json.RawMessage{idOrNull(req.ID)}, false
+}
+
+func idOrNull(id json.RawMessage) json.RawMessage {
+	if len(id) == 0 {
+		return nullID
+	}
+	return id
+}
+
+// buildErrorPayload builds the JSON-RPC error response payload for the
+// request payload, a batch request gets a batch response with one error
+// object for each request in the batch.
+func buildErrorPayload(reqPayload []byte, code int, message string) []byte {
+	ids, batch := parseRequestIDs(reqPayload)
+
+	resps := make([]*jsonrpcErrorResponse, 0, len(ids))
+	for _, id := range ids {
+		resps = append(resps, &jsonrpcErrorResponse{
+			Version: "2.0",
+			ID:      id,
+			Error:   &jsonrpcError{Code: code, Message: message},
+		})
+	}
+
+	var data []byte
+	if batch {
+		data, _ = json.Marshal(resps)
+	} else {
+		data, _ = json.Marshal(resps[0])
+	}
+	return data
+}
+
+// setFailureResponse sets a JSON-RPC error response for the failure, and
+// returns the filter result.
+func (m *ProviderProxy) setFailureResponse(ctx *context.Context, req *httpprot.Request, f *rpcFailure) string {
+	resp, _ := ctx.GetOutputResponse().(*httpprot.Response)
+	if resp == nil {
+		resp, _ = httpprot.NewResponse(nil)
+	}
+
+	// the headers of the provider response describe the body which is
+	// replaced.
+	resp.SetStatusCode(f.statusCode)
+	resp.HTTPHeader().Del("Content-Length")
+	resp.HTTPHeader().Del("Content-Encoding")
+	resp.HTTPHeader().Set("Content-Type", "application/json")
+	resp.SetPayload(buildErrorPayload(req.RawPayload(), f.code, f.message))
+	ctx.SetOutputResponse(resp)
+	return f.result
+}
+
+// isFailureStatusCode checks whether the status code of a provider
+// response indicates a failure.
+func isFailureStatusCode(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// isJSONRPCResponse checks whether the payload is a JSON-RPC response,
+// which is either a response object or an array of response objects.
+func isJSONRPCResponse(payload []byte) bool {
+	type rpcResponse struct {
+		Version string `json:"jsonrpc"`
+	}
+
+	payload = bytes.TrimSpace(payload)
+	if len(payload) == 0 {
+		return false
+	}
+
+	if payload[0] == '[' {
+		var batch []rpcResponse
+		return json.Unmarshal(payload, &batch) == nil && len(batch) > 0 && batch[0].Version != ""
+	}
+
+	var resp rpcResponse
+	return json.Unmarshal(payload, &resp) == nil && resp.Version != ""
+}
+
+// maxObservedBodySize is the max size of stream response bodies which are
+// buffered to find their JSON-RPC error code. JSON-RPC errors are small, so
+// larger bodies are treated as results.
+const maxObservedBodySize = 64 * 1024
+
+// onResponseDone calls fn with the size and the payload of the response
+// after its body is completely read. The body of a stream response is
+// observed while it is being streamed to the client, and body is the
+// reader of the underlying http.Response. At most limit bytes of a stream
+// response are buffered, payload is nil if the body is larger than limit
+// or if it is not completely read.
+func onResponseDone(resp *httpprot.Response, body *readers.CallbackReader, limit int, fn func(size int64, payload []byte)) {
+	if !resp.IsStream() {
+		fn(resp.PayloadSize(), resp.RawPayload())
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	// called once when reach EOF or meet an error.
+	body.OnAfter(func(total int, p []byte, err error) {
+		if total <= limit {
+			buf.Write(p)
+		}
+		if err == nil {
+			return
+		}
+		var payload []byte
+		if err == io.EOF && total <= limit {
+			payload = buf.Bytes()
+		}
+		fn(int64(total), payload)
+	})
+
+	// Drain off the body to make sure fn is called even no one read the
+	// stream.
+	body.OnClose(func() {
+		io.Copy(io.Discard, resp.GetPayload())
+	})
+}
+
+// parseRPCErrorCode returns the code of the first JSON-RPC error object in
+// the payload, the payload could be a single response or a batch response.
+func parseRPCErrorCode(payload []byte) int {
+	type rpcResponse struct {
+		Error *struct {
+			Code int `json:"code"`
+		} `json:"error"`
+	}
+
+	payload = bytes.TrimSpace(payload)
+	if len(payload) == 0 {
+		return 0
+	}
+
+	if payload[0] == '[' {
+		var batch []rpcResponse
+		if json.Unmarshal(payload, &batch) != nil {
+			return 0
+		}
+		for _, resp := range batch {
+			if resp.Error != nil {
+				return resp.Error.Code
+			}
+		}
+		return 0
+	}
+
+	var resp rpcResponse
+	if json.Unmarshal(payload, &resp) != nil || resp.Error == nil {
+		return 0
+	}
+	return resp.Error.Code
+}
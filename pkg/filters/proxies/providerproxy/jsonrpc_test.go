@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providerproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/util/readers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRPCErrorCode(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(0, parseRPCErrorCode(nil))
+	assert.Equal(0, parseRPCErrorCode([]byte("not json")))
+	assert.Equal(0, parseRPCErrorCode([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`)))
+	assert.Equal(-32005, parseRPCErrorCode([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32005,"message":"limit exceeded"}}`)))
+	assert.Equal(-32000, parseRPCErrorCode([]byte(` [{"jsonrpc":"2.0","id":1,"result":"0x1"},{"jsonrpc":"2.0","id":2,"error":{"code":-32000,"message":"header not found"}}]`)))
+	assert.Equal(0, parseRPCErrorCode([]byte(`[{"jsonrpc":"2.0","id":1,"result":"0x1"}]`)))
+}
+
+func TestOnResponseDone(t *testing.T) {
+	assert := assert.New(t)
+
+	newResponse := func(body string, maxBodySize int64) (*httpprot.Response, *readers.CallbackReader) {
+		cr := readers.NewCallbackReader(strings.NewReader(body))
+		resp, err := httpprot.NewResponse(&http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: cr, ContentLength: -1})
+		assert.NoError(err)
+		assert.NoError(resp.FetchPayload(maxBodySize))
+		return resp, cr
+	}
+	rpcError := `{"jsonrpc":"2.0","id":1,"error":{"code":-32005,"message":"limit exceeded"}}`
+
+	var size int64
+	var code, calls int
+	done := func(s int64, payload []byte) {
+		size, code = s, parseRPCErrorCode(payload)
+		calls++
+	}
+
+	// the payload of non-stream responses is checked directly.
+	resp, cr := newResponse(rpcError, 0)
+	onResponseDone(resp, cr, maxObservedBodySize, done)
+	assert.Equal(1, calls)
+	assert.Equal(int64(len(rpcError)), size)
+	assert.Equal(-32005, code)
+
+	// stream responses are checked after they are streamed.
+	resp, cr = newResponse(rpcError, -1)
+	onResponseDone(resp, cr, maxObservedBodySize, done)
+	assert.Equal(1, calls)
+	data, _ := io.ReadAll(resp.GetPayload())
+	assert.Equal(rpcError, string(data))
+	resp.Close()
+	assert.Equal(2, calls)
+	assert.Equal(int64(len(rpcError)), size)
+	assert.Equal(-32005, code)
+
+	// the stream is drained if no one reads it.
+	large := `{"jsonrpc":"2.0","id":1,"result":"` + strings.Repeat("0", maxObservedBodySize) + `"}`
+	resp, cr = newResponse(large, -1)
+	onResponseDone(resp, cr, maxObservedBodySize, done)
+	resp.Close()
+	assert.Equal(3, calls)
+	assert.Equal(int64(len(large)), size)
+	assert.Equal(0, code)
+}
+
+func TestBuildErrorPayload(t *testing.T) {
+	assert := assert.New(t)
+
+	payload := buildErrorPayload([]byte(`{"jsonrpc":"2.0","id":"abc","method":"eth_blockNumber"}`), ErrCodeInternal, "failed")
+	assert.JSONEq(`{"jsonrpc":"2.0","id":"abc","error":{"code":-32603,"message":"failed"}}`, string(payload))
+
+	payload = buildErrorPayload([]byte(`[{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"},{"jsonrpc":"2.0","method":"eth_chainId"}]`), ErrCodeLimitExceeded, "limited")
+	assert.JSONEq(`[{"jsonrpc":"2.0","id":1,"error":{"code":-32005,"message":"limited"}},{"jsonrpc":"2.0","id":null,"error":{"code":-32005,"message":"limited"}}]`, string(payload))
+
+	payload = buildErrorPayload([]byte(`not json`), ErrCodeInternal, "failed")
+	assert.JSONEq(`{"jsonrpc":"2.0","id":null,"error":{"code":-32603,"message":"failed"}}`, string(payload))
+
+	payload = buildErrorPayload([]byte(`[]`), ErrCodeInternal, "failed")
+	assert.JSONEq(`{"jsonrpc":"2.0","id":null,"error":{"code":-32603,"message":"failed"}}`, string(payload))
+}
+
+func TestIsJSONRPCResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(isJSONRPCResponse([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`)))
+	assert.True(isJSONRPCResponse([]byte(`[{"jsonrpc":"2.0","id":1,"result":"0x1"}]`)))
+	assert.False(isJSONRPCResponse([]byte(`[]`)))
+	assert.False(isJSONRPCResponse([]byte(`Too Many Requests`)))
+	assert.False(isJSONRPCResponse(nil))
+}
+
+func TestHandleFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	var statusCode int
+	var body string
+	header := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range header {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(statusCode)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	proxy := newTestProviderProxy(`
+name: providerProxy
+kind: ProviderProxy
+urls:
+  - `+server.URL, assert)
+	defer proxy.Close()
+
+	handle := func(payload string) (string, *httpprot.Response) {
+		stdr, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1/", strings.NewReader(payload))
+		ctx := getCtx(stdr)
+		result := proxy.Handle(ctx)
+		return result, ctx.GetResponse(context.DefaultNamespace).(*httpprot.Response)
+	}
+
+	statusCode, body = http.StatusTooManyRequests, "Too Many Requests"
+	result, resp := handle(`{"jsonrpc":"2.0","id":7,"method":"eth_blockNumber"}`)
+	assert.Equal(resultRateLimited, result)
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode())
+	data, _ := io.ReadAll(resp.GetPayload())
+	assert.JSONEq(`{"jsonrpc":"2.0","id":7,"error":{"code":-32005,"message":"request rate limited by provider"}}`, string(data))
+
+	// the headers describing the replaced body are reset.
+	statusCode, body = http.StatusServiceUnavailable, "Service Unavailable"
+	header["Content-Type"], header["Content-Encoding"] = "text/html", "identity"
+	result, resp = handle(`[{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"},{"jsonrpc":"2.0","id":2,"method":"eth_chainId"}]`)
+	assert.Equal(resultServerError, result)
+	assert.Equal(http.StatusBadGateway, resp.StatusCode())
+	assert.Equal("application/json", resp.HTTPHeader().Get("Content-Type"))
+	assert.Empty(resp.HTTPHeader().Get("Content-Encoding"))
+	assert.Empty(resp.HTTPHeader().Get("Content-Length"))
+	header = map[string]string{}
+	data, _ = io.ReadAll(resp.GetPayload())
+	assert.JSONEq(`[{"jsonrpc":"2.0","id":1,"error":{"code":-32603,"message":"provider request failed"}},{"jsonrpc":"2.0","id":2,"error":{"code":-32603,"message":"provider request failed"}}]`, string(data))
+
+	// the JSON-RPC response of the provider is kept.
+	statusCode, body = http.StatusInternalServerError, `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"header not found"}}`
+	result, resp = handle(`{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber"}`)
+	assert.Equal(resultServerError, result)
+	assert.Equal(http.StatusInternalServerError, resp.StatusCode())
+	data, _ = io.ReadAll(resp.GetPayload())
+	assert.JSONEq(body, string(data))
+
+	statusCode, body = http.StatusOK, `{"jsonrpc":"2.0","id":1,"result":"0x1"}`
+	result, resp = handle(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`)
+	assert.Equal("", result)
+	assert.Equal(http.StatusOK, resp.StatusCode())
+
+	server.Close()
+	result, resp = handle(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`)
+	assert.Equal(resultUpstreamError, result)
+	assert.Equal(http.StatusBadGateway, resp.StatusCode())
+	data, _ = io.ReadAll(resp.GetPayload())
+	assert.JSONEq(`{"jsonrpc":"2.0","id":1,"error":{"code":-32603,"message":"provider request failed"}}`, string(data))
+}
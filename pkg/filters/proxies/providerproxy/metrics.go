@@ -10,11 +10,15 @@ import (
 
 type (
 	metrics struct {
-		TotalRequests    *prometheus.CounterVec
-		RequestsDuration prometheus.ObserverVec
+		TotalRequests      *prometheus.CounterVec
+		RequestsDuration   prometheus.ObserverVec
+		ShadowRequests     *prometheus.CounterVec
+		ShadowLatencyDelta prometheus.ObserverVec
 	}
 
 	RequestMetrics struct {
+		Chain      string
+		Policy     string
 		Provider   string
 		RpcMethod  []string
 		StatusCode int
@@ -28,7 +32,11 @@ func (m *ProviderProxy) newMetrics() *metrics {
 		"kind":         Kind,
 	}
 	prometheusLabels := []string{
-		"pipelineName", "kind", "policy", "statusCode", "provider", "rpcMethod",
+		"pipelineName", "kind", "chain", "policy", "statusCode", "provider", "rpcMethod",
+	}
+
+	shadowLabels := []string{
+		"pipelineName", "kind", "chain", "provider", "rpcMethod",
 	}
 
 	return &metrics{
@@ -41,13 +49,24 @@ func (m *ProviderProxy) newMetrics() *metrics {
 				Help:    "request processing duration histogram of a backend",
 				Buckets: prometheushelper.DefaultDurationBuckets(),
 			}, prometheusLabels).MustCurryWith(commonLabels),
+		ShadowRequests: prometheushelper.NewCounter(
+			"providerproxy_shadow_requests",
+			"the total count of shadow requests by comparison result",
+			append(shadowLabels, "result")).MustCurryWith(commonLabels),
+		ShadowLatencyDelta: prometheushelper.NewSummary(
+			prometheus.SummaryOpts{
+				Name:       "providerproxy_shadow_latency_delta",
+				Help:       "the latency of shadow provider minus the latency of primary provider in seconds",
+				Objectives: prometheushelper.DefaultObjectives(),
+			}, shadowLabels).MustCurryWith(commonLabels),
 	}
 }
 
 func (m *ProviderProxy) collectMetrics(requestMetrics RequestMetrics) {
 	for _, method := range requestMetrics.RpcMethod {
 		labels := prometheus.Labels{
-			"policy":     m.spec.Policy,
+			"chain":      requestMetrics.Chain,
+			"policy":     requestMetrics.Policy,
 			"statusCode": strconv.Itoa(requestMetrics.StatusCode),
 			"provider":   requestMetrics.Provider,
 			"rpcMethod":  method,
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mockprovider
+
+import (
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/filters"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+)
+
+const (
+	// Kind is the kind of MockProvider.
+	Kind = "MockProvider"
+)
+
+var kind = &filters.Kind{
+	Name:        Kind,
+	Description: "MockProvider simulates a JSON-RPC blockchain provider.",
+	Results:     []string{},
+	DefaultSpec: func() filters.Spec {
+		return &Spec{
+			ProviderSpec: ProviderSpec{
+				ChainID:   1,
+				BlockTime: "12s",
+			},
+		}
+	},
+	CreateInstance: func(spec filters.Spec) filters.Filter {
+		return &MockProvider{spec: spec.(*Spec)}
+	},
+}
+
+func init() {
+	filters.Register(kind)
+}
+
+type (
+	// MockProvider is the filter which responds JSON-RPC requests with a
+	// mock provider, it is mainly used in staging environments.
+	MockProvider struct {
+		spec     *Spec
+		provider *Provider
+	}
+
+	// Spec describes the MockProvider.
+	Spec struct {
+		filters.BaseSpec `json:",inline"`
+		ProviderSpec     `json:",inline"`
+	}
+)
+
+// Validate validates Spec.
+func (spec *Spec) Validate() error {
+	return spec.ProviderSpec.Validate()
+}
+
+// Name returns the name of the MockProvider filter instance.
+func (m *MockProvider) Name() string {
+	return m.spec.Name()
+}
+
+// Kind returns the kind of MockProvider.
+func (m *MockProvider) Kind() *filters.Kind {
+	return kind
+}
+
+// Spec returns the spec used by the MockProvider.
+func (m *MockProvider) Spec() filters.Spec {
+	return m.spec
+}
+
+// Init initializes MockProvider.
+func (m *MockProvider) Init() {
+	m.reload()
+}
+
+// Inherit inherits previous generation of MockProvider.
+func (m *MockProvider) Inherit(previousGeneration filters.Filter) {
+	m.Init()
+}
+
+func (m *MockProvider) reload() {
+	provider, err := New(&m.spec.ProviderSpec)
+	if err != nil {
+		panic(err)
+	}
+	m.provider = provider
+}
+
+// Handle responds the request with the mock provider.
+func (m *MockProvider) Handle(ctx *context.Context) string {
+	req := ctx.GetInputRequest().(*httpprot.Request)
+	r := m.provider.Handle(req.RawPayload())
+
+	resp, _ := httpprot.NewResponse(nil)
+	resp.SetStatusCode(r.StatusCode)
+	resp.HTTPHeader().Set("Content-Type", "application/json")
+	resp.SetPayload(r.Body)
+	ctx.SetOutputResponse(resp)
+
+	if r.Delay <= 0 {
+		return ""
+	}
+
+	select {
+	case <-req.Context().Done():
+		logger.Debugf("request cancelled in the middle of delay mocking")
+	case <-time.After(r.Delay):
+	}
+	return ""
+}
+
+// Status returns status.
+func (m *MockProvider) Status() interface{} {
+	return nil
+}
+
+// Close closes MockProvider.
+func (m *MockProvider) Close() {
+}
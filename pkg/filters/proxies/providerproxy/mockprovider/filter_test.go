@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mockprovider
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/filters"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/tracing"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMockProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	const yamlConfig = `
+kind: MockProvider
+name: mock
+chainID: 137
+startHeight: 1000
+latency:
+  mean: 1ms
+`
+	rawSpec := map[string]interface{}{}
+	assert.NoError(codectool.Unmarshal([]byte(yamlConfig), &rawSpec))
+	spec, err := filters.NewSpec(nil, "", rawSpec)
+	assert.NoError(err)
+
+	m := kind.CreateInstance(spec).(*MockProvider)
+	m.Init()
+	defer m.Close()
+	assert.Equal(kind, m.Kind())
+	assert.Equal("mock", m.Name())
+	assert.Nil(m.Status())
+
+	stdr, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1/", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`))
+	req, _ := httpprot.NewRequest(stdr)
+	assert.NoError(req.FetchPayload(0))
+	ctx := context.New(tracing.NoopSpan)
+	ctx.SetInputRequest(req)
+
+	assert.Equal("", m.Handle(ctx))
+	resp := ctx.GetOutputResponse().(*httpprot.Response)
+	assert.Equal(http.StatusOK, resp.StatusCode())
+	body, _ := io.ReadAll(resp.GetPayload())
+	assert.JSONEq(`{"jsonrpc":"2.0","id":1,"result":"0x89"}`, string(body))
+
+	newM := kind.CreateInstance(spec).(*MockProvider)
+	newM.Inherit(m)
+	assert.Equal(uint64(1000), newM.provider.Head())
+}
@@ -0,0 +1,577 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package mockprovider provides an in-process JSON-RPC provider, which
+// simulates the head progression, lag, latency, errors, rate limiting and
+// forks of a blockchain node. It could be used from Go tests as an
+// http.Handler, or in a pipeline as the MockProvider filter.
+package mockprovider
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JSON-RPC error codes returned by the Provider.
+const (
+	errCodeParse          = -32700
+	errCodeMethodNotFound = -32601
+	errCodeInvalidParams  = -32602
+	errCodeInternal       = -32603
+	errCodeLimitExceeded  = -32005
+)
+
+type (
+	// ProviderSpec describes the behavior of a mock provider.
+	ProviderSpec struct {
+		ChainID uint64 `json:"chainID,omitempty" jsonschema:"default=1"`
+		// StartHeight is the head height when the provider starts.
+		StartHeight uint64 `json:"startHeight,omitempty"`
+		// BlockTime is the interval to produce a new block, the head does
+		// not progress if it is not set.
+		BlockTime string `json:"blockTime,omitempty" jsonschema:"format=duration"`
+		// Lag is the number of blocks the provider lags behind the head.
+		Lag uint64 `json:"lag,omitempty"`
+
+		Latency *LatencySpec `json:"latency,omitempty"`
+		// ErrorRate is the fraction of requests failed with an internal
+		// error.
+		ErrorRate float64 `json:"errorRate,omitempty" jsonschema:"minimum=0,maximum=1"`
+		// RateLimit is the max number of requests per second, requests
+		// exceeding the limit are rejected with status code 429.
+		RateLimit int `json:"rateLimit,omitempty"`
+
+		// ForkInterval is the number of blocks between two forks, and on
+		// each fork, the hashes of the latest ForkDepth blocks change.
+		ForkInterval uint64 `json:"forkInterval,omitempty"`
+		ForkDepth    uint64 `json:"forkDepth,omitempty"`
+
+		// LogsPerBlock is the number of logs in each block returned by
+		// eth_getLogs, and MaxLogs is the max number of logs eth_getLogs
+		// returns, a query matching more logs is rejected.
+		LogsPerBlock int `json:"logsPerBlock,omitempty"`
+		MaxLogs      int `json:"maxLogs,omitempty"`
+
+		// Seed is the seed of the random generator, which makes the
+		// latency and errors reproducible.
+		Seed int64 `json:"seed,omitempty"`
+	}
+
+	// LatencySpec describes the latency distribution of responses.
+	LatencySpec struct {
+		Distribution string `json:"distribution,omitempty" jsonschema:"enum=,enum=fixed,enum=uniform,enum=normal"`
+		Mean         string `json:"mean,omitempty" jsonschema:"format=duration"`
+		StdDev       string `json:"stdDev,omitempty" jsonschema:"format=duration"`
+		Min          string `json:"min,omitempty" jsonschema:"format=duration"`
+		Max          string `json:"max,omitempty" jsonschema:"format=duration"`
+	}
+
+	// Provider is a mock JSON-RPC provider.
+	Provider struct {
+		spec      *ProviderSpec
+		blockTime time.Duration
+		latency   latency
+
+		mutex       sync.Mutex
+		now         func() time.Time
+		startTime   time.Time
+		rand        *rand.Rand
+		window      time.Time
+		windowCount int
+	}
+
+	// Response is a response of the Provider.
+	Response struct {
+		StatusCode int
+		Body       []byte
+		// Delay is the simulated latency of the response.
+		Delay time.Duration
+	}
+
+	latency struct {
+		distribution string
+		mean, stdDev time.Duration
+		min, max     time.Duration
+	}
+
+	rpcRequest struct {
+		Version string            `json:"jsonrpc"`
+		ID      json.RawMessage   `json:"id"`
+		Method  string            `json:"method"`
+		Params  []json.RawMessage `json:"params"`
+	}
+
+	rpcError struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+
+	rpcResponse struct {
+		Version string          `json:"jsonrpc"`
+		ID      json.RawMessage `json:"id"`
+		Result  interface{}     `json:"result,omitempty"`
+		Error   *rpcError       `json:"error,omitempty"`
+	}
+)
+
+// Validate validates ProviderSpec.
+func (spec *ProviderSpec) Validate() error {
+	if _, err := parseDuration(spec.BlockTime); err != nil {
+		return fmt.Errorf("invalid blockTime: %v", err)
+	}
+	if spec.ErrorRate < 0 || spec.ErrorRate > 1 {
+		return fmt.Errorf("errorRate must be in [0, 1]")
+	}
+	if spec.ForkInterval > 0 && spec.ForkDepth == 0 {
+		return fmt.Errorf("forkDepth is required if forkInterval is set")
+	}
+	if spec.Latency != nil {
+		if _, err := spec.Latency.parse(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (spec *LatencySpec) parse() (latency, error) {
+	var l latency
+	var err error
+
+	l.distribution = spec.Distribution
+	if l.mean, err = parseDuration(spec.Mean); err != nil {
+		return l, fmt.Errorf("invalid latency mean: %v", err)
+	}
+	if l.stdDev, err = parseDuration(spec.StdDev); err != nil {
+		return l, fmt.Errorf("invalid latency stdDev: %v", err)
+	}
+	if l.min, err = parseDuration(spec.Min); err != nil {
+		return l, fmt.Errorf("invalid latency min: %v", err)
+	}
+	if l.max, err = parseDuration(spec.Max); err != nil {
+		return l, fmt.Errorf("invalid latency max: %v", err)
+	}
+	if l.max > 0 && l.min > l.max {
+		return l, fmt.Errorf("latency min is larger than max")
+	}
+	return l, nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// New creates a Provider.
+func New(spec *ProviderSpec) (*Provider, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+
+	p := &Provider{
+		spec: spec,
+		now:  time.Now,
+		rand: rand.New(rand.NewSource(spec.Seed)),
+	}
+	p.blockTime, _ = parseDuration(spec.BlockTime)
+	if spec.Latency != nil {
+		p.latency, _ = spec.Latency.parse()
+	}
+	p.startTime = p.now()
+	return p, nil
+}
+
+// SetClock replaces the clock of the Provider, and restarts the head
+// progression from the current time of the clock. It is used to control
+// the time in tests.
+func (p *Provider) SetClock(now func() time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.now = now
+	p.startTime = now()
+	p.window = time.Time{}
+	p.windowCount = 0
+}
+
+// Head returns the head height reported by the Provider, which takes the
+// lag into account.
+func (p *Provider) Head() uint64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.head()
+}
+
+func (p *Provider) head() uint64 {
+	head := p.spec.StartHeight
+	if p.blockTime > 0 {
+		head += uint64(p.now().Sub(p.startTime) / p.blockTime)
+	}
+	if head < p.spec.Lag {
+		return 0
+	}
+	return head - p.spec.Lag
+}
+
+// BlockHash returns the hash of block number at the current head, the
+// hash of a block changes when it is rewritten by a fork.
+func (p *Provider) BlockHash(number uint64) string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.blockHash(number, p.head())
+}
+
+// blockHash computes the hash of a block from its number and the number of
+// forks which rewrote it.
+func (p *Provider) blockHash(number, head uint64) string {
+	generation := uint64(0)
+	if p.spec.ForkInterval > 0 {
+		// a fork at height f rewrites blocks in (f-depth, f], so block
+		// number is rewritten by forks in [number, number+depth).
+		last := number + p.spec.ForkDepth - 1
+		if last > head {
+			last = head
+		}
+		switch {
+		case last < number:
+		case number == 0:
+			generation = last / p.spec.ForkInterval
+		default:
+			generation = last/p.spec.ForkInterval - (number-1)/p.spec.ForkInterval
+		}
+	}
+
+	buf := make([]byte, 24)
+	binary.BigEndian.PutUint64(buf, p.spec.ChainID)
+	binary.BigEndian.PutUint64(buf[8:], number)
+	binary.BigEndian.PutUint64(buf[16:], generation)
+	sum := sha256.Sum256(buf)
+	return fmt.Sprintf("0x%x", sum)
+}
+
+// Handle handles a JSON-RPC request payload, which could be a single
+// request or a batch request.
+func (p *Provider) Handle(payload []byte) *Response {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	resp := &Response{StatusCode: http.StatusOK, Delay: p.sampleLatency()}
+
+	payload = bytes.TrimSpace(payload)
+	batch := len(payload) > 0 && payload[0] == '['
+
+	if p.rateLimited() {
+		resp.StatusCode = http.StatusTooManyRequests
+		resp.Body = p.errorBody(payload, batch, errCodeLimitExceeded, "rate limit exceeded")
+		return resp
+	}
+
+	if p.spec.ErrorRate > 0 && p.rand.Float64() < p.spec.ErrorRate {
+		resp.StatusCode = http.StatusInternalServerError
+		resp.Body = p.errorBody(payload, batch, errCodeInternal, "internal error")
+		return resp
+	}
+
+	if batch {
+		var reqs []*rpcRequest
+		if err := json.Unmarshal(payload, &reqs); err != nil {
+			resp.Body, _ = json.Marshal(newErrorResponse(nil, errCodeParse, err.Error()))
+			return resp
+		}
+		resps := make([]*rpcResponse, 0, len(reqs))
+		for _, req := range reqs {
+			resps = append(resps, p.call(req))
+		}
+		resp.Body, _ = json.Marshal(resps)
+		return resp
+	}
+
+	req := &rpcRequest{}
+	if err := json.Unmarshal(payload, req); err != nil {
+		resp.Body, _ = json.Marshal(newErrorResponse(nil, errCodeParse, err.Error()))
+		return resp
+	}
+	resp.Body, _ = json.Marshal(p.call(req))
+	return resp
+}
+
+// ServeHTTP implements http.Handler.
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	buf := &bytes.Buffer{}
+	buf.ReadFrom(r.Body)
+	resp := p.Handle(buf.Bytes())
+
+	if resp.Delay > 0 {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(resp.Delay):
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	w.Write(resp.Body)
+}
+
+// rateLimited checks whether the current request exceeds the rate limit,
+// requests are counted in fixed one second windows.
+func (p *Provider) rateLimited() bool {
+	if p.spec.RateLimit <= 0 {
+		return false
+	}
+
+	now := p.now()
+	if now.Sub(p.window) >= time.Second {
+		p.window = now
+		p.windowCount = 0
+	}
+	p.windowCount++
+	return p.windowCount > p.spec.RateLimit
+}
+
+func (p *Provider) sampleLatency() time.Duration {
+	l := &p.latency
+	var d time.Duration
+
+	switch l.distribution {
+	case "uniform":
+		if l.max > l.min {
+			d = l.min + time.Duration(p.rand.Int63n(int64(l.max-l.min)))
+		} else {
+			d = l.min
+		}
+	case "normal":
+		d = l.mean + time.Duration(p.rand.NormFloat64()*float64(l.stdDev))
+	default:
+		d = l.mean
+	}
+
+	if d < l.min {
+		d = l.min
+	}
+	if l.max > 0 && d > l.max {
+		d = l.max
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+func (p *Provider) errorBody(payload []byte, batch bool, code int, message string) []byte {
+	if !batch {
+		req := &rpcRequest{}
+		json.Unmarshal(payload, req)
+		body, _ := json.Marshal(newErrorResponse(req.ID, code, message))
+		return body
+	}
+
+	var reqs []*rpcRequest
+	json.Unmarshal(payload, &reqs)
+	resps := make([]*rpcResponse, 0, len(reqs))
+	for _, req := range reqs {
+		resps = append(resps, newErrorResponse(req.ID, code, message))
+	}
+	body, _ := json.Marshal(resps)
+	return body
+}
+
+func newErrorResponse(id json.RawMessage, code int, message string) *rpcResponse {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return &rpcResponse{
+		Version: "2.0",
+		ID:      id,
+		Error:   &rpcError{Code: code, Message: message},
+	}
+}
+
+func (p *Provider) call(req *rpcRequest) *rpcResponse {
+	head := p.head()
+	resp := &rpcResponse{Version: "2.0", ID: req.ID}
+	if len(resp.ID) == 0 {
+		resp.ID = json.RawMessage("null")
+	}
+
+	switch req.Method {
+	case "eth_chainId":
+		resp.Result = hexUint(p.spec.ChainID)
+	case "net_version":
+		resp.Result = strconv.FormatUint(p.spec.ChainID, 10)
+	case "eth_blockNumber":
+		resp.Result = hexUint(head)
+	case "getSlot":
+		resp.Result = head
+	case "eth_getBlockByNumber":
+		if len(req.Params) == 0 {
+			resp.Error = &rpcError{Code: errCodeInvalidParams, Message: "missing block number"}
+			break
+		}
+		number, err := parseBlockNumber(req.Params[0], head)
+		if err != nil {
+			resp.Error = &rpcError{Code: errCodeInvalidParams, Message: err.Error()}
+			break
+		}
+		if number > head {
+			// a block not produced yet is null.
+			resp.Result = json.RawMessage("null")
+			break
+		}
+		resp.Result = p.block(number, head)
+	case "eth_getLogs":
+		resp.Result, resp.Error = p.logs(req.Params, head)
+	default:
+		resp.Error = &rpcError{
+			Code:    errCodeMethodNotFound,
+			Message: fmt.Sprintf("the method %s does not exist/is not available", req.Method),
+		}
+	}
+	return resp
+}
+
+func (p *Provider) block(number, head uint64) map[string]interface{} {
+	zeroHash := "0x" + strings.Repeat("0", 64)
+	parentHash := zeroHash
+	if number > 0 {
+		parentHash = p.blockHash(number-1, head)
+	}
+
+	timestamp := p.startTime.Unix()
+	if p.blockTime > 0 {
+		offset := int64(number) - int64(p.spec.StartHeight)
+		timestamp += offset * int64(p.blockTime/time.Second)
+	}
+	if timestamp < 0 {
+		timestamp = 0
+	}
+
+	return map[string]interface{}{
+		"number":           hexUint(number),
+		"hash":             p.blockHash(number, head),
+		"parentHash":       parentHash,
+		"sha3Uncles":       zeroHash,
+		"miner":            "0x" + strings.Repeat("0", 40),
+		"stateRoot":        zeroHash,
+		"transactionsRoot": zeroHash,
+		"receiptsRoot":     zeroHash,
+		"logsBloom":        "0x" + strings.Repeat("0", 512),
+		"difficulty":       "0x0",
+		"gasLimit":         hexUint(30000000),
+		"gasUsed":          "0x0",
+		"timestamp":        hexUint(uint64(timestamp)),
+		"extraData":        "0x",
+		"mixHash":          zeroHash,
+		"nonce":            "0x0000000000000000",
+		"transactions":     []interface{}{},
+		"uncles":           []interface{}{},
+	}
+}
+
+// logs returns the logs of the eth_getLogs query, the filters other than
+// the block range are ignored.
+func (p *Provider) logs(params []json.RawMessage, head uint64) (interface{}, *rpcError) {
+	filter := struct {
+		FromBlock json.RawMessage `json:"fromBlock"`
+		ToBlock   json.RawMessage `json:"toBlock"`
+	}{}
+	if len(params) == 0 || json.Unmarshal(params[0], &filter) != nil {
+		return nil, &rpcError{Code: errCodeInvalidParams, Message: "invalid filter"}
+	}
+
+	from, to := head, head
+	var err error
+	if len(filter.FromBlock) > 0 {
+		if from, err = parseBlockNumber(filter.FromBlock, head); err != nil {
+			return nil, &rpcError{Code: errCodeInvalidParams, Message: err.Error()}
+		}
+	}
+	if len(filter.ToBlock) > 0 {
+		if to, err = parseBlockNumber(filter.ToBlock, head); err != nil {
+			return nil, &rpcError{Code: errCodeInvalidParams, Message: err.Error()}
+		}
+	}
+	if to > head {
+		to = head
+	}
+
+	logs := []interface{}{}
+	if from > to || p.spec.LogsPerBlock == 0 {
+		return logs, nil
+	}
+	count := (to - from + 1) * uint64(p.spec.LogsPerBlock)
+	if p.spec.MaxLogs > 0 && count > uint64(p.spec.MaxLogs) {
+		return nil, &rpcError{
+			Code:    errCodeLimitExceeded,
+			Message: fmt.Sprintf("query returned more than %d results", p.spec.MaxLogs),
+		}
+	}
+
+	for n := from; n <= to; n++ {
+		hash := p.blockHash(n, head)
+		for i := 0; i < p.spec.LogsPerBlock; i++ {
+			logs = append(logs, map[string]interface{}{
+				"address":          "0x" + strings.Repeat("0", 40),
+				"topics":           []string{},
+				"data":             "0x",
+				"blockNumber":      hexUint(n),
+				"blockHash":        hash,
+				"transactionHash":  "0x" + strings.Repeat("0", 64),
+				"transactionIndex": "0x0",
+				"logIndex":         hexUint(uint64(i)),
+				"removed":          false,
+			})
+		}
+	}
+	return logs, nil
+}
+
+func hexUint(n uint64) string {
+	return "0x" + strconv.FormatUint(n, 16)
+}
+
+// parseBlockNumber parses a block number parameter, which is a hex number
+// or a tag like "latest".
+func parseBlockNumber(param json.RawMessage, head uint64) (uint64, error) {
+	var s string
+	if err := json.Unmarshal(param, &s); err != nil {
+		return 0, fmt.Errorf("invalid block number: %s", param)
+	}
+
+	switch s {
+	case "latest", "pending", "safe", "finalized":
+		return head, nil
+	case "earliest":
+		return 0, nil
+	}
+
+	if !strings.HasPrefix(s, "0x") {
+		return 0, fmt.Errorf("invalid block number: %s", s)
+	}
+	return strconv.ParseUint(s[2:], 16, 64)
+}
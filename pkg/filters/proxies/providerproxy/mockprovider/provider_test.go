@@ -0,0 +1,224 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mockprovider
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestProvider(t *testing.T, spec *ProviderSpec) (*Provider, *fakeClock) {
+	p, err := New(spec)
+	assert.NoError(t, err)
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	p.SetClock(clock.Now)
+	return p, clock
+}
+
+func call(p *Provider, method string, params ...interface{}) (*Response, map[string]json.RawMessage) {
+	req := map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": method}
+	if params != nil {
+		req["params"] = params
+	}
+	payload, _ := json.Marshal(req)
+	resp := p.Handle(payload)
+	body := map[string]json.RawMessage{}
+	json.Unmarshal(resp.Body, &body)
+	return resp, body
+}
+
+func TestSpecValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&ProviderSpec{}).Validate())
+	assert.Error((&ProviderSpec{BlockTime: "abc"}).Validate())
+	assert.Error((&ProviderSpec{ErrorRate: 2}).Validate())
+	assert.Error((&ProviderSpec{ForkInterval: 10}).Validate())
+	assert.Error((&ProviderSpec{Latency: &LatencySpec{Min: "2s", Max: "1s"}}).Validate())
+	assert.Error((&ProviderSpec{Latency: &LatencySpec{Mean: "x"}}).Validate())
+}
+
+func TestHeadProgression(t *testing.T) {
+	assert := assert.New(t)
+
+	p, clock := newTestProvider(t, &ProviderSpec{ChainID: 1, StartHeight: 100, BlockTime: "12s", Lag: 3})
+	assert.Equal(uint64(97), p.Head())
+
+	clock.Advance(25 * time.Second)
+	assert.Equal(uint64(99), p.Head())
+
+	_, body := call(p, "eth_blockNumber")
+	assert.Equal(`"0x63"`, string(body["result"]))
+
+	_, body = call(p, "eth_chainId")
+	assert.Equal(`"0x1"`, string(body["result"]))
+
+	_, body = call(p, "getSlot")
+	assert.Equal(`99`, string(body["result"]))
+
+	_, body = call(p, "eth_getBlockByNumber", "latest", false)
+	head := types.Header{}
+	assert.NoError(json.Unmarshal(body["result"], &head))
+	assert.Equal(uint64(99), head.Number.Uint64())
+	assert.Equal(p.BlockHash(98), head.ParentHash.Hex())
+
+	_, body = call(p, "eth_getBlockByNumber", "0x1000", false)
+	assert.Equal(`null`, string(body["result"]))
+
+	_, body = call(p, "eth_getBlockByNumber", "abc", false)
+	assert.Contains(string(body["error"]), "-32602")
+
+	_, body = call(p, "eth_unknown")
+	assert.Contains(string(body["error"]), "-32601")
+}
+
+func TestForks(t *testing.T) {
+	assert := assert.New(t)
+
+	p, clock := newTestProvider(t, &ProviderSpec{StartHeight: 8, BlockTime: "1s", ForkInterval: 10, ForkDepth: 2})
+	hash8, hash9 := p.BlockHash(8), p.BlockHash(9)
+	assert.NotEqual(hash8, hash9)
+
+	// head is 9, the fork at 10 does not happen yet.
+	clock.Advance(time.Second)
+	assert.Equal(hash8, p.BlockHash(8))
+	assert.Equal(hash9, p.BlockHash(9))
+
+	// head is 10, the fork at 10 rewrites block 9 and 10.
+	clock.Advance(time.Second)
+	assert.Equal(hash8, p.BlockHash(8))
+	assert.NotEqual(hash9, p.BlockHash(9))
+}
+
+func TestErrorsAndRateLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	p, clock := newTestProvider(t, &ProviderSpec{RateLimit: 2})
+	resp, _ := call(p, "eth_blockNumber")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	resp, _ = call(p, "eth_blockNumber")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	resp, body := call(p, "eth_blockNumber")
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	assert.Contains(string(body["error"]), "-32005")
+	clock.Advance(time.Second)
+	resp, _ = call(p, "eth_blockNumber")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// errors are reproducible with the same seed.
+	count := func() int {
+		p, _ := newTestProvider(t, &ProviderSpec{ErrorRate: 0.3, Seed: 42})
+		failures := 0
+		for i := 0; i < 100; i++ {
+			if resp, _ := call(p, "eth_blockNumber"); resp.StatusCode == http.StatusInternalServerError {
+				failures++
+			}
+		}
+		return failures
+	}
+	failures := count()
+	assert.Equal(failures, count())
+	assert.InDelta(30, failures, 15)
+
+	clock.Advance(time.Second)
+	resp = p.Handle([]byte(`[{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"},{"jsonrpc":"2.0","id":2,"method":"eth_chainId"}]`))
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	var batch []map[string]json.RawMessage
+	assert.NoError(json.Unmarshal(resp.Body, &batch))
+	assert.Len(batch, 2)
+	assert.Equal(`2`, string(batch[1]["id"]))
+
+	clock.Advance(time.Second)
+	resp = p.Handle([]byte(`{not json`))
+	assert.Contains(string(resp.Body), "-32700")
+}
+
+func TestGetLogs(t *testing.T) {
+	assert := assert.New(t)
+
+	p, _ := newTestProvider(t, &ProviderSpec{StartHeight: 100, LogsPerBlock: 2, MaxLogs: 10})
+	_, body := call(p, "eth_getLogs", map[string]string{"fromBlock": "0x10", "toBlock": "0x12"})
+	var logs []map[string]interface{}
+	assert.NoError(json.Unmarshal(body["result"], &logs))
+	assert.Len(logs, 6)
+	assert.Equal("0x10", logs[0]["blockNumber"])
+	assert.Equal("0x12", logs[5]["blockNumber"])
+
+	_, body = call(p, "eth_getLogs", map[string]string{"fromBlock": "0x10", "toBlock": "0x20"})
+	assert.Contains(string(body["error"]), "query returned more than 10 results")
+
+	_, body = call(p, "eth_getLogs", map[string]string{"fromBlock": "latest"})
+	assert.NoError(json.Unmarshal(body["result"], &logs))
+	assert.Len(logs, 2)
+
+	_, body = call(p, "eth_getLogs")
+	assert.Contains(string(body["error"]), "-32602")
+}
+
+func TestLatency(t *testing.T) {
+	assert := assert.New(t)
+
+	p, _ := newTestProvider(t, &ProviderSpec{Latency: &LatencySpec{Mean: "10ms"}})
+	resp, _ := call(p, "eth_blockNumber")
+	assert.Equal(10*time.Millisecond, resp.Delay)
+
+	p, _ = newTestProvider(t, &ProviderSpec{Latency: &LatencySpec{Distribution: "uniform", Min: "10ms", Max: "20ms"}})
+	for i := 0; i < 100; i++ {
+		resp, _ := call(p, "eth_blockNumber")
+		assert.GreaterOrEqual(resp.Delay, 10*time.Millisecond)
+		assert.Less(resp.Delay, 20*time.Millisecond)
+	}
+
+	p, _ = newTestProvider(t, &ProviderSpec{Latency: &LatencySpec{Distribution: "normal", Mean: "50ms", StdDev: "100ms", Min: "5ms", Max: "80ms"}})
+	for i := 0; i < 100; i++ {
+		resp, _ := call(p, "eth_blockNumber")
+		assert.GreaterOrEqual(resp.Delay, 5*time.Millisecond)
+		assert.LessOrEqual(resp.Delay, 80*time.Millisecond)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	assert := assert.New(t)
+
+	p, _ := newTestProvider(t, &ProviderSpec{StartHeight: 10, Latency: &LatencySpec{Mean: "1ms"}})
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL, "application/json", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`))
+	assert.NoError(err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.JSONEq(`{"jsonrpc":"2.0","id":1,"result":"0xa"}`, string(body))
+}
@@ -20,13 +20,14 @@ package providerproxy
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 
 	"github.com/megaease/easegress/v2/pkg/context"
 	"github.com/megaease/easegress/v2/pkg/filters"
-	proxy "github.com/megaease/easegress/v2/pkg/filters/proxies/httpproxy"
 	"github.com/megaease/easegress/v2/pkg/filters/proxies/providerproxy/selector"
 	"github.com/megaease/easegress/v2/pkg/logger"
 	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
@@ -42,11 +43,16 @@ const (
 
 type (
 	ProviderProxy struct {
-		super            *supervisor.Supervisor
-		spec             *Spec
-		client           *http.Client
-		providerSelector selector.ProviderSelector
-		metrics          *metrics
+		super        *supervisor.Supervisor
+		spec         *Spec
+		chains       []*chain
+		defaultChain *chain
+		metrics      *metrics
+		accessLogger *accessLogger
+		scorecard    *scorecard
+
+		clientsLock sync.Mutex
+		clients     map[string]*providerClient
 	}
 
 	Spec struct {
@@ -56,19 +62,112 @@ type (
 		Interval string   `yaml:"interval,omitempty" jsonschema:"format=duration"`
 		Lag      uint64   `yaml:"lag,omitempty" jsonschema:"default=100"`
 		Policy   string   `yaml:"policy,omitempty" jsonschema:"default=roundRobin"`
+		// Costs are the costs and capacities of the providers, used by the
+		// cost policy.
+		Costs []*selector.ProviderCostSpec `json:"costs,omitempty"`
+		// ProbeType is the way to probe the head height of providers.
+		ProbeType string `json:"probeType,omitempty" jsonschema:"enum=,enum=evm,enum=solana"`
+
+		// Shadow mirrors sampled requests of the default chain to candidate
+		// providers for comparison.
+		Shadow *ShadowSpec `json:"shadow,omitempty"`
+
+		// Chains are the chains served by the ProviderProxy in addition to
+		// the default one built from the top level providers.
+		Chains []*ChainSpec `json:"chains,omitempty"`
+		// ChainHeader is the request header carrying the chain name.
+		ChainHeader string `json:"chainHeader,omitempty"`
+
+		// Transport is the default transport of providers, and
+		// ProviderTransports override it for individual providers.
+		Transport          *TransportSpec           `json:"transport,omitempty"`
+		ProviderTransports []*ProviderTransportSpec `json:"providerTransports,omitempty"`
 
 		MaxIdleConns        int `json:"maxIdleConns,omitempty"`
 		MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost,omitempty"`
 		MaxRedirection      int `json:"maxRedirection,omitempty"`
+		// ServerMaxBodySize is the max size of response body, the response
+		// body is taken as a stream when it is -1, which is the default.
+		ServerMaxBodySize int64 `json:"serverMaxBodySize,omitempty"`
+
+		// PropagateTraceContext injects the trace context into upstream
+		// requests, it should only be enabled for providers which accept
+		// the trace propagation headers.
+		PropagateTraceContext bool           `json:"propagateTraceContext,omitempty"`
+		AccessLog             *AccessLogSpec `json:"accessLog,omitempty"`
+		// GetLogs enables splitting eth_getLogs queries over large block
+		// ranges.
+		GetLogs *GetLogsSpec `json:"getLogs,omitempty"`
+		// Scorecard enables the rolling scorecard of providers, which is
+		// served by the admin API.
+		Scorecard *ScorecardSpec `json:"scorecard,omitempty"`
 	}
 )
 
-func (m *ProviderProxy) SelectNode() (*url.URL, error) {
-	rpcUrl, err := m.providerSelector.ChooseServer()
-	if err != nil {
-		return nil, err
+// Validate validates Spec.
+func (spec *Spec) Validate() error {
+	if len(spec.Urls) == 0 && len(spec.Chains) == 0 {
+		return errors.New("node address not provided")
+	}
+
+	// the costs are inherited by chains without costs, so they could be
+	// of the providers of these chains.
+	urls := map[string]bool{}
+	for _, u := range spec.Urls {
+		urls[u] = true
+	}
+	for _, c := range spec.Chains {
+		if len(c.Costs) == 0 {
+			for _, u := range c.Urls {
+				urls[u] = true
+			}
+		}
+	}
+	for _, c := range spec.Costs {
+		if err := c.Validate(); err != nil {
+			return err
+		}
+		if !urls[c.Url] {
+			return fmt.Errorf("provider cost of %s: not a provider url", c.Url)
+		}
 	}
-	return url.Parse(rpcUrl)
+
+	if spec.Shadow != nil {
+		if err := spec.Shadow.Validate(); err != nil {
+			return err
+		}
+	}
+	if spec.Transport != nil {
+		if err := spec.Transport.Validate(); err != nil {
+			return fmt.Errorf("transport: %v", err)
+		}
+	}
+	for _, t := range spec.ProviderTransports {
+		if t.Url == "" {
+			return errors.New("providerTransports: url not provided")
+		}
+		if err := t.Validate(); err != nil {
+			return fmt.Errorf("transport of %s: %v", t.Url, err)
+		}
+	}
+
+	if spec.Scorecard != nil {
+		if err := spec.Scorecard.Validate(); err != nil {
+			return err
+		}
+	}
+
+	names := map[string]bool{}
+	for _, c := range spec.Chains {
+		if err := c.Validate(); err != nil {
+			return err
+		}
+		if names[c.Name] {
+			return fmt.Errorf("chain %s is duplicated", c.Name)
+		}
+		names[c.Name] = true
+	}
+	return nil
 }
 
 func (m *ProviderProxy) ParsePayloadMethod(payload []byte) []string {
@@ -100,57 +199,84 @@ func (m *ProviderProxy) ParsePayloadMethod(payload []byte) []string {
 	for _, item := range jsonBodyArr {
 		method, exists := item["method"].(string)
 		if !exists {
-			methods = append(methods, "UNKNOWN")
+			method = "UNKNOWN"
 		}
 		methods = append(methods, method)
 	}
 	return methods
 }
 
-func (m *ProviderProxy) HandleRequest(req *httpprot.Request, providerUrl *url.URL) (forwardReq *http.Request, method []string, err error) {
-	if len(req.URL().Path) != 0 && req.URL().Path != "/" {
-		providerUrl = providerUrl.JoinPath(req.URL().Path)
-		pathMethod := strings.Replace(req.URL().Path, "//", "/", -1)
-		method = []string{pathMethod}
-	} else {
-		bodyBytes := req.RawPayload()
-		method = m.ParsePayloadMethod(bodyBytes)
+// requestMethods returns the methods of the request, which are the
+// JSON-RPC methods in the payload, or the path for REST requests.
+func (m *ProviderProxy) requestMethods(req *httpprot.Request, path string) []string {
+	if len(path) != 0 && path != "/" {
+		return []string{strings.Replace(path, "//", "/", -1)}
 	}
+	return m.ParsePayloadMethod(req.RawPayload())
+}
 
-	forwardReq, err = http.NewRequestWithContext(req.Context(), req.Method(), providerUrl.String(), req.GetPayload())
-	return
+func (m *ProviderProxy) HandleRequest(req *httpprot.Request, providerUrl *url.URL, path string) (*http.Request, error) {
+	if len(path) != 0 && path != "/" {
+		providerUrl = providerUrl.JoinPath(path)
+	}
+	return http.NewRequestWithContext(req.Context(), req.Method(), providerUrl.String(), req.GetPayload())
 }
 
 func (m *ProviderProxy) Handle(ctx *context.Context) (result string) {
 	requestMetrics := RequestMetrics{}
+	req := ctx.GetInputRequest().(*httpprot.Request)
+	// the entry is written when the response is done, which is after
+	// the body is streamed to the client for stream responses.
+	entry := m.accessLogger.newEntry(m.spec.Pipeline(), req)
 
 	startTime := fasttime.Now()
-	reqUrl, err := m.SelectNode()
+	c, path, err := m.selectChain(req)
 	if err != nil {
-		logger.Errorf(err.Error())
-		return err.Error()
+		return m.handleFailure(ctx, req, entry, resultUnknownChain, err)
+	}
+
+	if m.spec.GetLogs != nil {
+		glr := parseGetLogsRequest(req.RawPayload(), m.spec.GetLogs.maxBlockRange())
+		if glr != nil && (path == "" || path == "/") {
+			return m.handleGetLogs(ctx, req, c, glr, entry)
+		}
+	}
+
+	requestMetrics.Chain = c.spec.Name
+	requestMetrics.Policy = c.spec.Policy
+	method := m.requestMethods(req, path)
+	shadowed := (path == "" || path == "/") && c.shadow.sample(method)
+	reqUrl, err := c.selectNode(method)
+	if err != nil {
+		return m.handleFailure(ctx, req, entry, resultNoProvider, err)
 	}
 
-	logger.Infof("select rpc provider: %s", reqUrl.String())
 	requestMetrics.Provider = reqUrl.String()
-	req := ctx.GetInputRequest().(*httpprot.Request)
-	forwardReq, method, err := m.HandleRequest(req, reqUrl)
+	forwardReq, err := m.HandleRequest(req, reqUrl, path)
+	entry.setRequest(c.spec.Name, reqUrl.String(), method)
 
 	if err != nil {
-		logger.Errorf(err.Error())
-		return err.Error()
+		return m.handleFailure(ctx, req, entry, resultInternalError, err)
 	}
 
 	for key := range req.HTTPHeader() {
 		forwardReq.Header.Add(key, req.HTTPHeader().Get(key))
 	}
 
-	response, err := m.client.Do(forwardReq)
+	span := m.startUpstreamSpan(ctx.Span(), forwardReq, c.spec.Name, reqUrl.String(), method, 1)
+	upstreamStartTime := fasttime.Now()
+	response, err := m.do(reqUrl.String(), forwardReq)
+	elapsed := fasttime.Since(upstreamStartTime)
+	entry.setUpstreamLatency(elapsed)
+	ctx.AddUpstreamTiming(m.Name(), elapsed)
 
 	if err != nil {
-		logger.Errorf(err.Error())
-		return err.Error()
+		c.reportResult(reqUrl, method, false)
+		m.scorecard.record(c.spec.Name, reqUrl.String(), fasttime.Since(upstreamStartTime), false, 0)
+		endUpstreamSpan(span, 0, 0, err)
+		return m.handleFailure(ctx, req, entry, resultUpstreamError, err)
 	}
+	c.reportResult(reqUrl, method, !isFailureStatusCode(response.StatusCode))
 
 	requestMetrics.RpcMethod = method
 	requestMetrics.Duration = fasttime.Since(startTime)
@@ -162,28 +288,94 @@ func (m *ProviderProxy) Handle(ctx *context.Context) (result string) {
 	outputResponse, err := httpprot.NewResponse(response)
 
 	if err != nil {
-		logger.Errorf(err.Error())
 		response.Body.Close()
-		return err.Error()
+		endUpstreamSpan(span, response.StatusCode, 0, err)
+		return m.handleFailure(ctx, req, entry, resultInternalError, err)
 	}
 
-	if err = outputResponse.FetchPayload(-1); err != nil {
-		logger.Errorf("%s: failed to fetch response payload: %v, please consider to set serverMaxBodySize of SimpleHTTPProxy to -1.", m.Name(), err)
+	// the body of a failure response is always fetched, so that it could
+	// be replaced by a JSON-RPC error if it is not a JSON-RPC response.
+	maxBodySize := m.spec.ServerMaxBodySize
+	if maxBodySize < 0 && isFailureStatusCode(response.StatusCode) {
+		maxBodySize = 0
+	}
+	if err = outputResponse.FetchPayload(maxBodySize); err != nil {
+		logger.Errorf("%s: failed to fetch response payload: %v, please consider to set serverMaxBodySize of ProviderProxy to -1.", m.Name(), err)
 		response.Body.Close()
-		return err.Error()
+		m.scorecard.record(c.spec.Name, reqUrl.String(), fasttime.Since(upstreamStartTime), false, 0)
+		endUpstreamSpan(span, response.StatusCode, 0, err)
+		return m.handleFailure(ctx, req, entry, resultUpstreamError, err)
 	}
+	upstreamLatency := fasttime.Since(upstreamStartTime)
 
 	if !outputResponse.IsStream() {
 		response.Body.Close()
 	}
 	ctx.SetResponse(context.DefaultNamespace, outputResponse)
-	return ""
+
+	switch {
+	case response.StatusCode == http.StatusTooManyRequests:
+		result = resultRateLimited
+	case response.StatusCode >= http.StatusInternalServerError:
+		result = resultServerError
+	}
+
+	// keep the JSON-RPC response of the provider if there is one,
+	// otherwise, replace the response with a JSON-RPC error.
+	replaced := result != "" && !outputResponse.IsStream() && !isJSONRPCResponse(outputResponse.RawPayload())
+
+	// the scorecard, the span and the access log entry are finished after
+	// the body is streamed to the client, so that they have the JSON-RPC
+	// error code, and so is the comparison of a mirrored request, which
+	// is skipped if the primary response is too large to be buffered.
+	statusCode := response.StatusCode
+	limit := maxObservedBodySize
+	if shadowed {
+		limit = maxShadowBodySize
+	}
+	reqPayload := req.RawPayload()
+	onResponseDone(outputResponse, body, limit, func(size int64, payload []byte) {
+		rpcErrorCode := parseRPCErrorCode(payload)
+		if shadowed && statusCode == http.StatusOK && payload != nil {
+			m.mirror(c, reqPayload, payload, method, upstreamLatency)
+		}
+		m.scorecard.record(c.spec.Name, reqUrl.String(), upstreamLatency, !isFailureStatusCode(statusCode), rpcErrorCode)
+		endUpstreamSpan(span, statusCode, rpcErrorCode, nil)
+		if !replaced {
+			entry.setResponse(statusCode, size, rpcErrorCode)
+			m.accessLogger.write(entry)
+		}
+	})
+
+	if replaced {
+		err = fmt.Errorf("provider %s responded with status code %d", reqUrl.Host, response.StatusCode)
+		return m.handleFailure(ctx, req, entry, result, err)
+	}
+	return result
+}
+
+// handleFailure logs the failure and sets a JSON-RPC error response, it
+// returns the filter result of the failure.
+func (m *ProviderProxy) handleFailure(ctx *context.Context, req *httpprot.Request,
+	entry *AccessLogEntry, result string, err error) string {
+	logger.Errorf("%s: %v", m.Name(), err)
+	f := newRPCFailure(result)
+	entry.setFailure(err, f)
+	m.accessLogger.write(entry)
+	return m.setFailureResponse(ctx, req, f)
 }
 
 var kind = &filters.Kind{
 	Name:        Kind,
 	Description: "ProviderProxy",
-	Results:     []string{},
+	Results: []string{
+		resultInternalError,
+		resultUnknownChain,
+		resultNoProvider,
+		resultUpstreamError,
+		resultServerError,
+		resultRateLimited,
+	},
 	DefaultSpec: func() filters.Spec {
 		return &Spec{
 			Urls:     make([]string, 0),
@@ -192,14 +384,15 @@ var kind = &filters.Kind{
 
 			MaxIdleConns:        10240,
 			MaxIdleConnsPerHost: 1024,
+			ServerMaxBodySize:   -1,
 		}
 	},
 	CreateInstance: func(spec filters.Spec) filters.Filter {
 		providerSpec := spec.(*Spec)
 		return &ProviderProxy{
-			spec:   providerSpec,
-			super:  spec.Super(),
-			client: http.DefaultClient,
+			spec:    providerSpec,
+			super:   spec.Super(),
+			clients: map[string]*providerClient{},
 		}
 	},
 }
@@ -217,49 +410,63 @@ func (m *ProviderProxy) Spec() filters.Spec { return m.spec }
 
 // Init initializes ProviderProxy.
 func (m *ProviderProxy) Init() {
-	urls := m.spec.Urls
-	if len(urls) == 0 {
-		panic(errors.New("node address not provided"))
+	if err := m.spec.Validate(); err != nil {
+		panic(err)
 	}
-	m.reload()
+	m.reload(nil)
 }
 
 // Inherit inherits previous generation of ProviderProxy.
 func (m *ProviderProxy) Inherit(previousGeneration filters.Filter) {
-	m.Init()
+	if err := m.spec.Validate(); err != nil {
+		panic(err)
+	}
+	m.reload(previousGeneration.(*ProviderProxy))
 }
 
-func (m *ProviderProxy) reload() {
-	clientSpec := &proxy.HTTPClientSpec{
-		MaxIdleConns:        m.spec.MaxIdleConns,
-		MaxIdleConnsPerHost: m.spec.MaxIdleConnsPerHost,
-		MaxRedirection:      &m.spec.MaxRedirection,
+func (m *ProviderProxy) reload(previousGeneration *ProviderProxy) {
+	m.metrics = m.newMetrics()
+	m.accessLogger = newAccessLogger(m.spec.AccessLog)
+
+	if len(m.spec.Urls) > 0 {
+		m.defaultChain = m.newChain(&ChainSpec{
+			Name:   defaultChainName,
+			Urls:   m.spec.Urls,
+			Shadow: m.spec.Shadow,
+		})
 	}
-
-	client := proxy.HTTPClient(nil, clientSpec, 0)
-	m.client = client
-
-	providerSelectorSpec := selector.ProviderSelectorSpec{
-		Name:     m.spec.BaseSpec.Name(),
-		Urls:     m.spec.Urls,
-		Interval: m.spec.Interval,
-		Lag:      m.spec.Lag,
+	for _, spec := range m.spec.Chains {
+		m.chains = append(m.chains, m.newChain(spec))
 	}
 
-	m.metrics = m.newMetrics()
-
-	providerSelector := selector.CreateProviderSelectorByPolicy(m.spec.Policy, providerSelectorSpec)
-	m.providerSelector = providerSelector
+	if m.spec.Scorecard != nil {
+		chains := m.chains
+		if m.defaultChain != nil {
+			chains = append([]*chain{m.defaultChain}, chains...)
+		}
+		var prev *scorecard
+		if previousGeneration != nil {
+			prev = previousGeneration.scorecard
+		}
+		m.scorecard = newScorecard(m.spec.Pipeline()+"/"+m.Name(), m.spec.Scorecard, chains, prev)
+		registerScorecard(m.scorecard)
+		go m.scorecard.run(m, chains)
+	}
 }
 
-// Status returns status.
-func (m *ProviderProxy) Status() interface{} { return nil }
-
 // Close closes ProviderProxy.
 func (m *ProviderProxy) Close() {
-	if m.providerSelector != nil {
-		ps := m.providerSelector
-		m.providerSelector = nil
-		ps.Close()
+	if m.defaultChain != nil {
+		m.defaultChain.close()
+		m.defaultChain = nil
+	}
+	for _, c := range m.chains {
+		c.close()
+	}
+	m.chains = nil
+	if m.scorecard != nil {
+		unregisterScorecard(m.scorecard)
+		m.scorecard.close()
 	}
+	m.closeClients()
 }
@@ -19,13 +19,16 @@ package providerproxy
 
 import (
 	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
 
 	"github.com/megaease/easegress/v2/pkg/context"
 	"github.com/megaease/easegress/v2/pkg/filters"
+	"github.com/megaease/easegress/v2/pkg/filters/proxies/providerproxy/mockprovider"
 	"github.com/megaease/easegress/v2/pkg/logger"
 	"github.com/megaease/easegress/v2/pkg/option"
 	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
@@ -161,3 +164,35 @@ urls:
 
 	proxy.Close()
 }
+
+func TestBlockLagWithMockProviders(t *testing.T) {
+	assert := assert.New(t)
+
+	newProvider := func(lag uint64) *httptest.Server {
+		p, err := mockprovider.New(&mockprovider.ProviderSpec{ChainID: 1, StartHeight: 1000, Lag: lag})
+		assert.NoError(err)
+		return httptest.NewServer(p)
+	}
+	lagging := newProvider(50)
+	defer lagging.Close()
+	fresh := newProvider(0)
+	defer fresh.Close()
+
+	proxy := newTestProviderProxy(`
+name: providerProxy
+kind: ProviderProxy
+policy: blockLag
+lag: 10
+urls:
+  - `+lagging.URL+`
+  - `+fresh.URL, assert)
+	defer proxy.Close()
+
+	for i := 0; i < 3; i++ {
+		stdr, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1/", strings.NewReader(`{"method":"eth_blockNumber","params":[],"id":1,"jsonrpc":"2.0"}`))
+		ctx := getCtx(stdr)
+		assert.Equal("", proxy.Handle(ctx))
+		data, _ := io.ReadAll(ctx.GetResponse(context.DefaultNamespace).GetPayload())
+		assert.JSONEq(`{"jsonrpc":"2.0","id":1,"result":"0x3e8"}`, string(data))
+	}
+}
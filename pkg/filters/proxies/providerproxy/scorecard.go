@@ -0,0 +1,439 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providerproxy
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBounds are the upper bounds in milliseconds of the latency
+// histogram buckets of the scorecard, latencies above the last bound fall
+// into an overflow bucket.
+var latencyBounds = [...]float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000}
+
+type (
+	// ScorecardSpec describes the rolling scorecard of providers.
+	ScorecardSpec struct {
+		// Windows are the windows the scorecard is computed over.
+		Windows []string `json:"windows,omitempty" jsonschema:"default=[5m,1h,24h]"`
+		// Resolution is the length of the time buckets of the scorecard.
+		Resolution string `json:"resolution,omitempty" jsonschema:"format=duration,default=1m"`
+		// SampleInterval is the interval to sample the block lag and the
+		// health of providers.
+		SampleInterval string `json:"sampleInterval,omitempty" jsonschema:"format=duration,default=10s"`
+	}
+
+	// Scorecard is the scorecard of the providers of a ProviderProxy over
+	// a window.
+	Scorecard struct {
+		Name      string               `json:"name"`
+		Window    string               `json:"window"`
+		Providers []*ProviderScorecard `json:"providers"`
+	}
+
+	// ProviderScorecard is the scorecard of a provider. Availability is
+	// the ratio of requests which did not fail at the transport or the
+	// HTTP level, ErrorRate also counts JSON-RPC errors, and ErrorRates
+	// breaks the JSON-RPC errors down by code. A provider is ejected when
+	// it is unhealthy, or lags behind the chain head by more than the lag
+	// of the chain.
+	ProviderScorecard struct {
+		Chain        string  `json:"chain"`
+		Provider     string  `json:"provider"`
+		Requests     int64   `json:"requests"`
+		Availability float64 `json:"availability"`
+		ErrorRate    float64 `json:"errorRate"`
+		// P50, P95 and P99 are the latency percentiles in milliseconds.
+		P50            float64            `json:"p50"`
+		P95            float64            `json:"p95"`
+		P99            float64            `json:"p99"`
+		ErrorRates     map[string]float64 `json:"errorRates,omitempty"`
+		AvgBlockLag    float64            `json:"avgBlockLag"`
+		EjectedSeconds float64            `json:"ejectedSeconds"`
+	}
+
+	scorecard struct {
+		name           string
+		windows        []string
+		resolution     time.Duration
+		sampleInterval time.Duration
+		retention      time.Duration
+		providers      []*providerScore
+		now            func() time.Time
+		done           chan struct{}
+	}
+
+	// providerScore keeps the observations of a provider in a ring of time
+	// buckets covering the longest window.
+	providerScore struct {
+		lock     sync.Mutex
+		chain    string
+		provider string
+		buckets  []scoreBucket
+	}
+
+	scoreBucket struct {
+		start      int64
+		requests   int64
+		failures   int64
+		rpcErrors  map[int]int64
+		latency    [len(latencyBounds) + 1]int64
+		lagSum     uint64
+		lagSamples int64
+		samples    int64
+		ejected    int64
+	}
+)
+
+// Validate validates ScorecardSpec.
+func (spec *ScorecardSpec) Validate() error {
+	for _, w := range spec.Windows {
+		if d, err := time.ParseDuration(w); err != nil || d <= 0 {
+			return fmt.Errorf("scorecard: invalid window %q", w)
+		}
+	}
+	if spec.Resolution != "" {
+		if d, err := time.ParseDuration(spec.Resolution); err != nil || d < time.Second {
+			return fmt.Errorf("scorecard: invalid resolution %q, it should be at least 1s", spec.Resolution)
+		}
+	}
+	if spec.SampleInterval != "" {
+		if d, err := time.ParseDuration(spec.SampleInterval); err != nil || d < time.Second {
+			return fmt.Errorf("scorecard: invalid sampleInterval %q, it should be at least 1s", spec.SampleInterval)
+		}
+	}
+	return nil
+}
+
+func (spec *ScorecardSpec) windows() []string {
+	if len(spec.Windows) == 0 {
+		return []string{"5m", "1h", "24h"}
+	}
+	return spec.Windows
+}
+
+func parseDurationOr(s string, d time.Duration) time.Duration {
+	if v, err := time.ParseDuration(s); err == nil && v > 0 {
+		return v
+	}
+	return d
+}
+
+// newScorecard creates the scorecard of the providers of the chains, the
+// observations of the previous scorecard are kept if the buckets of both
+// scorecards are the same.
+func newScorecard(name string, spec *ScorecardSpec, chains []*chain, prev *scorecard) *scorecard {
+	sc := &scorecard{
+		name:           name,
+		windows:        spec.windows(),
+		resolution:     parseDurationOr(spec.Resolution, time.Minute),
+		sampleInterval: parseDurationOr(spec.SampleInterval, 10*time.Second),
+		now:            time.Now,
+		done:           make(chan struct{}),
+	}
+	for _, w := range sc.windows {
+		if d := parseDurationOr(w, 0); d > sc.retention {
+			sc.retention = d
+		}
+	}
+	numBuckets := int(sc.retention/sc.resolution) + 1
+
+	if prev != nil && (prev.resolution != sc.resolution || prev.retention != sc.retention) {
+		prev = nil
+	}
+	for _, c := range chains {
+		for _, u := range c.spec.Urls {
+			if ps := prev.find(c.spec.Name, u); ps != nil {
+				sc.providers = append(sc.providers, ps)
+				continue
+			}
+			sc.providers = append(sc.providers, &providerScore{
+				chain:    c.spec.Name,
+				provider: u,
+				buckets:  make([]scoreBucket, numBuckets),
+			})
+		}
+	}
+	return sc
+}
+
+func (sc *scorecard) find(chain, provider string) *providerScore {
+	if sc == nil {
+		return nil
+	}
+	for _, ps := range sc.providers {
+		if ps.chain == chain && ps.provider == provider {
+			return ps
+		}
+	}
+	return nil
+}
+
+// bucket returns the bucket of time t, the bucket is reset if it was
+// used by an earlier time. The caller must hold the lock.
+func (ps *providerScore) bucket(t time.Time, resolution time.Duration) *scoreBucket {
+	start := t.UnixNano() / int64(resolution)
+	b := &ps.buckets[start%int64(len(ps.buckets))]
+	if b.start != start {
+		*b = scoreBucket{start: start}
+	}
+	return b
+}
+
+// record records the result of a request to the provider. The request
+// fails if success is false, and rpcErrorCode is the JSON-RPC error code
+// of the response, or 0 if there is none.
+func (sc *scorecard) record(chain, provider string, latency time.Duration, success bool, rpcErrorCode int) {
+	ps := sc.find(chain, provider)
+	if ps == nil {
+		return
+	}
+
+	ms := float64(latency) / float64(time.Millisecond)
+	i := sort.SearchFloat64s(latencyBounds[:], ms)
+
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	b := ps.bucket(sc.now(), sc.resolution)
+	b.requests++
+	b.latency[i]++
+	if !success {
+		b.failures++
+	}
+	if rpcErrorCode != 0 {
+		if b.rpcErrors == nil {
+			b.rpcErrors = map[int]int64{}
+		}
+		b.rpcErrors[rpcErrorCode]++
+	}
+}
+
+// sample records the block lag and whether the provider is ejected.
+func (sc *scorecard) sample(chain, provider string, lag uint64, healthy, ejected bool) {
+	ps := sc.find(chain, provider)
+	if ps == nil {
+		return
+	}
+
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	b := ps.bucket(sc.now(), sc.resolution)
+	b.samples++
+	if healthy {
+		b.lagSum += lag
+		b.lagSamples++
+	}
+	if ejected {
+		b.ejected++
+	}
+}
+
+// run samples the providers of the chains periodically until the
+// scorecard is closed.
+func (sc *scorecard) run(m *ProviderProxy, chains []*chain) {
+	ticker := time.NewTicker(sc.sampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sc.done:
+			return
+		case <-ticker.C:
+			for _, c := range chains {
+				m.sampleChain(sc, c)
+			}
+		}
+	}
+}
+
+func (sc *scorecard) close() {
+	close(sc.done)
+}
+
+// sampleChain samples the block lag and the health of the providers of the
+// chain into the scorecard.
+func (m *ProviderProxy) sampleChain(sc *scorecard, c *chain) {
+	probed, maxHeight := probeStatus(c)
+	for _, u := range c.spec.Urls {
+		var lag uint64
+		healthy := true
+		if p := probed[u]; p != nil {
+			healthy = p.Healthy
+			if healthy && p.Height < maxHeight {
+				lag = maxHeight - p.Height
+			}
+		}
+		ejected := !healthy || (c.spec.Lag > 0 && lag > c.spec.Lag)
+		sc.sample(c.spec.Name, u, lag, healthy, ejected)
+	}
+}
+
+// scorecards returns the scorecards over the windows.
+func (sc *scorecard) scorecards(windows []string) ([]*Scorecard, error) {
+	if len(windows) == 0 {
+		windows = sc.windows
+	}
+
+	result := make([]*Scorecard, 0, len(windows))
+	for _, w := range windows {
+		d, err := time.ParseDuration(w)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid window %q", w)
+		}
+		if d > sc.retention {
+			return nil, fmt.Errorf("window %s exceeds the retention %s of the scorecard", w, sc.retention)
+		}
+
+		card := &Scorecard{Name: sc.name, Window: w}
+		for _, ps := range sc.providers {
+			card.Providers = append(card.Providers, ps.scorecard(sc, d))
+		}
+		result = append(result, card)
+	}
+	return result, nil
+}
+
+// scorecard aggregates the buckets of the provider in the window.
+func (ps *providerScore) scorecard(sc *scorecard, window time.Duration) *ProviderScorecard {
+	now := sc.now().UnixNano() / int64(sc.resolution)
+	oldest := now - int64(window/sc.resolution)
+
+	total := scoreBucket{rpcErrors: map[int]int64{}}
+	ps.lock.Lock()
+	for i := range ps.buckets {
+		b := &ps.buckets[i]
+		if b.start <= oldest || b.start > now {
+			continue
+		}
+		total.requests += b.requests
+		total.failures += b.failures
+		for code, n := range b.rpcErrors {
+			total.rpcErrors[code] += n
+		}
+		for j, n := range b.latency {
+			total.latency[j] += n
+		}
+		total.lagSum += b.lagSum
+		total.lagSamples += b.lagSamples
+		total.samples += b.samples
+		total.ejected += b.ejected
+	}
+	ps.lock.Unlock()
+
+	card := &ProviderScorecard{
+		Chain:          ps.chain,
+		Provider:       redactURL(ps.provider),
+		Requests:       total.requests,
+		Availability:   1,
+		EjectedSeconds: float64(total.ejected) * sc.sampleInterval.Seconds(),
+	}
+	if total.lagSamples > 0 {
+		card.AvgBlockLag = float64(total.lagSum) / float64(total.lagSamples)
+	}
+	if total.requests == 0 {
+		return card
+	}
+
+	var rpcErrors int64
+	for code, n := range total.rpcErrors {
+		if card.ErrorRates == nil {
+			card.ErrorRates = map[string]float64{}
+		}
+		card.ErrorRates[strconv.Itoa(code)] = float64(n) / float64(total.requests)
+		rpcErrors += n
+	}
+	requests := float64(total.requests)
+	card.Availability = 1 - float64(total.failures)/requests
+	card.ErrorRate = float64(total.failures+rpcErrors) / requests
+	if card.ErrorRate > 1 {
+		card.ErrorRate = 1
+	}
+	card.P50 = total.percentile(0.5)
+	card.P95 = total.percentile(0.95)
+	card.P99 = total.percentile(0.99)
+	return card
+}
+
+// percentile estimates the latency percentile in milliseconds by linear
+// interpolation in the histogram bucket the percentile falls into.
+func (b *scoreBucket) percentile(q float64) float64 {
+	target := q * float64(b.requests)
+	var count float64
+	for i, n := range b.latency {
+		if n == 0 || count+float64(n) < target {
+			count += float64(n)
+			continue
+		}
+		if i == len(latencyBounds) {
+			return latencyBounds[i-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = latencyBounds[i-1]
+		}
+		return lower + (latencyBounds[i]-lower)*(target-count)/float64(n)
+	}
+	return latencyBounds[len(latencyBounds)-1]
+}
+
+// writeScorecardsCSV writes the scorecards as CSV, one row per provider and
+// window. The error rates by JSON-RPC code are joined as "code:rate" pairs.
+func writeScorecardsCSV(w io.Writer, cards []*Scorecard) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{
+		"name", "window", "chain", "provider", "requests", "availability", "errorRate",
+		"p50", "p95", "p99", "errorRates", "avgBlockLag", "ejectedSeconds",
+	})
+
+	formatFloat := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	for _, card := range cards {
+		for _, p := range card.Providers {
+			codes := make([]string, 0, len(p.ErrorRates))
+			for code := range p.ErrorRates {
+				codes = append(codes, code)
+			}
+			sort.Strings(codes)
+			for i, code := range codes {
+				codes[i] = code + ":" + formatFloat(p.ErrorRates[code])
+			}
+
+			cw.Write([]string{
+				card.Name, card.Window, p.Chain, p.Provider,
+				strconv.FormatInt(p.Requests, 10),
+				formatFloat(p.Availability),
+				formatFloat(p.ErrorRate),
+				formatFloat(p.P50),
+				formatFloat(p.P95),
+				formatFloat(p.P99),
+				strings.Join(codes, ";"),
+				formatFloat(p.AvgBlockLag),
+				formatFloat(p.EjectedSeconds),
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providerproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/filters/proxies/providerproxy/mockprovider"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScorecardSpecValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&ScorecardSpec{}).Validate())
+	assert.NoError((&ScorecardSpec{Windows: []string{"1m", "1h"}, Resolution: "10s", SampleInterval: "5s"}).Validate())
+	assert.Error((&ScorecardSpec{Windows: []string{"1x"}}).Validate())
+	assert.Error((&ScorecardSpec{Resolution: "100ms"}).Validate())
+	assert.Error((&ScorecardSpec{SampleInterval: "-1s"}).Validate())
+}
+
+func TestScorecardWindows(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &chain{spec: &ChainSpec{Name: "eth", Urls: []string{"http://a", "http://b"}}}
+	sc := newScorecard("pipeline/proxy", &ScorecardSpec{Windows: []string{"5m", "1h"}}, []*chain{c}, nil)
+	now := time.Unix(1700000000, 0)
+	sc.now = func() time.Time { return now }
+
+	// observations of 30 minutes ago only count in the 1h window.
+	now = now.Add(-30 * time.Minute)
+	for i := 0; i < 10; i++ {
+		sc.record("eth", "http://a", 200*time.Millisecond, false, 0)
+	}
+	sc.sample("eth", "http://b", 0, false, true)
+	now = now.Add(30 * time.Minute)
+
+	for i := 0; i < 100; i++ {
+		sc.record("eth", "http://a", time.Duration(i+1)*time.Millisecond, true, 0)
+	}
+	sc.record("eth", "http://b", time.Millisecond, true, -32005)
+	sc.record("eth", "http://b", time.Millisecond, true, 0)
+	sc.sample("eth", "http://b", 4, true, false)
+	sc.sample("eth", "http://b", 8, true, true)
+	sc.record("unknown", "http://a", time.Millisecond, true, 0)
+
+	cards, err := sc.scorecards(nil)
+	assert.NoError(err)
+	assert.Len(cards, 2)
+
+	short := cards[0]
+	assert.Equal("5m", short.Window)
+	a, b := short.Providers[0], short.Providers[1]
+	assert.Equal(int64(100), a.Requests)
+	assert.Equal(1.0, a.Availability)
+	assert.Equal(0.0, a.ErrorRate)
+	assert.InDelta(50, a.P50, 1)
+	assert.InDelta(95, a.P95, 5)
+	assert.InDelta(99, a.P99, 5)
+	assert.Equal(int64(2), b.Requests)
+	assert.Equal(0.5, b.ErrorRate)
+	assert.Equal(map[string]float64{"-32005": 0.5}, b.ErrorRates)
+	assert.Equal(6.0, b.AvgBlockLag)
+	assert.Equal(10.0, b.EjectedSeconds)
+
+	long := cards[1]
+	assert.Equal("1h", long.Window)
+	a, b = long.Providers[0], long.Providers[1]
+	assert.Equal(int64(110), a.Requests)
+	assert.InDelta(100.0/110, a.Availability, 1e-9)
+	assert.Equal(20.0, b.EjectedSeconds)
+
+	_, err = sc.scorecards([]string{"2h"})
+	assert.Error(err)
+	_, err = sc.scorecards([]string{"abc"})
+	assert.Error(err)
+
+	// observations expire after the longest window.
+	now = now.Add(2 * time.Hour)
+	cards, err = sc.scorecards([]string{"1h"})
+	assert.NoError(err)
+	assert.Equal(int64(0), cards[0].Providers[0].Requests)
+	assert.Equal(1.0, cards[0].Providers[0].Availability)
+
+	// observations are kept by the next generation with the same buckets.
+	next := newScorecard("pipeline/proxy", &ScorecardSpec{Windows: []string{"1h", "5m"}}, []*chain{c}, sc)
+	assert.Same(sc.providers[0], next.providers[0])
+	next = newScorecard("pipeline/proxy", &ScorecardSpec{Windows: []string{"2h"}}, []*chain{c}, sc)
+	assert.NotSame(sc.providers[0], next.providers[0])
+}
+
+func TestScorecardPercentile(t *testing.T) {
+	assert := assert.New(t)
+
+	b := &scoreBucket{requests: 4}
+	b.latency[0] = 2
+	b.latency[len(latencyBounds)] = 2
+	assert.Equal(2.5, b.percentile(0.25))
+	assert.Equal(5.0, b.percentile(0.5))
+	assert.Equal(30000.0, b.percentile(0.99))
+}
+
+func TestWriteScorecardsCSV(t *testing.T) {
+	assert := assert.New(t)
+
+	cards := []*Scorecard{{
+		Name:   "pipeline/proxy",
+		Window: "1h",
+		Providers: []*ProviderScorecard{{
+			Chain:        "eth",
+			Provider:     "http://a",
+			Requests:     4,
+			Availability: 0.75,
+			ErrorRate:    0.5,
+			P50:          10,
+			P95:          20,
+			P99:          30,
+			ErrorRates:   map[string]float64{"3": 0.25, "-32005": 0.25},
+			AvgBlockLag:  1.5,
+		}},
+	}}
+
+	buf := &bytes.Buffer{}
+	assert.NoError(writeScorecardsCSV(buf, cards))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(lines, 2)
+	assert.Equal("name,window,chain,provider,requests,availability,errorRate,p50,p95,p99,errorRates,avgBlockLag,ejectedSeconds", lines[0])
+	assert.Equal("pipeline/proxy,1h,eth,http://a,4,0.75,0.5,10,20,30,-32005:0.25;3:0.25,1.5,0", lines[1])
+}
+
+func TestScorecardAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := mockprovider.New(&mockprovider.ProviderSpec{StartHeight: 1000})
+	assert.NoError(err)
+	provider := httptest.NewServer(p)
+	defer provider.Close()
+	lp, err := mockprovider.New(&mockprovider.ProviderSpec{StartHeight: 1000, Lag: 20})
+	assert.NoError(err)
+	lagging := httptest.NewServer(lp)
+	defer lagging.Close()
+
+	proxy := newTestProviderProxy(`
+name: providerProxy
+kind: ProviderProxy
+policy: blockLag
+interval: 1h
+lag: 10
+urls:
+  - `+provider.URL+`
+  - `+lagging.URL+`
+scorecard:
+  windows: [5m, 1h]
+  sampleInterval: 1h
+`, assert)
+	defer proxy.Close()
+
+	for i := 0; i < 3; i++ {
+		stdr, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1/", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`))
+		ctx := getCtx(stdr)
+		proxy.Handle(ctx)
+		// requests are recorded after the response body is sent.
+		ctx.GetResponse(context.DefaultNamespace).Close()
+	}
+	proxy.sampleChain(proxy.scorecard, proxy.defaultChain)
+
+	router := chi.NewRouter()
+	router.Get(ScorecardsAPIPath, listScorecards)
+	router.Get(ScorecardsAPIPath+"/{pipeline}/{filter}", getScorecard)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	// the test proxy is not in a pipeline, name it as if it was.
+	unregisterScorecard(proxy.scorecard)
+	proxy.scorecard.name = "pipeline/providerProxy"
+	registerScorecard(proxy.scorecard)
+	name := proxy.scorecard.name
+	w := get(ScorecardsAPIPath + "/" + name + "?window=5m")
+	assert.Equal(http.StatusOK, w.Code)
+	cards := []*Scorecard{}
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &cards))
+	assert.Len(cards, 1)
+	assert.Equal("5m", cards[0].Window)
+	providers := cards[0].Providers
+	assert.Len(providers, 2)
+	assert.Equal(int64(3), providers[0].Requests+providers[1].Requests)
+	assert.Equal(0.0, providers[0].AvgBlockLag)
+	assert.Equal(20.0, providers[1].AvgBlockLag)
+	assert.Equal(0.0, providers[0].EjectedSeconds)
+	assert.Equal(3600.0, providers[1].EjectedSeconds)
+
+	w = get(ScorecardsAPIPath + "?format=csv")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("text/csv", w.Header().Get("Content-Type"))
+	assert.Contains(w.Body.String(), name+",1h,default,")
+
+	assert.Equal(http.StatusBadRequest, get(ScorecardsAPIPath+"/"+name+"?window=24h").Code)
+	assert.Equal(http.StatusBadRequest, get(ScorecardsAPIPath+"/"+name+"?format=xml").Code)
+	assert.Equal(http.StatusNotFound, get(ScorecardsAPIPath+"/pipeline/unknown").Code)
+}
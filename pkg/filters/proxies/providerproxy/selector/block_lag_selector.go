@@ -18,12 +18,10 @@
 package selector
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"time"
 
-	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/megaease/easegress/v2/pkg/logger"
 	"github.com/megaease/easegress/v2/pkg/util/prometheushelper"
 	"github.com/prometheus/client_golang/prometheus"
@@ -40,6 +38,7 @@ type BlockLagProviderSelector struct {
 	done      chan struct{}
 	providers []ProviderWeight
 	lag       uint64
+	probeType string
 	metrics   *metrics
 }
 
@@ -52,7 +51,8 @@ func NewBlockLagProviderSelector(spec ProviderSelectorSpec) ProviderSelector {
 		client := &RPCClient{
 			Endpoint: value,
 			client: http.Client{
-				Timeout: intervalDuration,
+				Timeout:   intervalDuration,
+				Transport: spec.Transports[value],
 			},
 		}
 		providers = append(providers, ProviderWeight{
@@ -66,6 +66,7 @@ func NewBlockLagProviderSelector(spec ProviderSelectorSpec) ProviderSelector {
 		done:      make(chan struct{}),
 		providers: providers,
 		lag:       spec.Lag,
+		probeType: spec.ProbeType,
 		metrics:   newMetrics(spec),
 	}
 	ticker := time.NewTicker(intervalDuration)
@@ -95,31 +96,13 @@ func (ps BlockLagProviderSelector) checkServers() {
 	startTime := time.Now().Local()
 	for i, _ := range ps.providers {
 		eg.Go(func() error {
-			client := ps.providers[i].Client
-			req, _ := client.NewRequest("eth_getBlockByNumber", "latest", false)
-
-			response, err := client.Send(req)
+			block, err := probeHeight(ps.providers[i].Client, ps.probeType)
 			if err != nil {
-				blockNumberChannel <- ProviderBlock{
-					index: i,
-					block: 0,
-				}
-				return nil
+				block = 0
 			}
-
-			head := types.Header{}
-			err = json.Unmarshal(response, &head)
-			if err != nil {
-				blockNumberChannel <- ProviderBlock{
-					index: i,
-					block: 0,
-				}
-				return nil
-			}
-
 			blockNumberChannel <- ProviderBlock{
 				index: i,
-				block: head.Number.Uint64(),
+				block: block,
 			}
 			return nil
 		})
@@ -142,6 +125,20 @@ func (ps BlockLagProviderSelector) checkServers() {
 	logger.Debugf("update block number time: %s", time.Since(startTime))
 }
 
+// ProviderStatus returns the status of providers, a provider is healthy
+// once its block number is probed.
+func (ps BlockLagProviderSelector) ProviderStatus() []*ProviderStatus {
+	status := make([]*ProviderStatus, 0, len(ps.providers))
+	for _, p := range ps.providers {
+		status = append(status, &ProviderStatus{
+			Url:     p.Url,
+			Height:  p.BlockNumber,
+			Healthy: p.BlockNumber != 0,
+		})
+	}
+	return status
+}
+
 func (ps BlockLagProviderSelector) Close() {
 	close(ps.done)
 }
@@ -183,9 +180,10 @@ func newMetrics(spec ProviderSelectorSpec) *metrics {
 	commonLabels := prometheus.Labels{
 		"pipelineName": spec.Name,
 		"kind":         "BlockLagProviderSelector",
+		"chain":        spec.Chain,
 	}
 	prometheusLabels := []string{
-		"pipelineName", "kind", "provider",
+		"pipelineName", "kind", "chain", "provider",
 	}
 
 	return &metrics{
@@ -0,0 +1,352 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package selector
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/util/prometheushelper"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/errgroup"
+)
+
+// Method classes used to look up the cost of a request.
+const (
+	// MethodClassDefault is the class of methods not in other classes.
+	MethodClassDefault = "default"
+	// MethodClassLogs is the class of eth_getLogs.
+	MethodClassLogs = "logs"
+	// MethodClassTrace is the class of trace_* and debug_* methods.
+	MethodClassTrace = "trace"
+	// MethodClassSend is the class of methods sending transactions.
+	MethodClassSend = "send"
+)
+
+type (
+	// ProviderCostSpec describes the price and the capacity of a provider.
+	ProviderCostSpec struct {
+		Url string `json:"url" jsonschema:"required"`
+		// Costs is the cost of a request by method name or method class, the
+		// cost of a method name takes precedence over the cost of its class,
+		// and the default class applies to methods without a cost.
+		Costs map[string]float64 `json:"costs,omitempty"`
+		// Capacity is the max number of requests per second sent to the
+		// provider before spilling over to pricier ones, 0 means unlimited.
+		Capacity int `json:"capacity,omitempty"`
+	}
+
+	costProvider struct {
+		url      string
+		costs    map[string]float64
+		capacity int
+		client   *RPCClient
+
+		height  uint64
+		healthy bool
+		failed  bool
+
+		window      time.Time
+		windowCount int
+	}
+
+	// CostProviderSelector chooses the cheapest provider which is healthy,
+	// fresh enough and has spare capacity. Providers without a cost spec
+	// are free and have unlimited capacity.
+	CostProviderSelector struct {
+		done      chan struct{}
+		mutex     sync.Mutex
+		providers []*costProvider
+		lag       uint64
+		probeType string
+		now       func() time.Time
+		metrics   *costMetrics
+	}
+
+	costMetrics struct {
+		ProviderBlockHeight *prometheus.GaugeVec
+		ProviderSpend       *prometheus.CounterVec
+	}
+)
+
+// Validate validates ProviderCostSpec.
+func (spec *ProviderCostSpec) Validate() error {
+	if spec.Url == "" {
+		return fmt.Errorf("provider cost: url not provided")
+	}
+	if spec.Capacity < 0 {
+		return fmt.Errorf("provider cost of %s: capacity must not be negative", spec.Url)
+	}
+	for k, v := range spec.Costs {
+		if v < 0 {
+			return fmt.Errorf("provider cost of %s: cost of %s must not be negative", spec.Url, k)
+		}
+	}
+	return nil
+}
+
+// MethodClass returns the class of the JSON-RPC method.
+func MethodClass(method string) string {
+	switch {
+	case method == "eth_getLogs":
+		return MethodClassLogs
+	case strings.HasPrefix(method, "trace_"), strings.HasPrefix(method, "debug_"):
+		return MethodClassTrace
+	case method == "eth_sendRawTransaction", method == "eth_sendTransaction":
+		return MethodClassSend
+	default:
+		return MethodClassDefault
+	}
+}
+
+// NewCostProviderSelector creates a CostProviderSelector.
+func NewCostProviderSelector(spec ProviderSelectorSpec) ProviderSelector {
+	costs := map[string]*ProviderCostSpec{}
+	for _, c := range spec.Costs {
+		costs[c.Url] = c
+	}
+
+	interval := spec.GetInterval()
+	providers := make([]*costProvider, 0, len(spec.Urls))
+	for _, u := range spec.Urls {
+		p := &costProvider{
+			url:     u,
+			healthy: true,
+			client: &RPCClient{
+				Endpoint: u,
+				client:   http.Client{Timeout: interval, Transport: spec.Transports[u]},
+			},
+		}
+		if c := costs[u]; c != nil {
+			p.costs = c.Costs
+			p.capacity = c.Capacity
+		}
+		providers = append(providers, p)
+	}
+
+	ps := &CostProviderSelector{
+		done:      make(chan struct{}),
+		providers: providers,
+		lag:       spec.Lag,
+		probeType: spec.ProbeType,
+		now:       time.Now,
+		metrics:   newCostMetrics(spec),
+	}
+
+	ticker := time.NewTicker(interval)
+	ps.checkServers()
+	go func() {
+		for {
+			select {
+			case <-ps.done:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				ps.checkServers()
+			}
+		}
+	}()
+	return ps
+}
+
+func newCostMetrics(spec ProviderSelectorSpec) *costMetrics {
+	commonLabels := prometheus.Labels{
+		"pipelineName": spec.Name,
+		"kind":         "CostProviderSelector",
+		"chain":        spec.Chain,
+	}
+	prometheusLabels := []string{
+		"pipelineName", "kind", "chain", "provider",
+	}
+
+	return &costMetrics{
+		ProviderBlockHeight: prometheushelper.NewGauge(
+			"provider_block_height",
+			"the block height of provider", prometheusLabels).MustCurryWith(commonLabels),
+		ProviderSpend: prometheushelper.NewCounter(
+			"provider_estimated_spend_total",
+			"the estimated spend of successful requests sent to provider", prometheusLabels).MustCurryWith(commonLabels),
+	}
+}
+
+// checkServers probes the head height of all providers, a provider is
+// unhealthy if the probe fails, and a successful probe clears the request
+// failure of the provider.
+func (ps *CostProviderSelector) checkServers() {
+	heights := make([]uint64, len(ps.providers))
+	errs := make([]error, len(ps.providers))
+	eg := new(errgroup.Group)
+	for i, p := range ps.providers {
+		eg.Go(func() error {
+			heights[i], errs[i] = probeHeight(p.client, ps.probeType)
+			return nil
+		})
+	}
+	eg.Wait()
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	for i, p := range ps.providers {
+		if errs[i] != nil {
+			logger.Debugf("probe provider %s failed: %v", p.url, errs[i])
+			p.healthy = false
+			continue
+		}
+		p.healthy, p.failed, p.height = true, false, heights[i]
+		ps.metrics.ProviderBlockHeight.With(prometheus.Labels{"provider": p.url}).Set(float64(p.height))
+	}
+}
+
+// cost returns the cost of a request calling the methods, a request
+// without methods costs as much as a method of the default class.
+func (p *costProvider) cost(methods []string) float64 {
+	if len(methods) == 0 {
+		return p.costs[MethodClassDefault]
+	}
+
+	total := 0.0
+	for _, method := range methods {
+		if c, ok := p.costs[method]; ok {
+			total += c
+		} else if c, ok := p.costs[MethodClass(method)]; ok {
+			total += c
+		} else {
+			total += p.costs[MethodClassDefault]
+		}
+	}
+	return total
+}
+
+func (p *costProvider) hasCapacity(now time.Time) bool {
+	if p.capacity <= 0 || now.Sub(p.window) >= time.Second {
+		return true
+	}
+	return p.windowCount < p.capacity
+}
+
+func (p *costProvider) take(now time.Time) {
+	if now.Sub(p.window) >= time.Second {
+		p.window, p.windowCount = now, 0
+	}
+	p.windowCount++
+}
+
+// ChooseServer chooses a provider for a request of the default method
+// class.
+func (ps *CostProviderSelector) ChooseServer() (string, error) {
+	return ps.ChooseServerForMethods(nil)
+}
+
+// ChooseServerForMethods chooses the cheapest provider for a request
+// calling the methods. It prefers providers which are healthy, fresh and
+// have spare capacity, then providers which are healthy and fresh, and
+// falls back to the cheapest provider if none is available.
+func (ps *CostProviderSelector) ChooseServerForMethods(methods []string) (string, error) {
+	if len(ps.providers) == 0 {
+		return "", fmt.Errorf("no provider available")
+	}
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	providers := make([]*costProvider, len(ps.providers))
+	copy(providers, ps.providers)
+	sort.SliceStable(providers, func(i, j int) bool {
+		return providers[i].cost(methods) < providers[j].cost(methods)
+	})
+
+	var maxHeight uint64
+	for _, p := range providers {
+		if p.healthy && p.height > maxHeight {
+			maxHeight = p.height
+		}
+	}
+	available := func(p *costProvider) bool {
+		if !p.healthy || p.failed {
+			return false
+		}
+		return ps.lag == 0 || p.height+ps.lag >= maxHeight
+	}
+
+	now := ps.now()
+	var chosen *costProvider
+	for _, p := range providers {
+		if available(p) && p.hasCapacity(now) {
+			chosen = p
+			break
+		}
+	}
+	if chosen == nil {
+		for _, p := range providers {
+			if available(p) {
+				chosen = p
+				break
+			}
+		}
+	}
+	if chosen == nil {
+		chosen = providers[0]
+	}
+
+	chosen.take(now)
+	return chosen.url, nil
+}
+
+// ReportResult counts the spend of a successful request calling the
+// methods, and marks the provider as failed if the request failed, a
+// failed provider is avoided until it passes the next probe.
+func (ps *CostProviderSelector) ReportResult(provider string, methods []string, success bool) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	for _, p := range ps.providers {
+		if p.url != provider {
+			continue
+		}
+		if success {
+			ps.metrics.ProviderSpend.With(prometheus.Labels{"provider": p.url}).Add(p.cost(methods))
+		} else {
+			p.failed = true
+		}
+	}
+}
+
+// ProviderStatus returns the status of providers.
+func (ps *CostProviderSelector) ProviderStatus() []*ProviderStatus {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	status := make([]*ProviderStatus, 0, len(ps.providers))
+	for _, p := range ps.providers {
+		status = append(status, &ProviderStatus{
+			Url:     p.url,
+			Height:  p.height,
+			Healthy: p.healthy && !p.failed,
+		})
+	}
+	return status
+}
+
+// Close closes the selector.
+func (ps *CostProviderSelector) Close() {
+	close(ps.done)
+}
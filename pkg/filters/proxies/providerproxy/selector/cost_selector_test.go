@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package selector
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/filters/proxies/providerproxy/mockprovider"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func TestMethodClassAndCost(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(MethodClassLogs, MethodClass("eth_getLogs"))
+	assert.Equal(MethodClassTrace, MethodClass("trace_block"))
+	assert.Equal(MethodClassTrace, MethodClass("debug_traceTransaction"))
+	assert.Equal(MethodClassSend, MethodClass("eth_sendRawTransaction"))
+	assert.Equal(MethodClassDefault, MethodClass("eth_call"))
+
+	p := &costProvider{costs: map[string]float64{"default": 1, "trace": 10, "trace_block": 20}}
+	assert.Equal(1.0, p.cost(nil))
+	assert.Equal(1.0, p.cost([]string{"eth_getLogs"}))
+	assert.Equal(10.0, p.cost([]string{"debug_traceTransaction"}))
+	assert.Equal(21.0, p.cost([]string{"trace_block", "eth_call"}))
+	assert.Equal(0.0, (&costProvider{}).cost([]string{"eth_call"}))
+
+	assert.NoError((&ProviderCostSpec{Url: "http://a"}).Validate())
+	assert.Error((&ProviderCostSpec{}).Validate())
+	assert.Error((&ProviderCostSpec{Url: "http://a", Capacity: -1}).Validate())
+	assert.Error((&ProviderCostSpec{Url: "http://a", Costs: map[string]float64{"default": -1}}).Validate())
+}
+
+func TestCostProviderSelector(t *testing.T) {
+	assert := assert.New(t)
+
+	newProvider := func(lag uint64) *httptest.Server {
+		p, err := mockprovider.New(&mockprovider.ProviderSpec{StartHeight: 1000, Lag: lag})
+		assert.NoError(err)
+		return httptest.NewServer(p)
+	}
+	selfHosted := newProvider(0)
+	defer selfHosted.Close()
+	cheap := newProvider(0)
+	defer cheap.Close()
+	pricey := newProvider(0)
+	defer pricey.Close()
+	stale := newProvider(50)
+	defer stale.Close()
+
+	spec := ProviderSelectorSpec{
+		Name:     "test-cost",
+		Urls:     []string{pricey.URL, stale.URL, cheap.URL, selfHosted.URL},
+		Interval: "1h",
+		Lag:      10,
+		Costs: []*ProviderCostSpec{
+			{Url: pricey.URL, Costs: map[string]float64{"default": 3}},
+			{Url: stale.URL, Costs: map[string]float64{"default": 0.5}},
+			{Url: cheap.URL, Costs: map[string]float64{"default": 1, "trace": 5}},
+			{Url: selfHosted.URL, Capacity: 2},
+		},
+	}
+	ps := CreateProviderSelectorByPolicy("cost", spec).(*CostProviderSelector)
+	defer ps.Close()
+
+	now := time.Unix(1700000000, 0)
+	ps.now = func() time.Time { return now }
+
+	// the free self-hosted node is preferred until it reaches its capacity,
+	// the stale provider is skipped though it is cheaper.
+	for i := 0; i < 2; i++ {
+		url, err := ps.ChooseServerForMethods([]string{"eth_call"})
+		assert.NoError(err)
+		assert.Equal(selfHosted.URL, url)
+	}
+	url, _ := ps.ChooseServerForMethods([]string{"eth_call"})
+	assert.Equal(cheap.URL, url)
+	url, _ = ps.ChooseServerForMethods([]string{"trace_block"})
+	assert.Equal(pricey.URL, url)
+
+	now = now.Add(time.Second)
+	url, _ = ps.ChooseServer()
+	assert.Equal(selfHosted.URL, url)
+
+	// a failed provider is avoided until it passes the next probe.
+	ps.ReportResult(selfHosted.URL, nil, false)
+	url, _ = ps.ChooseServer()
+	assert.Equal(cheap.URL, url)
+	ps.checkServers()
+	url, _ = ps.ChooseServer()
+	assert.Equal(selfHosted.URL, url)
+
+	// an unreachable provider is unhealthy.
+	selfHosted.Close()
+	ps.checkServers()
+	now = now.Add(time.Second)
+	url, _ = ps.ChooseServer()
+	assert.Equal(cheap.URL, url)
+
+	// the spend is counted when requests succeed.
+	spend := ps.metrics.ProviderSpend.With(prometheus.Labels{"provider": cheap.URL})
+	assert.Equal(0.0, testutil.ToFloat64(spend))
+	ps.ReportResult(cheap.URL, []string{"eth_call", "trace_block"}, true)
+	ps.ReportResult(cheap.URL, []string{"eth_call"}, false)
+	assert.Equal(6.0, testutil.ToFloat64(spend))
+	ps.ReportResult(pricey.URL, []string{"trace_block"}, true)
+	spend = ps.metrics.ProviderSpend.With(prometheus.Labels{"provider": pricey.URL})
+	assert.Equal(3.0, testutil.ToFloat64(spend))
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package selector
+
+import (
+	"encoding/json"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const (
+	// ProbeTypeEVM probes the head of EVM compatible chains by
+	// eth_getBlockByNumber, it is the default probe type.
+	ProbeTypeEVM = "evm"
+	// ProbeTypeSolana probes the head of Solana by getSlot.
+	ProbeTypeSolana = "solana"
+)
+
+// probeHeight returns the head height of the provider.
+func probeHeight(client *RPCClient, probeType string) (uint64, error) {
+	switch probeType {
+	case ProbeTypeSolana:
+		req, err := client.NewRequest("getSlot")
+		if err != nil {
+			return 0, err
+		}
+		response, err := client.Send(req)
+		if err != nil {
+			return 0, err
+		}
+		var slot uint64
+		err = json.Unmarshal(response, &slot)
+		return slot, err
+
+	default:
+		req, err := client.NewRequest("eth_getBlockByNumber", "latest", false)
+		if err != nil {
+			return 0, err
+		}
+		response, err := client.Send(req)
+		if err != nil {
+			return 0, err
+		}
+		head := types.Header{}
+		if err = json.Unmarshal(response, &head); err != nil {
+			return 0, err
+		}
+		return head.Number.Uint64(), nil
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package selector
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeHeight(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg := jsonrpcMessage{}
+		json.NewDecoder(r.Body).Decode(&msg)
+		switch msg.Method {
+		case "getSlot":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":289452123}`))
+		case "eth_getBlockByNumber":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{` +
+				`"parentHash":"0x0000000000000000000000000000000000000000000000000000000000000000",` +
+				`"sha3Uncles":"0x0000000000000000000000000000000000000000000000000000000000000000",` +
+				`"miner":"0x0000000000000000000000000000000000000000",` +
+				`"stateRoot":"0x0000000000000000000000000000000000000000000000000000000000000000",` +
+				`"transactionsRoot":"0x0000000000000000000000000000000000000000000000000000000000000000",` +
+				`"receiptsRoot":"0x0000000000000000000000000000000000000000000000000000000000000000",` +
+				`"logsBloom":"0x` + strings.Repeat("0", 512) + `",` +
+				`"difficulty":"0x0","number":"0x1b4","gasLimit":"0x0","gasUsed":"0x0","timestamp":"0x0",` +
+				`"extraData":"0x","mixHash":"0x0000000000000000000000000000000000000000000000000000000000000000",` +
+				`"nonce":"0x0000000000000000"}}`))
+		default:
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"method not found"}}`))
+		}
+	}))
+	defer server.Close()
+
+	client := &RPCClient{Endpoint: server.URL}
+
+	height, err := probeHeight(client, ProbeTypeSolana)
+	assert.NoError(err)
+	assert.Equal(uint64(289452123), height)
+
+	height, err = probeHeight(client, ProbeTypeEVM)
+	assert.NoError(err)
+	assert.Equal(uint64(0x1b4), height)
+
+	height, err = probeHeight(client, "")
+	assert.NoError(err)
+	assert.Equal(uint64(0x1b4), height)
+}
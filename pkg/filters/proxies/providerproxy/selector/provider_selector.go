@@ -18,14 +18,23 @@
 package selector
 
 import (
+	"net/http"
 	"time"
 )
 
 type ProviderSelectorSpec struct {
-	Name     string   `json:"name"`
-	Urls     []string `json:"urls"`
-	Interval string   `json:"interval,omitempty" jsonschema:"format=duration"`
-	Lag      uint64   `json:"lag,omitempty" jsonschema:"default=100"`
+	Name      string   `json:"name"`
+	Chain     string   `json:"chain,omitempty"`
+	Urls      []string `json:"urls"`
+	Interval  string   `json:"interval,omitempty" jsonschema:"format=duration"`
+	Lag       uint64   `json:"lag,omitempty" jsonschema:"default=100"`
+	ProbeType string   `json:"probeType,omitempty"`
+	// Costs are the costs and capacities of providers, used by the cost
+	// policy.
+	Costs []*ProviderCostSpec `json:"costs,omitempty"`
+	// Transports are the transports of providers used by probes, the
+	// default transport is used for providers not in it.
+	Transports map[string]http.RoundTripper `json:"-"`
 }
 
 // GetInterval returns the interval duration.
@@ -42,10 +51,35 @@ type ProviderSelector interface {
 	Close()
 }
 
+// ProviderStatus is the status of a provider known by a selector.
+type ProviderStatus struct {
+	Url     string
+	Height  uint64
+	Healthy bool
+}
+
+// StatusProviderSelector is a ProviderSelector which probes providers and
+// reports their status.
+type StatusProviderSelector interface {
+	ProviderSelector
+	ProviderStatus() []*ProviderStatus
+}
+
+// MethodAwareProviderSelector is a ProviderSelector which chooses the
+// provider by the JSON-RPC methods of the request, and learns from the
+// result of requests.
+type MethodAwareProviderSelector interface {
+	ProviderSelector
+	ChooseServerForMethods(methods []string) (string, error)
+	ReportResult(provider string, methods []string, success bool)
+}
+
 func CreateProviderSelectorByPolicy(policy string, spec ProviderSelectorSpec) ProviderSelector {
 	switch policy {
 	case "blockLag":
 		return NewBlockLagProviderSelector(spec)
+	case "cost":
+		return NewCostProviderSelector(spec)
 	case "roundRobin":
 		return NewRoundRobinProviderSelector(spec)
 	default:
@@ -0,0 +1,299 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providerproxy
+
+import (
+	"bytes"
+	stdcontext "context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/util/fasttime"
+	"github.com/megaease/easegress/v2/pkg/util/sampler"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	shadowResultMatch    = "match"
+	shadowResultMismatch = "mismatch"
+	shadowResultError    = "error"
+
+	// maxShadowRequests is the max number of in-flight shadow requests of
+	// a chain, requests are not mirrored when it is reached.
+	maxShadowRequests = 64
+
+	// maxShadowBodySize is the max size of the primary response body which
+	// is buffered for comparison, larger responses are not compared.
+	maxShadowBodySize = 4 * 1024 * 1024
+)
+
+// writeMethodPrefixes are the prefixes of methods which change the state
+// of the chain or of the provider, requests calling them are never
+// mirrored.
+var writeMethodPrefixes = []string{
+	"eth_send", "eth_sign", "eth_submit",
+	"eth_newFilter", "eth_newBlockFilter", "eth_newPendingTransactionFilter",
+	"eth_uninstallFilter", "eth_getFilterChanges", "eth_subscribe", "eth_unsubscribe",
+	"personal_", "admin_", "miner_",
+	"sendTransaction", "requestAirdrop",
+}
+
+type (
+	// ShadowSpec describes the shadow providers which receive a copy of
+	// sampled read-only requests, their responses are compared with the
+	// response of the primary provider, but never sent to the client.
+	ShadowSpec struct {
+		Urls []string `json:"urls" jsonschema:"required"`
+		// SampleRate is the fraction of read-only requests mirrored.
+		SampleRate float64 `json:"sampleRate" jsonschema:"required,minimum=0,maximum=1"`
+		Timeout    string  `json:"timeout,omitempty" jsonschema:"format=duration,default=10s"`
+		// IgnoreFields are the fields of results ignored by the comparison,
+		// for fields which differ between providers by nature.
+		IgnoreFields []string `json:"ignoreFields,omitempty"`
+	}
+
+	shadow struct {
+		spec      *ShadowSpec
+		timeout   time.Duration
+		sampler   *sampler.RateSampler
+		semaphore chan struct{}
+	}
+)
+
+// Validate validates ShadowSpec.
+func (spec *ShadowSpec) Validate() error {
+	if len(spec.Urls) == 0 {
+		return fmt.Errorf("shadow: urls not provided")
+	}
+	if spec.SampleRate <= 0 || spec.SampleRate > 1 {
+		return fmt.Errorf("shadow: sampleRate must be in (0, 1]")
+	}
+	if spec.Timeout != "" {
+		if _, err := time.ParseDuration(spec.Timeout); err != nil {
+			return fmt.Errorf("shadow: invalid timeout %s: %v", spec.Timeout, err)
+		}
+	}
+	return nil
+}
+
+func newShadow(spec *ShadowSpec) *shadow {
+	if spec == nil {
+		return nil
+	}
+
+	timeout, _ := time.ParseDuration(spec.Timeout)
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &shadow{
+		spec:      spec,
+		timeout:   timeout,
+		sampler:   sampler.NewRateSampler(spec.SampleRate),
+		semaphore: make(chan struct{}, maxShadowRequests),
+	}
+}
+
+// isReadOnlyMethod checks whether the method is known to not change the
+// state of the chain or the provider.
+func isReadOnlyMethod(method string) bool {
+	if method == "" || method == "UNKNOWN" {
+		return false
+	}
+	for _, prefix := range writeMethodPrefixes {
+		if strings.HasPrefix(method, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// sample checks whether a request calling the methods should be mirrored.
+func (s *shadow) sample(methods []string) bool {
+	if s == nil || len(methods) == 0 {
+		return false
+	}
+	for _, method := range methods {
+		if !isReadOnlyMethod(method) {
+			return false
+		}
+	}
+	return s.sampler.Sample()
+}
+
+// mirror sends the request payload to the shadow providers in background,
+// and compares their responses with the response of the primary provider.
+func (m *ProviderProxy) mirror(c *chain, payload, primary []byte, methods []string, primaryLatency time.Duration) {
+	s := c.shadow
+	select {
+	case s.semaphore <- struct{}{}:
+	default:
+		logger.Debugf("%s: too many shadow requests, request not mirrored", m.Name())
+		return
+	}
+
+	go func() {
+		defer func() { <-s.semaphore }()
+		for _, u := range s.spec.Urls {
+			body, latency, err := m.callShadow(u, payload, s.timeout)
+
+			result := shadowResultMatch
+			if err != nil {
+				logger.Debugf("%s: shadow provider %s failed: %v", m.Name(), u, err)
+				result = shadowResultError
+			} else if !responsesEqual(primary, body, s.spec.IgnoreFields) {
+				logger.Debugf("%s: shadow provider %s responded differently to %v", m.Name(), u, methods)
+				result = shadowResultMismatch
+			}
+
+			for _, method := range methods {
+				labels := prometheus.Labels{
+					"chain":     c.spec.Name,
+					"provider":  u,
+					"rpcMethod": method,
+				}
+				if err == nil {
+					m.metrics.ShadowLatencyDelta.With(labels).Observe((latency - primaryLatency).Seconds())
+				}
+				labels["result"] = result
+				m.metrics.ShadowRequests.With(labels).Inc()
+			}
+		}
+	}()
+}
+
+// callShadow sends the payload to the shadow provider, and returns the
+// response body and the latency.
+func (m *ProviderProxy) callShadow(u string, payload []byte, timeout time.Duration) ([]byte, time.Duration, error) {
+	ctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(payload))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	startTime := fasttime.Now()
+	resp, err := m.do(u, req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	latency := fasttime.Since(startTime)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	if !isJSONRPCResponse(body) {
+		return nil, 0, fmt.Errorf("invalid JSON-RPC response")
+	}
+	return body, latency, nil
+}
+
+// responsesEqual compares two JSON-RPC responses after normalization, the
+// ids and error messages are not compared, hex strings are compared case
+// insensitively, and the responses of a batch are matched by id.
+func responsesEqual(a, b []byte, ignoreFields []string) bool {
+	na, err := normalizeResponse(a, ignoreFields)
+	if err != nil {
+		return false
+	}
+	nb, err := normalizeResponse(b, ignoreFields)
+	if err != nil {
+		return false
+	}
+	return reflect.DeepEqual(na, nb)
+}
+
+func normalizeResponse(payload []byte, ignoreFields []string) (interface{}, error) {
+	payload = bytes.TrimSpace(payload)
+	if len(payload) > 0 && payload[0] == '[' {
+		var batch []map[string]json.RawMessage
+		if err := json.Unmarshal(payload, &batch); err != nil {
+			return nil, err
+		}
+		result := map[string]interface{}{}
+		for _, resp := range batch {
+			n, err := normalizeResponseObject(resp, ignoreFields)
+			if err != nil {
+				return nil, err
+			}
+			result[string(idOrNull(resp["id"]))] = n
+		}
+		return result, nil
+	}
+
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		return nil, err
+	}
+	return normalizeResponseObject(resp, ignoreFields)
+}
+
+func normalizeResponseObject(resp map[string]json.RawMessage, ignoreFields []string) (interface{}, error) {
+	if raw, ok := resp["error"]; ok && string(raw) != "null" {
+		e := jsonrpcError{}
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"error": e.Code}, nil
+	}
+
+	var result interface{}
+	if raw, ok := resp["result"]; ok {
+		if err := json.Unmarshal(raw, &result); err != nil {
+			return nil, err
+		}
+	}
+	return map[string]interface{}{"result": normalizeValue(result, ignoreFields)}, nil
+}
+
+func normalizeValue(v interface{}, ignoreFields []string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, f := range ignoreFields {
+			delete(v, f)
+		}
+		for k, e := range v {
+			v[k] = normalizeValue(e, ignoreFields)
+		}
+		return v
+	case []interface{}:
+		for i, e := range v {
+			v[i] = normalizeValue(e, ignoreFields)
+		}
+		return v
+	case string:
+		if strings.HasPrefix(v, "0x") || strings.HasPrefix(v, "0X") {
+			return strings.ToLower(v)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providerproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/filters/proxies/providerproxy/mockprovider"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShadowSpecValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&ShadowSpec{Urls: []string{"http://a"}, SampleRate: 0.5}).Validate())
+	assert.Error((&ShadowSpec{SampleRate: 0.5}).Validate())
+	assert.Error((&ShadowSpec{Urls: []string{"http://a"}}).Validate())
+	assert.Error((&ShadowSpec{Urls: []string{"http://a"}, SampleRate: 2}).Validate())
+	assert.Error((&ShadowSpec{Urls: []string{"http://a"}, SampleRate: 1, Timeout: "x"}).Validate())
+}
+
+func TestShadowSample(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(isReadOnlyMethod("eth_call"))
+	assert.True(isReadOnlyMethod("getSlot"))
+	assert.False(isReadOnlyMethod("eth_sendRawTransaction"))
+	assert.False(isReadOnlyMethod("eth_newFilter"))
+	assert.False(isReadOnlyMethod("UNKNOWN"))
+
+	var s *shadow
+	assert.False(s.sample([]string{"eth_call"}))
+
+	s = newShadow(&ShadowSpec{Urls: []string{"http://a"}, SampleRate: 0.5})
+	assert.False(s.sample([]string{"eth_call", "eth_sendRawTransaction"}))
+	sampled := 0
+	for i := 0; i < 10; i++ {
+		if s.sample([]string{"eth_call"}) {
+			sampled++
+		}
+	}
+	assert.Equal(5, sampled)
+}
+
+func TestResponsesEqual(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(responsesEqual(
+		[]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0xABC","n":1}}`),
+		[]byte(`{"id":2,"jsonrpc":"2.0","result":{"n":1,"hash":"0xabc"}}`), nil))
+	assert.False(responsesEqual(
+		[]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`),
+		[]byte(`{"jsonrpc":"2.0","id":1,"result":"0x2"}`), nil))
+	assert.True(responsesEqual(
+		[]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"a"}}`),
+		[]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"b"}}`), nil))
+	assert.False(responsesEqual(
+		[]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"a"}}`),
+		[]byte(`{"jsonrpc":"2.0","id":1,"result":null}`), nil))
+	assert.True(responsesEqual(
+		[]byte(`[{"jsonrpc":"2.0","id":1,"result":"0x1"},{"jsonrpc":"2.0","id":2,"result":[{"a":1,"t":5}]}]`),
+		[]byte(`[{"jsonrpc":"2.0","id":2,"result":[{"a":1,"t":6}]},{"jsonrpc":"2.0","id":1,"result":"0x1"}]`),
+		[]string{"t"}))
+	assert.False(responsesEqual([]byte(`{`), []byte(`{}`), nil))
+}
+
+func TestShadowMirror(t *testing.T) {
+	assert := assert.New(t)
+
+	newProvider := func(spec *mockprovider.ProviderSpec) *httptest.Server {
+		p, err := mockprovider.New(spec)
+		assert.NoError(err)
+		return httptest.NewServer(p)
+	}
+	primary := newProvider(&mockprovider.ProviderSpec{ChainID: 1, StartHeight: 1000})
+	defer primary.Close()
+	same := newProvider(&mockprovider.ProviderSpec{ChainID: 1, StartHeight: 1000})
+	defer same.Close()
+	lagging := newProvider(&mockprovider.ProviderSpec{ChainID: 1, StartHeight: 1000, Lag: 5})
+	defer lagging.Close()
+
+	proxy := newTestProviderProxy(`
+name: providerProxy
+kind: ProviderProxy
+urls:
+  - `+primary.URL+`
+shadow:
+  sampleRate: 1
+  urls:
+    - `+same.URL+`
+    - `+lagging.URL, assert)
+	defer proxy.Close()
+
+	handle := func(payload string) {
+		stdr, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1/", strings.NewReader(payload))
+		ctx := getCtx(stdr)
+		assert.Equal("", proxy.Handle(ctx))
+		data, _ := io.ReadAll(ctx.GetResponse(context.DefaultNamespace).GetPayload())
+		assert.Contains(string(data), `"id":1`)
+	}
+	handle(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`)
+	handle(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+	handle(`{"jsonrpc":"2.0","id":1,"method":"eth_sendRawTransaction","params":["0x00"]}`)
+
+	count := func(provider, method, result string) float64 {
+		return testutil.ToFloat64(proxy.metrics.ShadowRequests.With(prometheus.Labels{
+			"chain": defaultChainName, "provider": provider, "rpcMethod": method, "result": result,
+		}))
+	}
+	assert.Eventually(func() bool {
+		return count(same.URL, "eth_blockNumber", shadowResultMatch) == 1 &&
+			count(lagging.URL, "eth_blockNumber", shadowResultMismatch) == 1 &&
+			count(same.URL, "eth_chainId", shadowResultMatch) == 1 &&
+			count(lagging.URL, "eth_chainId", shadowResultMatch) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(0.0, count(same.URL, "eth_sendRawTransaction", shadowResultMatch))
+}
+
+func TestShadowLargeResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	large := `{"jsonrpc":"2.0","id":1,"result":"` + strings.Repeat("0", maxShadowBodySize) + `"}`
+	newServer := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(large))
+		}))
+	}
+	primary := newServer()
+	defer primary.Close()
+	shadow := newServer()
+	defer shadow.Close()
+
+	proxy := newTestProviderProxy(`
+name: providerProxy
+kind: ProviderProxy
+urls:
+  - `+primary.URL+`
+shadow:
+  sampleRate: 1
+  urls:
+    - `+shadow.URL, assert)
+	defer proxy.Close()
+
+	// the primary response is streamed as usual, but not compared as it
+	// is larger than maxShadowBodySize.
+	stdr, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1/", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber"}`))
+	ctx := getCtx(stdr)
+	assert.Equal("", proxy.Handle(ctx))
+	data, _ := io.ReadAll(ctx.GetResponse(context.DefaultNamespace).GetPayload())
+	assert.Equal(len(large), len(data))
+
+	time.Sleep(100 * time.Millisecond)
+	for _, result := range []string{shadowResultMatch, shadowResultMismatch, shadowResultError} {
+		assert.Equal(0.0, testutil.ToFloat64(proxy.metrics.ShadowRequests.With(prometheus.Labels{
+			"chain": defaultChainName, "provider": shadow.URL, "rpcMethod": "eth_getBlockByNumber", "result": result,
+		})))
+	}
+}
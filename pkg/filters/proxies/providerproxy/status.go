@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providerproxy
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/filters/proxies/providerproxy/selector"
+)
+
+// redactedSegmentLength is the min length of path segments redacted from
+// provider URLs, as such segments are usually API keys.
+const redactedSegmentLength = 16
+
+type (
+	// Status is the status of ProviderProxy.
+	Status struct {
+		Chains []*ChainStatus `json:"chains"`
+		Pools  []*PoolStatus  `json:"pools"`
+	}
+
+	// ChainStatus is the status of a chain.
+	ChainStatus struct {
+		Name      string            `json:"name"`
+		Policy    string            `json:"policy"`
+		Providers []*ProviderStatus `json:"providers"`
+	}
+
+	// ProviderStatus is the status of a provider. The head height, lag
+	// and health are only probed by the policies which check providers
+	// periodically, and a provider is taken as healthy otherwise.
+	ProviderStatus struct {
+		Provider  string  `json:"provider"`
+		Height    uint64  `json:"height,omitempty"`
+		Lag       uint64  `json:"lag"`
+		Healthy   bool    `json:"healthy"`
+		Requests  int64   `json:"requests"`
+		ErrorRate float64 `json:"errorRate"`
+		// P50 and P99 are the latency percentiles in milliseconds.
+		P50 float64 `json:"p50"`
+		P99 float64 `json:"p99"`
+	}
+
+	// PoolStatus is the status of the connection pool of a provider.
+	PoolStatus struct {
+		Provider       string `json:"provider"`
+		OpenConns      int64  `json:"openConns"`
+		ActiveRequests int64  `json:"activeRequests"`
+		TotalRequests  int64  `json:"totalRequests"`
+		ReusedConns    int64  `json:"reusedConns"`
+		Dials          int64  `json:"dials"`
+		DialErrors     int64  `json:"dialErrors"`
+	}
+)
+
+// redactURL removes the query, the user info and the path segments which
+// look like API keys from the provider URL.
+func redactURL(provider string) string {
+	u, err := url.Parse(provider)
+	if err != nil {
+		return "***"
+	}
+
+	segments := strings.Split(u.Path, "/")
+	for i, s := range segments {
+		if len(s) >= redactedSegmentLength {
+			segments[i] = "***"
+		}
+	}
+	return u.Scheme + "://" + u.Host + strings.Join(segments, "/")
+}
+
+// Status returns status.
+func (m *ProviderProxy) Status() interface{} {
+	chains := m.chains
+	if m.defaultChain != nil {
+		chains = append([]*chain{m.defaultChain}, chains...)
+	}
+
+	status := &Status{Pools: m.poolStatus()}
+	for _, c := range chains {
+		status.Chains = append(status.Chains, m.chainStatus(c))
+	}
+	return status
+}
+
+// probeStatus returns the probed status of the providers of the chain by
+// URL, and the max head height of the healthy providers.
+func probeStatus(c *chain) (map[string]*selector.ProviderStatus, uint64) {
+	probed := map[string]*selector.ProviderStatus{}
+	if s, ok := c.selector.(selector.StatusProviderSelector); ok {
+		for _, ps := range s.ProviderStatus() {
+			probed[ps.Url] = ps
+		}
+	}
+
+	var maxHeight uint64
+	for _, ps := range probed {
+		if ps.Healthy && ps.Height > maxHeight {
+			maxHeight = ps.Height
+		}
+	}
+	return probed, maxHeight
+}
+
+func (m *ProviderProxy) chainStatus(c *chain) *ChainStatus {
+	probed, maxHeight := probeStatus(c)
+	status := &ChainStatus{Name: c.spec.Name, Policy: c.spec.Policy}
+	for _, u := range c.spec.Urls {
+		ps := &ProviderStatus{Provider: redactURL(u), Healthy: true}
+		if p := probed[u]; p != nil {
+			ps.Height, ps.Healthy = p.Height, p.Healthy
+			if p.Healthy && p.Height < maxHeight {
+				ps.Lag = maxHeight - p.Height
+			}
+		}
+
+		pc := m.providerClient(u)
+		ps.Requests = pc.totalRequests.Load()
+		if ps.Requests > 0 {
+			ps.ErrorRate = float64(pc.failures.Load()) / float64(ps.Requests)
+		}
+		pc.latencyLock.Lock()
+		percentiles := pc.latency.Percentiles()
+		pc.latencyLock.Unlock()
+		ps.P50, ps.P99 = percentiles[1], percentiles[5]
+
+		status.Providers = append(status.Providers, ps)
+	}
+	return status
+}
+
+// poolStatus returns the status of the connection pools of all providers.
+func (m *ProviderProxy) poolStatus() []*PoolStatus {
+	m.clientsLock.Lock()
+	defer m.clientsLock.Unlock()
+
+	providers := make([]string, 0, len(m.clients))
+	for p := range m.clients {
+		providers = append(providers, p)
+	}
+	sort.Strings(providers)
+	pools := make([]*PoolStatus, 0, len(providers))
+	for _, p := range providers {
+		pools = append(pools, m.clients[p].status())
+	}
+	return pools
+}
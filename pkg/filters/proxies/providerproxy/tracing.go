@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providerproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// span attributes follow the OpenTelemetry semantic conventions for
+// JSON-RPC, provider specific attributes are prefixed by "providerproxy".
+const (
+	attrRPCSystem        = attribute.Key("rpc.system")
+	attrRPCMethod        = attribute.Key("rpc.method")
+	attrRPCErrorCode     = attribute.Key("rpc.jsonrpc.error_code")
+	attrRPCBatchSize     = attribute.Key("rpc.jsonrpc.batch_size")
+	attrHTTPStatusCode   = attribute.Key("http.response.status_code")
+	attrChain            = attribute.Key("providerproxy.chain")
+	attrProvider         = attribute.Key("providerproxy.provider")
+	attrAttempt          = attribute.Key("providerproxy.attempt")
+	rpcSystemJSONRPC     = "jsonrpc"
+	batchMethodSeparator = ","
+)
+
+// startUpstreamSpan starts a client span for an upstream attempt, and injects
+// the trace context into the upstream request if it is configured to.
+func (m *ProviderProxy) startUpstreamSpan(parent *tracing.Span, forwardReq *http.Request,
+	chain, provider string, methods []string, attempt int) *tracing.Span {
+	span := parent.NewClientChild(m.Name())
+	if span.IsNoop() {
+		return span
+	}
+
+	span.SetAttributes(
+		attrRPCSystem.String(rpcSystemJSONRPC),
+		attrRPCMethod.String(strings.Join(methods, batchMethodSeparator)),
+		attrRPCBatchSize.Int(len(methods)),
+		attrChain.String(chain),
+		attrProvider.String(provider),
+		attrAttempt.Int(attempt),
+	)
+	if m.spec.PropagateTraceContext {
+		span.InjectHTTP(forwardReq)
+	}
+	return span
+}
+
+// endUpstreamSpan records the result of an upstream attempt and ends the span.
+func endUpstreamSpan(span *tracing.Span, statusCode int, rpcErrorCode int, err error) {
+	if span.IsNoop() {
+		return
+	}
+
+	if statusCode != 0 {
+		span.SetAttributes(attrHTTPStatusCode.Int(statusCode))
+	}
+	if rpcErrorCode != 0 {
+		span.SetAttributes(attrRPCErrorCode.Int(rpcErrorCode))
+	}
+
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	case statusCode >= http.StatusInternalServerError:
+		span.SetStatus(codes.Error, http.StatusText(statusCode))
+	case rpcErrorCode != 0:
+		span.SetStatus(codes.Error, fmt.Sprintf("JSON-RPC error %d", rpcErrorCode))
+	}
+	span.End()
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providerproxy
+
+import (
+	stdcontext "context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/tracing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamSpan(t *testing.T) {
+	assert := assert.New(t)
+
+	traceparent := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("Traceparent")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"header not found"}}`))
+	}))
+	defer server.Close()
+
+	proxy := newTestProviderProxy(`
+name: providerProxy
+kind: ProviderProxy
+propagateTraceContext: true
+urls:
+  - `+server.URL, assert)
+	defer proxy.Close()
+
+	tracer, err := tracing.New(&tracing.Spec{
+		ServiceName: "test",
+		SampleRate:  1,
+		Exporter: &tracing.ExporterSpec{
+			Zipkin: &tracing.ZipkinSpec{Endpoint: "http://localhost:2181"},
+		},
+	})
+	assert.NoError(err)
+	defer tracer.Close()
+
+	stdr, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1/", strings.NewReader(`{"method":"eth_blockNumber","params":[],"id":1,"jsonrpc":"2.0"}`))
+	req, _ := httpprot.NewRequest(stdr)
+	assert.NoError(req.FetchPayload(1024 * 1024))
+	span := tracer.NewSpan(stdcontext.Background(), "test")
+	defer span.End()
+	ctx := context.New(span)
+	ctx.SetRequest(context.DefaultNamespace, req)
+
+	assert.Equal("", proxy.Handle(ctx))
+	assert.Contains(<-traceparent, span.SpanContext().TraceID().String())
+
+	// trace context is not propagated when it is disabled.
+	proxy.spec.PropagateTraceContext = false
+	stdr, _ = http.NewRequest(http.MethodPost, "http://127.0.0.1/", strings.NewReader(`{"method":"eth_blockNumber","params":[],"id":1,"jsonrpc":"2.0"}`))
+	req, _ = httpprot.NewRequest(stdr)
+	assert.NoError(req.FetchPayload(1024 * 1024))
+	ctx = context.New(span)
+	ctx.SetRequest(context.DefaultNamespace, req)
+
+	assert.Equal("", proxy.Handle(ctx))
+	assert.Empty(<-traceparent)
+}
@@ -0,0 +1,360 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providerproxy
+
+import (
+	stdcontext "context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	proxy "github.com/megaease/easegress/v2/pkg/filters/proxies/httpproxy"
+	"github.com/megaease/easegress/v2/pkg/util/fasttime"
+	"github.com/megaease/easegress/v2/pkg/util/sampler"
+	"golang.org/x/net/http2"
+)
+
+type (
+	// TransportSpec describes the transport used to connect providers.
+	TransportSpec struct {
+		// RootCertBase64 is the CA certificates used to verify providers,
+		// the system roots are used if it is empty.
+		RootCertBase64 string `json:"rootCertBase64,omitempty" jsonschema:"format=base64"`
+		// MTLS is the client certificate for providers requiring mTLS.
+		MTLS               *proxy.MTLS `json:"mtls,omitempty"`
+		ServerName         string      `json:"serverName,omitempty"`
+		InsecureSkipVerify bool        `json:"insecureSkipVerify,omitempty"`
+
+		// Proxy is the URL of the outbound HTTP proxy, the proxy is taken
+		// from the environment variables if it is empty.
+		Proxy string `json:"proxy,omitempty"`
+		// HTTP2 enables HTTP/2 to the providers supporting it.
+		HTTP2 *HTTP2Spec `json:"http2,omitempty"`
+
+		DialTimeout           string `json:"dialTimeout,omitempty" jsonschema:"format=duration,default=30s"`
+		KeepAlive             string `json:"keepAlive,omitempty" jsonschema:"format=duration,default=60s"`
+		IdleConnTimeout       string `json:"idleConnTimeout,omitempty" jsonschema:"format=duration,default=90s"`
+		TLSHandshakeTimeout   string `json:"tlsHandshakeTimeout,omitempty" jsonschema:"format=duration,default=10s"`
+		ResponseHeaderTimeout string `json:"responseHeaderTimeout,omitempty" jsonschema:"format=duration"`
+
+		// MaxIdleConns and MaxIdleConnsPerHost default to the ones of the
+		// ProviderProxy spec.
+		MaxIdleConns        int `json:"maxIdleConns,omitempty"`
+		MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost,omitempty"`
+		MaxConnsPerHost     int `json:"maxConnsPerHost,omitempty"`
+	}
+
+	// HTTP2Spec describes the HTTP/2 settings.
+	HTTP2Spec struct {
+		// ReadIdleTimeout is the timeout after which a health check ping is
+		// sent if no frame is received on the connection.
+		ReadIdleTimeout string `json:"readIdleTimeout,omitempty" jsonschema:"format=duration"`
+		// PingTimeout is the timeout after which the connection is closed
+		// if the health check ping is not responded.
+		PingTimeout                string `json:"pingTimeout,omitempty" jsonschema:"format=duration,default=15s"`
+		StrictMaxConcurrentStreams bool   `json:"strictMaxConcurrentStreams,omitempty"`
+	}
+
+	// ProviderTransportSpec is the transport of a provider, which
+	// overrides the default transport of the ProviderProxy.
+	ProviderTransportSpec struct {
+		Url           string `json:"url" jsonschema:"required"`
+		TransportSpec `json:",inline"`
+	}
+
+	// providerClient is the HTTP client of a provider, each provider has
+	// its own connection pool.
+	providerClient struct {
+		provider  string
+		client    *http.Client
+		transport *http.Transport
+
+		latencyLock sync.Mutex
+		latency     *sampler.DurationSampler
+		failures    atomic.Int64
+
+		openConns      atomic.Int64
+		activeRequests atomic.Int64
+		totalRequests  atomic.Int64
+		reusedConns    atomic.Int64
+		dials          atomic.Int64
+		dialErrors     atomic.Int64
+	}
+
+	// trackedConn is a connection which updates the pool stats on close.
+	trackedConn struct {
+		net.Conn
+		once   sync.Once
+		client *providerClient
+	}
+)
+
+// Validate validates TransportSpec.
+func (spec *TransportSpec) Validate() error {
+	for name, d := range map[string]string{
+		"dialTimeout":           spec.DialTimeout,
+		"keepAlive":             spec.KeepAlive,
+		"idleConnTimeout":       spec.IdleConnTimeout,
+		"tlsHandshakeTimeout":   spec.TLSHandshakeTimeout,
+		"responseHeaderTimeout": spec.ResponseHeaderTimeout,
+	} {
+		if _, err := parseOptionalDuration(d, 0); err != nil {
+			return fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+	if spec.HTTP2 != nil {
+		if _, err := parseOptionalDuration(spec.HTTP2.ReadIdleTimeout, 0); err != nil {
+			return fmt.Errorf("invalid http2.readIdleTimeout: %v", err)
+		}
+		if _, err := parseOptionalDuration(spec.HTTP2.PingTimeout, 0); err != nil {
+			return fmt.Errorf("invalid http2.pingTimeout: %v", err)
+		}
+	}
+	if spec.Proxy != "" {
+		if _, err := url.Parse(spec.Proxy); err != nil {
+			return fmt.Errorf("invalid proxy: %v", err)
+		}
+	}
+	_, err := spec.tlsConfig()
+	return err
+}
+
+func parseOptionalDuration(s string, defaultValue time.Duration) (time.Duration, error) {
+	if s == "" {
+		return defaultValue, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// tlsConfig returns the TLS config of the transport, it returns nil if no
+// TLS setting is configured.
+func (spec *TransportSpec) tlsConfig() (*tls.Config, error) {
+	if spec.RootCertBase64 == "" && spec.MTLS == nil && spec.ServerName == "" && !spec.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		ServerName:         spec.ServerName,
+		InsecureSkipVerify: spec.InsecureSkipVerify,
+	}
+
+	rootCerts := []string{}
+	if spec.RootCertBase64 != "" {
+		rootCerts = append(rootCerts, spec.RootCertBase64)
+	}
+	if spec.MTLS != nil {
+		certPem, _ := base64.StdEncoding.DecodeString(spec.MTLS.CertBase64)
+		keyPem, _ := base64.StdEncoding.DecodeString(spec.MTLS.KeyBase64)
+		cert, err := tls.X509KeyPair(certPem, keyPem)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+		cfg.InsecureSkipVerify = cfg.InsecureSkipVerify || spec.MTLS.InsecureSkipVerify
+		if spec.MTLS.RootCertBase64 != "" {
+			rootCerts = append(rootCerts, spec.MTLS.RootCertBase64)
+		}
+	}
+
+	if len(rootCerts) > 0 {
+		pool := x509.NewCertPool()
+		for _, c := range rootCerts {
+			pem, err := base64.StdEncoding.DecodeString(c)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode root certificate: %v", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("failed to parse root certificate")
+			}
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// transportSpec returns the transport spec of the provider.
+func (m *ProviderProxy) transportSpec(provider string) *TransportSpec {
+	for _, t := range m.spec.ProviderTransports {
+		if t.Url == provider {
+			return &t.TransportSpec
+		}
+	}
+	if m.spec.Transport != nil {
+		return m.spec.Transport
+	}
+	return &TransportSpec{}
+}
+
+// newProviderClient creates the HTTP client of the provider, the spec
+// has been validated, so errors are not expected here.
+func (m *ProviderProxy) newProviderClient(provider string) *providerClient {
+	spec := m.transportSpec(provider)
+	pc := &providerClient{provider: provider, latency: sampler.NewDurationSampler()}
+
+	dialTimeout, _ := parseOptionalDuration(spec.DialTimeout, 30*time.Second)
+	keepAlive, _ := parseOptionalDuration(spec.KeepAlive, 60*time.Second)
+	idleConnTimeout, _ := parseOptionalDuration(spec.IdleConnTimeout, 90*time.Second)
+	tlsHandshakeTimeout, _ := parseOptionalDuration(spec.TLSHandshakeTimeout, 10*time.Second)
+	responseHeaderTimeout, _ := parseOptionalDuration(spec.ResponseHeaderTimeout, 0)
+	tlsCfg, _ := spec.tlsConfig()
+
+	dialer := &net.Dialer{Timeout: dialTimeout, KeepAlive: keepAlive}
+	dialFunc := func(ctx stdcontext.Context, network, addr string) (net.Conn, error) {
+		pc.dials.Add(1)
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			pc.dialErrors.Add(1)
+			return nil, err
+		}
+		pc.openConns.Add(1)
+		return &trackedConn{Conn: conn, client: pc}, nil
+	}
+
+	proxyFunc := http.ProxyFromEnvironment
+	if spec.Proxy != "" {
+		proxyURL, _ := url.Parse(spec.Proxy)
+		proxyFunc = http.ProxyURL(proxyURL)
+	}
+
+	maxIdleConns := spec.MaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = m.spec.MaxIdleConns
+	}
+	maxIdleConnsPerHost := spec.MaxIdleConnsPerHost
+	if maxIdleConnsPerHost == 0 {
+		maxIdleConnsPerHost = m.spec.MaxIdleConnsPerHost
+	}
+
+	pc.transport = &http.Transport{
+		Proxy:                 proxyFunc,
+		DialContext:           dialFunc,
+		TLSClientConfig:       tlsCfg,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		MaxConnsPerHost:       spec.MaxConnsPerHost,
+		IdleConnTimeout:       idleConnTimeout,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if spec.HTTP2 != nil {
+		t2, err := http2.ConfigureTransports(pc.transport)
+		if err == nil {
+			t2.ReadIdleTimeout, _ = parseOptionalDuration(spec.HTTP2.ReadIdleTimeout, 0)
+			t2.PingTimeout, _ = parseOptionalDuration(spec.HTTP2.PingTimeout, 0)
+			t2.StrictMaxConcurrentStreams = spec.HTTP2.StrictMaxConcurrentStreams
+		}
+	}
+
+	pc.client = &http.Client{Transport: pc.transport}
+	maxRedirection := m.spec.MaxRedirection
+	pc.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if maxRedirection <= 0 {
+			return http.ErrUseLastResponse
+		}
+		if len(via) >= maxRedirection {
+			return fmt.Errorf("stopped after %d redirects", maxRedirection)
+		}
+		return nil
+	}
+	return pc
+}
+
+// providerClient returns the HTTP client of the provider, the client is
+// created on first use.
+func (m *ProviderProxy) providerClient(provider string) *providerClient {
+	m.clientsLock.Lock()
+	defer m.clientsLock.Unlock()
+
+	pc := m.clients[provider]
+	if pc == nil {
+		pc = m.newProviderClient(provider)
+		m.clients[provider] = pc
+	}
+	return pc
+}
+
+// do sends the request to the provider by its client.
+func (m *ProviderProxy) do(provider string, req *http.Request) (*http.Response, error) {
+	return m.providerClient(provider).do(req)
+}
+
+func (pc *providerClient) do(req *http.Request) (*http.Response, error) {
+	pc.totalRequests.Add(1)
+	pc.activeRequests.Add(1)
+	defer pc.activeRequests.Add(-1)
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				pc.reusedConns.Add(1)
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	startTime := fasttime.Now()
+	resp, err := pc.client.Do(req)
+	pc.observe(fasttime.Since(startTime), err == nil && !isFailureStatusCode(resp.StatusCode))
+	return resp, err
+}
+
+// observe records the latency until the response header is received,
+// and whether the request succeeded.
+func (pc *providerClient) observe(latency time.Duration, success bool) {
+	if !success {
+		pc.failures.Add(1)
+	}
+	pc.latencyLock.Lock()
+	pc.latency.Update(latency)
+	pc.latencyLock.Unlock()
+}
+
+func (pc *providerClient) status() *PoolStatus {
+	return &PoolStatus{
+		Provider:       redactURL(pc.provider),
+		OpenConns:      pc.openConns.Load(),
+		ActiveRequests: pc.activeRequests.Load(),
+		TotalRequests:  pc.totalRequests.Load(),
+		ReusedConns:    pc.reusedConns.Load(),
+		Dials:          pc.dials.Load(),
+		DialErrors:     pc.dialErrors.Load(),
+	}
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.client.openConns.Add(-1) })
+	return c.Conn.Close()
+}
+
+// closeClients closes the idle connections of all providers.
+func (m *ProviderProxy) closeClients() {
+	m.clientsLock.Lock()
+	defer m.clientsLock.Unlock()
+	for _, pc := range m.clients {
+		pc.transport.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providerproxy
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/filters/proxies/providerproxy/mockprovider"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransportSpecValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&TransportSpec{}).Validate())
+	assert.NoError((&TransportSpec{DialTimeout: "1s", HTTP2: &HTTP2Spec{PingTimeout: "5s"}}).Validate())
+	assert.Error((&TransportSpec{DialTimeout: "x"}).Validate())
+	assert.Error((&TransportSpec{HTTP2: &HTTP2Spec{ReadIdleTimeout: "x"}}).Validate())
+	assert.Error((&TransportSpec{RootCertBase64: "not base64"}).Validate())
+	assert.Error((&TransportSpec{RootCertBase64: base64.StdEncoding.EncodeToString([]byte("no cert"))}).Validate())
+	assert.Error((&TransportSpec{Proxy: "://"}).Validate())
+
+	spec := &Spec{
+		Urls:               []string{"http://a"},
+		ProviderTransports: []*ProviderTransportSpec{{TransportSpec: TransportSpec{}}},
+	}
+	assert.Error(spec.Validate())
+}
+
+func TestProviderTransports(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := mockprovider.New(&mockprovider.ProviderSpec{StartHeight: 100})
+	assert.NoError(err)
+
+	// a TLS provider with its own CA and HTTP/2.
+	tlsServer := httptest.NewUnstartedServer(p)
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	rootCert := base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: tlsServer.Certificate().Raw,
+	}))
+
+	// a plain provider reached through an outbound HTTP proxy.
+	plainServer := httptest.NewServer(p)
+	defer plainServer.Close()
+	var proxied int32
+	outboundProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&proxied, 1)
+		p.ServeHTTP(w, r)
+	}))
+	defer outboundProxy.Close()
+
+	proxy := newTestProviderProxy(`
+name: providerProxy
+kind: ProviderProxy
+chainHeader: X-Chain
+chains:
+  - name: tls
+    urls:
+      - `+tlsServer.URL+`
+  - name: plain
+    urls:
+      - `+plainServer.URL+`
+transport:
+  proxy: `+outboundProxy.URL+`
+providerTransports:
+  - url: `+tlsServer.URL+`
+    rootCertBase64: `+rootCert+`
+    http2: {}`, assert)
+	defer proxy.Close()
+
+	handle := func(chain string) {
+		stdr, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1/", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`))
+		stdr.Header.Set("X-Chain", chain)
+		ctx := getCtx(stdr)
+		assert.Equal("", proxy.Handle(ctx))
+		data, _ := io.ReadAll(ctx.GetResponse(context.DefaultNamespace).GetPayload())
+		assert.JSONEq(`{"jsonrpc":"2.0","id":1,"result":"0x64"}`, string(data))
+	}
+	handle("tls")
+	handle("tls")
+	handle("plain")
+	assert.Equal(int32(1), atomic.LoadInt32(&proxied))
+
+	status := proxy.Status().(*Status)
+	assert.Len(status.Pools, 2)
+	for _, pool := range status.Pools {
+		if strings.HasPrefix(pool.Provider, "https://") {
+			assert.Equal(int64(2), pool.TotalRequests)
+			assert.Equal(int64(1), pool.Dials)
+			assert.Equal(int64(1), pool.OpenConns)
+		}
+	}
+
+	pc := proxy.providerClient(tlsServer.URL)
+	assert.NotNil(pc.transport.TLSClientConfig.RootCAs)
+	stdr, _ := http.NewRequest(http.MethodPost, tlsServer.URL, strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`))
+	resp, err := pc.do(stdr)
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(2, resp.ProtoMajor)
+}
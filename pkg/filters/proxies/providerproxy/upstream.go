@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providerproxy
+
+import (
+	"bytes"
+	stdcontext "context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/util/fasttime"
+)
+
+// upstreamResponse is the response of a JSON-RPC call made by the
+// ProviderProxy itself, rather than a request forwarded from the client.
+type upstreamResponse struct {
+	provider   string
+	statusCode int
+	body       []byte
+}
+
+// callUpstream sends a JSON-RPC payload built by ProviderProxy to a
+// provider of the chain with stdctx, the whole response body is read into
+// memory.
+func (m *ProviderProxy) callUpstream(ctx *context.Context, stdctx stdcontext.Context, c *chain, payload []byte, method string, attempt int) (*upstreamResponse, error) {
+	providerUrl, err := c.selectNode([]string{method})
+	if err != nil {
+		return nil, err
+	}
+
+	forwardReq, err := http.NewRequestWithContext(stdctx, http.MethodPost, providerUrl.String(), bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	forwardReq.Header.Set("Content-Type", "application/json")
+
+	methods := []string{method}
+	span := m.startUpstreamSpan(ctx.Span(), forwardReq, c.spec.Name, providerUrl.String(), methods, attempt)
+	startTime := fasttime.Now()
+	response, err := m.do(providerUrl.String(), forwardReq)
+	if err != nil && stdctx.Err() != nil {
+		// the call is canceled, which is not a failure of the provider.
+		endUpstreamSpan(span, 0, 0, err)
+		return nil, err
+	}
+	if err != nil {
+		c.reportResult(providerUrl, methods, false)
+		m.scorecard.record(c.spec.Name, providerUrl.String(), fasttime.Since(startTime), false, 0)
+		endUpstreamSpan(span, 0, 0, err)
+		return nil, err
+	}
+	defer response.Body.Close()
+	c.reportResult(providerUrl, methods, !isFailureStatusCode(response.StatusCode))
+
+	var reader io.Reader = response.Body
+	if m.spec.ServerMaxBodySize > 0 {
+		reader = io.LimitReader(response.Body, m.spec.ServerMaxBodySize+1)
+	}
+	body, err := io.ReadAll(reader)
+	if err == nil && m.spec.ServerMaxBodySize > 0 && int64(len(body)) > m.spec.ServerMaxBodySize {
+		err = fmt.Errorf("response body exceeds serverMaxBodySize %d", m.spec.ServerMaxBodySize)
+	}
+	rpcErrorCode := parseRPCErrorCode(body)
+	endUpstreamSpan(span, response.StatusCode, rpcErrorCode, err)
+	m.scorecard.record(c.spec.Name, providerUrl.String(), fasttime.Since(startTime),
+		err == nil && !isFailureStatusCode(response.StatusCode), rpcErrorCode)
+
+	m.collectMetrics(RequestMetrics{
+		Chain:      c.spec.Name,
+		Policy:     c.spec.Policy,
+		Provider:   providerUrl.String(),
+		RpcMethod:  methods,
+		StatusCode: response.StatusCode,
+		Duration:   fasttime.Since(startTime),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return &upstreamResponse{
+		provider:   providerUrl.String(),
+		statusCode: response.StatusCode,
+		body:       body,
+	}, nil
+}
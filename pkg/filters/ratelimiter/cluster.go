@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ratelimiter
+
+import (
+	"sort"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/cluster"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+const (
+	// maxClusterDataSize is the max size of the counters an instance puts
+	// to the cluster, it is well under the request size limit of etcd,
+	// which is 1.5MB by default.
+	maxClusterDataSize = 512 * 1024
+	// counterSizeEstimate is the estimated size of a counter in JSON, the
+	// size of its key is not included.
+	counterSizeEstimate = 64
+)
+
+type (
+	// clusterSyncer syncs the counters of window limiters between the
+	// instances of a cluster.
+	clusterSyncer struct {
+		cluster  cluster.Cluster
+		prefix   string
+		key      string
+		interval time.Duration
+		limiters map[string]*windowLimiter
+		done     chan struct{}
+
+		// lastEmpty is true if the data put last time is empty.
+		lastEmpty bool
+	}
+
+	// clusterData is the counters of an instance, indexed by limiter ID
+	// and then the key of requests.
+	clusterData map[string]map[string]windowCounter
+)
+
+func newClusterSyncer(c cluster.Cluster, pipeline, name string, interval time.Duration, limiters map[string]*windowLimiter) *clusterSyncer {
+	s := &clusterSyncer{
+		cluster:  c,
+		prefix:   c.Layout().RateLimiterPrefix(pipeline, name),
+		key:      c.Layout().RateLimiterKey(pipeline, name),
+		interval: interval,
+		limiters: limiters,
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *clusterSyncer) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.sync()
+		}
+	}
+}
+
+func (s *clusterSyncer) sync() {
+	data := clusterData{}
+	for id, l := range s.limiters {
+		if m := l.snapshot(); len(m) > 0 {
+			data[id] = m
+		}
+	}
+
+	if len(data) > 0 || !s.lastEmpty {
+		data = data.trim(maxClusterDataSize)
+		buf := codectool.MustMarshalJSON(data)
+		if err := s.cluster.PutUnderLease(s.key, string(buf)); err != nil {
+			logger.Errorf("put rate limiter counters to %s failed: %v", s.key, err)
+		} else {
+			s.lastEmpty = len(data) == 0
+		}
+	}
+
+	kvs, err := s.cluster.GetPrefix(s.prefix)
+	if err != nil {
+		logger.Errorf("get rate limiter counters from %s failed: %v", s.prefix, err)
+		return
+	}
+
+	others := map[string][]map[string]windowCounter{}
+	for k, v := range kvs {
+		if k == s.key {
+			continue
+		}
+		d := clusterData{}
+		if err := codectool.UnmarshalJSON([]byte(v), &d); err != nil {
+			logger.Errorf("unmarshal rate limiter counters of %s failed: %v", k, err)
+			continue
+		}
+		for id, m := range d {
+			others[id] = append(others[id], m)
+		}
+	}
+
+	for id, l := range s.limiters {
+		l.merge(others[id])
+	}
+}
+
+// trim keeps the counters of the keys with most requests if the estimated
+// size of the data exceeds maxSize, the requests of the dropped keys are
+// not seen by other instances, but they are still counted locally.
+func (d clusterData) trim(maxSize int) clusterData {
+	type entry struct {
+		id, key string
+		count   int
+	}
+
+	size := 0
+	entries := []entry{}
+	for id, m := range d {
+		size += len(id) + counterSizeEstimate
+		for k, c := range m {
+			size += len(k) + counterSizeEstimate
+			entries = append(entries, entry{id: id, key: k, count: c.Current + c.Previous})
+		}
+	}
+	if size <= maxSize {
+		return d
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].count > entries[j].count
+	})
+
+	size = 0
+	trimmed := clusterData{}
+	for _, e := range entries {
+		m := trimmed[e.id]
+		if m == nil {
+			size += len(e.id) + counterSizeEstimate
+		}
+		size += len(e.key) + counterSizeEstimate
+		if size > maxSize {
+			break
+		}
+		if m == nil {
+			m = map[string]windowCounter{}
+			trimmed[e.id] = m
+		}
+		m[e.key] = d[e.id][e.key]
+	}
+
+	logger.Warnf("rate limiter counters of %d keys exceed %d bytes, only %d keys with most requests are synced",
+		len(entries), maxSize, countKeys(trimmed))
+	return trimmed
+}
+
+func countKeys(d clusterData) int {
+	n := 0
+	for _, m := range d {
+		n += len(m)
+	}
+	return n
+}
+
+func (s *clusterSyncer) close() {
+	close(s.done)
+}
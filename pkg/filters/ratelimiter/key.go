@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ratelimiter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+)
+
+const (
+	keySeparator  = "+"
+	defaultAPIKey = "X-API-Key"
+)
+
+// hashKey hashes the value of the key, so that the values, which may be
+// credentials like API keys, are not kept in clear text in the memory, the
+// cluster storage or Redis.
+func hashKey(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:16])
+}
+
+// keyFunc extracts the rate limiting key from a request.
+type keyFunc func(req *httpprot.Request) string
+
+// parseKey parses a key expression, which is one or more key sources joined
+// by '+', and a key source is one of:
+//
+//	clientIP            the real IP of the client
+//	header:<name>       value of the header
+//	query:<name>        value of the query parameter
+//	cookie:<name>       value of the cookie
+//	jwtClaim:<name>     value of the claim of the bearer JWT token
+//	apiKey[:<header>]   the API key, default header is X-API-Key
+//
+// parseKey returns nil if the expression is empty.
+func parseKey(expr string) (keyFunc, error) {
+	if expr == "" {
+		return nil, nil
+	}
+
+	var fns []keyFunc
+	for _, src := range strings.Split(expr, keySeparator) {
+		fn, err := parseKeySource(strings.TrimSpace(src))
+		if err != nil {
+			return nil, err
+		}
+		fns = append(fns, fn)
+	}
+
+	if len(fns) == 1 {
+		return fns[0], nil
+	}
+
+	return func(req *httpprot.Request) string {
+		parts := make([]string, len(fns))
+		for i, fn := range fns {
+			parts[i] = fn(req)
+		}
+		return strings.Join(parts, keySeparator)
+	}, nil
+}
+
+func parseKeySource(src string) (keyFunc, error) {
+	kind, name, _ := strings.Cut(src, ":")
+
+	switch kind {
+	case "clientIP":
+		return func(req *httpprot.Request) string {
+			return req.RealIP()
+		}, nil
+	case "apiKey":
+		if name == "" {
+			name = defaultAPIKey
+		}
+		return headerKey(name), nil
+	}
+
+	if name == "" {
+		return nil, fmt.Errorf("invalid key source %q: name is required", src)
+	}
+
+	switch kind {
+	case "header":
+		return headerKey(name), nil
+	case "query":
+		return func(req *httpprot.Request) string {
+			return req.URL().Query().Get(name)
+		}, nil
+	case "cookie":
+		return func(req *httpprot.Request) string {
+			if c, err := req.Cookie(name); err == nil {
+				return c.Value
+			}
+			return ""
+		}, nil
+	case "jwtClaim":
+		return func(req *httpprot.Request) string {
+			return jwtClaim(req, name)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("invalid key source %q", src)
+}
+
+func headerKey(name string) keyFunc {
+	return func(req *httpprot.Request) string {
+		return req.HTTPHeader().Get(name)
+	}
+}
+
+// jwtClaim returns the claim of the bearer token. The signature of the token
+// is NOT verified, a Validator should be placed before the RateLimiter if
+// the claims must be trusted.
+func jwtClaim(req *httpprot.Request, name string) string {
+	const prefix = "Bearer "
+	authHdr := req.HTTPHeader().Get("Authorization")
+	if !strings.HasPrefix(authHdr, prefix) {
+		return ""
+	}
+
+	claims := jwt.MapClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(authHdr[len(prefix):], claims)
+	if err != nil {
+		return ""
+	}
+
+	if v, ok := claims[name]; ok && v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
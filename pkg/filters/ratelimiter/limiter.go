@@ -0,0 +1,263 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ratelimiter
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	librl "github.com/megaease/easegress/v2/pkg/util/ratelimiter"
+)
+
+// for unit testing cases to mock 'time.Now' only
+var nowFunc = time.Now
+
+type (
+	// limiter limits the requests of a URL rule.
+	limiter interface {
+		// acquire acquires a permission for key.
+		acquire(key string) *result
+	}
+
+	// result is the result of acquiring a permission.
+	result struct {
+		permitted bool
+		// wait is the duration the request should wait before proceed
+		// when permitted.
+		wait  time.Duration
+		limit int
+		// remaining is the number of permissions left in current period.
+		remaining int
+		// reset is the duration before the request could be permitted
+		// when not permitted, or before the quota is fully restored.
+		reset time.Duration
+	}
+
+	// localLimiter limits the requests in current instance only.
+	localLimiter struct {
+		policy *librl.Policy
+		rl     *librl.RateLimiter
+
+		lock  sync.Mutex
+		keyed *lru.Cache
+	}
+
+	// windowCounter is the request counter of a key in a sliding window.
+	windowCounter struct {
+		Window   int64 `json:"window"`
+		Current  int   `json:"current"`
+		Previous int   `json:"previous"`
+	}
+
+	// windowLimiter limits the requests with the sliding window algorithm,
+	// the counters of other instances are merged in by the cluster syncer.
+	// The local counters are kept in an LRU cache, the counter of the least
+	// recently used key is evicted when there are too many keys.
+	windowLimiter struct {
+		limit  int
+		period time.Duration
+
+		lock   sync.Mutex
+		local  *lru.Cache
+		remote map[string]*windowCounter
+	}
+)
+
+func newLocalLimiter(policy *librl.Policy, keyed bool, maxKeys int) *localLimiter {
+	l := &localLimiter{policy: policy}
+	if keyed {
+		l.keyed, _ = lru.New(maxKeys)
+	} else {
+		l.rl = librl.New(policy)
+	}
+	return l
+}
+
+func (l *localLimiter) get(key string) *librl.RateLimiter {
+	if l.keyed == nil {
+		return l.rl
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if v, ok := l.keyed.Get(key); ok {
+		return v.(*librl.RateLimiter)
+	}
+	rl := librl.New(l.policy)
+	l.keyed.Add(key, rl)
+	return rl
+}
+
+func (l *localLimiter) acquire(key string) *result {
+	permitted, d := l.get(key).AcquirePermission()
+	r := &result{permitted: permitted, limit: l.policy.LimitForPeriod}
+	if permitted {
+		r.wait = d
+	} else {
+		r.reset = l.policy.LimitRefreshPeriod
+	}
+	return r
+}
+
+// roll moves the counter forward to window w.
+func (c *windowCounter) roll(w int64) {
+	switch {
+	case w <= c.Window:
+		return
+	case w == c.Window+1:
+		c.Previous, c.Current = c.Current, 0
+	default:
+		c.Previous, c.Current = 0, 0
+	}
+	c.Window = w
+}
+
+func (c *windowCounter) isZero() bool {
+	return c.Current == 0 && c.Previous == 0
+}
+
+func newWindowLimiter(policy *librl.Policy, maxKeys int) *windowLimiter {
+	local, _ := lru.New(maxKeys)
+	return &windowLimiter{
+		limit:  policy.LimitForPeriod,
+		period: policy.LimitRefreshPeriod,
+		local:  local,
+		remote: map[string]*windowCounter{},
+	}
+}
+
+// window returns the index of the window of now and the elapsed duration
+// in it, windows are aligned to the Unix epoch so that they are the same
+// in all instances.
+func (l *windowLimiter) window(now time.Time) (int64, time.Duration) {
+	ns := now.UnixNano()
+	return ns / int64(l.period), time.Duration(ns % int64(l.period))
+}
+
+func (l *windowLimiter) acquire(key string) *result {
+	w, elapsed := l.window(nowFunc())
+	r := &result{limit: l.limit}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var lc *windowCounter
+	if v, ok := l.local.Get(key); ok {
+		lc = v.(*windowCounter)
+	} else {
+		lc = &windowCounter{Window: w}
+		l.local.Add(key, lc)
+	}
+	lc.roll(w)
+
+	cur, prev := lc.Current, lc.Previous
+	if rc := l.remote[key]; rc != nil {
+		rc.roll(w)
+		cur += rc.Current
+		prev += rc.Previous
+	}
+
+	frac := float64(elapsed) / float64(l.period)
+	estimate := float64(prev)*(1-frac) + float64(cur) + 1
+	if estimate > float64(l.limit) {
+		r.reset = l.retryAfter(cur, prev, elapsed)
+		return r
+	}
+
+	lc.Current++
+	r.permitted = true
+	r.remaining = l.limit - int(math.Ceil(estimate))
+	r.reset = l.period - elapsed
+	return r
+}
+
+// retryAfter returns the duration before the estimated count of requests
+// drops below the limit.
+func (l *windowLimiter) retryAfter(cur, prev int, elapsed time.Duration) time.Duration {
+	free := float64(l.limit - 1)
+
+	var d time.Duration
+	if float64(cur) > free {
+		// wait until the next window, in which the requests of current
+		// window become the previous ones.
+		frac := 1 - free/float64(cur)
+		d = l.period - elapsed + time.Duration(frac*float64(l.period))
+	} else {
+		frac := 1 - (free-float64(cur))/float64(prev)
+		d = time.Duration(frac*float64(l.period)) - elapsed
+	}
+
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// snapshot returns the local counters in use and removes the others.
+func (l *windowLimiter) snapshot() map[string]windowCounter {
+	w, _ := l.window(nowFunc())
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	m := make(map[string]windowCounter, l.local.Len())
+	for _, k := range l.local.Keys() {
+		v, ok := l.local.Peek(k)
+		if !ok {
+			continue
+		}
+		c := v.(*windowCounter)
+		c.roll(w)
+		if c.isZero() {
+			l.local.Remove(k)
+			continue
+		}
+		m[k.(string)] = *c
+	}
+	return m
+}
+
+// merge replaces the remote counters with the counters of other instances.
+func (l *windowLimiter) merge(others []map[string]windowCounter) {
+	w, _ := l.window(nowFunc())
+
+	remote := map[string]*windowCounter{}
+	for _, m := range others {
+		for k, c := range m {
+			c.roll(w)
+			if c.isZero() {
+				continue
+			}
+			rc := remote[k]
+			if rc == nil {
+				rc = &windowCounter{Window: w}
+				remote[k] = rc
+			}
+			rc.Current += c.Current
+			rc.Previous += c.Previous
+		}
+	}
+
+	l.lock.Lock()
+	l.remote = remote
+	l.lock.Unlock()
+}
@@ -20,8 +20,10 @@ package ratelimiter
 
 import (
 	"fmt"
+	"math"
 	"net/http"
 	"reflect"
+	"strconv"
 	"time"
 
 	"github.com/megaease/easegress/v2/pkg/context"
@@ -36,6 +38,14 @@ const (
 	// Kind is the kind of RateLimiter.
 	Kind              = "RateLimiter"
 	resultRateLimited = "rateLimited"
+
+	// BackendEtcd syncs the counters of rate limiters by the cluster storage.
+	BackendEtcd = "etcd"
+	// BackendRedis stores the state of rate limiters in a Redis compatible backend.
+	BackendRedis = "redis"
+
+	defaultMaxKeys      = 10000
+	defaultSyncInterval = time.Second
 )
 
 var kind = &filters.Kind{
@@ -67,7 +77,7 @@ type (
 	URLRule struct {
 		urlrule.URLRule `json:",inline"`
 		policy          *Policy
-		rl              *librl.RateLimiter
+		limiter         limiter
 	}
 
 	// Spec is the configuration of a rate limiter
@@ -81,14 +91,44 @@ type (
 		Policies         []*Policy  `json:"policies" jsonschema:"required"`
 		DefaultPolicyRef string     `json:"defaultPolicyRef,omitempty"`
 		URLs             []*URLRule `json:"urls" jsonschema:"required"`
+		// Key is the expression to extract the key of a request, requests
+		// are limited by key if it is not empty.
+		Key     string       `json:"key,omitempty"`
+		MaxKeys int          `json:"maxKeys,omitempty" jsonschema:"minimum=1"`
+		Cluster *ClusterSpec `json:"cluster,omitempty"`
+	}
+
+	// ClusterSpec is the configuration of cluster-wide rate limiting.
+	ClusterSpec struct {
+		Backend      string     `json:"backend,omitempty" jsonschema:"enum=,enum=etcd,enum=redis"`
+		SyncInterval string     `json:"syncInterval,omitempty" jsonschema:"format=duration"`
+		Redis        *RedisSpec `json:"redis,omitempty"`
 	}
 
 	// RateLimiter defines the rate limiter
 	RateLimiter struct {
-		spec *Spec
+		spec   *Spec
+		keyFn  keyFunc
+		redis  *redisClient
+		syncer *clusterSyncer
 	}
 )
 
+func (c *ClusterSpec) backend() string {
+	if c.Backend == "" {
+		return BackendEtcd
+	}
+	return c.Backend
+}
+
+func (c *ClusterSpec) syncInterval() time.Duration {
+	if c.SyncInterval == "" {
+		return defaultSyncInterval
+	}
+	d, _ := time.ParseDuration(c.SyncInterval)
+	return d
+}
+
 // Validate implements custom validation for Spec
 func (spec Spec) Validate() error {
 URLLoop:
@@ -107,31 +147,94 @@ URLLoop:
 		return fmt.Errorf("policy '%s' is not defined", name)
 	}
 
+	if _, err := parseKey(spec.Key); err != nil {
+		return err
+	}
+
+	if spec.Cluster != nil {
+		return spec.validateCluster()
+	}
+
 	return nil
 }
 
-func (url *URLRule) createRateLimiter() {
+func (spec *Spec) validateCluster() error {
+	switch spec.Cluster.backend() {
+	case BackendEtcd:
+		d := defaultSyncInterval
+		if s := spec.Cluster.SyncInterval; s != "" {
+			var err error
+			if d, err = time.ParseDuration(s); err != nil || d <= 0 {
+				return fmt.Errorf("invalid sync interval '%s'", s)
+			}
+		}
+		// the counters of other instances are synced every sync interval,
+		// the window must be large enough to make them meaningful.
+		for _, p := range spec.Policies {
+			if toLibPolicy(p).LimitRefreshPeriod < d {
+				return fmt.Errorf("limitRefreshPeriod of policy '%s' is less than the sync interval", p.Name)
+			}
+		}
+	case BackendRedis:
+		if spec.Cluster.Redis == nil || spec.Cluster.Redis.Address == "" {
+			return fmt.Errorf("redis address is required")
+		}
+	default:
+		return fmt.Errorf("unknown backend '%s'", spec.Cluster.Backend)
+	}
+	return nil
+}
+
+func toLibPolicy(p *Policy) *librl.Policy {
 	policy := librl.Policy{
-		LimitForPeriod: url.policy.LimitForPeriod,
+		LimitForPeriod: p.LimitForPeriod,
 	}
 
 	if policy.LimitForPeriod == 0 {
 		policy.LimitForPeriod = 50
 	}
 
-	if d := url.policy.TimeoutDuration; d != "" {
+	if d := p.TimeoutDuration; d != "" {
 		policy.TimeoutDuration, _ = time.ParseDuration(d)
 	} else {
 		policy.TimeoutDuration = 100 * time.Millisecond
 	}
 
-	if d := url.policy.LimitRefreshPeriod; d != "" {
+	if d := p.LimitRefreshPeriod; d != "" {
 		policy.LimitRefreshPeriod, _ = time.ParseDuration(d)
 	} else {
 		policy.LimitRefreshPeriod = 10 * time.Millisecond
 	}
 
-	url.rl = librl.New(&policy)
+	return &policy
+}
+
+func (rl *RateLimiter) maxKeys() int {
+	if rl.spec.MaxKeys > 0 {
+		return rl.spec.MaxKeys
+	}
+	return defaultMaxKeys
+}
+
+func (rl *RateLimiter) createLimiter(idx int, url *URLRule) {
+	policy := toLibPolicy(url.policy)
+
+	if rl.spec.Cluster == nil {
+		url.limiter = newLocalLimiter(policy, rl.keyFn != nil, rl.maxKeys())
+		return
+	}
+
+	if rl.spec.Cluster.backend() == BackendRedis {
+		prefix := rl.spec.Cluster.Redis.KeyPrefix
+		if prefix == "" {
+			prefix = defaultRedisKeyPrefix
+		}
+		prefix = fmt.Sprintf("%s%s:%s:%d:", prefix, rl.spec.Pipeline(), rl.spec.Name(), idx)
+		url.limiter = newGCRALimiter(rl.redis, prefix, policy.LimitForPeriod, policy.LimitRefreshPeriod)
+		return
+	}
+
+	url.limiter = newWindowLimiter(policy, rl.maxKeys())
 }
 
 // Name returns the name of the RateLimiter filter instance.
@@ -150,7 +253,11 @@ func (rl *RateLimiter) Spec() filters.Spec {
 }
 
 func (rl *RateLimiter) setStateListenerForURL(u *URLRule) {
-	u.rl.SetStateListener(func(event *librl.Event) {
+	l, ok := u.limiter.(*localLimiter)
+	if !ok || l.rl == nil {
+		return
+	}
+	l.rl.SetStateListener(func(event *librl.Event) {
 		logger.Infof("state of rate limiter '%s' on URL(%s) transited to %s at %d",
 			rl.spec.Name(),
 			u.ID(),
@@ -174,10 +281,10 @@ func (rl *RateLimiter) bindPolicyToURL(u *URLRule) {
 	}
 }
 
-func (rl *RateLimiter) createRateLimiterForURL(u *URLRule) {
+func (rl *RateLimiter) createRateLimiterForURL(idx int, u *URLRule) {
 	u.Init()
 	rl.bindPolicyToURL(u)
-	u.createRateLimiter()
+	rl.createLimiter(idx, u)
 	rl.setStateListenerForURL(u)
 }
 
@@ -207,16 +314,40 @@ func isSamePolicy(spec1, spec2 *Spec, policyName string) bool {
 	return reflect.DeepEqual(p1, p2)
 }
 
+// canInheritLimiters returns whether the limiters of the previous generation
+// could be reused, limiters in Redis are never reused as their state is
+// stored in Redis.
+func (rl *RateLimiter) canInheritLimiters(prev *RateLimiter) bool {
+	if prev == nil {
+		return false
+	}
+
+	spec1, spec2 := rl.spec, prev.spec
+	if spec1.Key != spec2.Key || spec1.MaxKeys != spec2.MaxKeys {
+		return false
+	}
+	if !reflect.DeepEqual(spec1.Cluster, spec2.Cluster) {
+		return false
+	}
+	return spec1.Cluster == nil || spec1.Cluster.backend() != BackendRedis
+}
+
 func (rl *RateLimiter) reload(previousGeneration *RateLimiter) {
-	if previousGeneration == nil {
-		for _, u := range rl.spec.URLs {
-			rl.createRateLimiterForURL(u)
+	rl.keyFn, _ = parseKey(rl.spec.Key)
+	if rl.spec.Cluster != nil && rl.spec.Cluster.backend() == BackendRedis {
+		rl.redis = newRedisClient(rl.spec.Cluster.Redis)
+	}
+	defer rl.startSyncer()
+
+	if !rl.canInheritLimiters(previousGeneration) {
+		for i, u := range rl.spec.URLs {
+			rl.createRateLimiterForURL(i, u)
 		}
 		return
 	}
 
 OuterLoop:
-	for _, url := range rl.spec.URLs {
+	for i, url := range rl.spec.URLs {
 		for _, prev := range previousGeneration.spec.URLs {
 			if !url.DeepEqual(&prev.URLRule) {
 				continue
@@ -227,13 +358,33 @@ OuterLoop:
 
 			url.Init()
 			rl.bindPolicyToURL(url)
-			url.rl = prev.rl
-			prev.rl = nil
+			url.limiter = prev.limiter
+			prev.limiter = nil
 			rl.setStateListenerForURL(url)
 			continue OuterLoop
 		}
-		rl.createRateLimiterForURL(url)
+		rl.createRateLimiterForURL(i, url)
+	}
+}
+
+// startSyncer starts the cluster syncer if the counters are synced by the
+// cluster storage.
+func (rl *RateLimiter) startSyncer() {
+	c := rl.spec.Cluster
+	if c == nil || c.backend() != BackendEtcd {
+		return
+	}
+
+	super := rl.spec.Super()
+	if super == nil || super.Cluster() == nil {
+		return
+	}
+
+	limiters := map[string]*windowLimiter{}
+	for i, u := range rl.spec.URLs {
+		limiters[strconv.Itoa(i)] = u.limiter.(*windowLimiter)
 	}
+	rl.syncer = newClusterSyncer(super.Cluster(), rl.spec.Pipeline(), rl.spec.Name(), c.syncInterval(), limiters)
 }
 
 // Init initializes RateLimiter.
@@ -254,22 +405,45 @@ func (rl *RateLimiter) Handle(ctx *context.Context) string {
 			continue
 		}
 
-		permitted, d := u.rl.AcquirePermission()
-		if !permitted {
-			ctx.AddTag("rateLimiter: too many requests")
-
-			resp, _ := ctx.GetOutputResponse().(*httpprot.Response)
-			if resp == nil {
-				resp, _ = httpprot.NewResponse(nil)
-			}
+		key := ""
+		if rl.keyFn != nil {
+			key = hashKey(rl.keyFn(req))
+		}
 
-			resp.SetStatusCode(http.StatusTooManyRequests)
-			resp.HTTPHeader().Set("X-EG-Rate-Limiter", "too-many-requests")
+		r := u.limiter.acquire(key)
 
+		// the headers are set to the output response, which is reused by
+		// the proxy, so they are sent with the final response too.
+		resp, _ := ctx.GetOutputResponse().(*httpprot.Response)
+		if resp == nil {
+			resp, _ = httpprot.NewResponse(nil)
 			ctx.SetOutputResponse(resp)
+		}
+		h := resp.HTTPHeader()
+		h.Set("RateLimit-Limit", strconv.Itoa(r.limit))
+
+		if !r.permitted {
+			ctx.AddTag("rateLimiter: too many requests")
+
+			resp.SetStatusCode(http.StatusTooManyRequests)
+			h.Set("X-EG-Rate-Limiter", "too-many-requests")
+			h.Set("RateLimit-Remaining", "0")
+			h.Set("RateLimit-Reset", formatSeconds(r.reset))
+			h.Set("Retry-After", formatSeconds(r.reset))
 			return resultRateLimited
 		}
 
+		// the local limiter doesn't know the remaining permissions.
+		if r.reset > 0 {
+			remaining := r.remaining
+			if remaining < 0 {
+				remaining = 0
+			}
+			h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+			h.Set("RateLimit-Reset", formatSeconds(r.reset))
+		}
+
+		d := r.wait
 		if d <= 0 {
 			break
 		}
@@ -287,6 +461,15 @@ func (rl *RateLimiter) Handle(ctx *context.Context) string {
 	return ""
 }
 
+// formatSeconds formats d as seconds, which is rounded up and at least 1.
+func formatSeconds(d time.Duration) string {
+	secs := int(math.Ceil(d.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.Itoa(secs)
+}
+
 // Status returns Status generated by Runtime.
 func (rl *RateLimiter) Status() interface{} {
 	return nil
@@ -294,4 +477,10 @@ func (rl *RateLimiter) Status() interface{} {
 
 // Close closes RateLimiter.
 func (rl *RateLimiter) Close() {
+	if rl.syncer != nil {
+		rl.syncer.close()
+	}
+	if rl.redis != nil {
+		rl.redis.close()
+	}
 }
@@ -0,0 +1,463 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ratelimiter
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/cluster/clustertest"
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/filters"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func createRateLimiter(yamlConfig string, prev *RateLimiter) *RateLimiter {
+	rawSpec := make(map[string]interface{})
+	codectool.MustUnmarshal([]byte(yamlConfig), &rawSpec)
+	spec, err := filters.NewSpec(nil, "", rawSpec)
+	if err != nil {
+		panic(err.Error())
+	}
+	rl := &RateLimiter{spec: spec.(*Spec)}
+	if prev == nil {
+		rl.Init()
+	} else {
+		rl.Inherit(prev)
+	}
+	return rl
+}
+
+func newContext(t *testing.T, stdReq *http.Request) *context.Context {
+	ctx := context.New(nil)
+	req, err := httpprot.NewRequest(stdReq)
+	assert.Nil(t, err)
+	ctx.SetInputRequest(req)
+	return ctx
+}
+
+func TestParseKey(t *testing.T) {
+	assert := assert.New(t)
+
+	fn, err := parseKey("")
+	assert.Nil(fn)
+	assert.Nil(err)
+
+	for _, expr := range []string{"unknown", "header", "query:", "jwtClaim"} {
+		_, err = parseKey(expr)
+		assert.Error(err, expr)
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":  "alice",
+		"tier": 2,
+	}).SignedString([]byte("secret"))
+	assert.Nil(err)
+
+	stdReq, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1/?user=bob", nil)
+	stdReq.Header.Set("X-Tenant", "megaease")
+	stdReq.Header.Set("X-API-Key", "key1")
+	stdReq.Header.Set("X-Real-Ip", "192.168.1.1")
+	stdReq.Header.Set("Authorization", "Bearer "+token)
+	stdReq.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+	req, _ := httpprot.NewRequest(stdReq)
+
+	cases := map[string]string{
+		"clientIP":                "192.168.1.1",
+		"header:X-Tenant":         "megaease",
+		"query:user":              "bob",
+		"cookie:session":          "s1",
+		"cookie:unknown":          "",
+		"jwtClaim:sub":            "alice",
+		"jwtClaim:tier":           "2",
+		"jwtClaim:unknown":        "",
+		"apiKey":                  "key1",
+		"apiKey:X-Tenant":         "megaease",
+		"clientIP + jwtClaim:sub": "192.168.1.1+alice",
+	}
+	for expr, expected := range cases {
+		fn, err := parseKey(expr)
+		assert.Nil(err, expr)
+		assert.Equal(expected, fn(req), expr)
+	}
+
+	stdReq.Header.Set("Authorization", "Basic xxx")
+	fn, _ = parseKey("jwtClaim:sub")
+	assert.Equal("", fn(req))
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	const base = `
+name: rl
+kind: RateLimiter
+policies:
+- name: policy1
+  limitRefreshPeriod: 100ms
+urls:
+- url:
+    prefix: /
+  policyRef: policy1
+`
+
+	for _, cfg := range []string{
+		base + "key: unknown\n",
+		base + "cluster:\n  backend: unknown\n",
+		base + "cluster:\n  backend: redis\n",
+		base + "cluster:\n  syncInterval: 1s\n",
+	} {
+		rawSpec := make(map[string]interface{})
+		codectool.MustUnmarshal([]byte(cfg), &rawSpec)
+		_, err := filters.NewSpec(nil, "", rawSpec)
+		assert.Error(err, cfg)
+	}
+
+	for _, cfg := range []string{
+		base + "key: clientIP\n",
+		base + "cluster:\n  syncInterval: 100ms\n",
+		base + "cluster:\n  backend: redis\n  redis:\n    address: 127.0.0.1:6379\n",
+	} {
+		rawSpec := make(map[string]interface{})
+		codectool.MustUnmarshal([]byte(cfg), &rawSpec)
+		_, err := filters.NewSpec(nil, "", rawSpec)
+		assert.Nil(err, cfg)
+	}
+}
+
+func TestKeyedRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	const yamlConfig = `
+name: rl
+kind: RateLimiter
+key: header:X-User
+policies:
+- name: policy1
+  timeoutDuration: 1ms
+  limitRefreshPeriod: 1h
+  limitForPeriod: 1
+defaultPolicyRef: policy1
+urls:
+- url:
+    prefix: /
+`
+	rl := createRateLimiter(yamlConfig, nil)
+	defer rl.Close()
+
+	handle := func(rl *RateLimiter, header, user string) (string, *context.Context) {
+		stdReq, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1/", nil)
+		stdReq.Header.Set(header, user)
+		ctx := newContext(t, stdReq)
+		return rl.Handle(ctx), ctx
+	}
+
+	result, ctx := handle(rl, "X-User", "alice")
+	assert.Empty(result)
+	// the headers are set to allowed responses too.
+	resp := ctx.GetOutputResponse().(*httpprot.Response)
+	assert.Equal("1", resp.HTTPHeader().Get("RateLimit-Limit"))
+	result, _ = handle(rl, "X-User", "bob")
+	assert.Empty(result)
+
+	// the values of the key are hashed.
+	keys := rl.spec.URLs[0].limiter.(*localLimiter).keyed.Keys()
+	assert.ElementsMatch([]interface{}{hashKey("alice"), hashKey("bob")}, keys)
+	assert.Len(hashKey("alice"), 32)
+
+	result, ctx = handle(rl, "X-User", "alice")
+	assert.Equal(resultRateLimited, result)
+	resp = ctx.GetOutputResponse().(*httpprot.Response)
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode())
+	assert.Equal("1", resp.HTTPHeader().Get("RateLimit-Limit"))
+	assert.Equal("0", resp.HTTPHeader().Get("RateLimit-Remaining"))
+	assert.Equal("3600", resp.HTTPHeader().Get("Retry-After"))
+
+	// the limiters are inherited if the key is not changed.
+	rl2 := createRateLimiter(yamlConfig, rl)
+	result, _ = handle(rl2, "X-User", "bob")
+	assert.Equal(resultRateLimited, result)
+
+	// but not if the key is changed.
+	rl3 := createRateLimiter(strings.Replace(yamlConfig, "X-User", "X-Client", 1), rl2)
+	result, _ = handle(rl3, "X-Client", "bob")
+	assert.Empty(result)
+}
+
+func TestWindowLimiter(t *testing.T) {
+	assert := assert.New(t)
+	defer func() { nowFunc = time.Now }()
+
+	start := time.Unix(1000, 0)
+	now := start
+	nowFunc = func() time.Time { return now }
+
+	l := newWindowLimiter(toLibPolicy(&Policy{LimitRefreshPeriod: "1s", LimitForPeriod: 10}), 2)
+
+	for i := 0; i < 10; i++ {
+		r := l.acquire("k1")
+		assert.True(r.permitted)
+		assert.Equal(9-i, r.remaining)
+	}
+	r := l.acquire("k1")
+	assert.False(r.permitted)
+	assert.InDelta(float64(1100*time.Millisecond), float64(r.reset), float64(time.Millisecond))
+
+	// half of previous window is counted.
+	now = start.Add(1500 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		assert.True(l.acquire("k1").permitted)
+	}
+	r = l.acquire("k1")
+	assert.False(r.permitted)
+	assert.InDelta(float64(100*time.Millisecond), float64(r.reset), float64(time.Millisecond))
+
+	// too many keys, the least recently used key is evicted.
+	assert.True(l.acquire("k2").permitted)
+	r = l.acquire("k3")
+	assert.True(r.permitted)
+	assert.Equal(9, r.remaining)
+	assert.True(l.local.Contains("k3"))
+	assert.False(l.local.Contains("k1"))
+
+	// counters of other instances.
+	now = start.Add(3 * time.Second)
+	snapshot := l.snapshot()
+	assert.Empty(snapshot)
+	l.merge([]map[string]windowCounter{
+		{"k1": {Window: 1003, Current: 6}},
+		{"k1": {Window: 1002, Current: 4}},
+	})
+	now = start.Add(3500 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		assert.True(l.acquire("k1").permitted)
+	}
+	assert.False(l.acquire("k1").permitted)
+
+	snapshot = l.snapshot()
+	assert.Equal(windowCounter{Window: 1003, Current: 2}, snapshot["k1"])
+}
+
+func TestClusterSyncer(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newWindowLimiter(toLibPolicy(&Policy{LimitRefreshPeriod: "1h", LimitForPeriod: 10}), 10)
+	l.acquire("k1")
+
+	w, _ := l.window(time.Now())
+	others := clusterData{"0": {"k1": {Window: w, Current: 9}}}
+
+	puts := map[string]string{}
+	c := clustertest.NewMockedCluster()
+	c.MockedPutUnderLease = func(key, value string) error {
+		puts[key] = value
+		return nil
+	}
+	c.MockedGetPrefix = func(prefix string) (map[string]string, error) {
+		return map[string]string{
+			"/ratelimiter/p/rl/m1": puts["/ratelimiter/p/rl/m1"],
+			"/ratelimiter/p/rl/m2": string(codectool.MustMarshalJSON(others)),
+		}, nil
+	}
+
+	s := &clusterSyncer{
+		cluster:  c,
+		prefix:   "/ratelimiter/p/rl/",
+		key:      "/ratelimiter/p/rl/m1",
+		limiters: map[string]*windowLimiter{"0": l},
+	}
+	s.sync()
+
+	data := clusterData{}
+	codectool.MustUnmarshalJSON([]byte(puts[s.key]), &data)
+	assert.Equal(1, data["0"]["k1"].Current)
+	assert.False(l.acquire("k1").permitted)
+	assert.True(l.acquire("k2").permitted)
+}
+
+func TestClusterDataTrim(t *testing.T) {
+	assert := assert.New(t)
+
+	d := clusterData{"0": {}, "1": {}}
+	for i := 0; i < 1000; i++ {
+		d["0"][fmt.Sprintf("key-%d", i)] = windowCounter{Window: 1700000000, Current: i, Previous: i}
+	}
+	d["1"]["key"] = windowCounter{Window: 1700000000, Current: 2000}
+	assert.Equal(d, d.trim(1024*1024))
+
+	// the keys with most requests are kept, and the size of JSON is under
+	// the limit.
+	trimmed := d.trim(4096)
+	assert.Less(len(codectool.MustMarshalJSON(trimmed)), 4096)
+	assert.Equal(d["1"], trimmed["1"])
+	assert.Contains(trimmed["0"], "key-999")
+	assert.NotContains(trimmed["0"], "key-0")
+	assert.Less(len(trimmed["0"]), 1000)
+}
+
+func TestRedisGCRALimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer ln.Close()
+
+	commands := make(chan []string, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		for {
+			reply, err := readReply(r)
+			if err != nil {
+				return
+			}
+			var args []string
+			for _, v := range reply.([]interface{}) {
+				args = append(args, v.(string))
+			}
+			commands <- args
+
+			switch args[0] {
+			case "AUTH":
+				conn.Write([]byte("+OK\r\n"))
+			case "SELECT":
+				conn.Write([]byte("-ERR DB index is out of range\r\n"))
+			case "EVALSHA":
+				if args[3] == "rl:k2" {
+					conn.Write([]byte("-NOSCRIPT No matching script. Please use EVAL.\r\n"))
+					continue
+				}
+				fallthrough
+			case "EVAL":
+				if args[3] == "rl:k1" {
+					conn.Write([]byte("*4\r\n:1\r\n:9\r\n:0\r\n:100000\r\n"))
+				} else {
+					conn.Write([]byte("*4\r\n:0\r\n:0\r\n:2500000\r\n:3500000\r\n"))
+				}
+			}
+		}
+	}()
+
+	client := newRedisClient(&RedisSpec{Address: ln.Addr().String(), Password: "pass", Timeout: "1s"})
+	defer client.close()
+	l := newGCRALimiter(client, "rl:", 10, time.Second)
+	assert.Equal(int64(100000), l.emission)
+	assert.Equal(int64(900000), l.tolerance)
+
+	r := l.acquire("k1")
+	assert.Equal([]string{"AUTH", "pass"}, <-commands)
+	args := <-commands
+	assert.Equal([]string{"EVALSHA", gcraScriptSHA, "1", "rl:k1", "100000", "900000"}, args)
+	assert.True(r.permitted)
+	assert.Equal(9, r.remaining)
+	assert.Equal(100*time.Millisecond, r.reset)
+
+	// the script is sent if it is not cached by the server.
+	r = l.acquire("k2")
+	assert.Equal("EVALSHA", (<-commands)[0])
+	assert.Equal([]string{"EVAL", gcraScript, "1", "rl:k2", "100000", "900000"}, <-commands)
+	assert.False(r.permitted)
+	assert.Equal(2500*time.Millisecond, r.reset)
+
+	_, err = client.do("SELECT", "100")
+	assert.Equal(redisError("ERR DB index is out of range"), err)
+
+	// fail open if the backend is not available.
+	ln.Close()
+	client.close()
+	client.spec.Address = ln.Addr().String()
+	assert.True(l.acquire("k1").permitted)
+}
+
+func TestReadReply(t *testing.T) {
+	assert := assert.New(t)
+
+	read := func(s string) (interface{}, error) {
+		return readReply(bufio.NewReader(strings.NewReader(s)))
+	}
+
+	v, err := read("+OK\r\n")
+	assert.NoError(err)
+	assert.Equal("OK", v)
+
+	_, err = read("-ERR unknown command\r\n")
+	assert.Equal(redisError("ERR unknown command"), err)
+
+	v, err = read(":-42\r\n")
+	assert.NoError(err)
+	assert.Equal(int64(-42), v)
+
+	v, err = read("$5\r\nhe\r\no\r\n")
+	assert.NoError(err)
+	assert.Equal("he\r\no", v)
+
+	v, err = read("$0\r\n\r\n")
+	assert.NoError(err)
+	assert.Equal("", v)
+
+	v, err = read("$-1\r\n")
+	assert.NoError(err)
+	assert.Nil(v)
+
+	v, err = read("*3\r\n:1\r\n$1\r\na\r\n*1\r\n+b\r\n")
+	assert.NoError(err)
+	assert.Equal([]interface{}{int64(1), "a", []interface{}{"b"}}, v)
+
+	v, err = read("*-1\r\n")
+	assert.NoError(err)
+	assert.Nil(v)
+
+	for _, s := range []string{
+		"",
+		"\r\n",
+		"+OK\n",
+		"+OK",
+		":abc\r\n",
+		"$abc\r\n",
+		"$5\r\nabc\r\n",
+		"$2147483647\r\n",
+		"*2\r\n:1\r\n",
+		"*2147483647\r\n",
+		"!unknown\r\n",
+	} {
+		_, err = read(s)
+		assert.Error(err, "%q", s)
+	}
+}
@@ -0,0 +1,341 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ratelimiter
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+)
+
+const (
+	defaultRedisKeyPrefix = "easegress:ratelimiter:"
+	defaultRedisTimeout   = 100 * time.Millisecond
+	defaultRedisPoolSize  = 16
+
+	// maxRedisReplyLen is the max length of bulk strings and arrays in
+	// replies, the replies of the commands used are far smaller.
+	maxRedisReplyLen = 1024 * 1024
+)
+
+// gcraScript implements the generic cell rate algorithm, it returns whether
+// the request is permitted, the remaining permissions, the microseconds to
+// wait before retry and the microseconds before the quota is fully restored.
+const gcraScript = `
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local emission = tonumber(ARGV[1])
+local tolerance = tonumber(ARGV[2])
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+local diff = tat - now
+if diff > tolerance then
+	return {0, 0, diff - tolerance, diff}
+end
+local newTat = tat + emission
+redis.call('SET', KEYS[1], string.format('%d', newTat), 'PX', math.ceil((newTat - now) / 1000) + 1)
+return {1, math.floor((tolerance - newTat + now) / emission) + 1, 0, newTat - now}
+`
+
+// gcraScriptSHA is the SHA1 digest of gcraScript, which is used to run the
+// script cached by the server with EVALSHA.
+var gcraScriptSHA = func() string {
+	sum := sha1.Sum([]byte(gcraScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+type (
+	// RedisSpec is the configuration of a Redis compatible backend.
+	RedisSpec struct {
+		Address   string `json:"address" jsonschema:"required"`
+		Username  string `json:"username,omitempty"`
+		Password  string `json:"password,omitempty"`
+		DB        int    `json:"db,omitempty" jsonschema:"minimum=0"`
+		TLS       bool   `json:"tls,omitempty"`
+		KeyPrefix string `json:"keyPrefix,omitempty"`
+		Timeout   string `json:"timeout,omitempty" jsonschema:"format=duration"`
+		PoolSize  int    `json:"poolSize,omitempty" jsonschema:"minimum=1"`
+	}
+
+	// redisClient is a minimal client of the Redis serialization protocol.
+	redisClient struct {
+		spec    *RedisSpec
+		timeout time.Duration
+		idle    chan *redisConn
+	}
+
+	redisConn struct {
+		net.Conn
+		r *bufio.Reader
+	}
+
+	// redisError is an error reply from the server.
+	redisError string
+
+	// gcraLimiter limits the requests with the generic cell rate algorithm,
+	// the state is stored in Redis and shared by all instances.
+	gcraLimiter struct {
+		client    *redisClient
+		prefix    string
+		limit     int
+		emission  int64
+		tolerance int64
+	}
+)
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+func newRedisClient(spec *RedisSpec) *redisClient {
+	c := &redisClient{spec: spec, timeout: defaultRedisTimeout}
+	if spec.Timeout != "" {
+		c.timeout, _ = time.ParseDuration(spec.Timeout)
+	}
+
+	size := spec.PoolSize
+	if size == 0 {
+		size = defaultRedisPoolSize
+	}
+	c.idle = make(chan *redisConn, size)
+	return c
+}
+
+func (c *redisClient) dial() (*redisConn, error) {
+	var conn net.Conn
+	var err error
+
+	dialer := &net.Dialer{Timeout: c.timeout}
+	if c.spec.TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.spec.Address, &tls.Config{})
+	} else {
+		conn, err = dialer.Dial("tcp", c.spec.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	rc.SetDeadline(time.Now().Add(c.timeout))
+
+	if c.spec.Password != "" {
+		args := []string{"AUTH", c.spec.Password}
+		if c.spec.Username != "" {
+			args = []string{"AUTH", c.spec.Username, c.spec.Password}
+		}
+		if _, err = rc.do(args...); err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+
+	if c.spec.DB != 0 {
+		if _, err = rc.do("SELECT", strconv.Itoa(c.spec.DB)); err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+
+	return rc, nil
+}
+
+// do sends a command to the server and returns the reply.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	var conn *redisConn
+	select {
+	case conn = <-c.idle:
+	default:
+		var err error
+		if conn, err = c.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	reply, err := conn.do(args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+func (c *redisClient) close() {
+	for {
+		select {
+		case conn := <-c.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+
+	if _, err := rc.Write(buf); err != nil {
+		return nil, err
+	}
+	return readReply(rc.r)
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("invalid reply line: %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// readReply reads a reply, the result is one of nil, string, int64,
+// []interface{} and redisError.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, fmt.Errorf("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		if n > maxRedisReplyLen {
+			return nil, fmt.Errorf("bulk string too long: %d", n)
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		if n > maxRedisReplyLen {
+			return nil, fmt.Errorf("array too long: %d", n)
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			v, err := readReply(r)
+			if err != nil {
+				return nil, err
+			}
+			arr[i] = v
+		}
+		return arr, nil
+	}
+
+	return nil, fmt.Errorf("unknown reply type: %q", line[0])
+}
+
+func newGCRALimiter(client *redisClient, prefix string, limit int, period time.Duration) *gcraLimiter {
+	emission := period.Microseconds() / int64(limit)
+	if emission == 0 {
+		emission = 1
+	}
+	return &gcraLimiter{
+		client:    client,
+		prefix:    prefix,
+		limit:     limit,
+		emission:  emission,
+		tolerance: period.Microseconds() - emission,
+	}
+}
+
+func (l *gcraLimiter) acquire(key string) *result {
+	r := &result{limit: l.limit}
+
+	args := []string{"1", l.prefix + key, strconv.FormatInt(l.emission, 10), strconv.FormatInt(l.tolerance, 10)}
+	reply, err := l.client.do(append([]string{"EVALSHA", gcraScriptSHA}, args...)...)
+	if e, ok := err.(redisError); ok && strings.HasPrefix(string(e), "NOSCRIPT") {
+		// the script is not cached by the server, EVAL caches it.
+		reply, err = l.client.do(append([]string{"EVAL", gcraScript}, args...)...)
+	}
+	if err != nil {
+		// fail open, the backend should not break the service.
+		logger.Errorf("acquire permission from redis failed: %v", err)
+		r.permitted = true
+		return r
+	}
+
+	arr, ok := reply.([]interface{})
+	if !ok || len(arr) != 4 {
+		logger.Errorf("unexpected reply from redis: %v", reply)
+		r.permitted = true
+		return r
+	}
+
+	values := make([]int64, len(arr))
+	for i, v := range arr {
+		values[i], _ = v.(int64)
+	}
+
+	r.permitted = values[0] == 1
+	r.remaining = int(values[1])
+	if r.permitted {
+		r.reset = time.Duration(values[3]) * time.Microsecond
+	} else {
+		r.reset = time.Duration(values[2]) * time.Microsecond
+	}
+	return r
+}
@@ -0,0 +1,485 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remotefilter
+
+import (
+	"bytes"
+	stdcontext "context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	lru "github.com/hashicorp/golang-lru"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+)
+
+const defaultAuthzCacheSize = 1024
+
+type (
+	// GRPCSpec describes the external authorization service, which
+	// implements envoy.service.auth.v3.Authorization.
+	GRPCSpec struct {
+		Address            string `json:"address" jsonschema:"required"`
+		TLS                bool   `json:"tls,omitempty"`
+		InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+		// FailureModeAllow lets the request pass if the authorization
+		// service is unavailable or returns an error.
+		FailureModeAllow bool `json:"failureModeAllow,omitempty"`
+		// StatusOnError is the status code of the response when the
+		// authorization service fails, default is 403.
+		StatusOnError     int               `json:"statusOnError,omitempty" jsonschema:"minimum=200,maximum=599"`
+		WithRequestBody   *BodySpec         `json:"withRequestBody,omitempty"`
+		ContextExtensions map[string]string `json:"contextExtensions,omitempty"`
+		Cache             *CacheSpec        `json:"cache,omitempty"`
+	}
+
+	// BodySpec describes how to send the request body to the
+	// authorization service.
+	BodySpec struct {
+		MaxRequestBytes int64 `json:"maxRequestBytes" jsonschema:"required,minimum=1"`
+		// AllowPartialMessage sends the first MaxRequestBytes bytes of
+		// the body if it is larger than MaxRequestBytes, otherwise, the
+		// request is rejected with 413.
+		AllowPartialMessage bool `json:"allowPartialMessage,omitempty"`
+		// PackAsBytes sends the body in the raw_body field instead of
+		// the body field.
+		PackAsBytes bool `json:"packAsBytes,omitempty"`
+	}
+
+	// CacheSpec describes the cache of the authorization results.
+	CacheSpec struct {
+		// Key is the sources of the cache key, a source is one of
+		// method, host, path, clientIP, header:<name> and query:<name>.
+		// The key must include the credential of the request, such as
+		// header:Authorization, otherwise, the result of a client would
+		// be used for other clients.
+		Key  []string `json:"key" jsonschema:"required,minItems=1"`
+		TTL  string   `json:"ttl" jsonschema:"required,format=duration"`
+		Size int      `json:"size,omitempty" jsonschema:"minimum=1"`
+	}
+
+	authzClient struct {
+		spec    *GRPCSpec
+		timeout time.Duration
+		conn    *grpc.ClientConn
+		client  authv3.AuthorizationClient
+
+		cacheKey []func(r *httpprot.Request) string
+		cacheTTL time.Duration
+		cache    *lru.Cache
+	}
+
+	authzCacheEntry struct {
+		resp     *authv3.CheckResponse
+		expireAt time.Time
+	}
+)
+
+// Validate validates CacheSpec.
+func (spec *CacheSpec) Validate() error {
+	credential := false
+	for _, src := range spec.Key {
+		if _, err := parseCacheKeySource(src); err != nil {
+			return err
+		}
+		if strings.HasPrefix(src, "header:") || strings.HasPrefix(src, "query:") {
+			credential = true
+		}
+	}
+	if !credential {
+		return fmt.Errorf("cache key must include the credential of the request, e.g. header:Authorization")
+	}
+	return nil
+}
+
+func parseCacheKeySource(src string) (func(r *httpprot.Request) string, error) {
+	switch src {
+	case "method":
+		return func(r *httpprot.Request) string { return r.Method() }, nil
+	case "host":
+		return func(r *httpprot.Request) string { return r.Host() }, nil
+	case "path":
+		return func(r *httpprot.Request) string { return r.Path() }, nil
+	case "clientIP":
+		return func(r *httpprot.Request) string { return r.RealIP() }, nil
+	}
+
+	kind, name, _ := strings.Cut(src, ":")
+	if name == "" {
+		return nil, fmt.Errorf("invalid cache key source %q", src)
+	}
+
+	switch kind {
+	case "header":
+		return func(r *httpprot.Request) string {
+			return strings.Join(r.HTTPHeader().Values(name), ",")
+		}, nil
+	case "query":
+		return func(r *httpprot.Request) string {
+			return strings.Join(r.URL().Query()[name], ",")
+		}, nil
+	}
+
+	return nil, fmt.Errorf("invalid cache key source %q", src)
+}
+
+func newAuthzClient(spec *GRPCSpec, timeout time.Duration) (*authzClient, error) {
+	c := &authzClient{spec: spec, timeout: timeout}
+
+	creds := insecure.NewCredentials()
+	if spec.TLS {
+		creds = credentials.NewTLS(&tls.Config{InsecureSkipVerify: spec.InsecureSkipVerify})
+	}
+
+	conn, err := grpc.NewClient(spec.Address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	c.client = authv3.NewAuthorizationClient(conn)
+
+	if spec.Cache != nil {
+		for _, src := range spec.Cache.Key {
+			fn, err := parseCacheKeySource(src)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			c.cacheKey = append(c.cacheKey, fn)
+		}
+
+		c.cacheTTL, _ = time.ParseDuration(spec.Cache.TTL)
+		size := spec.Cache.Size
+		if size <= 0 {
+			size = defaultAuthzCacheSize
+		}
+		c.cache, _ = lru.New(size)
+	}
+
+	return c, nil
+}
+
+func (c *authzClient) close() {
+	c.conn.Close()
+}
+
+func (c *authzClient) statusOnError() int {
+	if c.spec.StatusOnError > 0 {
+		return c.spec.StatusOnError
+	}
+	return http.StatusForbidden
+}
+
+func (c *authzClient) getCacheKey(r *httpprot.Request) string {
+	parts := make([]string, len(c.cacheKey))
+	for i, fn := range c.cacheKey {
+		parts[i] = fn(r)
+	}
+	// NOTE: use a character which can't be in the key sources as separator.
+	return strings.Join(parts, "\n")
+}
+
+func (c *authzClient) getCache(key string) *authv3.CheckResponse {
+	v, ok := c.cache.Get(key)
+	if !ok {
+		return nil
+	}
+
+	entry := v.(*authzCacheEntry)
+	if time.Now().After(entry.expireAt) {
+		c.cache.Remove(key)
+		return nil
+	}
+	return entry.resp
+}
+
+func (c *authzClient) putCache(key string, resp *authv3.CheckResponse) {
+	c.cache.Add(key, &authzCacheEntry{resp: resp, expireAt: time.Now().Add(c.cacheTTL)})
+}
+
+// readBody reads at most n+1 bytes of the request body, and the body is
+// kept intact for the following filters.
+func readBody(r *httpprot.Request, n int64) ([]byte, error) {
+	if !r.IsStream() {
+		return r.RawPayload(), nil
+	}
+
+	buf := bytes.NewBuffer(nil)
+	_, err := io.CopyN(buf, r.GetPayload(), n+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	body := buf.Bytes()
+	r.SetPayload(io.MultiReader(bytes.NewReader(body), r.GetPayload()))
+	return body, nil
+}
+
+func splitHostPort(addr string) (string, uint32) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	p, _ := strconv.ParseUint(port, 10, 16)
+	return host, uint32(p)
+}
+
+func newPeer(host string, port uint32) *authv3.AttributeContext_Peer {
+	return &authv3.AttributeContext_Peer{
+		Address: &corev3.Address{
+			Address: &corev3.Address_SocketAddress{
+				SocketAddress: &corev3.SocketAddress{
+					Address:       host,
+					PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: port},
+				},
+			},
+		},
+	}
+}
+
+func (c *authzClient) newCheckRequest(r *httpprot.Request, body []byte) *authv3.CheckRequest {
+	stdr := r.Std()
+
+	headers := map[string]string{
+		":method":    r.Method(),
+		":path":      stdr.URL.RequestURI(),
+		":authority": r.Host(),
+		":scheme":    r.Scheme(),
+	}
+	for k, vs := range stdr.Header {
+		headers[strings.ToLower(k)] = strings.Join(vs, ",")
+	}
+
+	httpReq := &authv3.AttributeContext_HttpRequest{
+		Id:       stdr.Header.Get("X-Request-Id"),
+		Method:   r.Method(),
+		Headers:  headers,
+		Path:     stdr.URL.RequestURI(),
+		Host:     r.Host(),
+		Scheme:   r.Scheme(),
+		Size:     stdr.ContentLength,
+		Protocol: r.Proto(),
+	}
+
+	if len(body) > 0 {
+		if c.spec.WithRequestBody.PackAsBytes {
+			httpReq.RawBody = body
+		} else if utf8.Valid(body) {
+			httpReq.Body = string(body)
+		} else {
+			// the body field must be a valid UTF-8 string
+			httpReq.RawBody = body
+		}
+	}
+
+	_, sourcePort := splitHostPort(stdr.RemoteAddr)
+	var destination string
+	var destinationPort uint32
+	if addr, ok := stdr.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		destination, destinationPort = splitHostPort(addr.String())
+	}
+
+	attrs := &authv3.AttributeContext{
+		Source:      newPeer(r.RealIP(), sourcePort),
+		Destination: newPeer(destination, destinationPort),
+		Request: &authv3.AttributeContext_Request{
+			Time: timestamppb.Now(),
+			Http: httpReq,
+		},
+		ContextExtensions: c.spec.ContextExtensions,
+	}
+
+	return &authv3.CheckRequest{Attributes: attrs}
+}
+
+func (c *authzClient) check(r *httpprot.Request, body []byte) (*authv3.CheckResponse, error) {
+	ctx := r.Context()
+	if c.timeout > 0 {
+		var cancel stdcontext.CancelFunc
+		ctx, cancel = stdcontext.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	return c.client.Check(ctx, c.newCheckRequest(r, body))
+}
+
+// deniedStatus maps the gRPC status code of a denied check to an HTTP
+// status code, it is used when the denied response has no status.
+func deniedStatus(code int32) int {
+	switch codes.Code(code) {
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusForbidden
+}
+
+// applyHeaderOption applies a header option, the default action is to
+// overwrite the header as Envoy does for the external authorization.
+func applyHeaderOption(h http.Header, opt *corev3.HeaderValueOption) {
+	hv := opt.GetHeader()
+	if hv.GetKey() == "" {
+		return
+	}
+	key, value := hv.GetKey(), hv.GetValue()
+	if len(hv.GetRawValue()) > 0 {
+		value = string(hv.GetRawValue())
+	}
+
+	if opt.GetAppend() != nil {
+		if opt.GetAppend().GetValue() {
+			h.Add(key, value)
+		} else {
+			h.Set(key, value)
+		}
+		return
+	}
+
+	_, exists := h[http.CanonicalHeaderKey(key)]
+	switch opt.GetAppendAction() {
+	case corev3.HeaderValueOption_ADD_IF_ABSENT:
+		if !exists {
+			h.Set(key, value)
+		}
+	case corev3.HeaderValueOption_OVERWRITE_IF_EXISTS:
+		if exists {
+			h.Set(key, value)
+		}
+	default:
+		h.Set(key, value)
+	}
+}
+
+func (rf *RemoteFilter) handleGRPC(ctx *context.Context) string {
+	r := ctx.GetInputRequest().(*httpprot.Request)
+	c := rf.authz
+
+	setStatus := func(code int) {
+		w, _ := httpprot.NewResponse(nil)
+		w.SetStatusCode(code)
+		ctx.SetOutputResponse(w)
+	}
+
+	var cacheKey string
+	var resp *authv3.CheckResponse
+	if c.cache != nil {
+		cacheKey = c.getCacheKey(r)
+		resp = c.getCache(cacheKey)
+	}
+
+	if resp == nil {
+		var body []byte
+		if bs := c.spec.WithRequestBody; bs != nil {
+			var err error
+			body, err = readBody(r, bs.MaxRequestBytes)
+			if err != nil {
+				ctx.AddTag(fmt.Sprintf("remoteFilterErr: read request body: %v", err))
+				setStatus(http.StatusBadRequest)
+				return resultFailed
+			}
+			if int64(len(body)) > bs.MaxRequestBytes {
+				if !bs.AllowPartialMessage {
+					setStatus(http.StatusRequestEntityTooLarge)
+					return resultFailed
+				}
+				body = body[:bs.MaxRequestBytes]
+			}
+		}
+
+		var err error
+		resp, err = c.check(r, body)
+		if err != nil {
+			ctx.AddTag(fmt.Sprintf("remoteFilterErr: check authorization: %v", err))
+			if c.spec.FailureModeAllow {
+				return ""
+			}
+			setStatus(c.statusOnError())
+			return resultFailed
+		}
+
+		if c.cache != nil {
+			c.putCache(cacheKey, resp)
+		}
+	}
+
+	if codes.Code(resp.GetStatus().GetCode()) != codes.OK {
+		code := deniedStatus(resp.GetStatus().GetCode())
+		w, _ := httpprot.NewResponse(nil)
+		if d := resp.GetDeniedResponse(); d != nil {
+			if status := int(d.GetStatus().GetCode()); status >= 200 && status < 600 {
+				code = status
+			}
+			for _, h := range d.GetHeaders() {
+				applyHeaderOption(w.Std().Header, h)
+			}
+			w.SetPayload([]byte(d.GetBody()))
+		}
+		w.SetStatusCode(code)
+		ctx.SetOutputResponse(w)
+		return resultDenied
+	}
+
+	ok := resp.GetOkResponse()
+	if ok == nil {
+		return ""
+	}
+
+	// the response doesn't exist yet when the filter runs, so the headers
+	// to add to the response are not supported.
+	if len(ok.GetResponseHeadersToAdd()) > 0 {
+		ctx.AddTag("remoteFilterErr: response_headers_to_add is not supported and is ignored")
+	}
+
+	for _, h := range ok.GetHeaders() {
+		applyHeaderOption(r.HTTPHeader(), h)
+	}
+	for _, key := range ok.GetHeadersToRemove() {
+		r.HTTPHeader().Del(key)
+	}
+
+	if len(ok.GetQueryParametersToSet()) > 0 || len(ok.GetQueryParametersToRemove()) > 0 {
+		query := r.URL().Query()
+		for _, q := range ok.GetQueryParametersToSet() {
+			query.Set(q.GetKey(), q.GetValue())
+		}
+		for _, key := range ok.GetQueryParametersToRemove() {
+			query.Del(key)
+		}
+		r.URL().RawQuery = query.Encode()
+	}
+
+	return ""
+}
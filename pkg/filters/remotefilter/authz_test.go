@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remotefilter
+
+import (
+	stdcontext "context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+)
+
+type mockAuthzServer struct {
+	authv3.UnimplementedAuthorizationServer
+	calls int32
+	last  atomic.Value
+}
+
+func (s *mockAuthzServer) Check(ctx stdcontext.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	atomic.AddInt32(&s.calls, 1)
+	s.last.Store(req)
+
+	h := req.GetAttributes().GetRequest().GetHttp()
+	if h.GetHeaders()["authorization"] != "Bearer alice" {
+		return &authv3.CheckResponse{
+			Status: &status.Status{Code: int32(codes.PermissionDenied)},
+			HttpResponse: &authv3.CheckResponse_DeniedResponse{
+				DeniedResponse: &authv3.DeniedHttpResponse{
+					Status: &typev3.HttpStatus{Code: typev3.StatusCode_Unauthorized},
+					Headers: []*corev3.HeaderValueOption{
+						{Header: &corev3.HeaderValue{Key: "www-authenticate", Value: "Bearer"}},
+					},
+					Body: "unauthorized",
+				},
+			},
+		}, nil
+	}
+
+	return &authv3.CheckResponse{
+		Status: &status.Status{Code: int32(codes.OK)},
+		HttpResponse: &authv3.CheckResponse_OkResponse{
+			OkResponse: &authv3.OkHttpResponse{
+				Headers: []*corev3.HeaderValueOption{
+					{
+						Header: &corev3.HeaderValue{Key: "x-user", Value: "alice"},
+						Append: wrapperspb.Bool(true),
+					},
+					{
+						Header:       &corev3.HeaderValue{Key: "x-raw", RawValue: []byte("raw")},
+						AppendAction: corev3.HeaderValueOption_ADD_IF_ABSENT,
+					},
+				},
+				HeadersToRemove:         []string{"authorization"},
+				QueryParametersToSet:    []*corev3.QueryParameter{{Key: "user", Value: "alice"}},
+				QueryParametersToRemove: []string{"token"},
+			},
+		},
+	}, nil
+}
+
+func startAuthzServer(t *testing.T) (*mockAuthzServer, string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	srv := &mockAuthzServer{}
+	s := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(s, srv)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return srv, lis.Addr().String()
+}
+
+func newAuthzContext(t *testing.T, body string, authorization string) *context.Context {
+	stdr, err := http.NewRequest(http.MethodPost, "http://example.com/orders?id=1&token=abc", http.NoBody)
+	assert.NoError(t, err)
+	stdr.RemoteAddr = "192.168.1.1:12345"
+	if authorization != "" {
+		stdr.Header.Set("Authorization", authorization)
+	}
+	stdr.Header.Set("X-Raw", "old")
+
+	req, err := httpprot.NewRequest(stdr)
+	assert.NoError(t, err)
+	req.SetPayload([]byte(body))
+
+	ctx := context.New(nil)
+	ctx.SetInputRequest(req)
+	return ctx
+}
+
+func TestHandleGRPC(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, addr := startAuthzServer(t)
+	spec := &GRPCSpec{
+		Address:           addr,
+		WithRequestBody:   &BodySpec{MaxRequestBytes: 5, AllowPartialMessage: true},
+		ContextExtensions: map[string]string{"service": "orders"},
+	}
+	c, err := newAuthzClient(spec, 0)
+	assert.NoError(err)
+	defer c.close()
+	rf := &RemoteFilter{authz: c}
+
+	// allowed
+	ctx := newAuthzContext(t, "hello world", "Bearer alice")
+	assert.Equal("", rf.Handle(ctx))
+
+	req := srv.last.Load().(*authv3.CheckRequest)
+	attrs := req.GetAttributes()
+	assert.Equal("192.168.1.1", attrs.GetSource().GetAddress().GetSocketAddress().GetAddress())
+	assert.Equal(uint32(12345), attrs.GetSource().GetAddress().GetSocketAddress().GetPortValue())
+	assert.Equal(map[string]string{"service": "orders"}, attrs.GetContextExtensions())
+	assert.NotNil(attrs.GetRequest().GetTime())
+	h := attrs.GetRequest().GetHttp()
+	assert.Equal("POST", h.GetMethod())
+	assert.Equal("/orders?id=1&token=abc", h.GetPath())
+	assert.Equal("example.com", h.GetHost())
+	assert.Equal("POST", h.GetHeaders()[":method"])
+	assert.Equal("hello", h.GetBody())
+
+	r := ctx.GetInputRequest().(*httpprot.Request)
+	assert.Equal("alice", r.HTTPHeader().Get("X-User"))
+	assert.Equal("old", r.HTTPHeader().Get("X-Raw"))
+	assert.Empty(r.HTTPHeader().Get("Authorization"))
+	assert.Equal("alice", r.URL().Query().Get("user"))
+	assert.Empty(r.URL().Query().Get("token"))
+	// the body is kept for the following filters.
+	assert.Equal("hello world", string(r.RawPayload()))
+
+	// denied
+	ctx = newAuthzContext(t, "", "Bearer bob")
+	assert.Equal(resultDenied, rf.Handle(ctx))
+	w := ctx.GetOutputResponse().(*httpprot.Response)
+	assert.Equal(http.StatusUnauthorized, w.StatusCode())
+	assert.Equal("Bearer", w.Std().Header.Get("WWW-Authenticate"))
+	assert.Equal("unauthorized", string(w.RawPayload()))
+
+	// the service is unavailable
+	c.close()
+	ctx = newAuthzContext(t, "", "Bearer alice")
+	assert.Equal(resultFailed, rf.Handle(ctx))
+	assert.Equal(http.StatusForbidden, ctx.GetOutputResponse().(*httpprot.Response).StatusCode())
+}
+
+func TestAuthzCache(t *testing.T) {
+	assert := assert.New(t)
+
+	// the cache key must include the credential of the request.
+	assert.Error((&CacheSpec{Key: []string{"method", "path"}, TTL: "1m"}).Validate())
+	assert.Error((&CacheSpec{Key: []string{"header:"}, TTL: "1m"}).Validate())
+	assert.NoError((&CacheSpec{Key: []string{"path", "header:Authorization"}, TTL: "1m"}).Validate())
+
+	srv, addr := startAuthzServer(t)
+	spec := &GRPCSpec{
+		Address: addr,
+		Cache:   &CacheSpec{Key: []string{"path", "header:Authorization"}, TTL: "1m"},
+	}
+	c, err := newAuthzClient(spec, 0)
+	assert.NoError(err)
+	defer c.close()
+	rf := &RemoteFilter{authz: c}
+
+	assert.Equal("", rf.Handle(newAuthzContext(t, "", "Bearer alice")))
+	assert.Equal("", rf.Handle(newAuthzContext(t, "", "Bearer alice")))
+	assert.Equal(int32(1), atomic.LoadInt32(&srv.calls))
+
+	// the result of a client is not used for other clients.
+	assert.Equal(resultDenied, rf.Handle(newAuthzContext(t, "", "Bearer bob")))
+	assert.Equal(int32(2), atomic.LoadInt32(&srv.calls))
+}
@@ -42,6 +42,10 @@ const (
 
 	resultFailed          = "failed"
 	resultResponseAlready = "responseAlready"
+	resultDenied          = "denied"
+
+	modeHTTP = "http"
+	modeGRPC = "grpc"
 
 	// 64KB
 	maxBodyBytes = 64 * 1024
@@ -52,7 +56,7 @@ const (
 var kind = &filters.Kind{
 	Name:        Kind,
 	Description: "RemoteFilter invokes remote apis.",
-	Results:     []string{resultFailed, resultResponseAlready},
+	Results:     []string{resultFailed, resultResponseAlready, resultDenied},
 	DefaultSpec: func() filters.Spec {
 		return &Spec{}
 	},
@@ -111,15 +115,19 @@ func (rf *RemoteFilter) Spec() filters.Spec {
 type (
 	// RemoteFilter is the filter making remote service acting like internal filter.
 	RemoteFilter struct {
-		spec *Spec
+		spec  *Spec
+		authz *authzClient
 	}
 
 	// Spec describes RemoteFilter.
 	Spec struct {
 		filters.BaseSpec `json:",inline"`
 
-		URL     string `json:"url" jsonschema:"required,format=uri"`
-		Timeout string `json:"timeout,omitempty" jsonschema:"format=duration"`
+		// Mode is http or grpc, default is http.
+		Mode    string    `json:"mode,omitempty" jsonschema:"enum=,enum=http,enum=grpc"`
+		URL     string    `json:"url,omitempty" jsonschema:"format=uri"`
+		GRPC    *GRPCSpec `json:"grpc,omitempty"`
+		Timeout string    `json:"timeout,omitempty" jsonschema:"format=duration"`
 
 		timeout time.Duration
 	}
@@ -154,6 +162,21 @@ type (
 	}
 )
 
+// Validate validates the spec.
+func (spec *Spec) Validate() error {
+	if spec.Mode == modeGRPC {
+		if spec.GRPC == nil {
+			return fmt.Errorf("grpc is required in grpc mode")
+		}
+		return nil
+	}
+
+	if spec.URL == "" {
+		return fmt.Errorf("url is required in http mode")
+	}
+	return nil
+}
+
 // Init initializes RemoteFilter.
 func (rf *RemoteFilter) Init() {
 	rf.reload()
@@ -172,6 +195,13 @@ func (rf *RemoteFilter) reload() {
 			logger.Errorf("BUG: parse duration %s failed: %v", rf.spec.Timeout, err)
 		}
 	}
+
+	if rf.spec.Mode == modeGRPC {
+		rf.authz, err = newAuthzClient(rf.spec.GRPC, rf.spec.timeout)
+		if err != nil {
+			panic(fmt.Errorf("create authorization client failed: %v", err))
+		}
+	}
 }
 
 func (rf *RemoteFilter) limitRead(reader io.Reader, n int64) []byte {
@@ -194,6 +224,10 @@ func (rf *RemoteFilter) limitRead(reader io.Reader, n int64) []byte {
 
 // Handle handles Context by calling remote service.
 func (rf *RemoteFilter) Handle(ctx *context.Context) (result string) {
+	if rf.authz != nil {
+		return rf.handleGRPC(ctx)
+	}
+
 	r := ctx.GetInputRequest().(*httpprot.Request)
 
 	var w *httpprot.Response
@@ -272,7 +306,11 @@ func (rf *RemoteFilter) Handle(ctx *context.Context) (result string) {
 func (rf *RemoteFilter) Status() interface{} { return nil }
 
 // Close closes RemoteFilter.
-func (rf *RemoteFilter) Close() {}
+func (rf *RemoteFilter) Close() {
+	if rf.authz != nil {
+		rf.authz.close()
+	}
+}
 
 func (rf *RemoteFilter) marshalHTTPContext(r *httpprot.Request, w *httpprot.Response, reqBody, respBody []byte) []byte {
 	ctxEntity := contextEntity{
@@ -0,0 +1,384 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package validator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/megaease/easegress/v2/pkg/cluster"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/supervisor"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+const (
+	// APIKeyDataKey is the key of the APIKey of a valid request in the
+	// context data.
+	APIKeyDataKey = "API_KEY"
+
+	apiKeyHashPrefix    = "sha256:"
+	defaultAPIKeyHeader = "X-API-Key"
+)
+
+// errAPIKeyForbidden means the API key is valid but not allowed to access
+// the request path.
+var errAPIKeyForbidden = errors.New("path is not allowed")
+
+type (
+	// APIKeyValidatorSpec defines the configuration of API key validator.
+	// There are 'FILE', 'ETCD' and 'CUSTOM_DATA' modes.
+	APIKeyValidatorSpec struct {
+		Mode string `json:"mode" jsonschema:"required,enum=FILE,enum=ETCD,enum=CUSTOM_DATA"`
+		// Required for 'FILE' mode.
+		// KeyFile is path to a YAML/JSON file containing an array of APIKeys.
+		KeyFile string `json:"keyFile,omitempty"`
+		// Required for 'ETCD' mode.
+		// APIKeys are stored under /custom-data/{etcdPrefix}/.
+		EtcdPrefix string `json:"etcdPrefix,omitempty"`
+		// Required for 'CUSTOM_DATA' mode.
+		// APIKeys are the custom data of this kind.
+		CustomDataKind string `json:"customDataKind,omitempty"`
+
+		// Header is the header to read the key from.
+		Header string `json:"header,omitempty"`
+		// Query is the query parameter to read the key from.
+		Query string `json:"query,omitempty"`
+		// PathRegexp is a regular expression whose first sub-match in the
+		// request path is the key.
+		PathRegexp string `json:"pathRegexp,omitempty" jsonschema:"format=regexp"`
+	}
+
+	// APIKey is an API key and its metadata, the key itself is not stored,
+	// but its SHA-256 hash in hex encoding, optionally prefixed by 'sha256:'.
+	APIKey struct {
+		Name      string            `json:"name" jsonschema:"required"`
+		Hash      string            `json:"hash" jsonschema:"required"`
+		Tenant    string            `json:"tenant,omitempty"`
+		Plan      string            `json:"plan,omitempty"`
+		Routes    []string          `json:"routes,omitempty"`
+		Metadata  map[string]string `json:"metadata,omitempty"`
+		ExpiresAt *time.Time        `json:"expiresAt,omitempty"`
+		Revoked   bool              `json:"revoked,omitempty"`
+	}
+
+	// APIKeyValidator defines the API key validator
+	APIKeyValidator struct {
+		spec       *APIKeyValidatorSpec
+		pathRegexp *regexp.Regexp
+
+		lock sync.RWMutex
+		keys map[string]*APIKey
+
+		stopCtx context.Context
+		cancel  context.CancelFunc
+	}
+)
+
+// Validate validates the spec of API key validator.
+func (spec *APIKeyValidatorSpec) Validate() error {
+	switch spec.Mode {
+	case "FILE":
+		if spec.KeyFile == "" {
+			return fmt.Errorf("keyFile is required in FILE mode")
+		}
+	case "ETCD":
+		if spec.EtcdPrefix == "" {
+			return fmt.Errorf("etcdPrefix is required in ETCD mode")
+		}
+	case "CUSTOM_DATA":
+		if spec.CustomDataKind == "" {
+			return fmt.Errorf("customDataKind is required in CUSTOM_DATA mode")
+		}
+	}
+
+	if spec.PathRegexp != "" {
+		re, err := regexp.Compile(spec.PathRegexp)
+		if err != nil {
+			return err
+		}
+		if re.NumSubexp() == 0 {
+			return fmt.Errorf("pathRegexp must have a sub-expression")
+		}
+	}
+	return nil
+}
+
+// HashAPIKey returns the hash of an API key.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewAPIKeyValidator creates a new API key validator
+func NewAPIKeyValidator(spec *APIKeyValidatorSpec, supervisor *supervisor.Supervisor) *APIKeyValidator {
+	v := &APIKeyValidator{spec: spec, keys: map[string]*APIKey{}}
+	v.stopCtx, v.cancel = context.WithCancel(context.Background())
+	if spec.PathRegexp != "" {
+		v.pathRegexp = regexp.MustCompile(spec.PathRegexp)
+	}
+
+	switch spec.Mode {
+	case "FILE":
+		v.loadFile()
+		go v.watchFile()
+	case "ETCD", "CUSTOM_DATA":
+		if supervisor == nil || supervisor.Cluster() == nil {
+			logger.Errorf("APIKey validator: failed to read data from etcd")
+			break
+		}
+		go v.watchEtcd(supervisor.Cluster())
+	}
+
+	return v
+}
+
+// setKeys replaces the API keys, the keys are indexed by their hash.
+func (v *APIKeyValidator) setKeys(keys []*APIKey) {
+	m := make(map[string]*APIKey, len(keys))
+	for _, k := range keys {
+		if k.Name == "" || k.Hash == "" {
+			logger.Errorf("APIKey validator: name and hash of API key are required")
+			continue
+		}
+		hash := strings.ToLower(strings.TrimPrefix(k.Hash, apiKeyHashPrefix))
+		m[hash] = k
+	}
+
+	v.lock.Lock()
+	v.keys = m
+	v.lock.Unlock()
+}
+
+func (v *APIKeyValidator) loadFile() {
+	data, err := os.ReadFile(v.spec.KeyFile)
+	if err != nil {
+		logger.Errorf("APIKey validator: read key file failed: %v", err)
+		return
+	}
+
+	var keys []*APIKey
+	if err = codectool.Unmarshal(data, &keys); err != nil {
+		logger.Errorf("APIKey validator: unmarshal key file failed: %v", err)
+		return
+	}
+	v.setKeys(keys)
+}
+
+func (v *APIKeyValidator) watchFile() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Errorf(err.Error())
+		return
+	}
+	defer watcher.Close()
+
+	if err = watcher.Add(v.spec.KeyFile); err != nil {
+		logger.Errorf(err.Error())
+	}
+
+	// reload periodically in case events are missed, e.g. the file is
+	// replaced instead of being modified.
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-v.stopCtx.Done():
+			return
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			v.loadFile()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Errorf(err.Error())
+		case <-ticker.C:
+			v.loadFile()
+		}
+	}
+}
+
+func (v *APIKeyValidator) etcdPrefix(c cluster.Cluster) string {
+	if v.spec.Mode == "ETCD" {
+		return customDataPrefix + strings.Trim(v.spec.EtcdPrefix, "/") + "/"
+	}
+	return c.Layout().CustomDataPrefix() + v.spec.CustomDataKind + "/"
+}
+
+func (v *APIKeyValidator) watchEtcd(c cluster.Cluster) {
+	prefix := v.etcdPrefix(c)
+
+	var (
+		syncer cluster.Syncer
+		err    error
+		ch     <-chan map[string]string
+	)
+
+	for {
+		syncer, err = c.Syncer(30 * time.Minute)
+		if err != nil {
+			logger.Errorf("failed to create syncer: %v", err)
+		} else if ch, err = syncer.SyncPrefix(prefix); err != nil {
+			logger.Errorf("failed to sync prefix: %v", err)
+			syncer.Close()
+		} else {
+			break
+		}
+
+		select {
+		case <-time.After(10 * time.Second):
+		case <-v.stopCtx.Done():
+			return
+		}
+	}
+	defer syncer.Close()
+
+	for {
+		select {
+		case <-v.stopCtx.Done():
+			return
+		case kvs := <-ch:
+			keys := make([]*APIKey, 0, len(kvs))
+			for k, value := range kvs {
+				key := &APIKey{}
+				if err := codectool.Unmarshal([]byte(value), key); err != nil {
+					logger.Errorf("APIKey validator: unmarshal %s failed: %v", k, err)
+					continue
+				}
+				keys = append(keys, key)
+			}
+			v.setKeys(keys)
+		}
+	}
+}
+
+func (v *APIKeyValidator) getKey(req *httpprot.Request) string {
+	if v.spec.Header != "" {
+		if key := req.HTTPHeader().Get(v.spec.Header); key != "" {
+			return key
+		}
+	}
+
+	if v.spec.Query != "" {
+		if key := req.URL().Query().Get(v.spec.Query); key != "" {
+			return key
+		}
+	}
+
+	if v.pathRegexp != nil {
+		if m := v.pathRegexp.FindStringSubmatch(req.Path()); len(m) > 1 {
+			return m[1]
+		}
+	}
+
+	if v.spec.Header == "" && v.spec.Query == "" && v.pathRegexp == nil {
+		return req.HTTPHeader().Get(defaultAPIKeyHeader)
+	}
+	return ""
+}
+
+// lookup looks up the API key by its hash, so the time of lookup reveals
+// nothing about the stored keys.
+func (v *APIKeyValidator) lookup(key string) *APIKey {
+	hash := HashAPIKey(key)
+
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	return v.keys[hash]
+}
+
+// allowPath returns whether the path matches one of the route prefixes.
+func (k *APIKey) allowPath(path string) bool {
+	if len(k.Routes) == 0 {
+		return true
+	}
+	for _, r := range k.Routes {
+		if hasPathPrefix(path, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPathPrefix returns whether the path is the prefix or under it, so
+// that prefix /api matches /api/v1 but not /api-admin.
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// Validate validates the API key of a http request, and returns the API key
+// if it is valid.
+func (v *APIKeyValidator) Validate(req *httpprot.Request) (*APIKey, error) {
+	key := v.getKey(req)
+	if key == "" {
+		return nil, fmt.Errorf("missing API key")
+	}
+
+	k := v.lookup(key)
+	if k == nil {
+		return nil, fmt.Errorf("invalid API key")
+	}
+	if k.Revoked {
+		return nil, fmt.Errorf("API key %s is revoked", k.Name)
+	}
+	if k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt) {
+		return nil, fmt.Errorf("API key %s is expired", k.Name)
+	}
+	if !k.allowPath(req.Path()) {
+		return nil, fmt.Errorf("API key %s: %w", k.Name, errAPIKeyForbidden)
+	}
+
+	// headers are removed if empty, so they could not be forged by clients.
+	h := req.HTTPHeader()
+	for name, value := range map[string]string{
+		"X-API-Key-Name":   k.Name,
+		"X-API-Key-Tenant": k.Tenant,
+		"X-API-Key-Plan":   k.Plan,
+	} {
+		if value == "" {
+			h.Del(name)
+		} else {
+			h.Set(name, value)
+		}
+	}
+	return k, nil
+}
+
+// Close closes the API key validator.
+func (v *APIKeyValidator) Close() {
+	v.cancel()
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package validator
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+const (
+	defaultJWKSRefreshInterval = 10 * time.Minute
+	defaultJWKSTimeout         = 10 * time.Second
+	// minJWKSRefreshInterval limits the refreshes caused by unknown key IDs.
+	minJWKSRefreshInterval = time.Minute
+)
+
+type (
+	// JWKSSpec defines the configuration of a JSON Web Key Set endpoint.
+	JWKSSpec struct {
+		URL                string `json:"url" jsonschema:"required,format=uri"`
+		RefreshInterval    string `json:"refreshInterval,omitempty" jsonschema:"format=duration"`
+		Timeout            string `json:"timeout,omitempty" jsonschema:"format=duration"`
+		InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+	}
+
+	// jwks fetches and caches the keys of a JSON Web Key Set endpoint.
+	jwks struct {
+		spec     *JWKSSpec
+		client   *http.Client
+		interval time.Duration
+		done     chan struct{}
+
+		lock sync.RWMutex
+		keys map[string]interface{}
+
+		refreshLock sync.Mutex
+		lastRefresh time.Time
+	}
+
+	jsonWebKey struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+		K   string `json:"k"`
+	}
+
+	jsonWebKeySet struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}
+)
+
+func newJWKS(spec *JWKSSpec) *jwks {
+	interval := defaultJWKSRefreshInterval
+	if spec.RefreshInterval != "" {
+		interval, _ = time.ParseDuration(spec.RefreshInterval)
+	}
+
+	timeout := defaultJWKSTimeout
+	if spec.Timeout != "" {
+		timeout, _ = time.ParseDuration(spec.Timeout)
+	}
+
+	j := &jwks{
+		spec:     spec,
+		interval: interval,
+		done:     make(chan struct{}),
+		keys:     map[string]interface{}{},
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: spec.InsecureSkipVerify,
+				},
+			},
+		},
+	}
+
+	go j.run()
+	return j
+}
+
+func (j *jwks) run() {
+	j.refresh(0)
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.done:
+			return
+		case <-ticker.C:
+			j.refresh(0)
+		}
+	}
+}
+
+// refresh fetches the keys if they were not refreshed in minInterval.
+func (j *jwks) refresh(minInterval time.Duration) {
+	j.refreshLock.Lock()
+	defer j.refreshLock.Unlock()
+
+	if time.Since(j.lastRefresh) < minInterval {
+		return
+	}
+	j.lastRefresh = time.Now()
+
+	keys, err := j.fetch()
+	if err != nil {
+		logger.Errorf("fetch JWKS from %s failed: %v", j.spec.URL, err)
+		return
+	}
+
+	j.lock.Lock()
+	j.keys = keys
+	j.lock.Unlock()
+}
+
+func (j *jwks) fetch() (map[string]interface{}, error) {
+	resp, err := j.client.Get(j.spec.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	set := jsonWebKeySet{}
+	if err = codectool.DecodeJSON(resp.Body, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]interface{}{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.parse()
+		if err != nil {
+			logger.Warnf("ignore key %q of JWKS %s: %v", jwk.Kid, j.spec.URL, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func (j *jwks) lookup(kid string) interface{} {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	if key, ok := j.keys[kid]; ok {
+		return key
+	}
+
+	// a token without key ID could only be verified by the only key.
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key
+		}
+	}
+
+	return nil
+}
+
+// key returns the key with the key ID, the keys are refreshed if not found
+// as the keys may be rotated.
+func (j *jwks) key(kid string) (interface{}, error) {
+	if key := j.lookup(kid); key != nil {
+		return key, nil
+	}
+
+	j.refresh(minJWKSRefreshInterval)
+	if key := j.lookup(kid); key != nil {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("key %q not found in JWKS", kid)
+}
+
+func (j *jwks) close() {
+	close(j.done)
+}
+
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func (jwk *jsonWebKey) parse() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBase64URL(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64URL(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", jwk.Crv)
+		}
+		x, err := decodeBase64URL(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64URL(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("invalid EC key")
+		}
+		return key, nil
+
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve: %s", jwk.Crv)
+		}
+		x, err := decodeBase64URL(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+
+	case "oct":
+		return decodeBase64URL(jwk.K)
+	}
+
+	return nil, fmt.Errorf("unsupported key type: %s", jwk.Kty)
+}
@@ -21,12 +21,26 @@ import (
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 
 	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+// errClaimRuleFailed means the token is valid but its claims do not satisfy
+// the claim rules.
+var errClaimRuleFailed = errors.New("claim rule failed")
+
+// Operators of claim rules.
+const (
+	ClaimOperatorExists   = "exists"
+	ClaimOperatorEquals   = "equals"
+	ClaimOperatorContains = "contains"
 )
 
 // JWTValidatorSpec defines the configuration of JWT validator
@@ -36,32 +50,130 @@ type JWTValidatorSpec struct {
 	PublicKey string `json:"publicKey" jsonschema:"pattern=^$|^[A-Fa-f0-9]+$"`
 	// Secret is in hex encoding
 	Secret string `json:"secret" jsonschema:"pattern=^$|^[A-Fa-f0-9]+$"`
+	// JWKS specifies an endpoint to get the keys, the key is selected by
+	// the 'kid' header of the token. PublicKey and Secret are ignored if
+	// it is not nil.
+	JWKS *JWKSSpec `json:"jwks,omitempty"`
 	// CookieName specifies the name of a cookie, if not empty, and the cookie with
 	// this name both exists and has a non-empty value, its value is used as token
 	// string, the Authorization header is used to get the token string otherwise.
 	CookieName string `json:"cookieName,omitempty"`
+	// Issuer is the required 'iss' claim if not empty.
+	Issuer string `json:"issuer,omitempty"`
+	// Audiences are the accepted audiences, the 'aud' claim must contain
+	// one of them if not empty.
+	Audiences []string `json:"audiences,omitempty"`
+	// Leeway is the allowed clock skew when verifying 'exp', 'nbf' and 'iat'.
+	Leeway string `json:"leeway,omitempty" jsonschema:"format=duration"`
+	// ClaimRules must all be satisfied by the claims of the token.
+	ClaimRules []*ClaimRule `json:"claimRules,omitempty"`
+	// ClaimsToHeaders sets the verified claims to request headers, the key
+	// is the claim and the value is the header.
+	ClaimsToHeaders map[string]string `json:"claimsToHeaders,omitempty"`
+}
+
+// ClaimRule defines a rule on a claim of the token, the claim could be a
+// path separated by '.' to select a nested claim.
+type ClaimRule struct {
+	Claim    string   `json:"claim" jsonschema:"required"`
+	Operator string   `json:"operator" jsonschema:"required,enum=exists,enum=equals,enum=contains"`
+	Values   []string `json:"values,omitempty"`
+}
+
+// Validate validates the spec of the JWT validator.
+func (spec *JWTValidatorSpec) Validate() error {
+	if spec.Leeway != "" {
+		if _, err := time.ParseDuration(spec.Leeway); err != nil {
+			return fmt.Errorf("invalid leeway: %v", err)
+		}
+	}
+
+	for _, r := range spec.ClaimRules {
+		switch r.Operator {
+		case ClaimOperatorExists:
+		case ClaimOperatorEquals, ClaimOperatorContains:
+			if len(r.Values) == 0 {
+				return fmt.Errorf("values of claim rule on %q are required", r.Claim)
+			}
+		default:
+			return fmt.Errorf("unknown operator %q of claim rule on %q", r.Operator, r.Claim)
+		}
+	}
+
+	return nil
 }
 
 // NewJWTValidator creates a new JWT validator
 func NewJWTValidator(spec *JWTValidatorSpec) *JWTValidator {
-	var key interface{}
+	v := &JWTValidator{spec: spec}
+
+	if spec.Leeway != "" {
+		v.leeway, _ = time.ParseDuration(spec.Leeway)
+	}
+
+	if spec.JWKS != nil {
+		v.jwks = newJWKS(spec.JWKS)
+		return v
+	}
+
 	if len(spec.PublicKey) > 0 {
 		publicKeyBytes, _ := hex.DecodeString(spec.PublicKey)
 		p, _ := pem.Decode(publicKeyBytes)
-		key, _ = x509.ParsePKIXPublicKey(p.Bytes)
+		v.key, _ = x509.ParsePKIXPublicKey(p.Bytes)
 	} else {
-		key, _ = hex.DecodeString(spec.Secret)
-	}
-	return &JWTValidator{
-		spec: spec,
-		key:  key,
+		v.key, _ = hex.DecodeString(spec.Secret)
 	}
+	return v
 }
 
 // JWTValidator defines the JWT validator
 type JWTValidator struct {
-	spec *JWTValidatorSpec
-	key  interface{}
+	spec   *JWTValidatorSpec
+	key    interface{}
+	jwks   *jwks
+	leeway time.Duration
+}
+
+func (v *JWTValidator) getKey(token *jwt.Token) (interface{}, error) {
+	if alg := token.Method.Alg(); alg != v.spec.Algorithm {
+		return nil, fmt.Errorf("unexpected signing method: %v", alg)
+	}
+	if v.jwks == nil {
+		return v.key, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	return v.jwks.key(kid)
+}
+
+// verifyClaims verifies the registered claims.
+func (v *JWTValidator) verifyClaims(claims jwt.MapClaims) error {
+	now := time.Now()
+	leeway := int64(v.leeway / time.Second)
+
+	if !claims.VerifyExpiresAt(now.Unix()-leeway, false) {
+		return fmt.Errorf("token is expired")
+	}
+	if !claims.VerifyNotBefore(now.Unix()+leeway, false) {
+		return fmt.Errorf("token is not valid yet")
+	}
+	if !claims.VerifyIssuedAt(now.Unix()+leeway, false) {
+		return fmt.Errorf("token used before issued")
+	}
+
+	if v.spec.Issuer != "" && !claims.VerifyIssuer(v.spec.Issuer, true) {
+		return fmt.Errorf("unexpected issuer: %v", claims["iss"])
+	}
+
+	if len(v.spec.Audiences) > 0 {
+		for _, aud := range v.spec.Audiences {
+			if claims.VerifyAudience(aud, true) {
+				return nil
+			}
+		}
+		return fmt.Errorf("unexpected audience: %v", claims["aud"])
+	}
+
+	return nil
 }
 
 // Validate validates the JWT token of a http request
@@ -82,18 +194,122 @@ func (v *JWTValidator) Validate(req *httpprot.Request) error {
 		}
 		token = authHdr[len(prefix):]
 	}
-	// jwt.Parse does everything including parsing and verification
-	t, e := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		if alg := token.Method.Alg(); alg != v.spec.Algorithm {
-			return nil, fmt.Errorf("unexpected signing method: %v", alg)
-		}
-		return v.key, nil
-	})
+
+	// the registered claims are verified by verifyClaims to support leeway.
+	parser := jwt.NewParser(jwt.WithJSONNumber(), jwt.WithoutClaimsValidation())
+	claims := jwt.MapClaims{}
+	t, e := parser.ParseWithClaims(token, claims, v.getKey)
 	if e != nil {
 		return e
 	}
 	if !t.Valid {
 		return fmt.Errorf("invalid jwt token")
 	}
+	if e = v.verifyClaims(claims); e != nil {
+		return e
+	}
+
+	for _, r := range v.spec.ClaimRules {
+		if !r.match(claims) {
+			return fmt.Errorf("%w: %s %s %v", errClaimRuleFailed, r.Claim, r.Operator, r.Values)
+		}
+	}
+
+	for claim, header := range v.spec.ClaimsToHeaders {
+		if value, ok := lookupClaim(claims, claim); ok {
+			req.HTTPHeader().Set(header, formatClaim(value))
+		} else {
+			// remove the header to prevent it from being forged by clients.
+			req.HTTPHeader().Del(header)
+		}
+	}
+
 	return nil
 }
+
+// Close closes the JWT validator.
+func (v *JWTValidator) Close() {
+	if v.jwks != nil {
+		v.jwks.close()
+	}
+}
+
+// lookupClaim returns the claim with the name, or the nested claim if the
+// name is a path separated by '.'.
+func lookupClaim(claims map[string]interface{}, name string) (interface{}, bool) {
+	if v, ok := claims[name]; ok {
+		return v, true
+	}
+
+	first, rest, found := strings.Cut(name, ".")
+	if !found {
+		return nil, false
+	}
+	m, ok := claims[first].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	return lookupClaim(m, rest)
+}
+
+// claimValues returns the values of a claim, a string claim is split by
+// spaces like the 'scope' claim.
+func claimValues(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+		return values
+	}
+	return []string{fmt.Sprint(claim)}
+}
+
+func formatClaim(claim interface{}) string {
+	switch v := claim.(type) {
+	case string:
+		return v
+	case []interface{}:
+		return strings.Join(claimValues(v), ",")
+	case map[string]interface{}:
+		return string(codectool.MustMarshalJSON(v))
+	}
+	return fmt.Sprint(claim)
+}
+
+func (r *ClaimRule) match(claims jwt.MapClaims) bool {
+	claim, ok := lookupClaim(claims, r.Claim)
+	if !ok {
+		return false
+	}
+
+	switch r.Operator {
+	case ClaimOperatorExists:
+		return true
+	case ClaimOperatorEquals:
+		s := fmt.Sprint(claim)
+		for _, v := range r.Values {
+			if v == s {
+				return true
+			}
+		}
+		return false
+	case ClaimOperatorContains:
+		values := claimValues(claim)
+	RuleLoop:
+		for _, v := range r.Values {
+			for _, cv := range values {
+				if cv == v {
+					continue RuleLoop
+				}
+			}
+			return false
+		}
+		return true
+	}
+
+	return false
+}
@@ -19,6 +19,7 @@
 package validator
 
 import (
+	"errors"
 	"net/http"
 
 	"fmt"
@@ -35,13 +36,14 @@ const (
 	// Kind is the kind of Validator.
 	Kind = "Validator"
 
-	resultInvalid = "invalid"
+	resultInvalid   = "invalid"
+	resultForbidden = "forbidden"
 )
 
 var kind = &filters.Kind{
 	Name:        Kind,
 	Description: "Validator validates HTTP request.",
-	Results:     []string{resultInvalid},
+	Results:     []string{resultInvalid, resultForbidden},
 	DefaultSpec: func() filters.Spec {
 		return &Spec{}
 	},
@@ -64,6 +66,7 @@ type (
 		signer    *signer.Signer
 		oauth2    *OAuth2Validator
 		basicAuth *BasicAuthValidator
+		apiKey    *APIKeyValidator
 	}
 
 	// Spec describes the Validator.
@@ -75,6 +78,7 @@ type (
 		Signature *signer.Spec              `json:"signature,omitempty"`
 		OAuth2    *OAuth2ValidatorSpec      `json:"oauth2,omitempty"`
 		BasicAuth *BasicAuthValidatorSpec   `json:"basicAuth,omitempty"`
+		APIKey    *APIKeyValidatorSpec      `json:"apiKey,omitempty"`
 	}
 )
 
@@ -127,6 +131,9 @@ func (v *Validator) reload() {
 	if v.spec.BasicAuth != nil {
 		v.basicAuth = NewBasicAuthValidator(v.spec.BasicAuth, v.spec.Super())
 	}
+	if v.spec.APIKey != nil {
+		v.apiKey = NewAPIKeyValidator(v.spec.APIKey, v.spec.Super())
+	}
 }
 
 // Handle validates the request in the context.
@@ -152,6 +159,10 @@ func (v *Validator) Handle(ctx *context.Context) string {
 	}
 	if v.jwt != nil {
 		if err := v.jwt.Validate(req); err != nil {
+			if errors.Is(err, errClaimRuleFailed) {
+				prepareErrorResponse(http.StatusForbidden, "JWT validator: ", err)
+				return resultForbidden
+			}
 			prepareErrorResponse(http.StatusUnauthorized, "JWT validator: ", err)
 			return resultInvalid
 		}
@@ -178,6 +189,18 @@ func (v *Validator) Handle(ctx *context.Context) string {
 			return resultInvalid
 		}
 	}
+	if v.apiKey != nil {
+		key, err := v.apiKey.Validate(req)
+		if errors.Is(err, errAPIKeyForbidden) {
+			prepareErrorResponse(http.StatusForbidden, "API key validator: ", err)
+			return resultForbidden
+		}
+		if err != nil {
+			prepareErrorResponse(http.StatusUnauthorized, "API key validator: ", err)
+			return resultInvalid
+		}
+		ctx.SetData(APIKeyDataKey, key)
+	}
 
 	return ""
 }
@@ -187,7 +210,13 @@ func (v *Validator) Status() interface{} { return nil }
 
 // Close closes validations.
 func (v *Validator) Close() {
+	if v.jwt != nil {
+		v.jwt.Close()
+	}
 	if v.basicAuth != nil {
 		v.basicAuth.Close()
 	}
+	if v.apiKey != nil {
+		v.apiKey.Close()
+	}
 }
@@ -18,15 +18,24 @@
 package validator
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math/big"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v4"
+
 	cluster "github.com/megaease/easegress/v2/pkg/cluster"
 	"github.com/megaease/easegress/v2/pkg/cluster/clustertest"
 	"github.com/megaease/easegress/v2/pkg/context"
@@ -243,6 +252,158 @@ jwt:
 	}
 }
 
+func TestJWTJWKS(t *testing.T) {
+	assert := assert.New(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwksJSON := codectool.MustMarshalJSON(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+			{"kty": "RSA", "kid": "enc1", "use": "enc", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+		},
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwksJSON)
+	}))
+	defer server.Close()
+
+	yamlConfig := fmt.Sprintf(`
+kind: Validator
+name: validator
+jwt:
+  algorithm: RS256
+  jwks:
+    url: %s
+  issuer: https://idp.example.com
+  audiences: [api1, api2]
+  leeway: 10s
+  claimRules:
+  - claim: scope
+    operator: contains
+    values: ["rpc:write"]
+  - claim: realm.role
+    operator: equals
+    values: [admin, operator]
+  claimsToHeaders:
+    sub: X-User
+    scope: X-Scope
+    realm.role: X-Role
+    email: X-Email
+`, server.URL)
+	v := createValidator(yamlConfig, nil, nil)
+	defer v.Close()
+
+	newClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":   "https://idp.example.com",
+			"aud":   []string{"api2"},
+			"sub":   "alice",
+			"exp":   time.Now().Add(-5 * time.Second).Unix(),
+			"scope": "rpc:read rpc:write",
+			"realm": map[string]interface{}{"role": "admin"},
+		}
+	}
+	sign := func(kid string, method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(method, claims)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		s, err := token.SignedString(key)
+		assert.Nil(err)
+		return s
+	}
+	handle := func(token string) (string, *http.Request) {
+		ctx := context.New(nil)
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-Email", "forged@example.com")
+		setRequest(t, ctx, req)
+		return v.Handle(ctx), req
+	}
+
+	result, req := handle(sign("rsa1", jwt.SigningMethodRS256, rsaKey, newClaims()))
+	assert.Equal("", result)
+	assert.Equal("alice", req.Header.Get("X-User"))
+	assert.Equal("rpc:read rpc:write", req.Header.Get("X-Scope"))
+	assert.Equal("admin", req.Header.Get("X-Role"))
+	assert.Equal("", req.Header.Get("X-Email"))
+
+	// unknown key, key for encryption and unexpected algorithm.
+	result, _ = handle(sign("rsa2", jwt.SigningMethodRS256, rsaKey, newClaims()))
+	assert.Equal(resultInvalid, result)
+	result, _ = handle(sign("enc1", jwt.SigningMethodRS256, rsaKey, newClaims()))
+	assert.Equal(resultInvalid, result)
+	result, _ = handle(sign("ec1", jwt.SigningMethodES256, ecKey, newClaims()))
+	assert.Equal(resultInvalid, result)
+
+	claims := newClaims()
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	result, _ = handle(sign("rsa1", jwt.SigningMethodRS256, rsaKey, claims))
+	assert.Equal(resultInvalid, result)
+
+	claims = newClaims()
+	claims["iss"] = "https://other.example.com"
+	result, _ = handle(sign("rsa1", jwt.SigningMethodRS256, rsaKey, claims))
+	assert.Equal(resultInvalid, result)
+
+	claims = newClaims()
+	claims["aud"] = "api3"
+	result, _ = handle(sign("rsa1", jwt.SigningMethodRS256, rsaKey, claims))
+	assert.Equal(resultInvalid, result)
+
+	claims = newClaims()
+	claims["scope"] = "rpc:read"
+	result, _ = handle(sign("rsa1", jwt.SigningMethodRS256, rsaKey, claims))
+	assert.Equal(resultForbidden, result)
+
+	claims = newClaims()
+	claims["realm"] = map[string]interface{}{"role": "guest"}
+	result, _ = handle(sign("rsa1", jwt.SigningMethodRS256, rsaKey, claims))
+	assert.Equal(resultForbidden, result)
+
+	// key of other algorithms.
+	yamlConfig = strings.Replace(yamlConfig, "RS256", "ES256", 1)
+	v = createValidator(yamlConfig, v, nil)
+	defer v.Close()
+	result, _ = handle(sign("ec1", jwt.SigningMethodES256, ecKey, newClaims()))
+	assert.Equal("", result)
+}
+
+func TestJWTValidatorSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, cfg := range []string{
+		"leeway: abc",
+		"claimRules: [{claim: scope, operator: contains}]",
+		"claimRules: [{claim: scope, operator: unknown, values: [a]}]",
+	} {
+		rawSpec := make(map[string]interface{})
+		codectool.MustUnmarshal([]byte("kind: Validator\nname: validator\njwt:\n  algorithm: HS256\n  secret: \"31\"\n  "+cfg), &rawSpec)
+		_, err := filters.NewSpec(nil, "", rawSpec)
+		assert.Error(err, cfg)
+	}
+
+	claims := map[string]interface{}{
+		"roles": []interface{}{"a", "b"},
+		"n":     json.Number("1700000000"),
+		"obj":   map[string]interface{}{"k": "v"},
+	}
+	assert.Equal("a,b", formatClaim(claims["roles"]))
+	assert.Equal("1700000000", formatClaim(claims["n"]))
+	assert.Equal(`{"k":"v"}`, formatClaim(claims["obj"]))
+	_, ok := lookupClaim(claims, "obj.x")
+	assert.False(ok)
+	assert.True((&ClaimRule{Claim: "roles", Operator: ClaimOperatorContains, Values: []string{"b", "a"}}).match(claims))
+	assert.False((&ClaimRule{Claim: "roles", Operator: ClaimOperatorContains, Values: []string{"c"}}).match(claims))
+	assert.True((&ClaimRule{Claim: "obj.k", Operator: ClaimOperatorExists}).match(claims))
+}
+
 func TestOAuth2JWT(t *testing.T) {
 	assert := assert.New(t)
 
@@ -615,3 +776,160 @@ basicAuth:
 		v.Close()
 	})
 }
+
+func TestAPIKey(t *testing.T) {
+	assert := assert.New(t)
+
+	expired := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	keys := fmt.Sprintf(`
+- name: key1
+  hash: sha256:%s
+  tenant: megaease
+  plan: gold
+  metadata:
+    region: us
+- name: key2
+  hash: %s
+  routes: [/public/, /keys/]
+- name: key3
+  hash: %s
+  expiresAt: %s
+- name: key4
+  hash: %s
+  revoked: true
+- name: key5
+  hash: %s
+  routes: [/api]
+`, HashAPIKey("secret1"), HashAPIKey("secret2"), HashAPIKey("secret3"), expired, HashAPIKey("secret4"), HashAPIKey("secret5"))
+
+	keyFile, err := os.CreateTemp("", "apikeys")
+	assert.Nil(err)
+	defer os.Remove(keyFile.Name())
+	keyFile.WriteString(keys)
+	keyFile.Close()
+
+	yamlConfig := fmt.Sprintf(`
+kind: Validator
+name: validator
+apiKey:
+  mode: FILE
+  keyFile: %s
+  query: apikey
+  pathRegexp: ^/keys/([^/]+)/
+`, keyFile.Name())
+	v := createValidator(yamlConfig, nil, nil)
+	defer v.Close()
+
+	handle := func(url string, header string) (string, *context.Context) {
+		ctx := context.New(nil)
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		assert.Nil(err)
+		if header != "" {
+			req.Header.Set("X-API-Key", header)
+		}
+		req.Header.Set("X-API-Key-Plan", "forged")
+		setRequest(t, ctx, req)
+		return v.Handle(ctx), ctx
+	}
+
+	result, ctx := handle("http://example.com/api?apikey=secret1", "")
+	assert.Equal("", result)
+	key := ctx.GetData(APIKeyDataKey).(*APIKey)
+	assert.Equal("key1", key.Name)
+	assert.Equal("us", key.Metadata["region"])
+	req := ctx.GetInputRequest().(*httpprot.Request)
+	assert.Equal("megaease", req.HTTPHeader().Get("X-API-Key-Tenant"))
+	assert.Equal("gold", req.HTTPHeader().Get("X-API-Key-Plan"))
+
+	result, ctx = handle("http://example.com/keys/secret2/public/a", "")
+	assert.Equal("", result)
+	req = ctx.GetInputRequest().(*httpprot.Request)
+	assert.Equal("key2", req.HTTPHeader().Get("X-API-Key-Name"))
+	assert.Equal("", req.HTTPHeader().Get("X-API-Key-Plan"))
+
+	// header is not used as query and pathRegexp are specified.
+	result, _ = handle("http://example.com/api", "secret1")
+	assert.Equal(resultInvalid, result)
+
+	result, _ = handle("http://example.com/private?apikey=secret2", "")
+	assert.Equal(resultForbidden, result)
+
+	// routes match path segments.
+	for _, path := range []string{"/api", "/api/", "/api/v1"} {
+		result, _ = handle("http://example.com"+path+"?apikey=secret5", "")
+		assert.Equal("", result, path)
+	}
+	for _, path := range []string{"/api-admin", "/apiv2", "/ap"} {
+		result, _ = handle("http://example.com"+path+"?apikey=secret5", "")
+		assert.Equal(resultForbidden, result, path)
+	}
+	result, _ = handle("http://example.com/api?apikey=secret3", "")
+	assert.Equal(resultInvalid, result)
+	result, _ = handle("http://example.com/api?apikey=secret4", "")
+	assert.Equal(resultInvalid, result)
+	result, _ = handle("http://example.com/api?apikey=unknown", "")
+	assert.Equal(resultInvalid, result)
+
+	// revoke key1 without reload.
+	keys = strings.Replace(keys, "plan: gold", "plan: gold\n  revoked: true", 1)
+	assert.Nil(os.WriteFile(keyFile.Name(), []byte(keys), 0o644))
+	v.apiKey.loadFile()
+	result, _ = handle("http://example.com/api?apikey=secret1", "")
+	assert.Equal(resultInvalid, result)
+
+	// the default header.
+	v.apiKey.spec.Query = ""
+	v.apiKey.pathRegexp = nil
+	result, _ = handle("http://example.com/api", "secret2")
+	assert.Equal(resultForbidden, result)
+}
+
+func TestAPIKeyEtcd(t *testing.T) {
+	assert := assert.New(t)
+
+	clusterInstance, syncerChannel := createClusterAndSyncer()
+	supervisor := supervisor.NewMock(nil, clusterInstance, nil, nil, false, nil, nil)
+
+	yamlConfig := `
+kind: Validator
+name: validator
+apiKey:
+  mode: ETCD
+  etcdPrefix: /apikeys/
+`
+	v := createValidator(yamlConfig, nil, supervisor)
+	defer v.Close()
+	assert.Equal("/custom-data/apikeys/", v.apiKey.etcdPrefix(clusterInstance))
+
+	syncerChannel <- map[string]string{
+		"/custom-data/apikeys/key1": "name: key1\nhash: " + HashAPIKey("secret1"),
+		"/custom-data/apikeys/bad":  "name: bad",
+	}
+
+	handle := func(key string) string {
+		ctx := context.New(nil)
+		req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		assert.Nil(err)
+		req.Header.Set("X-API-Key", key)
+		setRequest(t, ctx, req)
+		return v.Handle(ctx)
+	}
+
+	assert.Eventually(func() bool { return handle("secret1") == "" }, time.Second, 10*time.Millisecond)
+	assert.Equal(resultInvalid, handle("secret2"))
+
+	syncerChannel <- map[string]string{}
+	assert.Eventually(func() bool { return handle("secret1") == resultInvalid }, time.Second, 10*time.Millisecond)
+
+	for _, cfg := range []string{
+		"{mode: FILE}",
+		"{mode: ETCD}",
+		"{mode: CUSTOM_DATA}",
+		"{mode: FILE, keyFile: a, pathRegexp: ^/keys/}",
+	} {
+		rawSpec := make(map[string]interface{})
+		codectool.MustUnmarshal([]byte("kind: Validator\nname: validator\napiKey: "+cfg), &rawSpec)
+		_, err := filters.NewSpec(nil, "", rawSpec)
+		assert.Error(err, cfg)
+	}
+}
@@ -0,0 +1,595 @@
+//go:build wasmhost
+// +build wasmhost
+
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package wasmhost
+
+import (
+	stdcontext "context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+)
+
+const (
+	// ABIEasegress is the native ABI of WasmHost, which is the default.
+	ABIEasegress = "easegress"
+	// ABIProxyWasm is the Proxy-Wasm ABI (0.2.x).
+	ABIProxyWasm = "proxy-wasm"
+
+	proxyWasmPhaseRequest  = "request"
+	proxyWasmPhaseResponse = "response"
+
+	proxyWasmRootContextID int32 = 1
+)
+
+// status codes defined by the Proxy-Wasm ABI
+const (
+	pwStatusOk                  int32 = 0
+	pwStatusNotFound            int32 = 1
+	pwStatusBadArgument         int32 = 2
+	pwStatusSerializationFailed int32 = 3
+	pwStatusInvalidMemoryAccess int32 = 6
+	pwStatusCasMismatch         int32 = 8
+	pwStatusUnimplemented       int32 = 12
+)
+
+// map types defined by the Proxy-Wasm ABI
+const (
+	pwMapRequestHeaders int32 = iota
+	pwMapRequestTrailers
+	pwMapResponseHeaders
+	pwMapResponseTrailers
+	pwMapGrpcInitialMetadata
+	pwMapGrpcTrailingMetadata
+	pwMapHTTPCallResponseHeaders
+	pwMapHTTPCallResponseTrailers
+)
+
+// buffer types defined by the Proxy-Wasm ABI
+const (
+	pwBufferRequestBody int32 = iota
+	pwBufferResponseBody
+	pwBufferDownstreamData
+	pwBufferUpstreamData
+	pwBufferHTTPCallResponseBody
+	pwBufferGrpcReceiveBuffer
+	pwBufferVMConfiguration
+	pwBufferPluginConfiguration
+	pwBufferCallData
+)
+
+// metric types defined by the Proxy-Wasm ABI
+const (
+	pwMetricCounter int32 = iota
+	pwMetricGauge
+	pwMetricHistogram
+)
+
+// exported functions which indicate the ABI version of a Proxy-Wasm module
+var proxyWasmABIVersions = []string{
+	"proxy_abi_version_0_2_1",
+	"proxy_abi_version_0_2_0",
+	"proxy_abi_version_0_1_0",
+}
+
+// callbacks which may be exported by a Proxy-Wasm module
+var proxyWasmCallbacks = []string{
+	"proxy_on_context_create",
+	"proxy_on_vm_start",
+	"proxy_on_configure",
+	"proxy_on_tick",
+	"proxy_on_request_headers",
+	"proxy_on_request_body",
+	"proxy_on_request_trailers",
+	"proxy_on_response_headers",
+	"proxy_on_response_body",
+	"proxy_on_response_trailers",
+	"proxy_on_http_call_response",
+	"proxy_on_done",
+	"proxy_on_log",
+	"proxy_on_delete",
+}
+
+type (
+	// ProxyWasmSpec is the spec of the Proxy-Wasm ABI mode
+	ProxyWasmSpec struct {
+		RootID          string            `json:"rootID,omitempty"`
+		VMID            string            `json:"vmID,omitempty"`
+		Configuration   string            `json:"configuration,omitempty"`
+		VMConfiguration string            `json:"vmConfiguration,omitempty"`
+		Phase           string            `json:"phase,omitempty" jsonschema:"enum=,enum=request,enum=response"`
+		Clusters        map[string]string `json:"clusters,omitempty"`
+	}
+
+	// proxyWasmState is the Proxy-Wasm specific state of a wasm VM
+	proxyWasmState struct {
+		fns           map[string]*wasmtime.Func
+		fnMalloc      *wasmtime.Func
+		nextContextID int32
+		tickPeriod    time.Duration
+		lastTick      time.Time
+
+		// below fields are reset for every request
+		contextID       int32
+		phase           string
+		requestReadOnly bool
+		localResponse   bool
+		properties      map[string][]byte
+		nextToken       uint32
+		callouts        []*proxyWasmCallout
+		calloutResp     *proxyWasmCalloutResponse
+	}
+
+	// proxyWasmCallout is an HTTP callout issued by proxy_http_call
+	proxyWasmCallout struct {
+		token   uint32
+		req     *http.Request
+		timeout time.Duration
+	}
+
+	// proxyWasmCalloutResponse is the response of an HTTP callout
+	proxyWasmCalloutResponse struct {
+		statusCode int
+		header     http.Header
+		trailer    http.Header
+		body       []byte
+	}
+
+	proxyWasmSharedEntry struct {
+		value []byte
+		cas   uint32
+	}
+
+	proxyWasmMetric struct {
+		name  string
+		typ   int32
+		value int64
+		count int64
+	}
+
+	// proxyWasmMetrics holds the metrics defined by the Proxy-Wasm module,
+	// it is shared by all VMs of a WasmHost
+	proxyWasmMetrics struct {
+		lock    sync.RWMutex
+		ids     map[string]int32
+		metrics []*proxyWasmMetric
+	}
+
+	// MetricStatus is the status of a metric defined by a Proxy-Wasm module
+	MetricStatus struct {
+		Type  string `json:"type"`
+		Value int64  `json:"value"`
+		Count int64  `json:"count,omitempty"`
+	}
+)
+
+// shared data of Proxy-Wasm modules, it is partitioned by VM ID and is
+// shared by all WasmHost filters with the same VM ID in this process.
+var proxyWasmSharedData = struct {
+	sync.Mutex
+	vms map[string]map[string]*proxyWasmSharedEntry
+}{vms: map[string]map[string]*proxyWasmSharedEntry{}}
+
+// Validate validates ProxyWasmSpec.
+func (spec *ProxyWasmSpec) Validate() error {
+	for name, cluster := range spec.Clusters {
+		u, e := url.Parse(cluster)
+		if e != nil {
+			return fmt.Errorf("invalid url of cluster %q: %v", name, e)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid url of cluster %q: scheme must be http or https", name)
+		}
+	}
+	return nil
+}
+
+func getProxyWasmSharedData(vmID, key string) ([]byte, uint32, bool) {
+	proxyWasmSharedData.Lock()
+	defer proxyWasmSharedData.Unlock()
+
+	entry := proxyWasmSharedData.vms[vmID][key]
+	if entry == nil {
+		return nil, 0, false
+	}
+	return entry.value, entry.cas, true
+}
+
+func setProxyWasmSharedData(vmID, key string, value []byte, cas uint32) int32 {
+	proxyWasmSharedData.Lock()
+	defer proxyWasmSharedData.Unlock()
+
+	data := proxyWasmSharedData.vms[vmID]
+	if data == nil {
+		data = map[string]*proxyWasmSharedEntry{}
+		proxyWasmSharedData.vms[vmID] = data
+	}
+
+	entry := data[key]
+	if entry == nil {
+		entry = &proxyWasmSharedEntry{}
+		data[key] = entry
+	} else if cas != 0 && cas != entry.cas {
+		return pwStatusCasMismatch
+	}
+
+	entry.value = value
+	entry.cas++
+	return pwStatusOk
+}
+
+func newProxyWasmMetrics() *proxyWasmMetrics {
+	return &proxyWasmMetrics{ids: map[string]int32{}}
+}
+
+func (m *proxyWasmMetrics) define(typ int32, name string) int32 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if id, ok := m.ids[name]; ok {
+		return id
+	}
+
+	id := int32(len(m.metrics))
+	m.metrics = append(m.metrics, &proxyWasmMetric{name: name, typ: typ})
+	m.ids[name] = id
+	return id
+}
+
+func (m *proxyWasmMetrics) get(id int32) *proxyWasmMetric {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if id < 0 || int(id) >= len(m.metrics) {
+		return nil
+	}
+	return m.metrics[id]
+}
+
+func (m *proxyWasmMetrics) status() map[string]*MetricStatus {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if len(m.metrics) == 0 {
+		return nil
+	}
+
+	result := make(map[string]*MetricStatus, len(m.metrics))
+	for _, metric := range m.metrics {
+		s := &MetricStatus{Value: atomic.LoadInt64(&metric.value)}
+		switch metric.typ {
+		case pwMetricCounter:
+			s.Type = "counter"
+		case pwMetricGauge:
+			s.Type = "gauge"
+		case pwMetricHistogram:
+			s.Type = "histogram"
+			s.Count = atomic.LoadInt64(&metric.count)
+		}
+		result[metric.name] = s
+	}
+	return result
+}
+
+func (c *proxyWasmCallout) do(parent stdcontext.Context) *proxyWasmCalloutResponse {
+	ctx, cancel := stdcontext.WithTimeout(parent, c.timeout)
+	defer cancel()
+
+	resp, e := http.DefaultClient.Do(c.req.WithContext(ctx))
+	if e != nil {
+		logger.Warnf("proxy-wasm http callout to %s failed: %v", c.req.URL, e)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	body, e := io.ReadAll(resp.Body)
+	if e != nil {
+		logger.Warnf("proxy-wasm http callout to %s failed: %v", c.req.URL, e)
+		return nil
+	}
+
+	return &proxyWasmCalloutResponse{
+		statusCode: resp.StatusCode,
+		header:     resp.Header,
+		trailer:    resp.Trailer,
+		body:       body,
+	}
+}
+
+func newProxyWasmVM(host *WasmHost, engine *wasmtime.Engine, module *wasmtime.Module) (*WasmVM, error) {
+	store := wasmtime.NewStore(engine)
+	store.SetEpochDeadline(1)
+	store.SetWasi(wasmtime.NewWasiConfig())
+	vm := &WasmVM{host: host, store: store, pw: &proxyWasmState{}}
+
+	linker := wasmtime.NewLinker(engine)
+	vm.importProxyWasmFuncs(linker)
+
+	e := linker.DefineWasi()
+	if e != nil {
+		return nil, e
+	}
+
+	inst, e := linker.Instantiate(store, module)
+	if e != nil {
+		return nil, e
+	}
+	vm.inst = inst
+
+	if e = vm.startProxyWasm(); e != nil {
+		return nil, e
+	}
+
+	return vm, nil
+}
+
+func (vm *WasmVM) exportProxyWasmFuncs() error {
+	found := false
+	for _, name := range proxyWasmABIVersions {
+		if vm.inst.GetExport(vm.store, name) != nil {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("wasm code is not a Proxy-Wasm module, it hasn't export an ABI version function")
+	}
+
+	if vm.inst.GetExport(vm.store, wasmMemory) == nil {
+		return fmt.Errorf("wasm code hasn't export memory")
+	}
+
+	for _, name := range []string{"proxy_on_memory_allocate", "malloc"} {
+		if extern := vm.inst.GetExport(vm.store, name); extern != nil {
+			vm.pw.fnMalloc = extern.Func()
+			break
+		}
+	}
+	if vm.pw.fnMalloc == nil {
+		return fmt.Errorf("wasm code hasn't export function 'proxy_on_memory_allocate'")
+	}
+
+	vm.pw.fns = map[string]*wasmtime.Func{}
+	for _, name := range proxyWasmCallbacks {
+		if extern := vm.inst.GetExport(vm.store, name); extern != nil {
+			if fn := extern.Func(); fn != nil {
+				vm.pw.fns[name] = fn
+			}
+		}
+	}
+
+	return nil
+}
+
+// startProxyWasm runs the start function of the module, creates the root
+// context and delivers the VM and plugin configurations to it.
+func (vm *WasmVM) startProxyWasm() (err error) {
+	if err = vm.exportProxyWasmFuncs(); err != nil {
+		return err
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	for _, name := range []string{"_initialize", "_start"} {
+		extern := vm.inst.GetExport(vm.store, name)
+		if extern == nil || extern.Func() == nil {
+			continue
+		}
+		// calling proc_exit in the start function of a WASI command traps
+		// even if the exit status is 0, so modules should be built as WASI
+		// reactors, or return from main instead of exiting.
+		if _, e := extern.Func().Call(vm.store); e != nil {
+			return e
+		}
+		break
+	}
+
+	spec := vm.host.spec.ProxyWasm
+	vm.pwCall("proxy_on_context_create", proxyWasmRootContextID, int32(0))
+	if !vm.pwCallBool("proxy_on_vm_start", proxyWasmRootContextID, int32(len(spec.VMConfiguration))) {
+		return fmt.Errorf("proxy_on_vm_start failed")
+	}
+	if !vm.pwCallBool("proxy_on_configure", proxyWasmRootContextID, int32(len(spec.Configuration))) {
+		return fmt.Errorf("proxy_on_configure failed, the plugin configuration is rejected")
+	}
+
+	vm.pw.nextContextID = proxyWasmRootContextID
+	vm.pw.lastTick = time.Now()
+	return nil
+}
+
+// pwCall calls a callback exported by the module, it returns 0 if the
+// module hasn't export the callback.
+func (vm *WasmVM) pwCall(name string, args ...interface{}) int32 {
+	fn := vm.pw.fns[name]
+	if fn == nil {
+		return 0
+	}
+
+	r, e := fn.Call(vm.store, args...)
+	if e != nil {
+		panic(e)
+	}
+	if n, ok := r.(int32); ok {
+		return n
+	}
+	return 0
+}
+
+// pwCallBool calls a callback which returns a boolean, it returns true if
+// the module hasn't export the callback.
+func (vm *WasmVM) pwCallBool(name string, args ...interface{}) bool {
+	if vm.pw.fns[name] == nil {
+		return true
+	}
+	return vm.pwCall(name, args...) != 0
+}
+
+// pwDispatch calls a callback and then performs the HTTP callouts issued by
+// the module, the responses of the callouts are delivered to the module by
+// proxy_on_http_call_response, which may issue more callouts.
+func (vm *WasmVM) pwDispatch(name string, args ...interface{}) {
+	pw := vm.pw
+	pw.callouts = nil
+	vm.pwCall(name, args...)
+
+	parent := stdcontext.Background()
+	if vm.ctx != nil {
+		parent = vm.ctx.GetInputRequest().(*httpprot.Request).Context()
+	}
+
+	for len(pw.callouts) > 0 && !pw.localResponse {
+		callouts := pw.callouts
+		pw.callouts = nil
+
+		resps := make([]*proxyWasmCalloutResponse, len(callouts))
+		var wg sync.WaitGroup
+		for i, c := range callouts {
+			wg.Add(1)
+			go func(i int, c *proxyWasmCallout) {
+				defer wg.Done()
+				resps[i] = c.do(parent)
+			}(i, c)
+		}
+		wg.Wait()
+
+		for i, c := range callouts {
+			var numHeaders, bodySize, numTrailers int32
+			if resp := resps[i]; resp != nil {
+				numHeaders = int32(len(resp.header) + 1) // +1 for ':status'
+				bodySize = int32(len(resp.body))
+				numTrailers = int32(len(resp.trailer))
+			}
+			pw.calloutResp = resps[i]
+			vm.pwCall("proxy_on_http_call_response", pw.contextID, int32(c.token), numHeaders, bodySize, numTrailers)
+			pw.calloutResp = nil
+		}
+	}
+}
+
+func (vm *WasmVM) pwTick() {
+	pw := vm.pw
+	if pw.tickPeriod <= 0 || time.Since(pw.lastTick) < pw.tickPeriod {
+		return
+	}
+	pw.lastTick = time.Now()
+	pw.contextID = proxyWasmRootContextID
+	vm.pwDispatch("proxy_on_tick", proxyWasmRootContextID)
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// runProxyWasm creates an HTTP context for the request, and calls the HTTP
+// callbacks of the phase.
+func (vm *WasmVM) runProxyWasm() string {
+	pw := vm.pw
+	spec := vm.host.spec.ProxyWasm
+
+	pw.phase = spec.Phase
+	if pw.phase == "" {
+		pw.phase = proxyWasmPhaseRequest
+	}
+	pw.localResponse = false
+	pw.properties = nil
+	pw.nextToken = 0
+
+	// ticks are delivered lazily, before the next request processed by the VM
+	vm.pwTick()
+
+	pw.nextContextID++
+	id := pw.nextContextID
+	pw.contextID = id
+	vm.pwCall("proxy_on_context_create", id, proxyWasmRootContextID)
+
+	// the request callbacks are also called in the response phase, so that
+	// the module could collect information from the request, but changes
+	// to the request are ignored.
+	pw.requestReadOnly = pw.phase == proxyWasmPhaseResponse
+	req := vm.ctx.GetOutputRequest().(*httpprot.Request)
+	vm.pwRunStream("request", req.HTTPHeader(), req.Std().Trailer, req.IsStream(), req.PayloadSize())
+
+	if !pw.localResponse && pw.phase == proxyWasmPhaseResponse {
+		pw.requestReadOnly = false
+		resp := vm.ctx.GetOutputResponse().(*httpprot.Response)
+		vm.pwRunStream("response", resp.HTTPHeader(), resp.Std().Trailer, resp.IsStream(), resp.PayloadSize())
+	}
+
+	pw.contextID = id
+	vm.pwCall("proxy_on_done", id)
+	vm.pwCall("proxy_on_log", id)
+	vm.pwCall("proxy_on_delete", id)
+
+	if pw.localResponse {
+		return resultLocalResponse
+	}
+	return ""
+}
+
+// pwRunStream calls the header, body and trailer callbacks of the request
+// or response stream, the body callback is skipped if the body is a stream.
+func (vm *WasmVM) pwRunStream(stream string, header, trailer http.Header, isStream bool, payloadSize int64) {
+	pw := vm.pw
+
+	bodySize := int64(0)
+	if !isStream {
+		bodySize = payloadSize
+	}
+
+	numHeaders := int32(len(header))
+	if stream == "request" {
+		numHeaders += 4 // :method, :path, :authority and :scheme
+	} else {
+		numHeaders++ // :status
+	}
+	endOfStream := bodySize == 0 && len(trailer) == 0 && !isStream
+
+	vm.pwDispatch("proxy_on_"+stream+"_headers", pw.contextID, numHeaders, boolToInt32(endOfStream))
+	if pw.localResponse {
+		return
+	}
+
+	if bodySize > 0 {
+		vm.pwDispatch("proxy_on_"+stream+"_body", pw.contextID, int32(bodySize), boolToInt32(len(trailer) == 0))
+		if pw.localResponse {
+			return
+		}
+	}
+
+	if len(trailer) > 0 {
+		vm.pwDispatch("proxy_on_"+stream+"_trailers", pw.contextID, int32(len(trailer)))
+	}
+}
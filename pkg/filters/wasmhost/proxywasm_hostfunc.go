@@ -0,0 +1,1088 @@
+//go:build wasmhost
+// +build wasmhost
+
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package wasmhost
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+)
+
+// proxyWasmHeaderMap is a header map accessed by the Proxy-Wasm host
+// functions, keys of pseudo headers start with ':'.
+type proxyWasmHeaderMap interface {
+	pairs() [][2]string
+	get(key string) (string, bool)
+	set(key, value string)
+	add(key, value string)
+	remove(key string)
+}
+
+type (
+	pwHTTPHeaderMap struct {
+		header     http.Header
+		statusCode int
+		readOnly   bool
+	}
+
+	pwRequestHeaderMap struct {
+		req      *httpprot.Request
+		readOnly bool
+	}
+
+	pwResponseHeaderMap struct {
+		resp *httpprot.Response
+	}
+)
+
+// helper functions
+
+func httpHeaderToPairs(h http.Header) [][2]string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs [][2]string
+	for _, k := range keys {
+		lk := strings.ToLower(k)
+		for _, v := range h[k] {
+			pairs = append(pairs, [2]string{lk, v})
+		}
+	}
+	return pairs
+}
+
+func httpHeaderGet(h http.Header, key string) (string, bool) {
+	values := h.Values(key)
+	if len(values) == 0 {
+		return "", false
+	}
+	return strings.Join(values, ","), true
+}
+
+// header pairs are serialized as the number of pairs, the sizes of keys and
+// values, and then the NUL terminated keys and values, all numbers are 32 bit
+// little endian integers.
+func encodeHeaderPairs(pairs [][2]string) []byte {
+	size := 4
+	for _, p := range pairs {
+		size += 8 + len(p[0]) + len(p[1]) + 2
+	}
+
+	buf := make([]byte, size)
+	binary.LittleEndian.PutUint32(buf, uint32(len(pairs)))
+	pos := 4
+	for _, p := range pairs {
+		binary.LittleEndian.PutUint32(buf[pos:], uint32(len(p[0])))
+		binary.LittleEndian.PutUint32(buf[pos+4:], uint32(len(p[1])))
+		pos += 8
+	}
+	for _, p := range pairs {
+		pos += copy(buf[pos:], p[0]) + 1
+		pos += copy(buf[pos:], p[1]) + 1
+	}
+
+	return buf
+}
+
+func decodeHeaderPairs(data []byte) ([][2]string, bool) {
+	if len(data) == 0 {
+		return nil, true
+	}
+	if len(data) < 4 {
+		return nil, false
+	}
+
+	n := int64(binary.LittleEndian.Uint32(data))
+	if int64(len(data)) < 4+n*8 {
+		return nil, false
+	}
+
+	pos := 4
+	sizes := make([][2]int, n)
+	for i := range sizes {
+		sizes[i][0] = int(binary.LittleEndian.Uint32(data[pos:]))
+		sizes[i][1] = int(binary.LittleEndian.Uint32(data[pos+4:]))
+		pos += 8
+	}
+
+	pairs := make([][2]string, n)
+	for i, s := range sizes {
+		if int64(pos)+int64(s[0])+int64(s[1])+2 > int64(len(data)) {
+			return nil, false
+		}
+		pairs[i][0] = string(data[pos : pos+s[0]])
+		pos += s[0] + 1
+		pairs[i][1] = string(data[pos : pos+s[1]])
+		pos += s[1] + 1
+	}
+
+	return pairs, true
+}
+
+// splitPropertyPath converts a property path, which is a sequence of NUL
+// separated segments, to the dot separated form.
+func splitPropertyPath(path []byte) string {
+	path = bytes.TrimRight(path, "\x00")
+	return string(bytes.ReplaceAll(path, []byte{0}, []byte{'.'}))
+}
+
+func int64ToBytes(v int64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(v))
+	return buf
+}
+
+// header maps
+
+func (m *pwHTTPHeaderMap) pairs() [][2]string {
+	pairs := httpHeaderToPairs(m.header)
+	if m.statusCode > 0 {
+		status := [2]string{":status", strconv.Itoa(m.statusCode)}
+		pairs = append([][2]string{status}, pairs...)
+	}
+	return pairs
+}
+
+func (m *pwHTTPHeaderMap) get(key string) (string, bool) {
+	if key == ":status" && m.statusCode > 0 {
+		return strconv.Itoa(m.statusCode), true
+	}
+	return httpHeaderGet(m.header, key)
+}
+
+func (m *pwHTTPHeaderMap) set(key, value string) {
+	if !m.readOnly && !strings.HasPrefix(key, ":") {
+		m.header.Set(key, value)
+	}
+}
+
+func (m *pwHTTPHeaderMap) add(key, value string) {
+	if !m.readOnly && !strings.HasPrefix(key, ":") {
+		m.header.Add(key, value)
+	}
+}
+
+func (m *pwHTTPHeaderMap) remove(key string) {
+	if !m.readOnly {
+		m.header.Del(key)
+	}
+}
+
+func (m *pwRequestHeaderMap) pairs() [][2]string {
+	pairs := [][2]string{
+		{":method", m.req.Method()},
+		{":path", m.req.Std().URL.RequestURI()},
+		{":authority", m.req.Host()},
+		{":scheme", m.req.Scheme()},
+	}
+	return append(pairs, httpHeaderToPairs(m.req.HTTPHeader())...)
+}
+
+func (m *pwRequestHeaderMap) get(key string) (string, bool) {
+	switch key {
+	case ":method":
+		return m.req.Method(), true
+	case ":path":
+		return m.req.Std().URL.RequestURI(), true
+	case ":authority":
+		return m.req.Host(), true
+	case ":scheme":
+		return m.req.Scheme(), true
+	}
+	return httpHeaderGet(m.req.HTTPHeader(), key)
+}
+
+func (m *pwRequestHeaderMap) set(key, value string) {
+	if m.readOnly {
+		return
+	}
+
+	switch key {
+	case ":method":
+		m.req.SetMethod(value)
+	case ":path":
+		if u, e := url.ParseRequestURI(value); e == nil {
+			m.req.SetPath(u.Path)
+			m.req.Std().URL.RawQuery = u.RawQuery
+		}
+	case ":authority":
+		m.req.SetHost(value)
+	case ":scheme":
+		m.req.Std().URL.Scheme = value
+	default:
+		m.req.HTTPHeader().Set(key, value)
+	}
+}
+
+func (m *pwRequestHeaderMap) add(key, value string) {
+	if strings.HasPrefix(key, ":") {
+		m.set(key, value)
+	} else if !m.readOnly {
+		m.req.HTTPHeader().Add(key, value)
+	}
+}
+
+func (m *pwRequestHeaderMap) remove(key string) {
+	if !m.readOnly && !strings.HasPrefix(key, ":") {
+		m.req.HTTPHeader().Del(key)
+	}
+}
+
+func (m *pwResponseHeaderMap) pairs() [][2]string {
+	status := [2]string{":status", strconv.Itoa(m.resp.StatusCode())}
+	return append([][2]string{status}, httpHeaderToPairs(m.resp.HTTPHeader())...)
+}
+
+func (m *pwResponseHeaderMap) get(key string) (string, bool) {
+	if key == ":status" {
+		return strconv.Itoa(m.resp.StatusCode()), true
+	}
+	return httpHeaderGet(m.resp.HTTPHeader(), key)
+}
+
+func (m *pwResponseHeaderMap) set(key, value string) {
+	if key != ":status" {
+		m.resp.HTTPHeader().Set(key, value)
+	} else if code, e := strconv.Atoi(value); e == nil {
+		m.resp.SetStatusCode(code)
+	}
+}
+
+func (m *pwResponseHeaderMap) add(key, value string) {
+	if strings.HasPrefix(key, ":") {
+		m.set(key, value)
+	} else {
+		m.resp.HTTPHeader().Add(key, value)
+	}
+}
+
+func (m *pwResponseHeaderMap) remove(key string) {
+	if !strings.HasPrefix(key, ":") {
+		m.resp.HTTPHeader().Del(key)
+	}
+}
+
+func (vm *WasmVM) pwRequest() *httpprot.Request {
+	if vm.ctx == nil {
+		return nil
+	}
+	return vm.ctx.GetOutputRequest().(*httpprot.Request)
+}
+
+func (vm *WasmVM) pwResponse() *httpprot.Response {
+	if vm.ctx == nil || vm.pw.phase != proxyWasmPhaseResponse {
+		return nil
+	}
+	return vm.ctx.GetOutputResponse().(*httpprot.Response)
+}
+
+func (vm *WasmVM) pwHeaderMap(mapType int32) proxyWasmHeaderMap {
+	switch mapType {
+	case pwMapRequestHeaders:
+		if req := vm.pwRequest(); req != nil {
+			return &pwRequestHeaderMap{req: req, readOnly: vm.pw.requestReadOnly}
+		}
+	case pwMapRequestTrailers:
+		if req := vm.pwRequest(); req != nil {
+			if req.Std().Trailer == nil {
+				req.Std().Trailer = http.Header{}
+			}
+			return &pwHTTPHeaderMap{header: req.Std().Trailer, readOnly: vm.pw.requestReadOnly}
+		}
+	case pwMapResponseHeaders:
+		if resp := vm.pwResponse(); resp != nil {
+			return &pwResponseHeaderMap{resp: resp}
+		}
+	case pwMapResponseTrailers:
+		if resp := vm.pwResponse(); resp != nil {
+			if resp.Std().Trailer == nil {
+				resp.Std().Trailer = http.Header{}
+			}
+			return &pwHTTPHeaderMap{header: resp.Std().Trailer}
+		}
+	case pwMapHTTPCallResponseHeaders:
+		if r := vm.pw.calloutResp; r != nil {
+			return &pwHTTPHeaderMap{header: r.header, statusCode: r.statusCode, readOnly: true}
+		}
+	case pwMapHTTPCallResponseTrailers:
+		if r := vm.pw.calloutResp; r != nil {
+			return &pwHTTPHeaderMap{header: r.trailer, readOnly: true}
+		}
+	}
+	return nil
+}
+
+// buffers
+
+func (vm *WasmVM) pwGetBuffer(bufferType int32) ([]byte, bool) {
+	spec := vm.host.spec.ProxyWasm
+
+	switch bufferType {
+	case pwBufferRequestBody:
+		if req := vm.pwRequest(); req != nil && !req.IsStream() {
+			return req.RawPayload(), true
+		}
+	case pwBufferResponseBody:
+		if resp := vm.pwResponse(); resp != nil && !resp.IsStream() {
+			return resp.RawPayload(), true
+		}
+	case pwBufferHTTPCallResponseBody:
+		if r := vm.pw.calloutResp; r != nil {
+			return r.body, true
+		}
+	case pwBufferVMConfiguration:
+		return []byte(spec.VMConfiguration), true
+	case pwBufferPluginConfiguration:
+		return []byte(spec.Configuration), true
+	}
+	return nil, false
+}
+
+func (vm *WasmVM) pwSetBuffer(bufferType int32, data []byte) bool {
+	switch bufferType {
+	case pwBufferRequestBody:
+		req := vm.pwRequest()
+		if req == nil || req.IsStream() {
+			return false
+		}
+		if !vm.pw.requestReadOnly {
+			req.SetPayload(data)
+		}
+		return true
+	case pwBufferResponseBody:
+		resp := vm.pwResponse()
+		if resp == nil || resp.IsStream() {
+			return false
+		}
+		resp.SetPayload(data)
+		return true
+	}
+	return false
+}
+
+// properties
+
+func (vm *WasmVM) pwGetProperty(path string) ([]byte, bool) {
+	if v, ok := vm.pw.properties[path]; ok {
+		return v, true
+	}
+
+	spec := vm.host.spec
+	switch path {
+	case "plugin_name":
+		return []byte(spec.Name()), true
+	case "plugin_root_id":
+		return []byte(spec.ProxyWasm.RootID), true
+	case "plugin_vm_id":
+		return []byte(spec.ProxyWasm.VMID), true
+	}
+
+	req := vm.pwRequest()
+	if req == nil {
+		return nil, false
+	}
+
+	var v string
+	switch path {
+	case "request.path":
+		v = req.Std().URL.RequestURI()
+	case "request.url_path":
+		v = req.Path()
+	case "request.host":
+		v = req.Host()
+	case "request.scheme":
+		v = req.Scheme()
+	case "request.method":
+		v = req.Method()
+	case "request.protocol":
+		v = req.Proto()
+	case "request.query":
+		v = req.Std().URL.RawQuery
+	case "request.id":
+		v = req.HTTPHeader().Get("X-Request-Id")
+	case "request.useragent":
+		v = req.HTTPHeader().Get("User-Agent")
+	case "request.referer":
+		v = req.HTTPHeader().Get("Referer")
+	case "source.address":
+		v = req.Std().RemoteAddr
+	case "response.code":
+		if resp := vm.pwResponse(); resp != nil {
+			return int64ToBytes(int64(resp.StatusCode())), true
+		}
+		return nil, false
+	default:
+		return nil, false
+	}
+
+	if v == "" {
+		return nil, false
+	}
+	return []byte(v), true
+}
+
+// memory helpers
+
+func (vm *WasmVM) pwMemory() []byte {
+	return vm.inst.GetExport(vm.store, wasmMemory).Memory().UnsafeData(vm.store)
+}
+
+func (vm *WasmVM) pwRead(ptr, size int32) ([]byte, bool) {
+	mem := vm.pwMemory()
+	if ptr < 0 || size < 0 || int64(ptr)+int64(size) > int64(len(mem)) {
+		return nil, false
+	}
+	data := make([]byte, size)
+	copy(data, mem[ptr:])
+	return data, true
+}
+
+func (vm *WasmVM) pwReadString(ptr, size int32) (string, bool) {
+	data, ok := vm.pwRead(ptr, size)
+	return string(data), ok
+}
+
+func (vm *WasmVM) pwWriteUint32(ptr int32, v uint32) bool {
+	mem := vm.pwMemory()
+	if ptr < 0 || int64(ptr)+4 > int64(len(mem)) {
+		return false
+	}
+	binary.LittleEndian.PutUint32(mem[ptr:], v)
+	return true
+}
+
+func (vm *WasmVM) pwWriteUint64(ptr int32, v uint64) bool {
+	mem := vm.pwMemory()
+	if ptr < 0 || int64(ptr)+8 > int64(len(mem)) {
+		return false
+	}
+	binary.LittleEndian.PutUint64(mem[ptr:], v)
+	return true
+}
+
+// pwReturnBytes copies data to memory allocated by the module, and writes
+// the address and size of the copy to retPtr and retSize.
+func (vm *WasmVM) pwReturnBytes(data []byte, retPtr, retSize int32) int32 {
+	addr := int32(0)
+	if len(data) > 0 {
+		v, e := vm.pw.fnMalloc.Call(vm.store, int32(len(data)))
+		if e != nil {
+			panic(e)
+		}
+		addr = v.(int32)
+
+		// memory may grow during allocation, so get it after that
+		mem := vm.pwMemory()
+		if addr <= 0 || int64(addr)+int64(len(data)) > int64(len(mem)) {
+			return pwStatusInvalidMemoryAccess
+		}
+		copy(mem[addr:], data)
+	}
+
+	if !vm.pwWriteUint32(retPtr, uint32(addr)) || !vm.pwWriteUint32(retSize, uint32(len(data))) {
+		return pwStatusInvalidMemoryAccess
+	}
+	return pwStatusOk
+}
+
+// logging and time functions
+
+func (vm *WasmVM) proxyLog(level, msgPtr, msgSize int32) int32 {
+	msg, ok := vm.pwReadString(msgPtr, msgSize)
+	if !ok {
+		return pwStatusInvalidMemoryAccess
+	}
+
+	switch level {
+	case 0, 1:
+		logger.Debugf("%s", msg)
+	case 2:
+		logger.Infof("%s", msg)
+	case 3:
+		logger.Warnf("%s", msg)
+	default:
+		logger.Errorf("%s", msg)
+	}
+	return pwStatusOk
+}
+
+func (vm *WasmVM) proxyGetLogLevel(retLevel int32) int32 {
+	// 2 is info, which is the default log level of Easegress
+	if !vm.pwWriteUint32(retLevel, 2) {
+		return pwStatusInvalidMemoryAccess
+	}
+	return pwStatusOk
+}
+
+func (vm *WasmVM) proxyGetCurrentTimeNanoseconds(retTime int32) int32 {
+	if !vm.pwWriteUint64(retTime, uint64(time.Now().UnixNano())) {
+		return pwStatusInvalidMemoryAccess
+	}
+	return pwStatusOk
+}
+
+func (vm *WasmVM) proxySetTickPeriodMilliseconds(period int32) int32 {
+	vm.pw.tickPeriod = time.Duration(period) * time.Millisecond
+	return pwStatusOk
+}
+
+// property functions
+
+func (vm *WasmVM) proxyGetProperty(pathPtr, pathSize, retValue, retSize int32) int32 {
+	path, ok := vm.pwRead(pathPtr, pathSize)
+	if !ok {
+		return pwStatusInvalidMemoryAccess
+	}
+
+	v, ok := vm.pwGetProperty(splitPropertyPath(path))
+	if !ok {
+		return pwStatusNotFound
+	}
+	return vm.pwReturnBytes(v, retValue, retSize)
+}
+
+func (vm *WasmVM) proxySetProperty(pathPtr, pathSize, valuePtr, valueSize int32) int32 {
+	path, ok := vm.pwRead(pathPtr, pathSize)
+	if !ok {
+		return pwStatusInvalidMemoryAccess
+	}
+	value, ok := vm.pwRead(valuePtr, valueSize)
+	if !ok {
+		return pwStatusInvalidMemoryAccess
+	}
+
+	if vm.pw.properties == nil {
+		vm.pw.properties = map[string][]byte{}
+	}
+	vm.pw.properties[splitPropertyPath(path)] = value
+	return pwStatusOk
+}
+
+// stream functions
+
+func (vm *WasmVM) proxyContinueStream(streamType int32) int32 {
+	// callbacks are always executed synchronously, so there's nothing to
+	// resume.
+	return pwStatusOk
+}
+
+func (vm *WasmVM) proxyCloseStream(streamType int32) int32 {
+	if vm.ctx == nil {
+		return pwStatusNotFound
+	}
+
+	// Easegress can't reset the downstream connection, so the stream is
+	// closed by a local response.
+	resp, _ := httpprot.NewResponse(nil)
+	resp.SetStatusCode(http.StatusServiceUnavailable)
+	vm.pwSetLocalResponse(resp)
+	return pwStatusOk
+}
+
+func (vm *WasmVM) proxyContinue() int32 {
+	return pwStatusOk
+}
+
+func (vm *WasmVM) pwSetLocalResponse(resp *httpprot.Response) {
+	if old, ok := vm.ctx.GetOutputResponse().(*httpprot.Response); ok && old.IsStream() {
+		if c, ok := old.GetPayload().(io.Closer); ok {
+			c.Close()
+		}
+	}
+	vm.ctx.SetOutputResponse(resp)
+	vm.pw.localResponse = true
+}
+
+func (vm *WasmVM) proxySendLocalResponse(statusCode, detailsPtr, detailsSize, bodyPtr, bodySize, headersPtr, headersSize, grpcStatus int32) int32 {
+	if vm.ctx == nil {
+		return pwStatusNotFound
+	}
+
+	body, ok := vm.pwRead(bodyPtr, bodySize)
+	if !ok {
+		return pwStatusInvalidMemoryAccess
+	}
+	data, ok := vm.pwRead(headersPtr, headersSize)
+	if !ok {
+		return pwStatusInvalidMemoryAccess
+	}
+	pairs, ok := decodeHeaderPairs(data)
+	if !ok {
+		return pwStatusSerializationFailed
+	}
+
+	resp, _ := httpprot.NewResponse(nil)
+	resp.SetStatusCode(int(statusCode))
+	for _, p := range pairs {
+		if !strings.HasPrefix(p[0], ":") {
+			resp.HTTPHeader().Add(p[0], p[1])
+		}
+	}
+	resp.SetPayload(body)
+
+	vm.pwSetLocalResponse(resp)
+	return pwStatusOk
+}
+
+// shared data functions
+
+func (vm *WasmVM) proxyGetSharedData(keyPtr, keySize, retValue, retSize, retCas int32) int32 {
+	key, ok := vm.pwReadString(keyPtr, keySize)
+	if !ok {
+		return pwStatusInvalidMemoryAccess
+	}
+
+	value, cas, ok := getProxyWasmSharedData(vm.host.spec.ProxyWasm.VMID, key)
+	if !ok {
+		return pwStatusNotFound
+	}
+	if !vm.pwWriteUint32(retCas, cas) {
+		return pwStatusInvalidMemoryAccess
+	}
+	return vm.pwReturnBytes(value, retValue, retSize)
+}
+
+func (vm *WasmVM) proxySetSharedData(keyPtr, keySize, valuePtr, valueSize, cas int32) int32 {
+	key, ok := vm.pwReadString(keyPtr, keySize)
+	if !ok {
+		return pwStatusInvalidMemoryAccess
+	}
+	value, ok := vm.pwRead(valuePtr, valueSize)
+	if !ok {
+		return pwStatusInvalidMemoryAccess
+	}
+	return setProxyWasmSharedData(vm.host.spec.ProxyWasm.VMID, key, value, uint32(cas))
+}
+
+// header map functions
+
+func (vm *WasmVM) proxyGetHeaderMapPairs(mapType, retData, retSize int32) int32 {
+	m := vm.pwHeaderMap(mapType)
+	if m == nil {
+		return pwStatusNotFound
+	}
+	return vm.pwReturnBytes(encodeHeaderPairs(m.pairs()), retData, retSize)
+}
+
+func (vm *WasmVM) proxySetHeaderMapPairs(mapType, dataPtr, dataSize int32) int32 {
+	m := vm.pwHeaderMap(mapType)
+	if m == nil {
+		return pwStatusNotFound
+	}
+
+	data, ok := vm.pwRead(dataPtr, dataSize)
+	if !ok {
+		return pwStatusInvalidMemoryAccess
+	}
+	pairs, ok := decodeHeaderPairs(data)
+	if !ok {
+		return pwStatusSerializationFailed
+	}
+
+	for _, p := range m.pairs() {
+		m.remove(p[0])
+	}
+	for _, p := range pairs {
+		m.add(p[0], p[1])
+	}
+	return pwStatusOk
+}
+
+func (vm *WasmVM) proxyGetHeaderMapValue(mapType, keyPtr, keySize, retValue, retSize int32) int32 {
+	m := vm.pwHeaderMap(mapType)
+	if m == nil {
+		return pwStatusNotFound
+	}
+
+	key, ok := vm.pwReadString(keyPtr, keySize)
+	if !ok {
+		return pwStatusInvalidMemoryAccess
+	}
+	v, ok := m.get(key)
+	if !ok {
+		return pwStatusNotFound
+	}
+	return vm.pwReturnBytes([]byte(v), retValue, retSize)
+}
+
+func (vm *WasmVM) pwUpdateHeaderMap(mapType, keyPtr, keySize, valuePtr, valueSize int32, fn func(m proxyWasmHeaderMap, key, value string)) int32 {
+	m := vm.pwHeaderMap(mapType)
+	if m == nil {
+		return pwStatusNotFound
+	}
+
+	key, ok := vm.pwReadString(keyPtr, keySize)
+	if !ok {
+		return pwStatusInvalidMemoryAccess
+	}
+	value, ok := vm.pwReadString(valuePtr, valueSize)
+	if !ok {
+		return pwStatusInvalidMemoryAccess
+	}
+
+	fn(m, key, value)
+	return pwStatusOk
+}
+
+func (vm *WasmVM) proxyReplaceHeaderMapValue(mapType, keyPtr, keySize, valuePtr, valueSize int32) int32 {
+	return vm.pwUpdateHeaderMap(mapType, keyPtr, keySize, valuePtr, valueSize, proxyWasmHeaderMap.set)
+}
+
+func (vm *WasmVM) proxyAddHeaderMapValue(mapType, keyPtr, keySize, valuePtr, valueSize int32) int32 {
+	return vm.pwUpdateHeaderMap(mapType, keyPtr, keySize, valuePtr, valueSize, proxyWasmHeaderMap.add)
+}
+
+func (vm *WasmVM) proxyRemoveHeaderMapValue(mapType, keyPtr, keySize int32) int32 {
+	m := vm.pwHeaderMap(mapType)
+	if m == nil {
+		return pwStatusNotFound
+	}
+
+	key, ok := vm.pwReadString(keyPtr, keySize)
+	if !ok {
+		return pwStatusInvalidMemoryAccess
+	}
+	m.remove(key)
+	return pwStatusOk
+}
+
+func (vm *WasmVM) proxyGetHeaderMapSize(mapType, retSize int32) int32 {
+	m := vm.pwHeaderMap(mapType)
+	if m == nil {
+		return pwStatusNotFound
+	}
+	if !vm.pwWriteUint32(retSize, uint32(len(encodeHeaderPairs(m.pairs())))) {
+		return pwStatusInvalidMemoryAccess
+	}
+	return pwStatusOk
+}
+
+// buffer functions
+
+func (vm *WasmVM) proxyGetBufferBytes(bufferType, start, maxSize, retData, retSize int32) int32 {
+	data, ok := vm.pwGetBuffer(bufferType)
+	if !ok {
+		return pwStatusNotFound
+	}
+	if start < 0 || maxSize < 0 {
+		return pwStatusBadArgument
+	}
+
+	begin, end := int64(start), int64(start)+int64(maxSize)
+	if begin > int64(len(data)) {
+		begin = int64(len(data))
+	}
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	return vm.pwReturnBytes(data[begin:end], retData, retSize)
+}
+
+func (vm *WasmVM) proxySetBufferBytes(bufferType, start, size, dataPtr, dataSize int32) int32 {
+	old, ok := vm.pwGetBuffer(bufferType)
+	if !ok {
+		return pwStatusNotFound
+	}
+	if start < 0 || size < 0 {
+		return pwStatusBadArgument
+	}
+	data, ok := vm.pwRead(dataPtr, dataSize)
+	if !ok {
+		return pwStatusInvalidMemoryAccess
+	}
+
+	// replace bytes in [start, start+size) with data
+	begin, end := int64(start), int64(start)+int64(size)
+	if begin > int64(len(old)) {
+		begin = int64(len(old))
+	}
+	if end > int64(len(old)) {
+		end = int64(len(old))
+	}
+	buf := make([]byte, 0, int64(len(old))-(end-begin)+int64(len(data)))
+	buf = append(buf, old[:begin]...)
+	buf = append(buf, data...)
+	buf = append(buf, old[end:]...)
+
+	if !vm.pwSetBuffer(bufferType, buf) {
+		return pwStatusBadArgument
+	}
+	return pwStatusOk
+}
+
+func (vm *WasmVM) proxyGetBufferStatus(bufferType, retLength, retFlags int32) int32 {
+	data, ok := vm.pwGetBuffer(bufferType)
+	if !ok {
+		return pwStatusNotFound
+	}
+	if !vm.pwWriteUint32(retLength, uint32(len(data))) || !vm.pwWriteUint32(retFlags, 0) {
+		return pwStatusInvalidMemoryAccess
+	}
+	return pwStatusOk
+}
+
+// HTTP callout functions
+
+func (vm *WasmVM) proxyHTTPCall(upstreamPtr, upstreamSize, headersPtr, headersSize, bodyPtr, bodySize, trailersPtr, trailersSize, timeout, retToken int32) int32 {
+	upstream, ok := vm.pwReadString(upstreamPtr, upstreamSize)
+	if !ok {
+		return pwStatusInvalidMemoryAccess
+	}
+	data, ok := vm.pwRead(headersPtr, headersSize)
+	if !ok {
+		return pwStatusInvalidMemoryAccess
+	}
+	body, ok := vm.pwRead(bodyPtr, bodySize)
+	if !ok {
+		return pwStatusInvalidMemoryAccess
+	}
+
+	base, ok := vm.host.spec.ProxyWasm.Clusters[upstream]
+	if !ok {
+		logger.Warnf("proxy-wasm http callout to unknown cluster %q", upstream)
+		return pwStatusBadArgument
+	}
+	pairs, ok := decodeHeaderPairs(data)
+	if !ok {
+		return pwStatusSerializationFailed
+	}
+
+	var method, path, authority string
+	header := http.Header{}
+	for _, p := range pairs {
+		switch p[0] {
+		case ":method":
+			method = p[1]
+		case ":path":
+			path = p[1]
+		case ":authority":
+			authority = p[1]
+		default:
+			if !strings.HasPrefix(p[0], ":") {
+				header.Add(p[0], p[1])
+			}
+		}
+	}
+	if method == "" || path == "" {
+		return pwStatusBadArgument
+	}
+
+	req, e := http.NewRequest(method, strings.TrimSuffix(base, "/")+path, bytes.NewReader(body))
+	if e != nil {
+		return pwStatusBadArgument
+	}
+	req.Header = header
+	if authority != "" {
+		req.Host = authority
+	}
+
+	c := &proxyWasmCallout{req: req, timeout: time.Duration(timeout) * time.Millisecond}
+	if c.timeout <= 0 || c.timeout > vm.host.spec.timeout {
+		c.timeout = vm.host.spec.timeout
+	}
+
+	vm.pw.nextToken++
+	c.token = vm.pw.nextToken
+	if !vm.pwWriteUint32(retToken, c.token) {
+		return pwStatusInvalidMemoryAccess
+	}
+	vm.pw.callouts = append(vm.pw.callouts, c)
+	return pwStatusOk
+}
+
+// metric functions
+
+func (vm *WasmVM) proxyDefineMetric(metricType, namePtr, nameSize, retID int32) int32 {
+	if metricType < pwMetricCounter || metricType > pwMetricHistogram {
+		return pwStatusBadArgument
+	}
+	name, ok := vm.pwReadString(namePtr, nameSize)
+	if !ok {
+		return pwStatusInvalidMemoryAccess
+	}
+
+	id := vm.host.pwMetrics.define(metricType, name)
+	if !vm.pwWriteUint32(retID, uint32(id)) {
+		return pwStatusInvalidMemoryAccess
+	}
+	return pwStatusOk
+}
+
+func (vm *WasmVM) proxyIncrementMetric(metricID int32, offset int64) int32 {
+	m := vm.host.pwMetrics.get(metricID)
+	if m == nil {
+		return pwStatusNotFound
+	}
+	if m.typ == pwMetricHistogram {
+		return pwStatusBadArgument
+	}
+	atomic.AddInt64(&m.value, offset)
+	return pwStatusOk
+}
+
+func (vm *WasmVM) proxyRecordMetric(metricID int32, value int64) int32 {
+	m := vm.host.pwMetrics.get(metricID)
+	if m == nil {
+		return pwStatusNotFound
+	}
+
+	switch m.typ {
+	case pwMetricGauge:
+		atomic.StoreInt64(&m.value, value)
+	case pwMetricHistogram:
+		// the sum and count of the records are kept for a histogram
+		atomic.AddInt64(&m.value, value)
+		atomic.AddInt64(&m.count, 1)
+	default:
+		return pwStatusBadArgument
+	}
+	return pwStatusOk
+}
+
+func (vm *WasmVM) proxyGetMetric(metricID, retValue int32) int32 {
+	m := vm.host.pwMetrics.get(metricID)
+	if m == nil {
+		return pwStatusNotFound
+	}
+	if !vm.pwWriteUint64(retValue, uint64(atomic.LoadInt64(&m.value))) {
+		return pwStatusInvalidMemoryAccess
+	}
+	return pwStatusOk
+}
+
+// misc functions
+
+func (vm *WasmVM) proxySetEffectiveContext(contextID int32) int32 {
+	return pwStatusOk
+}
+
+func (vm *WasmVM) proxyDone() int32 {
+	return pwStatusOk
+}
+
+func (vm *WasmVM) proxyCallForeignFunction(namePtr, nameSize, argsPtr, argsSize, retData, retSize int32) int32 {
+	return pwStatusNotFound
+}
+
+// importProxyWasmFuncs imports the host functions defined by the Proxy-Wasm
+// ABI into wasm, functions which are not supported by Easegress return
+// 'Unimplemented'.
+func (vm *WasmVM) importProxyWasmFuncs(linker *wasmtime.Linker) {
+	defineFunc := func(name string, fn interface{}) {
+		if e := linker.DefineFunc(vm.store, "env", name, fn); e != nil {
+			panic(e) // should never happen
+		}
+	}
+
+	// logging and time functions
+	defineFunc("proxy_log", vm.proxyLog)
+	defineFunc("proxy_get_log_level", vm.proxyGetLogLevel)
+	defineFunc("proxy_get_current_time_nanoseconds", vm.proxyGetCurrentTimeNanoseconds)
+	defineFunc("proxy_set_tick_period_milliseconds", vm.proxySetTickPeriodMilliseconds)
+
+	// property functions
+	defineFunc("proxy_get_property", vm.proxyGetProperty)
+	defineFunc("proxy_set_property", vm.proxySetProperty)
+
+	// stream functions
+	defineFunc("proxy_continue_stream", vm.proxyContinueStream)
+	defineFunc("proxy_close_stream", vm.proxyCloseStream)
+	defineFunc("proxy_send_local_response", vm.proxySendLocalResponse)
+	defineFunc("proxy_continue_request", vm.proxyContinue)
+	defineFunc("proxy_continue_response", vm.proxyContinue)
+	defineFunc("proxy_clear_route_cache", vm.proxyContinue)
+
+	// shared data and queue functions
+	defineFunc("proxy_get_shared_data", vm.proxyGetSharedData)
+	defineFunc("proxy_set_shared_data", vm.proxySetSharedData)
+	defineFunc("proxy_register_shared_queue", func(namePtr, nameSize, retID int32) int32 {
+		return pwStatusUnimplemented
+	})
+	defineFunc("proxy_resolve_shared_queue", func(vmIDPtr, vmIDSize, namePtr, nameSize, retID int32) int32 {
+		return pwStatusUnimplemented
+	})
+	defineFunc("proxy_enqueue_shared_queue", func(queueID, valuePtr, valueSize int32) int32 {
+		return pwStatusUnimplemented
+	})
+	defineFunc("proxy_dequeue_shared_queue", func(queueID, retData, retSize int32) int32 {
+		return pwStatusUnimplemented
+	})
+
+	// header map functions
+	defineFunc("proxy_get_header_map_pairs", vm.proxyGetHeaderMapPairs)
+	defineFunc("proxy_set_header_map_pairs", vm.proxySetHeaderMapPairs)
+	defineFunc("proxy_get_header_map_value", vm.proxyGetHeaderMapValue)
+	defineFunc("proxy_replace_header_map_value", vm.proxyReplaceHeaderMapValue)
+	defineFunc("proxy_add_header_map_value", vm.proxyAddHeaderMapValue)
+	defineFunc("proxy_remove_header_map_value", vm.proxyRemoveHeaderMapValue)
+	defineFunc("proxy_get_header_map_size", vm.proxyGetHeaderMapSize)
+
+	// buffer functions
+	defineFunc("proxy_get_buffer_bytes", vm.proxyGetBufferBytes)
+	defineFunc("proxy_set_buffer_bytes", vm.proxySetBufferBytes)
+	defineFunc("proxy_get_buffer_status", vm.proxyGetBufferStatus)
+
+	// HTTP and gRPC callout functions
+	defineFunc("proxy_http_call", vm.proxyHTTPCall)
+	defineFunc("proxy_grpc_call", func(a1, a2, a3, a4, a5, a6, a7, a8, a9, a10, a11, a12 int32) int32 {
+		return pwStatusUnimplemented
+	})
+	defineFunc("proxy_grpc_stream", func(a1, a2, a3, a4, a5, a6, a7, a8, a9 int32) int32 {
+		return pwStatusUnimplemented
+	})
+	defineFunc("proxy_grpc_send", func(token, msgPtr, msgSize, endOfStream int32) int32 {
+		return pwStatusUnimplemented
+	})
+	defineFunc("proxy_grpc_cancel", func(token int32) int32 {
+		return pwStatusUnimplemented
+	})
+	defineFunc("proxy_grpc_close", func(token int32) int32 {
+		return pwStatusUnimplemented
+	})
+	defineFunc("proxy_get_status", func(retCode, retData, retSize int32) int32 {
+		return pwStatusUnimplemented
+	})
+
+	// metric functions
+	defineFunc("proxy_define_metric", vm.proxyDefineMetric)
+	defineFunc("proxy_increment_metric", vm.proxyIncrementMetric)
+	defineFunc("proxy_record_metric", vm.proxyRecordMetric)
+	defineFunc("proxy_get_metric", vm.proxyGetMetric)
+
+	// misc functions
+	defineFunc("proxy_set_effective_context", vm.proxySetEffectiveContext)
+	defineFunc("proxy_done", vm.proxyDone)
+	defineFunc("proxy_call_foreign_function", vm.proxyCallForeignFunction)
+}
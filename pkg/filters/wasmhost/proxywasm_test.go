@@ -0,0 +1,200 @@
+//go:build wasmhost
+// +build wasmhost
+
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package wasmhost
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderPairs(t *testing.T) {
+	assert := assert.New(t)
+
+	pairs := [][2]string{{":method", "GET"}, {":path", "/test"}, {"x-empty", ""}}
+	data := encodeHeaderPairs(pairs)
+	result, ok := decodeHeaderPairs(data)
+	assert.True(ok)
+	assert.Equal(pairs, result)
+
+	result, ok = decodeHeaderPairs(encodeHeaderPairs(nil))
+	assert.True(ok)
+	assert.Empty(result)
+
+	result, ok = decodeHeaderPairs(nil)
+	assert.True(ok)
+	assert.Nil(result)
+}
+
+func TestDecodeHeaderPairsBounds(t *testing.T) {
+	assert := assert.New(t)
+
+	_, ok := decodeHeaderPairs([]byte{1, 0})
+	assert.False(ok)
+
+	// the count is larger than the data
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, 0xffffffff)
+	_, ok = decodeHeaderPairs(data)
+	assert.False(ok)
+
+	// the sizes are larger than the data
+	data = encodeHeaderPairs([][2]string{{"a", "b"}})
+	binary.LittleEndian.PutUint32(data[8:], 100)
+	_, ok = decodeHeaderPairs(data)
+	assert.False(ok)
+
+	// the sizes overflow 32 bit integers
+	data = encodeHeaderPairs([][2]string{{"a", "b"}})
+	binary.LittleEndian.PutUint32(data[4:], 0xffffffff)
+	binary.LittleEndian.PutUint32(data[8:], 0xffffffff)
+	_, ok = decodeHeaderPairs(data)
+	assert.False(ok)
+
+	// truncated data
+	data = encodeHeaderPairs([][2]string{{"a", "b"}})
+	_, ok = decodeHeaderPairs(data[:len(data)-1])
+	assert.False(ok)
+}
+
+func TestProxyWasmSharedData(t *testing.T) {
+	assert := assert.New(t)
+
+	vmID := "test-shared-data-" + time.Now().String()
+
+	_, _, ok := getProxyWasmSharedData(vmID, "key")
+	assert.False(ok)
+
+	assert.Equal(pwStatusOk, setProxyWasmSharedData(vmID, "key", []byte("v1"), 0))
+	value, cas, ok := getProxyWasmSharedData(vmID, "key")
+	assert.True(ok)
+	assert.Equal([]byte("v1"), value)
+
+	assert.Equal(pwStatusCasMismatch, setProxyWasmSharedData(vmID, "key", []byte("v2"), cas+1))
+	value, _, _ = getProxyWasmSharedData(vmID, "key")
+	assert.Equal([]byte("v1"), value)
+
+	assert.Equal(pwStatusOk, setProxyWasmSharedData(vmID, "key", []byte("v2"), cas))
+	value, newCas, _ := getProxyWasmSharedData(vmID, "key")
+	assert.Equal([]byte("v2"), value)
+	assert.NotEqual(cas, newCas)
+
+	// the old cas is stale now
+	assert.Equal(pwStatusCasMismatch, setProxyWasmSharedData(vmID, "key", []byte("v3"), cas))
+
+	// data is isolated by VM ID
+	_, _, ok = getProxyWasmSharedData(vmID+"-other", "key")
+	assert.False(ok)
+}
+
+// calloutWat issues an HTTP callout to cluster 'backend' on tick, and one
+// more callout when the response of the first callout arrives. The header
+// count and body size of the response of callout N are recorded at address
+// 256+N*8.
+const calloutWat = `
+(module
+  (import "env" "proxy_http_call"
+    (func $http_call (param i32 i32 i32 i32 i32 i32 i32 i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (global $heap (mut i32) (i32.const 1024))
+  (data (i32.const 0) "backend")
+  (data (i32.const 16) "\02\00\00\00\07\00\00\00\03\00\00\00\05\00\00\00\05\00\00\00:method\00GET\00:path\00/test\00")
+
+  (func (export "proxy_abi_version_0_2_0"))
+
+  (func (export "proxy_on_memory_allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $heap))
+    (global.set $heap (i32.add (global.get $heap) (local.get $size)))
+    (local.get $ptr))
+
+  (func $call
+    (drop (call $http_call
+      (i32.const 0) (i32.const 7) (i32.const 16) (i32.const 44)
+      (i32.const 0) (i32.const 0) (i32.const 0) (i32.const 0)
+      (i32.const 1000) (i32.const 128))))
+
+  (func (export "proxy_on_tick") (param $ctx i32)
+    (call $call))
+
+  (func (export "proxy_on_http_call_response")
+    (param $ctx i32) (param $token i32) (param $headers i32) (param $body i32) (param $trailers i32)
+    (i32.store (i32.add (i32.const 256) (i32.mul (local.get $token) (i32.const 8))) (local.get $headers))
+    (i32.store (i32.add (i32.const 260) (i32.mul (local.get $token) (i32.const 8))) (local.get $body))
+    (if (i32.eq (local.get $token) (i32.const 1))
+      (then (call $call))))
+)
+`
+
+func TestProxyWasmCalloutDispatch(t *testing.T) {
+	assert := assert.New(t)
+
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		assert.Equal(http.MethodGet, r.Method)
+		assert.Equal("/test", r.URL.Path)
+		w.Header().Set("X-Test", "test")
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	code, err := wasmtime.Wat2Wasm(calloutWat)
+	assert.NoError(err)
+
+	cfg := wasmtime.NewConfig()
+	cfg.SetEpochInterruption(true)
+	engine := wasmtime.NewEngineWithConfig(cfg)
+	module, err := wasmtime.NewModule(engine, code)
+	assert.NoError(err)
+
+	host := &WasmHost{
+		spec: &Spec{
+			ABI:     ABIProxyWasm,
+			timeout: time.Second,
+			ProxyWasm: &ProxyWasmSpec{
+				Clusters: map[string]string{"backend": server.URL},
+			},
+		},
+		pwMetrics: newProxyWasmMetrics(),
+	}
+	vm, err := newProxyWasmVM(host, engine, module)
+	assert.NoError(err)
+
+	vm.pw.contextID = proxyWasmRootContextID
+	vm.pwDispatch("proxy_on_tick", proxyWasmRootContextID)
+
+	assert.Equal(int32(2), atomic.LoadInt32(&count))
+	assert.Empty(vm.pw.callouts)
+
+	mem := vm.pwMemory()
+	for token := 1; token <= 2; token++ {
+		addr := 256 + token*8
+		assert.Greater(binary.LittleEndian.Uint32(mem[addr:]), uint32(1))
+		assert.Equal(uint32(5), binary.LittleEndian.Uint32(mem[addr+4:]))
+	}
+}
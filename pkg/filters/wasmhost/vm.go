@@ -37,6 +37,7 @@ type WasmVM struct {
 	fnRun   *wasmtime.Func
 	fnAlloc *wasmtime.Func
 	fnFree  *wasmtime.Func
+	pw      *proxyWasmState
 }
 
 // Interrupt interrupts the execution of wasm code
@@ -103,6 +104,10 @@ func (vm *WasmVM) callInit(params []string) (err error) {
 }
 
 func newWasmVM(host *WasmHost, engine *wasmtime.Engine, module *wasmtime.Module, params []string) (*WasmVM, error) {
+	if host.spec.ABI == ABIProxyWasm {
+		return newProxyWasmVM(host, engine, module)
+	}
+
 	store := wasmtime.NewStore(engine)
 	store.SetEpochDeadline(1)
 	vm := &WasmVM{host: host, store: store}
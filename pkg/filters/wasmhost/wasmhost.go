@@ -47,9 +47,10 @@ const (
 )
 
 var (
-	resultOutOfVM   = "outOfVM"
-	resultWasmError = "wasmError"
-	results         = []string{resultOutOfVM, resultWasmError}
+	resultOutOfVM       = "outOfVM"
+	resultWasmError     = "wasmError"
+	resultLocalResponse = "localResponse"
+	results             = []string{resultOutOfVM, resultWasmError, resultLocalResponse}
 )
 
 func wasmResultToFilterResult(r int32) string {
@@ -92,6 +93,8 @@ type (
 		Code           string            `json:"code" jsonschema:"required"`
 		Timeout        string            `json:"timeout" jsonschema:"required,format=duration"`
 		Parameters     map[string]string `json:"parameters,omitempty"`
+		ABI            string            `json:"abi,omitempty" jsonschema:"enum=,enum=easegress,enum=proxy-wasm"`
+		ProxyWasm      *ProxyWasmSpec    `json:"proxyWasm,omitempty"`
 		timeout        time.Duration
 	}
 
@@ -104,6 +107,7 @@ type (
 		data       atomic.Value
 		vmPool     atomic.Value
 		chStop     chan struct{}
+		pwMetrics  *proxyWasmMetrics
 
 		numOfRequest   int64
 		numOfWasmError int64
@@ -114,9 +118,19 @@ type (
 		Health         string `json:"health"`
 		NumOfRequest   int64  `json:"numOfRequest"`
 		NumOfWasmError int64  `json:"numOfWasmError"`
+
+		Metrics map[string]*MetricStatus `json:"metrics,omitempty"`
 	}
 )
 
+// Validate validates Spec.
+func (spec *Spec) Validate() error {
+	if spec.ProxyWasm != nil && spec.ABI != ABIProxyWasm {
+		return fmt.Errorf("proxyWasm is only valid when abi is %s", ABIProxyWasm)
+	}
+	return nil
+}
+
 // Name returns the name of the WasmHost filter instance.
 func (wh *WasmHost) Name() string {
 	return wh.spec.Name()
@@ -281,6 +295,10 @@ func (wh *WasmHost) reload() {
 	wh.dataPrefix = wh.Cluster().Layout().WasmDataPrefix(spec.Pipeline(), spec.Name())
 
 	wh.spec.timeout, _ = time.ParseDuration(wh.spec.Timeout)
+	if spec.ABI == ABIProxyWasm && spec.ProxyWasm == nil {
+		spec.ProxyWasm = &ProxyWasmSpec{}
+	}
+	wh.pwMetrics = newProxyWasmMetrics()
 	wh.chStop = make(chan struct{})
 
 	wh.loadWasmCode()
@@ -368,6 +386,10 @@ func (wh *WasmHost) Handle(ctx *context.Context) (result string) {
 	}
 	ctx.SetOutputResponse(resp)
 
+	if wh.spec.ABI == ABIProxyWasm {
+		return vm.runProxyWasm()
+	}
+
 	r := vm.Run() // execute wasm code
 	n, ok := r.(int32)
 	if !ok || n < 0 || n > maxWasmResult {
@@ -389,6 +411,9 @@ func (wh *WasmHost) Status() interface{} {
 
 	s.NumOfRequest = atomic.LoadInt64(&wh.numOfRequest)
 	s.NumOfWasmError = atomic.LoadInt64(&wh.numOfWasmError)
+	if wh.pwMetrics != nil {
+		s.Metrics = wh.pwMetrics.status()
+	}
 	return s
 }
 
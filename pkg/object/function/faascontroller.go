@@ -85,11 +85,8 @@ func (f *FaasController) DefaultSpec() interface{} {
 
 // Validate validates the spec
 func (f *FaasController) Validate() error {
-	switch f.spec.Provider {
-	case spec.ProviderKnative:
-		//
-	default:
-		return fmt.Errorf("unknown FaaS provider: %s", f.spec.Provider)
+	if err := f.spec.Validate(); err != nil {
+		return err
 	}
 
 	vr := v.Validate(f.spec.HTTPServer)
@@ -0,0 +1,659 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/function/spec"
+	"github.com/megaease/easegress/v2/pkg/object/function/storage"
+	"github.com/megaease/easegress/v2/pkg/supervisor"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+const (
+	localAutoscaleInterval   = 2 * time.Second
+	localDefaultMaxReplica   = 10
+	localDefaultTarget       = 100
+	localDefaultStartTimeout = 30 * time.Second
+	localDefaultWindow       = 60 * time.Second
+	localStopTimeout         = 10 * time.Second
+)
+
+var (
+	errLocalFunctionDeleted   = errors.New("function deleted")
+	errLocalCommandNotAllowed = errors.New("functions with command are not allowed, set local.allowCommands of the FaaSController to allow them")
+)
+
+type (
+	// localProvider runs functions as local processes or containers, and
+	// routes requests to them by an activator listening on a local address.
+	localProvider struct {
+		superSpec *supervisor.Spec
+		spec      *spec.Local
+		store     storage.Storage
+
+		startTimeout time.Duration
+		stableWindow time.Duration
+		gracePeriod  time.Duration
+
+		process   localRuntime
+		container localRuntime
+
+		server *http.Server
+
+		mutex     sync.RWMutex
+		functions map[string]*localFunction
+		done      chan struct{}
+	}
+
+	// localFunction holds the instances of a function and the statistics
+	// for autoscaling.
+	localFunction struct {
+		provider *localProvider
+
+		// inflight, requests and lastRequest are accessed atomically.
+		inflight    int64
+		requests    int64
+		lastRequest int64
+
+		mutex      sync.Mutex
+		spec       *spec.Spec
+		instances  []*localInstance
+		starting   int
+		generation int
+		initial    bool
+		closed     bool
+		lastErr    error
+		readyCh    chan struct{}
+		next       int
+		samples    []localSample
+	}
+
+	localSample struct {
+		time        time.Time
+		concurrency int64
+		requests    int64
+	}
+
+	localInstance struct {
+		// inflight is accessed atomically.
+		inflight int64
+		proc     localProcess
+		proxy    *httputil.ReverseProxy
+	}
+)
+
+func newLocalProvider(superSpec *supervisor.Spec) *localProvider {
+	return &localProvider{
+		superSpec: superSpec,
+		store:     storage.NewStorage(superSpec.Name(), superSpec.Super().Cluster()),
+		functions: map[string]*localFunction{},
+		done:      make(chan struct{}),
+	}
+}
+
+func parseDurationDefault(s string, d time.Duration) time.Duration {
+	if s == "" {
+		return d
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil || v <= 0 {
+		logger.Errorf("BUG: parse duration %s failed: %v", s, err)
+		return d
+	}
+	return v
+}
+
+// Init initializes the local provider, it starts the activator and restores
+// the functions in the store.
+func (lp *localProvider) Init() error {
+	adm := lp.superSpec.ObjectSpec().(*spec.Admin)
+	lp.spec = adm.LocalSpec()
+
+	lp.startTimeout = parseDurationDefault(lp.spec.StartTimeout, localDefaultStartTimeout)
+	lp.stableWindow = parseDurationDefault(lp.spec.StableWindow, localDefaultWindow)
+	lp.gracePeriod = parseDurationDefault(lp.spec.ScaleToZeroGracePeriod, localDefaultWindow)
+
+	lp.process = &processRuntime{}
+	docker, err := newDockerRuntime(lp.spec.DockerHost, lp.superSpec.Name())
+	if err != nil {
+		logger.Infof("container runtime is unavailable, only functions with command are supported: %v", err)
+	} else {
+		docker.cleanup()
+		lp.container = docker
+	}
+
+	ln, err := net.Listen("tcp", lp.spec.GetListenAddress())
+	if err != nil {
+		logger.Errorf("local faas provider listen on %s failed: %v", lp.spec.GetListenAddress(), err)
+		return err
+	}
+	lp.server = &http.Server{Handler: lp}
+	go lp.server.Serve(ln)
+
+	lp.restore()
+	go lp.run()
+	return nil
+}
+
+// restore registers the functions in the store, their instances are started
+// on demand.
+func (lp *localProvider) restore() {
+	kvs, err := lp.store.GetPrefix(storage.GetAllFunctionSpecPrefix(lp.superSpec.Name()))
+	if err != nil {
+		logger.Errorf("list function specs failed: %v", err)
+		return
+	}
+
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+	for _, v := range kvs {
+		funcSpec := &spec.Spec{}
+		if err = codectool.Unmarshal([]byte(v), funcSpec); err != nil {
+			logger.Errorf("BUG: unmarshal %s to json failed: %v", v, err)
+			continue
+		}
+		lp.functions[funcSpec.Name] = lp.newFunction(funcSpec)
+	}
+}
+
+func (lp *localProvider) newFunction(funcSpec *spec.Spec) *localFunction {
+	return &localFunction{
+		provider:    lp,
+		spec:        funcSpec,
+		readyCh:     make(chan struct{}),
+		lastRequest: time.Now().UnixNano(),
+	}
+}
+
+func (lp *localProvider) run() {
+	for {
+		select {
+		case <-lp.done:
+			return
+		case now := <-time.After(localAutoscaleInterval):
+			lp.mutex.RLock()
+			for _, fn := range lp.functions {
+				fn.autoscale(now)
+			}
+			lp.mutex.RUnlock()
+		}
+	}
+}
+
+func (lp *localProvider) runtime(funcSpec *spec.Spec) (localRuntime, error) {
+	if len(funcSpec.Command) > 0 {
+		if !lp.spec.AllowCommands {
+			return nil, errLocalCommandNotAllowed
+		}
+		return lp.process, nil
+	}
+	if lp.container != nil {
+		return lp.container, nil
+	}
+	return nil, fmt.Errorf("function %s has no command and the container runtime is unavailable", funcSpec.Name)
+}
+
+// newInstance starts an instance of the function and waits for it to be ready.
+func (lp *localProvider) newInstance(funcSpec *spec.Spec) (*localInstance, error) {
+	rt, err := lp.runtime(funcSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+
+	proc, err := rt.run(funcSpec, port)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	if err = waitReady(addr, proc, lp.startTimeout); err != nil {
+		proc.stop()
+		return nil, err
+	}
+
+	return &localInstance{
+		proc:  proc,
+		proxy: httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: addr}),
+	}, nil
+}
+
+func freePort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+func waitReady(addr string, proc localProcess, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-proc.done():
+			return fmt.Errorf("instance exited before being ready")
+		default:
+		}
+
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("instance is not ready in %v", timeout)
+}
+
+// ServeHTTP is the activator, it routes the request to the function by the
+// first label of the host.
+func (lp *localProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	name, _, _ := strings.Cut(host, ".")
+
+	lp.mutex.RLock()
+	fn := lp.functions[name]
+	lp.mutex.RUnlock()
+
+	if fn == nil {
+		http.Error(w, fmt.Sprintf("function %s not found", name), http.StatusNotFound)
+		return
+	}
+	fn.serve(w, r)
+}
+
+// Create creates the function and starts its initial instances.
+func (lp *localProvider) Create(funcSpec *spec.Spec) error {
+	if len(funcSpec.Command) > 0 && !lp.spec.AllowCommands {
+		return errLocalCommandNotAllowed
+	}
+
+	lp.mutex.Lock()
+	fn := lp.functions[funcSpec.Name]
+	if fn == nil {
+		fn = lp.newFunction(funcSpec)
+		lp.functions[funcSpec.Name] = fn
+	}
+	lp.mutex.Unlock()
+
+	fn.update(funcSpec)
+	return nil
+}
+
+// Update updates the function, existing instances are replaced.
+func (lp *localProvider) Update(funcSpec *spec.Spec) error {
+	if len(funcSpec.Command) > 0 && !lp.spec.AllowCommands {
+		return errLocalCommandNotAllowed
+	}
+
+	lp.mutex.RLock()
+	fn := lp.functions[funcSpec.Name]
+	lp.mutex.RUnlock()
+
+	if fn == nil {
+		return lp.Create(funcSpec)
+	}
+	fn.update(funcSpec)
+	return nil
+}
+
+// Delete deletes the function and stops its instances.
+func (lp *localProvider) Delete(name string) error {
+	lp.mutex.Lock()
+	fn := lp.functions[name]
+	delete(lp.functions, name)
+	lp.mutex.Unlock()
+
+	if fn != nil {
+		for _, inst := range fn.close() {
+			go inst.drain()
+		}
+	}
+	return nil
+}
+
+// GetStatus returns the status of the function.
+func (lp *localProvider) GetStatus(name string) (*spec.Status, error) {
+	lp.mutex.RLock()
+	fn := lp.functions[name]
+	lp.mutex.RUnlock()
+
+	if fn == nil {
+		return nil, fmt.Errorf("function %s not found", name)
+	}
+
+	fn.mutex.Lock()
+	defer fn.mutex.Unlock()
+
+	status := &spec.Status{
+		ExtData: map[string]string{"replicas": strconv.Itoa(len(fn.instances))},
+	}
+	switch {
+	case len(fn.instances) == 0 && fn.lastErr != nil:
+		status.Event = spec.ErrorEvent
+		status.ExtData["error"] = fn.lastErr.Error()
+	case fn.initial:
+		status.Event = spec.PendingEvent
+	default:
+		status.Event = spec.ReadyEvent
+	}
+	return status, nil
+}
+
+// Close stops the activator and all instances.
+func (lp *localProvider) Close() {
+	close(lp.done)
+	if lp.server != nil {
+		lp.server.Close()
+	}
+
+	lp.mutex.Lock()
+	functions := lp.functions
+	lp.functions = map[string]*localFunction{}
+	lp.mutex.Unlock()
+
+	wg := &sync.WaitGroup{}
+	for _, fn := range functions {
+		for _, inst := range fn.close() {
+			wg.Add(1)
+			go func(inst *localInstance) {
+				defer wg.Done()
+				inst.proc.stop()
+			}(inst)
+		}
+	}
+	wg.Wait()
+}
+
+func (fn *localFunction) serve(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&fn.inflight, 1)
+	defer atomic.AddInt64(&fn.inflight, -1)
+	atomic.AddInt64(&fn.requests, 1)
+	atomic.StoreInt64(&fn.lastRequest, time.Now().UnixNano())
+
+	ctx, cancel := context.WithTimeout(r.Context(), fn.provider.startTimeout)
+	inst, err := fn.pick(ctx)
+	cancel()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	defer atomic.AddInt64(&inst.inflight, -1)
+	inst.proxy.ServeHTTP(w, r)
+}
+
+// pick picks an instance in round-robin, it starts an instance and waits
+// for it if there is none.
+func (fn *localFunction) pick(ctx context.Context) (*localInstance, error) {
+	started := false
+	for {
+		fn.mutex.Lock()
+		if fn.closed {
+			fn.mutex.Unlock()
+			return nil, errLocalFunctionDeleted
+		}
+
+		if n := len(fn.instances); n > 0 {
+			inst := fn.instances[fn.next%n]
+			fn.next++
+			atomic.AddInt64(&inst.inflight, 1)
+			fn.mutex.Unlock()
+			return inst, nil
+		}
+
+		if fn.starting == 0 {
+			if started {
+				err := fn.lastErr
+				fn.mutex.Unlock()
+				if err == nil {
+					err = fmt.Errorf("no instance available")
+				}
+				return nil, err
+			}
+			fn.startInstances(1)
+			started = true
+		}
+		ch := fn.readyCh
+		fn.mutex.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// startInstances starts n instances, the caller must hold the lock.
+func (fn *localFunction) startInstances(n int) {
+	for i := 0; i < n; i++ {
+		fn.starting++
+		go fn.startInstance(fn.spec, fn.generation)
+	}
+}
+
+func (fn *localFunction) startInstance(funcSpec *spec.Spec, generation int) {
+	inst, err := fn.provider.newInstance(funcSpec)
+
+	fn.mutex.Lock()
+	defer fn.mutex.Unlock()
+
+	if fn.closed || generation != fn.generation {
+		if inst != nil {
+			go inst.drain()
+		}
+		return
+	}
+
+	fn.starting--
+	if err != nil {
+		logger.Errorf("start instance of function %s failed: %v", funcSpec.Name, err)
+		fn.lastErr = err
+	} else {
+		fn.lastErr = nil
+		fn.initial = false
+		fn.instances = append(fn.instances, inst)
+	}
+	fn.broadcast()
+}
+
+// broadcast wakes up requests waiting for instances, the caller must hold
+// the lock.
+func (fn *localFunction) broadcast() {
+	close(fn.readyCh)
+	fn.readyCh = make(chan struct{})
+}
+
+// update replaces the spec and the instances of the function.
+func (fn *localFunction) update(funcSpec *spec.Spec) {
+	fn.mutex.Lock()
+	defer fn.mutex.Unlock()
+
+	old := fn.instances
+	fn.spec = funcSpec
+	fn.generation++
+	fn.instances = nil
+	fn.starting = 0
+	fn.initial = true
+	fn.lastErr = nil
+	fn.samples = nil
+	atomic.StoreInt64(&fn.lastRequest, time.Now().UnixNano())
+
+	initial := funcSpec.MinReplica
+	if initial < 1 {
+		initial = 1
+	}
+	fn.startInstances(initial)
+	fn.broadcast()
+
+	for _, inst := range old {
+		go inst.drain()
+	}
+}
+
+// close marks the function as closed and returns its instances.
+func (fn *localFunction) close() []*localInstance {
+	fn.mutex.Lock()
+	defer fn.mutex.Unlock()
+
+	instances := fn.instances
+	fn.instances = nil
+	fn.closed = true
+	fn.broadcast()
+	return instances
+}
+
+// target returns the target value of the autoscale metric per instance.
+func (fn *localFunction) target() float64 {
+	v, err := strconv.ParseFloat(fn.spec.AutoScaleValue, 64)
+	if err != nil || v <= 0 {
+		return localDefaultTarget
+	}
+	return v
+}
+
+// observe returns the average value of the autoscale metric in the stable
+// window, cpu is not measurable for local instances and falls back to
+// concurrency.
+func (fn *localFunction) observe() float64 {
+	if len(fn.samples) == 0 {
+		return 0
+	}
+
+	total := 0.0
+	for _, s := range fn.samples {
+		if fn.spec.AutoScaleType == spec.AutoScaleMetricRPS {
+			total += float64(s.requests)
+		} else {
+			total += float64(s.concurrency)
+		}
+	}
+
+	if fn.spec.AutoScaleType == spec.AutoScaleMetricRPS {
+		return total / (float64(len(fn.samples)) * localAutoscaleInterval.Seconds())
+	}
+	return total / float64(len(fn.samples))
+}
+
+// autoscale calculates the desired replicas and scales the function.
+func (fn *localFunction) autoscale(now time.Time) {
+	fn.mutex.Lock()
+	defer fn.mutex.Unlock()
+
+	if fn.closed {
+		return
+	}
+
+	alive := make([]*localInstance, 0, len(fn.instances))
+	for _, inst := range fn.instances {
+		if inst.exited() {
+			logger.Errorf("instance of function %s exited unexpectedly", fn.spec.Name)
+			fn.lastErr = fmt.Errorf("instance exited unexpectedly")
+			continue
+		}
+		alive = append(alive, inst)
+	}
+	fn.instances = alive
+
+	inflight := atomic.LoadInt64(&fn.inflight)
+	fn.samples = append(fn.samples, localSample{
+		time:        now,
+		concurrency: inflight,
+		requests:    atomic.SwapInt64(&fn.requests, 0),
+	})
+	for len(fn.samples) > 0 && now.Sub(fn.samples[0].time) > fn.provider.stableWindow {
+		fn.samples = fn.samples[1:]
+	}
+
+	target := fn.target()
+	desired := int(math.Ceil(fn.observe() / target))
+	if burst := int(math.Ceil(float64(inflight) / target)); burst > desired {
+		desired = burst
+	}
+
+	current := len(fn.instances) + fn.starting
+	lastRequest := time.Unix(0, atomic.LoadInt64(&fn.lastRequest))
+	if desired == 0 && current > 0 && now.Sub(lastRequest) < fn.provider.gracePeriod {
+		desired = 1
+	}
+
+	maxReplica := fn.spec.MaxReplica
+	if maxReplica <= 0 {
+		maxReplica = localDefaultMaxReplica
+	}
+	if desired < fn.spec.MinReplica {
+		desired = fn.spec.MinReplica
+	}
+	if desired > maxReplica {
+		desired = maxReplica
+	}
+
+	switch {
+	case desired > current:
+		logger.Debugf("scale function %s from %d to %d", fn.spec.Name, current, desired)
+		fn.startInstances(desired - current)
+	case desired < len(fn.instances):
+		logger.Debugf("scale function %s from %d to %d", fn.spec.Name, len(fn.instances), desired)
+		for _, inst := range fn.instances[desired:] {
+			go inst.drain()
+		}
+		fn.instances = append([]*localInstance(nil), fn.instances[:desired]...)
+	}
+}
+
+func (inst *localInstance) exited() bool {
+	select {
+	case <-inst.proc.done():
+		return true
+	default:
+		return false
+	}
+}
+
+// drain waits for the inflight requests of the instance and stops it.
+func (inst *localInstance) drain() {
+	deadline := time.Now().Add(localStopTimeout)
+	for atomic.LoadInt64(&inst.inflight) > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	inst.proc.stop()
+}
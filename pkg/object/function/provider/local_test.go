@@ -0,0 +1,328 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/function/spec"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+// fakeRuntime runs instances as HTTP servers in this process.
+type fakeRuntime struct {
+	lock    sync.Mutex
+	runs    int
+	stopped int
+	err     error
+	// gate blocks run if it is not nil.
+	gate chan struct{}
+}
+
+type fakeProcess struct {
+	rt     *fakeRuntime
+	server *http.Server
+	doneCh chan struct{}
+	once   sync.Once
+}
+
+func (rt *fakeRuntime) run(funcSpec *spec.Spec, port int) (localProcess, error) {
+	rt.lock.Lock()
+	rt.runs++
+	err, gate := rt.err, rt.gate
+	rt.lock.Unlock()
+
+	if gate != nil {
+		<-gate
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		return nil, err
+	}
+	image := funcSpec.Image
+	p := &fakeProcess{rt: rt, doneCh: make(chan struct{})}
+	p.server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(image))
+	})}
+	go p.server.Serve(ln)
+	return p, nil
+}
+
+func (rt *fakeRuntime) numOfRuns() int {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	return rt.runs
+}
+
+func (rt *fakeRuntime) numOfStopped() int {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	return rt.stopped
+}
+
+func (p *fakeProcess) done() <-chan struct{} {
+	return p.doneCh
+}
+
+func (p *fakeProcess) stop() {
+	p.once.Do(func() {
+		p.server.Close()
+		close(p.doneCh)
+		p.rt.lock.Lock()
+		p.rt.stopped++
+		p.rt.lock.Unlock()
+	})
+}
+
+func newTestLocalProvider(rt *fakeRuntime) *localProvider {
+	return &localProvider{
+		spec:         &spec.Local{AllowCommands: true},
+		startTimeout: 5 * time.Second,
+		stableWindow: time.Minute,
+		gracePeriod:  time.Minute,
+		process:      rt,
+		container:    rt,
+		functions:    map[string]*localFunction{},
+		done:         make(chan struct{}),
+	}
+}
+
+func newTestFunctionSpec(name, image string, minReplica int) *spec.Spec {
+	return &spec.Spec{
+		Name:           name,
+		Image:          image,
+		AutoScaleType:  spec.AutoScaleMetricConcurrency,
+		AutoScaleValue: "1",
+		MinReplica:     minReplica,
+		MaxReplica:     3,
+	}
+}
+
+func (fn *localFunction) numOfInstances() int {
+	fn.mutex.Lock()
+	defer fn.mutex.Unlock()
+	return len(fn.instances)
+}
+
+func TestLocalAllowCommands(t *testing.T) {
+	assert := assert.New(t)
+
+	rt := &fakeRuntime{}
+	lp := newTestLocalProvider(rt)
+	defer lp.Close()
+	lp.spec.AllowCommands = false
+
+	funcSpec := newTestFunctionSpec("demo", "", 0)
+	funcSpec.Command = []string{"sh", "-c", "exit 1"}
+	assert.Equal(errLocalCommandNotAllowed, lp.Create(funcSpec))
+	assert.Equal(errLocalCommandNotAllowed, lp.Update(funcSpec))
+	assert.Empty(lp.functions)
+
+	// functions restored from the store can't run either
+	_, err := lp.runtime(funcSpec)
+	assert.Equal(errLocalCommandNotAllowed, err)
+
+	lp.spec.AllowCommands = true
+	_, err = lp.runtime(funcSpec)
+	assert.NoError(err)
+}
+
+func TestLocalServe(t *testing.T) {
+	assert := assert.New(t)
+
+	rt := &fakeRuntime{}
+	lp := newTestLocalProvider(rt)
+	defer lp.Close()
+
+	assert.NoError(lp.Create(newTestFunctionSpec("demo", "v1", 0)))
+	fn := lp.functions["demo"]
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://demo.default.faas.local/", nil)
+	lp.ServeHTTP(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+	body, _ := io.ReadAll(w.Body)
+	assert.Equal("v1", string(body))
+	assert.Equal(1, fn.numOfInstances())
+
+	status, err := lp.GetStatus("demo")
+	assert.NoError(err)
+	assert.Equal(spec.ReadyEvent, status.Event)
+
+	// unknown function
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "http://unknown.default.faas.local/", nil)
+	lp.ServeHTTP(w, r)
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	_, err = lp.GetStatus("unknown")
+	assert.Error(err)
+
+	assert.NoError(lp.Delete("demo"))
+	_, err = fn.pick(context.Background())
+	assert.Equal(errLocalFunctionDeleted, err)
+	assert.Eventually(func() bool { return rt.numOfStopped() == 1 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestLocalPickFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	rt := &fakeRuntime{err: fmt.Errorf("no such image")}
+	lp := newTestLocalProvider(rt)
+	defer lp.Close()
+
+	assert.NoError(lp.Create(newTestFunctionSpec("demo", "v1", 0)))
+	fn := lp.functions["demo"]
+
+	_, err := fn.pick(context.Background())
+	assert.Error(err)
+	assert.Contains(err.Error(), "no such image")
+
+	status, err := lp.GetStatus("demo")
+	assert.NoError(err)
+	assert.Equal(spec.ErrorEvent, status.Event)
+	assert.Contains(status.ExtData["error"], "no such image")
+
+	// the request waits for the starting instance until it is canceled
+	rt.lock.Lock()
+	rt.err = nil
+	rt.gate = make(chan struct{})
+	rt.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err = fn.pick(ctx)
+	cancel()
+	assert.Equal(context.DeadlineExceeded, err)
+
+	// the instance is ready now
+	close(rt.gate)
+	inst, err := fn.pick(context.Background())
+	assert.NoError(err)
+	assert.NotNil(inst)
+	atomic.AddInt64(&inst.inflight, -1)
+}
+
+func TestLocalAutoscale(t *testing.T) {
+	assert := assert.New(t)
+
+	rt := &fakeRuntime{}
+	lp := newTestLocalProvider(rt)
+	defer lp.Close()
+
+	assert.NoError(lp.Create(newTestFunctionSpec("demo", "v1", 0)))
+	fn := lp.functions["demo"]
+	assert.Eventually(func() bool { return fn.numOfInstances() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// scale out by the concurrency, limited by maxReplica
+	now := time.Now()
+	atomic.StoreInt64(&fn.inflight, 5)
+	fn.autoscale(now)
+	assert.Eventually(func() bool { return fn.numOfInstances() == 3 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(3, rt.numOfRuns())
+
+	// keep one instance in the grace period
+	atomic.StoreInt64(&fn.inflight, 0)
+	now = now.Add(2 * time.Minute)
+	atomic.StoreInt64(&fn.lastRequest, now.Add(-time.Second).UnixNano())
+	fn.autoscale(now)
+	assert.Equal(1, fn.numOfInstances())
+	assert.Eventually(func() bool { return rt.numOfStopped() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	// scale to zero after the grace period
+	now = now.Add(2 * time.Minute)
+	fn.autoscale(now)
+	assert.Equal(0, fn.numOfInstances())
+	assert.Eventually(func() bool { return rt.numOfStopped() == 3 }, 5*time.Second, 10*time.Millisecond)
+
+	// exited instances are removed
+	inst, err := fn.pick(context.Background())
+	assert.NoError(err)
+	atomic.AddInt64(&inst.inflight, -1)
+	inst.proc.stop()
+	fn.autoscale(now)
+	assert.Equal(0, fn.numOfInstances())
+	assert.Error(fn.lastErr)
+}
+
+func TestLocalUpdate(t *testing.T) {
+	assert := assert.New(t)
+
+	gate := make(chan struct{})
+	rt := &fakeRuntime{gate: gate}
+	lp := newTestLocalProvider(rt)
+	defer lp.Close()
+
+	// the instance of the first generation is still starting
+	assert.NoError(lp.Create(newTestFunctionSpec("demo", "v1", 0)))
+	fn := lp.functions["demo"]
+	assert.Eventually(func() bool { return rt.numOfRuns() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	rt.lock.Lock()
+	rt.gate = nil
+	rt.lock.Unlock()
+	assert.NoError(lp.Update(newTestFunctionSpec("demo", "v2", 0)))
+	assert.Eventually(func() bool { return fn.numOfInstances() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	status, err := lp.GetStatus("demo")
+	assert.NoError(err)
+	assert.Equal(spec.ReadyEvent, status.Event)
+
+	// the instance of the first generation is discarded after it is ready
+	close(gate)
+	assert.Eventually(func() bool { return rt.numOfStopped() == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(1, fn.numOfInstances())
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://demo.default.faas.local/", nil)
+	lp.ServeHTTP(w, r)
+	body, _ := io.ReadAll(w.Body)
+	assert.Equal("v2", string(body))
+
+	// instances of the previous generation are replaced
+	assert.NoError(lp.Update(newTestFunctionSpec("demo", "v3", 0)))
+	assert.Eventually(func() bool { return rt.numOfStopped() == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(func() bool { return fn.numOfInstances() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	w = httptest.NewRecorder()
+	lp.ServeHTTP(w, r)
+	body, _ = io.ReadAll(w.Body)
+	assert.Equal("v3", string(body))
+}
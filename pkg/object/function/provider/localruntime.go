@@ -0,0 +1,334 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	k8sresource "k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/function/spec"
+)
+
+const (
+	localDefaultDockerHost    = "unix:///var/run/docker.sock"
+	localDefaultContainerPort = 8080
+	localDockerTimeout        = 30 * time.Second
+
+	localLabelController = "easegress.faas.controller"
+	localLabelFunction   = "easegress.faas.function"
+)
+
+type (
+	// localRuntime runs instances of functions.
+	localRuntime interface {
+		// run starts an instance of the function which serves on port of
+		// the local host.
+		run(funcSpec *spec.Spec, port int) (localProcess, error)
+	}
+
+	// localProcess is a running instance.
+	localProcess interface {
+		// done is closed after the instance exits.
+		done() <-chan struct{}
+		// stop stops the instance and releases its resources.
+		stop()
+	}
+
+	// processRuntime runs functions as local processes.
+	processRuntime struct{}
+
+	localCmd struct {
+		cmd    *exec.Cmd
+		doneCh chan struct{}
+	}
+
+	// dockerRuntime runs functions as containers by the Docker Engine API.
+	dockerRuntime struct {
+		client     *http.Client
+		baseURL    string
+		controller string
+	}
+
+	localContainer struct {
+		runtime *dockerRuntime
+		id      string
+		doneCh  chan struct{}
+	}
+)
+
+// envList returns the environment variables of the function in a stable order.
+func envList(funcSpec *spec.Spec, port int) []string {
+	keys := make([]string, 0, len(funcSpec.Env))
+	for k := range funcSpec.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	env := make([]string, 0, len(keys)+1)
+	for _, k := range keys {
+		env = append(env, k+"="+funcSpec.Env[k])
+	}
+	return append(env, "PORT="+strconv.Itoa(port))
+}
+
+func (pr *processRuntime) run(funcSpec *spec.Spec, port int) (localProcess, error) {
+	cmd := exec.Command(funcSpec.Command[0], funcSpec.Command[1:]...)
+	cmd.Env = append(os.Environ(), envList(funcSpec, port)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start command of function %s failed: %v", funcSpec.Name, err)
+	}
+
+	lc := &localCmd{cmd: cmd, doneCh: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(lc.doneCh)
+	}()
+	return lc, nil
+}
+
+func (lc *localCmd) done() <-chan struct{} {
+	return lc.doneCh
+}
+
+func (lc *localCmd) stop() {
+	if err := lc.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		lc.cmd.Process.Kill()
+	}
+
+	select {
+	case <-lc.doneCh:
+	case <-time.After(localStopTimeout):
+		lc.cmd.Process.Kill()
+		<-lc.doneCh
+	}
+}
+
+func newDockerRuntime(host, controller string) (*dockerRuntime, error) {
+	if host == "" {
+		host = localDefaultDockerHost
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+
+	dr := &dockerRuntime{controller: controller}
+	switch u.Scheme {
+	case "unix":
+		if _, err := os.Stat(u.Path); err != nil {
+			return nil, err
+		}
+		dialer := &net.Dialer{}
+		dr.baseURL = "http://docker"
+		dr.client = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", u.Path)
+				},
+			},
+		}
+	case "tcp", "http":
+		dr.baseURL = "http://" + u.Host
+		dr.client = &http.Client{}
+	default:
+		return nil, fmt.Errorf("unsupported docker host: %s", host)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), localDockerTimeout)
+	defer cancel()
+	if _, err := dr.do(ctx, http.MethodGet, "/_ping", nil, nil, nil); err != nil {
+		return nil, err
+	}
+	return dr, nil
+}
+
+// do sends a request to the Docker Engine API, out is decoded from the
+// response body if it is not nil.
+func (dr *dockerRuntime) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) (int, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	u := dr.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return 0, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := dr.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, fmt.Errorf("docker %s %s: %d %s", method, path, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	if out != nil {
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, err
+}
+
+// cleanup removes containers left by the previous run of the controller.
+func (dr *dockerRuntime) cleanup() {
+	ctx, cancel := context.WithTimeout(context.Background(), localDockerTimeout)
+	defer cancel()
+
+	filters, _ := json.Marshal(map[string][]string{
+		"label": {localLabelController + "=" + dr.controller},
+	})
+	containers := []struct {
+		ID string `json:"Id"`
+	}{}
+	query := url.Values{"all": {"1"}, "filters": {string(filters)}}
+	if _, err := dr.do(ctx, http.MethodGet, "/containers/json", query, nil, &containers); err != nil {
+		logger.Errorf("list containers failed: %v", err)
+		return
+	}
+	for _, c := range containers {
+		dr.remove(c.ID)
+	}
+}
+
+func (dr *dockerRuntime) remove(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), localDockerTimeout)
+	defer cancel()
+	query := url.Values{"force": {"1"}}
+	if _, err := dr.do(ctx, http.MethodDelete, "/containers/"+id, query, nil, nil); err != nil {
+		logger.Errorf("remove container %s failed: %v", id, err)
+	}
+}
+
+func (dr *dockerRuntime) pull(image string) error {
+	logger.Infof("pulling image %s", image)
+	_, err := dr.do(context.Background(), http.MethodPost, "/images/create", url.Values{"fromImage": {image}}, nil, nil)
+	return err
+}
+
+func (dr *dockerRuntime) run(funcSpec *spec.Spec, port int) (localProcess, error) {
+	containerPort := funcSpec.Port
+	if containerPort == 0 {
+		containerPort = localDefaultContainerPort
+	}
+	portKey := strconv.Itoa(containerPort) + "/tcp"
+
+	hostConfig := map[string]interface{}{
+		"PortBindings": map[string]interface{}{
+			portKey: []map[string]string{{"HostIp": "127.0.0.1", "HostPort": strconv.Itoa(port)}},
+		},
+	}
+	if q, err := k8sresource.ParseQuantity(funcSpec.LimitMemory); err == nil {
+		hostConfig["Memory"] = q.Value()
+	}
+	if q, err := k8sresource.ParseQuantity(funcSpec.LimitCPU); err == nil {
+		hostConfig["NanoCpus"] = q.MilliValue() * 1000000
+	}
+
+	config := map[string]interface{}{
+		"Image":        funcSpec.Image,
+		"Env":          envList(funcSpec, containerPort),
+		"ExposedPorts": map[string]interface{}{portKey: struct{}{}},
+		"Labels": map[string]string{
+			localLabelController: dr.controller,
+			localLabelFunction:   funcSpec.Name,
+		},
+		"HostConfig": hostConfig,
+	}
+
+	create := func() (string, int, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), localDockerTimeout)
+		defer cancel()
+		resp := struct {
+			ID string `json:"Id"`
+		}{}
+		code, err := dr.do(ctx, http.MethodPost, "/containers/create", nil, config, &resp)
+		return resp.ID, code, err
+	}
+
+	id, code, err := create()
+	if code == http.StatusNotFound {
+		if err = dr.pull(funcSpec.Image); err != nil {
+			return nil, err
+		}
+		id, _, err = create()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), localDockerTimeout)
+	defer cancel()
+	if _, err = dr.do(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil, nil); err != nil {
+		dr.remove(id)
+		return nil, err
+	}
+
+	lc := &localContainer{runtime: dr, id: id, doneCh: make(chan struct{})}
+	go func() {
+		dr.do(context.Background(), http.MethodPost, "/containers/"+id+"/wait", nil, nil, nil)
+		close(lc.doneCh)
+	}()
+	return lc, nil
+}
+
+func (lc *localContainer) done() <-chan struct{} {
+	return lc.doneCh
+}
+
+func (lc *localContainer) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), localDockerTimeout)
+	defer cancel()
+	query := url.Values{"t": {strconv.Itoa(int(localStopTimeout.Seconds()))}}
+	code, err := lc.runtime.do(ctx, http.MethodPost, "/containers/"+lc.id+"/stop", query, nil, nil)
+	if err != nil && code != http.StatusNotModified {
+		logger.Errorf("stop container %s failed: %v", lc.id, err)
+	}
+	lc.runtime.remove(lc.id)
+}
@@ -45,6 +45,7 @@ type (
 		Create(funcSpec *spec.Spec) error
 		Delete(name string) error
 		Update(funcSpec *spec.Spec) error
+		Close()
 	}
 
 	// knativeClient is client for communicating with Knative type FaaSProvider
@@ -57,6 +58,9 @@ type (
 )
 
 func (kc *knativeClient) Create(funcSpec *spec.Spec) error {
+	if err := checkKnativeSpec(funcSpec); err != nil {
+		return err
+	}
 	return kc.createService(funcSpec)
 }
 
@@ -101,6 +105,9 @@ func (kc *knativeClient) GetStatus(name string) (*spec.Status, error) {
 }
 
 func (kc *knativeClient) Update(spec *spec.Spec) error {
+	if err := checkKnativeSpec(spec); err != nil {
+		return err
+	}
 	return kc.updateService(spec)
 }
 
@@ -108,13 +115,33 @@ func (kc *knativeClient) Delete(name string) error {
 	return kc.deleteService(name)
 }
 
-// NewProvider returns FaaSProvider client. It only supports Knative now.
+// Close closes the knative client, it does nothing.
+func (kc *knativeClient) Close() {}
+
+// NewProvider returns FaaSProvider client according to the provider type.
 func NewProvider(superSpec *supervisor.Spec) FaaSProvider {
+	adm := superSpec.ObjectSpec().(*spec.Admin)
+	if adm.Provider == spec.ProviderLocal {
+		return newLocalProvider(superSpec)
+	}
 	return &knativeClient{
 		superSpec: superSpec,
 	}
 }
 
+// checkKnativeSpec checks the fields which are optional in Spec but
+// required by Knative.
+func checkKnativeSpec(funcSpec *spec.Spec) error {
+	if funcSpec.Image == "" {
+		return fmt.Errorf("image is required by knative")
+	}
+	if funcSpec.LimitCPU == "" || funcSpec.LimitMemory == "" ||
+		funcSpec.RequestCPU == "" || funcSpec.RequestMemory == "" {
+		return fmt.Errorf("limitCPU, limitMemory, requestCPU and requestMemory are required by knative")
+	}
+	return nil
+}
+
 // Init initializes knative client.
 func (kc *knativeClient) Init() error {
 	var err error
@@ -36,6 +36,13 @@ const (
 
 	// ProviderKnative is the FaaS provider Knative.
 	ProviderKnative = "knative"
+	// ProviderLocal is the FaaS provider which runs functions on the local machine.
+	ProviderLocal = "local"
+
+	// LocalHostSuffix is the host suffix of functions of the local provider.
+	LocalHostSuffix = "faas.local"
+	// LocalNamespace is the namespace of functions of the local provider.
+	LocalNamespace = "default"
 )
 
 type (
@@ -50,9 +57,11 @@ type (
 		// HTTPServer is the HTTP traffic gate for accepting ingress traffic.
 		HTTPServer *httpserver.Spec `json:"httpServer" jsonschema:"required"`
 
-		// Currently we only supports knative type faas provider, so this filed should be
-		// "required" right now.
-		Knative *Knative `json:"knative" jsonschema:"required"`
+		// Knative is required if Provider is knative.
+		Knative *Knative `json:"knative,omitempty"`
+
+		// Local is the local provider, it is optional.
+		Local *Local `json:"local,omitempty"`
 	}
 
 	// Function contains the FaaSFunction's spec ,runtime status with a build-in fsm.
@@ -65,7 +74,7 @@ type (
 	// Spec is the spec of FaaSFunction.
 	Spec struct {
 		Name           string `json:"name" jsonschema:"required"`
-		Image          string `json:"image" jsonschema:"required"`
+		Image          string `json:"image,omitempty"`
 		Port           int    `json:"port,omitempty"`
 		AutoScaleType  string `json:"autoScaleType" jsonschema:"required"`
 		AutoScaleValue string `json:"autoScaleValue" jsonschema:"required"`
@@ -76,6 +85,12 @@ type (
 		RequestCPU     string `json:"requestCPU,omitempty"`
 		RequestMemory  string `json:"requestMemory,omitempty"`
 
+		// Command and Env are used by the local provider to run the function
+		// as a local process, the port to listen on is passed to the process
+		// in the PORT environment variable.
+		Command []string          `json:"command,omitempty"`
+		Env     map[string]string `json:"env,omitempty"`
+
 		RequestAdaptor *builder.RequestAdaptorSpec `json:"requestAdaptor" jsonschema:"required"`
 	}
 
@@ -89,14 +104,70 @@ type (
 
 	// Knative is the faas provider Knative.
 	Knative struct {
-		HostSuffix      string `json:"hostSuffix" jsonschema:"required"`
-		NetworkLayerURL string `json:"networkLayerURL" jsonschema:"required,format=uri"`
+		HostSuffix      string `json:"hostSuffix,omitempty"`
+		NetworkLayerURL string `json:"networkLayerURL,omitempty" jsonschema:"format=uri"`
 
 		Namespace string `json:"namespace,omitempty"`
 		Timeout   string `json:"timeout,omitempty" jsonschema:"format=duration"`
 	}
+
+	// Local is the faas provider which runs functions as local processes,
+	// or as containers if the container runtime is available.
+	Local struct {
+		// ListenAddress is the address of the activator, which routes
+		// requests to the instances of functions, default is 127.0.0.1:10090.
+		ListenAddress string `json:"listenAddress,omitempty"`
+		// DockerHost is the socket of the container runtime, default is
+		// unix:///var/run/docker.sock.
+		DockerHost string `json:"dockerHost,omitempty"`
+		// StartTimeout is the timeout for an instance to be ready, default is 30s.
+		StartTimeout string `json:"startTimeout,omitempty" jsonschema:"format=duration"`
+		// StableWindow is the time window to calculate the metric for
+		// autoscaling, default is 60s.
+		StableWindow string `json:"stableWindow,omitempty" jsonschema:"format=duration"`
+		// ScaleToZeroGracePeriod is the idle time before the last instance is
+		// stopped, default is 60s.
+		ScaleToZeroGracePeriod string `json:"scaleToZeroGracePeriod,omitempty" jsonschema:"format=duration"`
+		// AllowCommands allows functions to run commands as local processes,
+		// which have the same privileges as Easegress, so anyone who can
+		// create functions can run any command on the machine. Functions
+		// with commands are rejected if it is false.
+		AllowCommands bool `json:"allowCommands,omitempty"`
+	}
 )
 
+// Validate validates Admin.
+func (adm *Admin) Validate() error {
+	switch adm.Provider {
+	case ProviderKnative:
+		if adm.Knative == nil || adm.Knative.HostSuffix == "" || adm.Knative.NetworkLayerURL == "" {
+			return fmt.Errorf("knative.hostSuffix and knative.networkLayerURL are required for provider knative")
+		}
+	case ProviderLocal:
+		//
+	default:
+		return fmt.Errorf("unknown FaaS provider: %s", adm.Provider)
+	}
+	return nil
+}
+
+// LocalSpec returns the spec of the local provider, a default one is
+// returned if it is not configured.
+func (adm *Admin) LocalSpec() *Local {
+	if adm.Local != nil {
+		return adm.Local
+	}
+	return &Local{}
+}
+
+// GetListenAddress returns the listen address of the activator.
+func (l *Local) GetListenAddress() string {
+	if l.ListenAddress != "" {
+		return l.ListenAddress
+	}
+	return "127.0.0.1:10090"
+}
+
 // Validate valid FaaSFunction's spec.
 func (spec *Spec) Validate() error {
 	if spec.MinReplica > spec.MaxReplica {
@@ -110,6 +181,10 @@ func (spec *Spec) Validate() error {
 		return fmt.Errorf("unknown autoscale type: %s", spec.AutoScaleType)
 	}
 
+	if spec.Image == "" && len(spec.Command) == 0 {
+		return fmt.Errorf("image or command is required")
+	}
+
 	checkK8s := func() (errMsg error) {
 		defer func() {
 			if err := recover(); err != nil {
@@ -117,11 +192,13 @@ func (spec *Spec) Validate() error {
 			}
 		}()
 
-		// check if k8s resource valid or note
-		k8sresource.MustParse(spec.LimitMemory)
-		k8sresource.MustParse(spec.LimitCPU)
-		k8sresource.MustParse(spec.RequestCPU)
-		k8sresource.MustParse(spec.RequestMemory)
+		// check if k8s resource valid or note, empty values are checked by
+		// the providers which require them.
+		for _, v := range []string{spec.LimitMemory, spec.LimitCPU, spec.RequestCPU, spec.RequestMemory} {
+			if v != "" {
+				k8sresource.MustParse(v)
+			}
+		}
 		return
 	}
 
@@ -86,6 +86,45 @@ func TestValidSpec(t *testing.T) {
 	}
 }
 
+func TestLocalSpec(t *testing.T) {
+	spec := Spec{
+		Name:           "demo",
+		Command:        []string{"./demo"},
+		Env:            map[string]string{"DEBUG": "1"},
+		AutoScaleType:  AutoScaleMetricConcurrency,
+		AutoScaleValue: "10",
+		MaxReplica:     2,
+	}
+	if err := spec.Validate(); err != nil {
+		t.Errorf("spec should be valid, err: %v", err)
+	}
+
+	spec.Command = nil
+	if err := spec.Validate(); err == nil {
+		t.Errorf("spec without image and command should not be valid")
+	}
+}
+
+func TestAdminValidate(t *testing.T) {
+	adm := &Admin{Provider: ProviderLocal}
+	if err := adm.Validate(); err != nil {
+		t.Errorf("admin should be valid, err: %v", err)
+	}
+	if addr := adm.LocalSpec().GetListenAddress(); addr != "127.0.0.1:10090" {
+		t.Errorf("unexpected default listen address: %s", addr)
+	}
+
+	adm = &Admin{Provider: ProviderKnative, Knative: &Knative{Namespace: "default"}}
+	if err := adm.Validate(); err == nil {
+		t.Errorf("knative admin without hostSuffix should not be valid")
+	}
+
+	adm = &Admin{Provider: "unknown"}
+	if err := adm.Validate(); err == nil {
+		t.Errorf("admin with unknown provider should not be valid")
+	}
+}
+
 func TestInValidSpecReplica(t *testing.T) {
 	spec := Spec{
 		Name:           "demo",
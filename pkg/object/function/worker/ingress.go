@@ -185,14 +185,20 @@ func (ings *ingressServer) Init() error {
 	if ings.httpServer != nil {
 		return nil
 	}
-	spec := ings.superSpec.ObjectSpec().(*spec.Admin)
-
-	ings.faasNetworkLayerURL = spec.Knative.NetworkLayerURL
-	ings.faasHostSuffix = spec.Knative.HostSuffix
-	ings.faasNamespace = spec.Knative.Namespace
+	adm := ings.superSpec.ObjectSpec().(*spec.Admin)
+
+	if adm.Provider == spec.ProviderLocal {
+		ings.faasNetworkLayerURL = "http://" + adm.LocalSpec().GetListenAddress()
+		ings.faasHostSuffix = spec.LocalHostSuffix
+		ings.faasNamespace = spec.LocalNamespace
+	} else {
+		ings.faasNetworkLayerURL = adm.Knative.NetworkLayerURL
+		ings.faasHostSuffix = adm.Knative.HostSuffix
+		ings.faasNamespace = adm.Knative.Namespace
+	}
 
 	builder := newHTTPServerSpecBuilder(ings.superSpec.Name())
-	builder.buildWithOutRules(spec.HTTPServer)
+	builder.buildWithOutRules(adm.HTTPServer)
 	superSpec, err := supervisor.NewSpec(builder.jsonConfig())
 	if err != nil {
 		logger.Errorf("new spec for %s failed: %v", builder.jsonConfig(), err)
@@ -190,4 +190,5 @@ func (worker *Worker) Close() {
 
 	close(worker.done)
 	worker.ingress.Close()
+	worker.provider.Close()
 }
@@ -197,6 +197,13 @@ func (gf *GlobalFilter) createPipeline(name string, spec *pipeline.Spec, previou
 
 // Handle `beforePipeline` and `afterPipeline` before and after the handler is executed.
 func (gf *GlobalFilter) Handle(ctx *context.Context, handler context.Handler) {
+	gf.HandleWithOnPipeline(ctx, handler, nil)
+}
+
+// HandleWithOnPipeline is like Handle, and onPipeline is called right
+// before the handler is executed, which means the request passes the
+// before pipeline.
+func (gf *GlobalFilter) HandleWithOnPipeline(ctx *context.Context, handler context.Handler, onPipeline func()) {
 	p, ok := handler.(*pipeline.Pipeline)
 	if !ok {
 		panic("handler is not a pipeline")
@@ -207,6 +214,7 @@ func (gf *GlobalFilter) Handle(ctx *context.Context, handler context.Handler) {
 	option := pipeline.HandleWithBeforeAfterOption{
 		FallthroughBefore:   gf.spec.Fallthrough.BeforePipeline,
 		FallthroughPipeline: gf.spec.Fallthrough.Pipeline,
+		OnPipeline:          onPipeline,
 	}
 	p.HandleWithBeforeAfter(ctx, before, after, option)
 }
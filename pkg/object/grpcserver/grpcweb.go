@@ -0,0 +1,309 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpcserver
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/util/stringtool"
+)
+
+const (
+	grpcContentType        = "application/grpc"
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+
+	// grpcWebTrailerFlag is the flag of the frame which carries the
+	// trailers in gRPC-Web responses.
+	grpcWebTrailerFlag = 0x80
+)
+
+// hopHeaders are the hop-by-hop headers, they must not be forwarded as
+// gRPC metadata.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Content-Length",
+}
+
+type (
+	// httpHandler serves gRPC-Web and transcoded HTTP/JSON requests
+	// besides native gRPC requests, the former are converted to native
+	// gRPC requests and then served by the gRPC server, so they are routed
+	// and handled in the same way as native gRPC requests.
+	httpHandler struct {
+		grpc       http.Handler
+		grpcWeb    *GRPCWebSpec
+		transcoder *transcoder
+	}
+
+	// grpcWebResponseWriter converts the gRPC response written by the gRPC
+	// server to a gRPC-Web response, the trailers are sent as the last
+	// frame of the body.
+	grpcWebResponseWriter struct {
+		w           http.ResponseWriter
+		header      http.Header
+		contentType string
+		text        bool
+		wroteHeader bool
+	}
+
+	// base64Reader decodes the body of grpc-web-text requests, the body may
+	// be the concatenation of several padded base64 strings, so it is
+	// decoded in quantums of 4 bytes.
+	base64Reader struct {
+		r   io.Reader
+		buf []byte
+		in  []byte
+		out []byte
+		err error
+	}
+)
+
+func newHTTPHandler(spec *Spec, grpc http.Handler) (*httpHandler, error) {
+	h := &httpHandler{grpc: grpc, grpcWeb: spec.GRPCWeb}
+	if spec.Transcoding != nil {
+		t, err := newTranscoder(spec.Transcoding, grpc)
+		if err != nil {
+			return nil, err
+		}
+		h.transcoder = t
+	}
+	return h, nil
+}
+
+func isGRPCWebRequest(r *http.Request) bool {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), grpcWebContentType) {
+		return true
+	}
+	// CORS preflight requests of gRPC-Web clients.
+	if r.Method == http.MethodOptions {
+		headers := strings.ToLower(r.Header.Get("Access-Control-Request-Headers"))
+		return strings.Contains(headers, "x-grpc-web")
+	}
+	return false
+}
+
+// ServeHTTP implements http.Handler.
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case isGRPCWebRequest(r):
+		if h.grpcWeb == nil {
+			http.Error(w, "gRPC-Web is not enabled", http.StatusUnsupportedMediaType)
+			return
+		}
+		h.serveGRPCWeb(w, r)
+	case r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), grpcContentType):
+		h.grpc.ServeHTTP(w, r)
+	case h.transcoder != nil:
+		h.transcoder.ServeHTTP(w, r)
+	default:
+		http.Error(w, "only gRPC requests are supported", http.StatusUnsupportedMediaType)
+	}
+}
+
+func (h *httpHandler) allowOrigin(origin string) bool {
+	origins := h.grpcWeb.AllowedOrigins
+	return len(origins) == 0 || stringtool.StrInSlice("*", origins) || stringtool.StrInSlice(origin, origins)
+}
+
+func (h *httpHandler) serveGRPCWeb(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if !h.allowOrigin(origin) {
+			http.Error(w, "origin is not allowed", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", "Grpc-Status, Grpc-Message, Grpc-Status-Details-Bin")
+		w.Header().Add("Vary", "Origin")
+	}
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", http.MethodPost)
+		w.Header().Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	text := strings.HasPrefix(contentType, grpcWebTextContentType)
+
+	req := toGRPCRequest(r)
+	if text {
+		req.Header.Set("Content-Type", grpcContentType+strings.TrimPrefix(contentType, grpcWebTextContentType))
+		req.Body = io.NopCloser(&base64Reader{r: r.Body})
+	} else {
+		req.Header.Set("Content-Type", grpcContentType+strings.TrimPrefix(contentType, grpcWebContentType))
+	}
+
+	gw := &grpcWebResponseWriter{
+		w:           w,
+		header:      http.Header{},
+		contentType: contentType,
+		text:        text,
+	}
+	h.grpc.ServeHTTP(gw, req)
+	gw.finish()
+}
+
+// toGRPCRequest converts r to a request which could be served by the gRPC
+// server, the caller sets the content type and the body.
+func toGRPCRequest(r *http.Request) *http.Request {
+	req := r.Clone(r.Context())
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	req.ContentLength = -1
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	return req
+}
+
+// Header implements http.ResponseWriter.
+func (gw *grpcWebResponseWriter) Header() http.Header {
+	return gw.header
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (gw *grpcWebResponseWriter) WriteHeader(code int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+
+	h := gw.w.Header()
+	for k, v := range gw.header {
+		if k == "Trailer" || strings.HasPrefix(k, http.TrailerPrefix) {
+			continue
+		}
+		h[k] = v
+	}
+	h.Set("Content-Type", gw.contentType)
+	gw.w.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter.
+func (gw *grpcWebResponseWriter) Write(data []byte) (int, error) {
+	gw.WriteHeader(http.StatusOK)
+	if !gw.text {
+		return gw.w.Write(data)
+	}
+	if _, err := gw.w.Write([]byte(base64.StdEncoding.EncodeToString(data))); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Flush implements http.Flusher.
+func (gw *grpcWebResponseWriter) Flush() {
+	gw.WriteHeader(http.StatusOK)
+	if f, ok := gw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// trailers returns the trailers set by the gRPC server, the header names
+// are in lower case as required by gRPC-Web.
+func (gw *grpcWebResponseWriter) trailers() []byte {
+	trailers := map[string][]string{}
+	for _, k := range gw.header.Values("Trailer") {
+		k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+		if v := gw.header.Values(k); len(v) > 0 {
+			trailers[strings.ToLower(k)] = v
+		}
+	}
+	for k, v := range gw.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			trailers[strings.ToLower(strings.TrimPrefix(k, http.TrailerPrefix))] = v
+		}
+	}
+
+	keys := make([]string, 0, len(trailers))
+	for k := range trailers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, k := range keys {
+		for _, v := range trailers[k] {
+			sb.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	return []byte(sb.String())
+}
+
+// finish writes the trailers frame.
+func (gw *grpcWebResponseWriter) finish() {
+	trailers := gw.trailers()
+	frame := make([]byte, 5, 5+len(trailers))
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(trailers)))
+	frame = append(frame, trailers...)
+	gw.Write(frame)
+	gw.Flush()
+}
+
+// Read implements io.Reader.
+func (br *base64Reader) Read(p []byte) (int, error) {
+	for len(br.out) == 0 {
+		if br.err != nil {
+			if br.err == io.EOF && len(br.in) > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, br.err
+		}
+
+		if br.buf == nil {
+			br.buf = make([]byte, 4096)
+		}
+		n, err := br.r.Read(br.buf)
+		br.in = append(br.in, br.buf[:n]...)
+		br.err = err
+
+		end := len(br.in) / 4 * 4
+		out := make([]byte, 0, end/4*3)
+		for i := 0; i < end; i += 4 {
+			var quantum [3]byte
+			n, err := base64.StdEncoding.Decode(quantum[:], br.in[i:i+4])
+			if err != nil {
+				br.err = err
+				break
+			}
+			out = append(out, quantum[:n]...)
+		}
+		br.out = out
+		br.in = append(br.in[:0], br.in[end:]...)
+	}
+
+	n := copy(p, br.out)
+	br.out = br.out[n:]
+	return n, nil
+}
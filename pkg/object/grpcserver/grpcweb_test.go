@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpcserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func TestBase64Reader(t *testing.T) {
+	assert := assert.New(t)
+
+	// concatenation of padded base64 strings.
+	data := base64.StdEncoding.EncodeToString([]byte("hello")) + base64.StdEncoding.EncodeToString([]byte(" world!"))
+	r := &base64Reader{r: io.MultiReader(strings.NewReader(data[:3]), strings.NewReader(data[3:]))}
+	out, err := io.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal("hello world!", string(out))
+
+	_, err = io.ReadAll(&base64Reader{r: strings.NewReader("aGVsbG8")})
+	assert.Equal(io.ErrUnexpectedEOF, err)
+
+	_, err = io.ReadAll(&base64Reader{r: strings.NewReader("!!!!")})
+	assert.Error(err)
+}
+
+func TestGRPCWeb(t *testing.T) {
+	assert := assert.New(t)
+
+	_, fd := newTestDescriptorSet()
+	s := newTestGRPCServer(fd)
+	defer s.Stop()
+
+	h, err := newHTTPHandler(&Spec{GRPCWeb: &GRPCWebSpec{AllowedOrigins: []string{"https://www.megaease.com"}}}, s)
+	assert.NoError(err)
+
+	md := fd.Messages().ByName("EchoRequest")
+	newRequest := func(contentType, name, errMsg string) *http.Request {
+		msg := dynamicpb.NewMessage(md)
+		msg.Set(md.Fields().ByName("name"), protoreflect.ValueOfString(name))
+		msg.Set(md.Fields().ByName("error"), protoreflect.ValueOfString(errMsg))
+		payload, _ := proto.Marshal(msg)
+		body := make([]byte, 5, 5+len(payload))
+		binary.BigEndian.PutUint32(body[1:], uint32(len(payload)))
+		body = append(body, payload...)
+		if strings.HasPrefix(contentType, grpcWebTextContentType) {
+			body = []byte(base64.StdEncoding.EncodeToString(body))
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/test.Echo/Echo", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Origin", "https://www.megaease.com")
+		req.Header.Set("Connection", "keep-alive")
+		req.Header.Set("X-Grpc-Web", "1")
+		return req
+	}
+
+	// parseResponse returns the messages and the trailers in the response.
+	parseResponse := func(w *httptest.ResponseRecorder) ([]string, string) {
+		var body io.Reader = w.Body
+		if strings.HasPrefix(w.Header().Get("Content-Type"), grpcWebTextContentType) {
+			body = &base64Reader{r: body}
+		}
+		data, err := io.ReadAll(body)
+		assert.NoError(err)
+
+		var messages []string
+		for len(data) >= 5 {
+			size := int(binary.BigEndian.Uint32(data[1:5]))
+			frame := data[5 : 5+size]
+			if data[0] == grpcWebTrailerFlag {
+				return messages, string(frame)
+			}
+			msg := dynamicpb.NewMessage(md)
+			assert.NoError(proto.Unmarshal(frame, msg))
+			messages = append(messages, msg.Get(md.Fields().ByName("name")).String())
+			data = data[5+size:]
+		}
+		t.Fatalf("no trailers in the response")
+		return nil, ""
+	}
+
+	for _, contentType := range []string{"application/grpc-web+proto", "application/grpc-web-text"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest(contentType, "frank", ""))
+		assert.Equal(http.StatusOK, w.Code)
+		assert.Equal(contentType, w.Header().Get("Content-Type"))
+		assert.Equal("https://www.megaease.com", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Empty(w.Header().Get("Grpc-Status"))
+		messages, trailers := parseResponse(w)
+		assert.Equal([]string{"frank"}, messages)
+		assert.Equal("grpc-status: 0\r\n", trailers)
+
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest(contentType, "frank", "gone"))
+		assert.Equal(http.StatusOK, w.Code)
+		messages, trailers = parseResponse(w)
+		assert.Empty(messages)
+		assert.Equal("grpc-message: gone\r\ngrpc-status: 5\r\n", trailers)
+	}
+
+	// CORS preflight.
+	req := httptest.NewRequest(http.MethodOptions, "/test.Echo/Echo", nil)
+	req.Header.Set("Origin", "https://www.megaease.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	req.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(http.StatusNoContent, w.Code)
+	assert.Equal("content-type,x-grpc-web", w.Header().Get("Access-Control-Allow-Headers"))
+
+	// origin not allowed.
+	req = newRequest("application/grpc-web", "frank", "")
+	req.Header.Set("Origin", "https://www.example.com")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(http.StatusForbidden, w.Code)
+
+	// gRPC-Web is not enabled.
+	h, err = newHTTPHandler(&Spec{}, s)
+	assert.NoError(err)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest("application/grpc-web", "frank", ""))
+	assert.Equal(http.StatusUnsupportedMediaType, w.Code)
+}
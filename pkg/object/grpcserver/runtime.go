@@ -18,7 +18,9 @@
 package grpcserver
 
 import (
+	stdcontext "context"
 	"fmt"
+	"net/http"
 	"reflect"
 	"sync/atomic"
 	"time"
@@ -29,6 +31,8 @@ import (
 	"github.com/megaease/easegress/v2/pkg/logger"
 	"github.com/megaease/easegress/v2/pkg/supervisor"
 	"github.com/megaease/easegress/v2/pkg/util/limitlistener"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/encoding"
 	"google.golang.org/grpc/keepalive"
@@ -70,6 +74,7 @@ type (
 		superSpec *supervisor.Spec
 		spec      *Spec
 		s         *grpc.Server
+		hs        *http.Server
 		mux       *mux
 		roundNum  uint64
 		eventChan chan interface{}
@@ -237,8 +242,30 @@ func (r *runtime) startServer() {
 	r.s = grpc.NewServer(opts...)
 	// avoid data race
 	srv := r.s
+	serve := func() error { return srv.Serve(limitListener) }
+
+	// gRPC-Web and transcoded requests are HTTP requests, so the gRPC
+	// server is served by an HTTP server which supports h2c.
+	if r.spec.GRPCWeb != nil || r.spec.Transcoding != nil {
+		h, err := newHTTPHandler(r.spec, srv)
+		if err != nil {
+			limitListener.Close()
+			r.setState(stateFailed)
+			r.setError(err)
+			return
+		}
+		hs := &http.Server{Handler: h2c.NewHandler(h, &http2.Server{})}
+		r.hs = hs
+		serve = func() error {
+			if err := hs.Serve(limitListener); err != http.ErrServerClosed {
+				return err
+			}
+			return nil
+		}
+	}
+
 	go func() {
-		err := srv.Serve(limitListener)
+		err := serve()
 		if err != nil {
 			r.eventChan <- &eventServeFailed{
 				err:      err,
@@ -285,6 +312,14 @@ func (r *runtime) buildServerKeepaliveOpt() []grpc.ServerOption {
 }
 
 func (r *runtime) closeServer() {
+	if r.hs != nil {
+		ctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), 30*time.Second)
+		defer cancel()
+		if err := r.hs.Shutdown(ctx); err != nil {
+			logger.Warnf("shutdown http server of %s failed: %v", r.superSpec.Name(), err)
+		}
+		r.hs = nil
+	}
 	if r.s != nil {
 		r.s.GracefulStop()
 	}
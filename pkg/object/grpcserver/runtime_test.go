@@ -18,6 +18,9 @@
 package grpcserver
 
 import (
+	"io"
+	"net/http"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -94,3 +97,37 @@ func TestBuildServerKeepaliveOpt(t *testing.T) {
 	opts := r.buildServerKeepaliveOpt()
 	assert.Equal(t, 2, len(opts))
 }
+
+func TestGRPCWebRuntime(t *testing.T) {
+	assert := assert.New(t)
+	s := `
+kind: GRPCServer
+port: 8851
+name: server-grpc-web
+grpcWeb: {}
+`
+	spec, err := supervisor.NewSpec(s)
+	assert.NoError(err)
+
+	r := newRuntime(spec, &contexttest.MockedMuxMapper{})
+	defer r.Close()
+	r.reload(spec, &contexttest.MockedMuxMapper{})
+	assert.Equal(stateRunning, r.getState())
+	assert.NotNil(r.hs)
+
+	// the backend is not found, the status is in the trailers frame.
+	var resp *http.Response
+	for i := 0; i < 20; i++ {
+		body := strings.NewReader("\x00\x00\x00\x00\x00")
+		if resp, err = http.Post("http://127.0.0.1:8851/test.Echo/Echo", "application/grpc-web+proto", body); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.NoError(err)
+	defer resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	data, err := io.ReadAll(resp.Body)
+	assert.NoError(err)
+	assert.Contains(string(data), "grpc-status: 5\r\n")
+}
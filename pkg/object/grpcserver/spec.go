@@ -50,6 +50,29 @@ type (
 		CacheSize     uint32         `json:"cacheSize,omitempty"`
 		GlobalFilter  string         `json:"globalFilter,omitempty"`
 		XForwardedFor bool           `json:"xForwardedFor,omitempty"`
+
+		// GRPCWeb enables gRPC-Web requests from browsers.
+		GRPCWeb *GRPCWebSpec `json:"grpcWeb,omitempty"`
+		// Transcoding enables HTTP/JSON requests to be transcoded to gRPC.
+		Transcoding *TranscodingSpec `json:"transcoding,omitempty"`
+	}
+
+	// GRPCWebSpec describes the gRPC-Web support of the server.
+	GRPCWebSpec struct {
+		// AllowedOrigins are the origins allowed to make cross-origin
+		// requests, empty means all origins are allowed.
+		AllowedOrigins []string `json:"allowedOrigins,omitempty" jsonschema:"uniqueItems=true"`
+	}
+
+	// TranscodingSpec describes the HTTP/JSON to gRPC transcoding of the
+	// server. The methods are mapped to HTTP by their google.api.http
+	// annotations in the protobuf descriptor set, which can be generated by
+	// protoc with --include_imports --descriptor_set_out.
+	TranscodingSpec struct {
+		DescriptorSetFile   string `json:"descriptorSetFile,omitempty"`
+		DescriptorSetBase64 string `json:"descriptorSetBase64,omitempty" jsonschema:"format=base64"`
+		// MaxBodySize is the max size of the request body, default is 4MB.
+		MaxBodySize int64 `json:"maxBodySize,omitempty" jsonschema:"minimum=0"`
 	}
 
 	// Rule is first level entry of router.
@@ -94,6 +117,18 @@ func (h *Header) initHeaderRoute() {
 	h.headerRE = regexp.MustCompile(h.Regexp)
 }
 
+// Validate validates TranscodingSpec.
+func (s *TranscodingSpec) Validate() error {
+	if (s.DescriptorSetFile == "") == (s.DescriptorSetBase64 == "") {
+		return fmt.Errorf("one and only one of descriptorSetFile and descriptorSetBase64 is required")
+	}
+	if s.MaxBodySize < 0 {
+		return fmt.Errorf("maxBodySize must not be negative")
+	}
+	_, err := newTranscoder(s, nil)
+	return err
+}
+
 // Validate validates Method.
 func (m *Method) Validate() error {
 	return nil
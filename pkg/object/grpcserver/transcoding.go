@@ -0,0 +1,685 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpcserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// defaultMaxBodySize is the default max size of the request body.
+const defaultMaxBodySize = 4 * 1024 * 1024
+
+var errUnknownField = errors.New("unknown field")
+
+type (
+	// transcoder transcodes HTTP/JSON requests to gRPC requests, and the
+	// gRPC responses back to HTTP/JSON responses.
+	transcoder struct {
+		grpc        http.Handler
+		bindings    []*httpBinding
+		maxBodySize int64
+
+		marshal   protojson.MarshalOptions
+		unmarshal protojson.UnmarshalOptions
+	}
+
+	// httpBinding is a HTTP rule of a gRPC method.
+	httpBinding struct {
+		method     protoreflect.MethodDescriptor
+		fullMethod string
+
+		httpMethod   string
+		pathRE       *regexp.Regexp
+		pathFields   [][]string
+		body         string
+		responseBody string
+	}
+
+	// grpcResponseRecorder records the response of the gRPC server.
+	grpcResponseRecorder struct {
+		code   int
+		header http.Header
+		body   bytes.Buffer
+	}
+)
+
+// httpStatusFromCode maps gRPC status codes to HTTP status codes, see
+// https://github.com/googleapis/googleapis/blob/master/google/rpc/code.proto
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		// Client Closed Request
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func loadDescriptorSet(spec *TranscodingSpec) (*descriptorpb.FileDescriptorSet, error) {
+	var data []byte
+	var err error
+	if spec.DescriptorSetFile != "" {
+		data, err = os.ReadFile(spec.DescriptorSetFile)
+	} else {
+		data, err = base64.StdEncoding.DecodeString(spec.DescriptorSetBase64)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load descriptor set failed: %v", err)
+	}
+
+	fds := &descriptorpb.FileDescriptorSet{}
+	if err = proto.Unmarshal(data, fds); err != nil {
+		return nil, fmt.Errorf("unmarshal descriptor set failed: %v", err)
+	}
+	return fds, nil
+}
+
+func newTranscoder(spec *TranscodingSpec, grpc http.Handler) (*transcoder, error) {
+	fds, err := loadDescriptorSet(spec)
+	if err != nil {
+		return nil, err
+	}
+	files, err := protodesc.NewFiles(fds)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %v", err)
+	}
+
+	types := dynamicpb.NewTypes(files)
+	t := &transcoder{
+		grpc:        grpc,
+		maxBodySize: spec.MaxBodySize,
+		marshal:     protojson.MarshalOptions{Resolver: types},
+		unmarshal:   protojson.UnmarshalOptions{Resolver: types, DiscardUnknown: true},
+	}
+	if t.maxBodySize == 0 {
+		t.maxBodySize = defaultMaxBodySize
+	}
+
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		services := fd.Services()
+		for i := 0; i < services.Len() && err == nil; i++ {
+			methods := services.Get(i).Methods()
+			for j := 0; j < methods.Len() && err == nil; j++ {
+				err = t.addMethod(methods.Get(j))
+			}
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// addMethod adds the bindings of the HTTP rules of the method. A method
+// without HTTP rules is bound to POST /package.Service/Method, and the
+// request body is the JSON of the request message.
+func (t *transcoder) addMethod(md protoreflect.MethodDescriptor) error {
+	fullMethod := fmt.Sprintf("/%s/%s", md.Parent().FullName(), md.Name())
+
+	rule, _ := proto.GetExtension(md.Options(), annotations.E_Http).(*annotations.HttpRule)
+	if rule == nil {
+		rule = &annotations.HttpRule{
+			Pattern: &annotations.HttpRule_Post{Post: fullMethod},
+			Body:    "*",
+		}
+	}
+
+	rules := append([]*annotations.HttpRule{rule}, rule.AdditionalBindings...)
+	for _, rule := range rules {
+		b, err := newHTTPBinding(md, rule)
+		if err != nil {
+			return fmt.Errorf("invalid http rule of %s: %v", fullMethod, err)
+		}
+		b.fullMethod = fullMethod
+		t.bindings = append(t.bindings, b)
+	}
+	return nil
+}
+
+func newHTTPBinding(md protoreflect.MethodDescriptor, rule *annotations.HttpRule) (*httpBinding, error) {
+	b := &httpBinding{
+		method:       md,
+		body:         rule.Body,
+		responseBody: rule.ResponseBody,
+	}
+
+	var template string
+	switch p := rule.Pattern.(type) {
+	case *annotations.HttpRule_Get:
+		b.httpMethod, template = http.MethodGet, p.Get
+	case *annotations.HttpRule_Put:
+		b.httpMethod, template = http.MethodPut, p.Put
+	case *annotations.HttpRule_Post:
+		b.httpMethod, template = http.MethodPost, p.Post
+	case *annotations.HttpRule_Delete:
+		b.httpMethod, template = http.MethodDelete, p.Delete
+	case *annotations.HttpRule_Patch:
+		b.httpMethod, template = http.MethodPatch, p.Patch
+	case *annotations.HttpRule_Custom:
+		b.httpMethod, template = p.Custom.Kind, p.Custom.Path
+	default:
+		return nil, fmt.Errorf("pattern is required")
+	}
+
+	var err error
+	b.pathRE, b.pathFields, err = compilePathTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.body != "" && b.body != "*" && md.Input().Fields().ByName(protoreflect.Name(b.body)) == nil {
+		return nil, fmt.Errorf("body field %s not found", b.body)
+	}
+	if b.responseBody != "" && md.Output().Fields().ByName(protoreflect.Name(b.responseBody)) == nil {
+		return nil, fmt.Errorf("response body field %s not found", b.responseBody)
+	}
+	for _, path := range b.pathFields {
+		if _, err := findField(md.Input(), path); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// compilePathTemplate compiles a path template, like
+// /v1/{name=shelves/*/books/*}:publish, to a regular expression, it returns
+// the field paths of the variables in the order of their capture groups.
+func compilePathTemplate(template string) (*regexp.Regexp, [][]string, error) {
+	if !strings.HasPrefix(template, "/") {
+		return nil, nil, fmt.Errorf("path template %s must start with /", template)
+	}
+
+	verb := ""
+	if i := strings.LastIndexByte(template, ':'); i > strings.LastIndexByte(template, '/') && i > strings.LastIndexByte(template, '}') {
+		template, verb = template[:i], template[i:]
+	}
+
+	segmentsRE := func(pattern string) string {
+		segments := strings.Split(pattern, "/")
+		for i, s := range segments {
+			switch s {
+			case "*":
+				segments[i] = "[^/]+"
+			case "**":
+				segments[i] = ".+"
+			default:
+				segments[i] = regexp.QuoteMeta(s)
+			}
+		}
+		return strings.Join(segments, "/")
+	}
+
+	var sb strings.Builder
+	var fields [][]string
+	sb.WriteString("^")
+	for rest := template[1:]; ; {
+		sb.WriteString("/")
+		if strings.HasPrefix(rest, "{") {
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				return nil, nil, fmt.Errorf("path template %s has unclosed variable", template)
+			}
+			name, pattern, found := strings.Cut(rest[1:end], "=")
+			if !found {
+				pattern = "*"
+			}
+			fields = append(fields, strings.Split(name, "."))
+			sb.WriteString("(" + segmentsRE(pattern) + ")")
+			rest = rest[end+1:]
+		} else {
+			end := strings.IndexByte(rest, '/')
+			if end < 0 {
+				end = len(rest)
+			}
+			sb.WriteString(segmentsRE(rest[:end]))
+			rest = rest[end:]
+		}
+
+		if rest == "" {
+			break
+		}
+		if rest[0] != '/' {
+			return nil, nil, fmt.Errorf("invalid path template %s", template)
+		}
+		rest = rest[1:]
+	}
+	sb.WriteString(regexp.QuoteMeta(verb) + "$")
+
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	return re, fields, nil
+}
+
+// findField finds the field descriptors of the field path, the field
+// names could be either the proto names or the JSON names.
+func findField(md protoreflect.MessageDescriptor, path []string) ([]protoreflect.FieldDescriptor, error) {
+	fds := make([]protoreflect.FieldDescriptor, 0, len(path))
+	for i, name := range path {
+		if md == nil {
+			return nil, fmt.Errorf("field %s is not a message", strings.Join(path[:i], "."))
+		}
+		fd := md.Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = md.Fields().ByJSONName(name)
+		}
+		if fd == nil {
+			return nil, fmt.Errorf("%w: %s", errUnknownField, strings.Join(path, "."))
+		}
+		fds = append(fds, fd)
+		md = nil
+		if fd.Message() != nil && !fd.IsList() && !fd.IsMap() {
+			md = fd.Message()
+		}
+	}
+	return fds, nil
+}
+
+// setField sets the field of the field path to the value in string.
+func (t *transcoder) setField(msg protoreflect.Message, path []string, value string) error {
+	fds, err := findField(msg.Descriptor(), path)
+	if err != nil {
+		return err
+	}
+	for _, fd := range fds[:len(fds)-1] {
+		msg = msg.Mutable(fd).Message()
+	}
+
+	fd := fds[len(fds)-1]
+	if fd.IsMap() {
+		return fmt.Errorf("map field %s is not supported", strings.Join(path, "."))
+	}
+
+	var v protoreflect.Value
+	if fd.IsList() {
+		v = msg.Mutable(fd).List().NewElement()
+	} else {
+		v = msg.NewField(fd)
+	}
+	if v, err = t.parseValue(fd, v, value); err != nil {
+		return fmt.Errorf("invalid value of %s: %v", strings.Join(path, "."), err)
+	}
+
+	if fd.IsList() {
+		msg.Mutable(fd).List().Append(v)
+	} else {
+		msg.Set(fd, v)
+	}
+	return nil
+}
+
+// parseValue parses the value of a field from a path variable or a query
+// parameter, messages are parsed from their JSON representations, which
+// makes well-known types like google.protobuf.Timestamp work.
+func (t *transcoder) parseValue(fd protoreflect.FieldDescriptor, v protoreflect.Value, s string) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(s), nil
+	case protoreflect.BoolKind:
+		b, err := strconv.ParseBool(s)
+		return protoreflect.ValueOfBool(b), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		i, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfInt32(int32(i)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		i, err := strconv.ParseInt(s, 10, 64)
+		return protoreflect.ValueOfInt64(i), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		i, err := strconv.ParseUint(s, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(i)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		i, err := strconv.ParseUint(s, 10, 64)
+		return protoreflect.ValueOfUint64(i), err
+	case protoreflect.FloatKind:
+		f, err := strconv.ParseFloat(s, 32)
+		return protoreflect.ValueOfFloat32(float32(f)), err
+	case protoreflect.DoubleKind:
+		f, err := strconv.ParseFloat(s, 64)
+		return protoreflect.ValueOfFloat64(f), err
+	case protoreflect.BytesKind:
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			b, err = base64.URLEncoding.DecodeString(s)
+		}
+		return protoreflect.ValueOfBytes(b), err
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(s)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		i, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(i)), err
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		msg := v.Message().Interface()
+		if err := t.unmarshal.Unmarshal([]byte(strconv.Quote(s)), msg); err != nil {
+			if err = t.unmarshal.Unmarshal([]byte(s), msg); err != nil {
+				return v, err
+			}
+		}
+		return v, nil
+	}
+	return v, fmt.Errorf("unsupported kind %s", fd.Kind())
+}
+
+// match returns the binding matching the request, and the values of the
+// path variables.
+func (t *transcoder) match(r *http.Request) (*httpBinding, []string) {
+	path := r.URL.EscapedPath()
+	for _, b := range t.bindings {
+		if b.httpMethod != r.Method {
+			continue
+		}
+		if m := b.pathRE.FindStringSubmatch(path); m != nil {
+			return b, m[1:]
+		}
+	}
+	return nil, nil
+}
+
+// decodeRequest builds the request message from the body, the path
+// variables and the query parameters of the request.
+func (t *transcoder) decodeRequest(w http.ResponseWriter, b *httpBinding, r *http.Request, values []string, msg protoreflect.Message) error {
+	if b.body != "" {
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, t.maxBodySize))
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			if b.body != "*" {
+				fd := msg.Descriptor().Fields().ByName(protoreflect.Name(b.body))
+				name, _ := json.Marshal(fd.JSONName())
+				data = bytes.Join([][]byte{[]byte("{"), name, []byte(":"), data, []byte("}")}, nil)
+			}
+			if err = t.unmarshal.Unmarshal(data, msg.Interface()); err != nil {
+				return err
+			}
+		}
+	}
+
+	bound := map[string]bool{}
+	for i, path := range b.pathFields {
+		value, err := url.PathUnescape(values[i])
+		if err != nil {
+			return err
+		}
+		if err = t.setField(msg, path, value); err != nil {
+			return err
+		}
+		bound[strings.Join(path, ".")] = true
+	}
+
+	if b.body == "*" {
+		return nil
+	}
+	for key, values := range r.URL.Query() {
+		if bound[key] || (b.body != "" && strings.HasPrefix(key+".", b.body+".")) {
+			continue
+		}
+		for _, value := range values {
+			err := t.setField(msg, strings.Split(key, "."), value)
+			if errors.Is(err, errUnknownField) {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// encodeResponse encodes the response message to JSON.
+func (t *transcoder) encodeResponse(b *httpBinding, msg proto.Message) ([]byte, error) {
+	if b.responseBody == "" {
+		return t.marshal.Marshal(msg)
+	}
+
+	opts := t.marshal
+	opts.EmitUnpopulated = true
+	data, err := opts.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	fd := msg.ProtoReflect().Descriptor().Fields().ByName(protoreflect.Name(b.responseBody))
+	return fields[fd.JSONName()], nil
+}
+
+// writeError writes the status as the JSON of google.rpc.Status.
+func (t *transcoder) writeError(w http.ResponseWriter, s *status.Status) {
+	t.writeErrorWithCode(w, httpStatusFromCode(s.Code()), s)
+}
+
+// writeErrorWithCode is like writeError, but with the HTTP status code.
+func (t *transcoder) writeErrorWithCode(w http.ResponseWriter, code int, s *status.Status) {
+	data, err := t.marshal.Marshal(s.Proto())
+	if err != nil {
+		data, _ = t.marshal.Marshal(&spb.Status{Code: int32(s.Code()), Message: s.Message()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// ServeHTTP implements http.Handler.
+func (t *transcoder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, values := t.match(r)
+	if b == nil {
+		t.writeError(w, status.Newf(codes.NotFound, "no gRPC method is bound to %s %s", r.Method, r.URL.Path))
+		return
+	}
+	if b.method.IsStreamingClient() {
+		t.writeError(w, status.Newf(codes.Unimplemented, "client streaming method %s can not be transcoded", b.fullMethod))
+		return
+	}
+
+	in := dynamicpb.NewMessage(b.method.Input())
+	if err := t.decodeRequest(w, b, r, values, in); err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			s := status.Newf(codes.InvalidArgument, "request body exceeds %d bytes", mbe.Limit)
+			t.writeErrorWithCode(w, http.StatusRequestEntityTooLarge, s)
+			return
+		}
+		t.writeError(w, status.Newf(codes.InvalidArgument, "invalid request: %v", err))
+		return
+	}
+	payload, err := proto.Marshal(in)
+	if err != nil {
+		t.writeError(w, status.Newf(codes.InvalidArgument, "invalid request: %v", err))
+		return
+	}
+
+	req := toGRPCRequest(r)
+	req.Method = http.MethodPost
+	req.URL = &url.URL{Path: b.fullMethod}
+	req.Header.Set("Content-Type", grpcContentType)
+	req.Header.Del("Accept-Encoding")
+	frame := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	req.Body = io.NopCloser(bytes.NewReader(append(frame, payload...)))
+
+	rec := &grpcResponseRecorder{header: http.Header{}}
+	t.grpc.ServeHTTP(rec, req)
+
+	s := rec.status()
+	if s.Code() != codes.OK {
+		t.writeError(w, s)
+		return
+	}
+
+	messages, err := rec.messages()
+	if err != nil {
+		t.writeError(w, status.Newf(codes.Internal, "invalid gRPC response: %v", err))
+		return
+	}
+	if !b.method.IsStreamingServer() && len(messages) != 1 {
+		t.writeError(w, status.Newf(codes.Internal, "invalid gRPC response: got %d messages", len(messages)))
+		return
+	}
+
+	var body bytes.Buffer
+	for _, m := range messages {
+		out := dynamicpb.NewMessage(b.method.Output())
+		if err = proto.Unmarshal(m, out); err != nil {
+			t.writeError(w, status.Newf(codes.Internal, "invalid gRPC response: %v", err))
+			return
+		}
+		data, err := t.encodeResponse(b, out)
+		if err != nil {
+			t.writeError(w, status.Newf(codes.Internal, "encode response failed: %v", err))
+			return
+		}
+		body.Write(data)
+		if b.method.IsStreamingServer() {
+			body.WriteByte('\n')
+		}
+	}
+
+	for k, v := range rec.header {
+		if k == "Content-Type" || k == "Trailer" || k == "Date" || strings.HasPrefix(k, "Grpc-") || strings.HasPrefix(k, http.TrailerPrefix) {
+			continue
+		}
+		w.Header()[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body.Bytes())
+}
+
+// Header implements http.ResponseWriter.
+func (rec *grpcResponseRecorder) Header() http.Header {
+	return rec.header
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (rec *grpcResponseRecorder) WriteHeader(code int) {
+	if rec.code == 0 {
+		rec.code = code
+	}
+}
+
+// Write implements http.ResponseWriter.
+func (rec *grpcResponseRecorder) Write(data []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(data)
+}
+
+// Flush implements http.Flusher.
+func (rec *grpcResponseRecorder) Flush() {
+	rec.WriteHeader(http.StatusOK)
+}
+
+// status returns the gRPC status of the response.
+func (rec *grpcResponseRecorder) status() *status.Status {
+	if rec.code != http.StatusOK {
+		return status.Newf(codes.Internal, "gRPC server responded %d: %s", rec.code, strings.TrimSpace(rec.body.String()))
+	}
+
+	get := func(key string) string {
+		if v := rec.header.Get(key); v != "" {
+			return v
+		}
+		return rec.header.Get(http.TrailerPrefix + key)
+	}
+
+	if v := get("Grpc-Status-Details-Bin"); v != "" {
+		data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(v, "="))
+		p := &spb.Status{}
+		if err == nil && proto.Unmarshal(data, p) == nil {
+			return status.FromProto(p)
+		}
+	}
+
+	code, err := strconv.Atoi(get("Grpc-Status"))
+	if err != nil {
+		return status.New(codes.Unknown, "missing gRPC status")
+	}
+	msg, err := url.PathUnescape(get("Grpc-Message"))
+	if err != nil {
+		msg = get("Grpc-Message")
+	}
+	return status.New(codes.Code(code), msg)
+}
+
+// messages returns the messages in the response body.
+func (rec *grpcResponseRecorder) messages() ([][]byte, error) {
+	var messages [][]byte
+	data := rec.body.Bytes()
+	for len(data) > 0 {
+		if len(data) < 5 {
+			return nil, fmt.Errorf("incomplete frame")
+		}
+		if data[0] != 0 {
+			return nil, fmt.Errorf("compressed messages are not supported")
+		}
+		size := int(binary.BigEndian.Uint32(data[1:5]))
+		if len(data) < 5+size {
+			return nil, fmt.Errorf("incomplete frame")
+		}
+		messages = append(messages, data[5:5+size])
+		data = data[5+size:]
+	}
+	return messages, nil
+}
@@ -0,0 +1,295 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpcserver
+
+import (
+	stdcontext "context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// newTestDescriptorSet returns the base64 encoded descriptor set of:
+//
+//	package test;
+//	message Inner { string value = 1; }
+//	message EchoRequest {
+//	  string name = 1;
+//	  int32 count = 2;
+//	  Inner inner = 3;
+//	  repeated string tags = 4;
+//	  string error = 5;
+//	}
+//	service Echo {
+//	  rpc Echo(EchoRequest) returns (EchoRequest) {
+//	    option (google.api.http) = {
+//	      get: "/v1/echo/{name}"
+//	      additional_bindings {
+//	        post: "/v1/{inner.value=items/*}:echo"
+//	        body: "*"
+//	        response_body: "inner"
+//	      }
+//	    };
+//	  }
+//	  rpc Update(EchoRequest) returns (EchoRequest) {
+//	    option (google.api.http) = { patch: "/v1/echo/{name}" body: "inner" };
+//	  }
+//	  rpc Post(EchoRequest) returns (EchoRequest);
+//	}
+func newTestDescriptorSet() (string, protoreflect.FileDescriptor) {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string, repeated bool) *descriptorpb.FieldDescriptorProto {
+		label := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+		if repeated {
+			label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+		}
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    label.Enum(),
+			Type:     typ.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	method := func(name string, rule *annotations.HttpRule) *descriptorpb.MethodDescriptorProto {
+		m := &descriptorpb.MethodDescriptorProto{
+			Name:       proto.String(name),
+			InputType:  proto.String(".test.EchoRequest"),
+			OutputType: proto.String(".test.EchoRequest"),
+		}
+		if rule != nil {
+			m.Options = &descriptorpb.MethodOptions{}
+			proto.SetExtension(m.Options, annotations.E_Http, rule)
+		}
+		return m
+	}
+
+	fdp := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("test.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name:  proto.String("Inner"),
+				Field: []*descriptorpb.FieldDescriptorProto{field("value", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, "", false)},
+			},
+			{
+				Name: proto.String("EchoRequest"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, "", false),
+					field("count", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32, "", false),
+					field("inner", 3, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".test.Inner", false),
+					field("tags", 4, descriptorpb.FieldDescriptorProto_TYPE_STRING, "", true),
+					field("error", 5, descriptorpb.FieldDescriptorProto_TYPE_STRING, "", false),
+				},
+			},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Echo"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				method("Echo", &annotations.HttpRule{
+					Pattern: &annotations.HttpRule_Get{Get: "/v1/echo/{name}"},
+					AdditionalBindings: []*annotations.HttpRule{{
+						Pattern:      &annotations.HttpRule_Post{Post: "/v1/{inner.value=items/*}:echo"},
+						Body:         "*",
+						ResponseBody: "inner",
+					}},
+				}),
+				method("Update", &annotations.HttpRule{
+					Pattern: &annotations.HttpRule_Patch{Patch: "/v1/echo/{name}"},
+					Body:    "inner",
+				}),
+				method("Post", nil),
+			},
+		}},
+	}
+
+	fd, err := protodesc.NewFile(fdp, nil)
+	if err != nil {
+		panic(err)
+	}
+	data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{fdp}})
+	if err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(data), fd
+}
+
+// newTestGRPCServer returns a gRPC server of the test.Echo service, which
+// echoes the requests, or responds the error in the request.
+func newTestGRPCServer(fd protoreflect.FileDescriptor) *grpc.Server {
+	md := fd.Messages().ByName("EchoRequest")
+	echo := func(srv interface{}, ctx stdcontext.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+		msg := dynamicpb.NewMessage(md)
+		if err := dec(msg); err != nil {
+			return nil, err
+		}
+		if e := msg.Get(md.Fields().ByName("error")).String(); e != "" {
+			return nil, status.Error(codes.NotFound, e)
+		}
+		return msg, nil
+	}
+
+	s := grpc.NewServer()
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.Echo",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{
+			{MethodName: "Echo", Handler: echo},
+			{MethodName: "Update", Handler: echo},
+			{MethodName: "Post", Handler: echo},
+		},
+	}, struct{}{})
+	return s
+}
+
+func TestCompilePathTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		template string
+		regexp   string
+		fields   [][]string
+	}{
+		{"/v1/echo", `^/v1/echo$`, nil},
+		{"/v1/echo/{name}", `^/v1/echo/([^/]+)$`, [][]string{{"name"}}},
+		{"/v1/{name=shelves/*/books/*}:publish", `^/v1/(shelves/[^/]+/books/[^/]+):publish$`, [][]string{{"name"}}},
+		{"/v1/{a.b}/*/{c=**}", `^/v1/([^/]+)/[^/]+/(.+)$`, [][]string{{"a", "b"}, {"c"}}},
+	}
+	for _, tt := range tests {
+		re, fields, err := compilePathTemplate(tt.template)
+		assert.NoError(err)
+		assert.Equal(tt.regexp, re.String())
+		assert.Equal(tt.fields, fields)
+	}
+
+	for _, template := range []string{"v1", "/v1/{name", "/v1/{name}abc"} {
+		_, _, err := compilePathTemplate(template)
+		assert.Error(err, template)
+	}
+}
+
+func TestTranscodingSpecValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	descriptorSet, _ := newTestDescriptorSet()
+	assert.NoError((&TranscodingSpec{DescriptorSetBase64: descriptorSet}).Validate())
+	assert.Error((&TranscodingSpec{}).Validate())
+	assert.Error((&TranscodingSpec{DescriptorSetBase64: descriptorSet, DescriptorSetFile: "a.pb"}).Validate())
+	assert.Error((&TranscodingSpec{DescriptorSetFile: "not-exist.pb"}).Validate())
+	assert.Error((&TranscodingSpec{DescriptorSetBase64: "invalid"}).Validate())
+	assert.Error((&TranscodingSpec{DescriptorSetBase64: descriptorSet, MaxBodySize: -1}).Validate())
+}
+
+func TestHTTPStatusFromCode(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(http.StatusOK, httpStatusFromCode(codes.OK))
+	assert.Equal(http.StatusBadRequest, httpStatusFromCode(codes.InvalidArgument))
+	assert.Equal(http.StatusUnauthorized, httpStatusFromCode(codes.Unauthenticated))
+	assert.Equal(http.StatusTooManyRequests, httpStatusFromCode(codes.ResourceExhausted))
+	assert.Equal(http.StatusServiceUnavailable, httpStatusFromCode(codes.Unavailable))
+	assert.Equal(http.StatusInternalServerError, httpStatusFromCode(codes.DataLoss))
+}
+
+func TestTranscoding(t *testing.T) {
+	assert := assert.New(t)
+
+	descriptorSet, fd := newTestDescriptorSet()
+	s := newTestGRPCServer(fd)
+	defer s.Stop()
+
+	h, err := newHTTPHandler(&Spec{Transcoding: &TranscodingSpec{DescriptorSetBase64: descriptorSet, MaxBodySize: 1024}}, s)
+	assert.NoError(err)
+
+	do := func(method, target, body string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		result := map[string]interface{}{}
+		assert.NoError(json.Unmarshal(w.Body.Bytes(), &result), w.Body.String())
+		assert.Equal("application/json", w.Header().Get("Content-Type"))
+		return w.Code, result
+	}
+
+	// path variables and query parameters.
+	code, result := do(http.MethodGet, "/v1/echo/frank%2Fz?count=3&tags=a&tags=b&inner.value=x&unknown=1", "")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(map[string]interface{}{
+		"name":  "frank/z",
+		"count": float64(3),
+		"tags":  []interface{}{"a", "b"},
+		"inner": map[string]interface{}{"value": "x"},
+	}, result)
+
+	// body field.
+	code, result = do(http.MethodPatch, "/v1/echo/frank?count=1", `{"value": "v"}`)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(map[string]interface{}{
+		"name":  "frank",
+		"count": float64(1),
+		"inner": map[string]interface{}{"value": "v"},
+	}, result)
+
+	// whole body, path variable of nested field, verb and response body.
+	code, result = do(http.MethodPost, "/v1/items/1:echo", `{"name": "frank", "inner": {"value": "ignored"}}`)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(map[string]interface{}{"value": "items/1"}, result)
+
+	// method without http rule.
+	code, result = do(http.MethodPost, "/test.Echo/Post", `{"name": "frank"}`)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(map[string]interface{}{"name": "frank"}, result)
+
+	// gRPC errors are mapped to HTTP status.
+	code, result = do(http.MethodGet, "/v1/echo/frank?error=gone", "")
+	assert.Equal(http.StatusNotFound, code)
+	assert.Equal(float64(codes.NotFound), result["code"])
+	assert.Equal("gone", result["message"])
+
+	code, result = do(http.MethodGet, "/v1/echo/frank?count=abc", "")
+	assert.Equal(http.StatusBadRequest, code)
+	assert.Equal(float64(codes.InvalidArgument), result["code"])
+
+	code, _ = do(http.MethodPost, "/test.Echo/Post", `{"name": 1}`)
+	assert.Equal(http.StatusBadRequest, code)
+
+	// the request body is limited.
+	code, result = do(http.MethodPost, "/test.Echo/Post", `{"name": "`+strings.Repeat("a", 1024)+`"}`)
+	assert.Equal(http.StatusRequestEntityTooLarge, code)
+	assert.Equal(float64(codes.InvalidArgument), result["code"])
+
+	code, _ = do(http.MethodDelete, "/v1/echo/frank", "")
+	assert.Equal(http.StatusNotFound, code)
+}
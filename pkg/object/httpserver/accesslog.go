@@ -0,0 +1,389 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/util/sampler"
+	"github.com/megaease/easegress/v2/pkg/util/stringtool"
+)
+
+const (
+	defaultAccessLogFormat = "[{{Time}}] [{{RemoteAddr}} {{RealIP}} {{Method}} {{URI}} {{Proto}} {{StatusCode}}] [{{Duration}} rx:{{ReqSize}}B tx:{{RespSize}}B] [{{Tags}}]"
+
+	// AccessLogFormatTemplate formats access logs with a template.
+	AccessLogFormatTemplate = "template"
+	// AccessLogFormatJSON formats access logs as JSON objects.
+	AccessLogFormatJSON = "json"
+	// AccessLogFormatCommon formats access logs in the Common Log Format.
+	AccessLogFormatCommon = "common"
+	// AccessLogFormatCombined formats access logs in the Combined Log Format.
+	AccessLogFormatCombined = "combined"
+
+	clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+)
+
+// accessLogFields are the fields available to the JSON format, in the
+// order they are written.
+var accessLogFields = []string{
+	"time", "remoteAddr", "realIP", "user", "method", "host", "uri", "proto",
+	"statusCode", "duration", "reqSize", "respSize", "referer", "userAgent",
+	"tlsVersion", "tlsCipher", "tlsServerName", "route", "pipeline",
+	"upstreamTimings", "tags", "reqHeaders", "respHeaders",
+}
+
+// defaultJSONFields are the fields of the JSON format if no field is
+// selected, the headers are excluded as they are verbose and could contain
+// credentials.
+var defaultJSONFields = accessLogFields[:len(accessLogFields)-2]
+
+type (
+	// AccessLogSpec describes the access log of the HTTPServer.
+	AccessLogSpec struct {
+		// Format is the format of access logs, it defaults to template.
+		Format string `json:"format,omitempty" jsonschema:"enum=,enum=template,enum=json,enum=common,enum=combined"`
+		// Template is the template of the template format, it defaults to
+		// the accessLogFormat of the HTTPServer.
+		Template string `json:"template,omitempty"`
+		// Fields are the fields of the JSON format.
+		Fields []string `json:"fields,omitempty" jsonschema:"uniqueItems=true"`
+		// Paths samples or excludes the access logs of requests by path,
+		// the first matched path applies, and requests not matching any
+		// path are always logged.
+		Paths []*AccessLogPathSpec `json:"paths,omitempty"`
+	}
+
+	// AccessLogPathSpec describes the sampling of the access logs of
+	// requests to a path. The access logs are excluded if SampleRate is 0.
+	AccessLogPathSpec struct {
+		Path       string  `json:"path,omitempty" jsonschema:"pattern=^/"`
+		PathPrefix string  `json:"pathPrefix,omitempty" jsonschema:"pattern=^/"`
+		PathRegexp string  `json:"pathRegexp,omitempty" jsonschema:"format=regexp"`
+		SampleRate float64 `json:"sampleRate,omitempty" jsonschema:"minimum=0,maximum=1"`
+	}
+
+	accessLogger struct {
+		mode      string
+		formatter *accessLogFormatter
+		fields    []string
+		paths     []*accessLogPath
+	}
+
+	accessLogPath struct {
+		spec    *AccessLogPathSpec
+		re      *regexp.Regexp
+		sampler *sampler.RateSampler
+	}
+
+	accessLogFormatter struct {
+		template *template.Template
+	}
+
+	accessLog struct {
+		Time            string
+		StartAt         time.Time
+		RemoteAddr      string
+		RealIP          string
+		User            string
+		Method          string
+		Host            string
+		URI             string
+		Proto           string
+		StatusCode      int
+		Duration        time.Duration
+		ReqSize         uint64
+		RespSize        uint64
+		Referer         string
+		UserAgent       string
+		TLSVersion      string
+		TLSCipher       string
+		TLSServerName   string
+		Route           string
+		Pipeline        string
+		UpstreamTimings upstreamTimings
+		ReqHeaders      string
+		RespHeaders     string
+		Tags            string
+	}
+
+	upstreamTimings []context.UpstreamTiming
+)
+
+// Validate validates AccessLogSpec.
+func (spec *AccessLogSpec) Validate() error {
+	switch spec.Format {
+	case "", AccessLogFormatTemplate, AccessLogFormatJSON, AccessLogFormatCommon, AccessLogFormatCombined:
+	default:
+		return fmt.Errorf("accessLog: unknown format %q", spec.Format)
+	}
+
+	for _, f := range spec.Fields {
+		if !stringtool.StrInSlice(f, accessLogFields) {
+			return fmt.Errorf("accessLog: unknown field %q", f)
+		}
+	}
+
+	for _, p := range spec.Paths {
+		if p.Path == "" && p.PathPrefix == "" && p.PathRegexp == "" {
+			return fmt.Errorf("accessLog: one of path, pathPrefix and pathRegexp is required")
+		}
+		if p.PathRegexp != "" {
+			if _, err := regexp.Compile(p.PathRegexp); err != nil {
+				return fmt.Errorf("accessLog: invalid pathRegexp %q: %v", p.PathRegexp, err)
+			}
+		}
+		if p.SampleRate < 0 || p.SampleRate > 1 {
+			return fmt.Errorf("accessLog: sampleRate of %s%s%s should be in [0, 1]", p.Path, p.PathPrefix, p.PathRegexp)
+		}
+	}
+	return nil
+}
+
+// newAccessLogger creates the access logger, format is the accessLogFormat
+// of the HTTPServer, which is used if spec is nil or spec.Template is empty.
+func newAccessLogger(spec *AccessLogSpec, format string) *accessLogger {
+	if spec == nil {
+		spec = &AccessLogSpec{}
+	}
+	if spec.Template != "" {
+		format = spec.Template
+	}
+
+	al := &accessLogger{mode: spec.Format, fields: spec.Fields}
+	switch al.mode {
+	case "", AccessLogFormatTemplate:
+		al.mode = AccessLogFormatTemplate
+		al.formatter = newAccessLogFormatter(format)
+	case AccessLogFormatJSON:
+		if len(al.fields) == 0 {
+			al.fields = defaultJSONFields
+		}
+	}
+
+	for _, p := range spec.Paths {
+		alp := &accessLogPath{spec: p, sampler: sampler.NewRateSampler(p.SampleRate)}
+		if p.PathRegexp != "" {
+			alp.re = regexp.MustCompile(p.PathRegexp)
+		}
+		al.paths = append(al.paths, alp)
+	}
+	return al
+}
+
+func (p *accessLogPath) match(path string) bool {
+	switch {
+	case p.spec.Path != "":
+		return p.spec.Path == path
+	case p.spec.PathPrefix != "":
+		return strings.HasPrefix(path, p.spec.PathPrefix)
+	default:
+		return p.re.MatchString(path)
+	}
+}
+
+// sample reports whether the access log of the request to path should be
+// written.
+func (al *accessLogger) sample(path string) bool {
+	for _, p := range al.paths {
+		if p.match(path) {
+			return p.sampler.Sample()
+		}
+	}
+	return true
+}
+
+func (al *accessLogger) format(log *accessLog) string {
+	switch al.mode {
+	case AccessLogFormatJSON:
+		return al.formatJSON(log)
+	case AccessLogFormatCommon:
+		return formatCLF(log, false)
+	case AccessLogFormatCombined:
+		return formatCLF(log, true)
+	default:
+		return al.formatter.format(log)
+	}
+}
+
+// formatJSON formats the access log as a JSON object of the selected
+// fields, durations are in milliseconds.
+func (al *accessLogger) formatJSON(log *accessLog) string {
+	buf := bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, f := range al.fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(strconv.Quote(f))
+		buf.WriteByte(':')
+
+		var v interface{}
+		switch f {
+		case "time":
+			v = log.Time
+		case "remoteAddr":
+			v = log.RemoteAddr
+		case "realIP":
+			v = log.RealIP
+		case "user":
+			v = log.User
+		case "method":
+			v = log.Method
+		case "host":
+			v = log.Host
+		case "uri":
+			v = log.URI
+		case "proto":
+			v = log.Proto
+		case "statusCode":
+			v = log.StatusCode
+		case "duration":
+			v = durationMillis(log.Duration)
+		case "reqSize":
+			v = log.ReqSize
+		case "respSize":
+			v = log.RespSize
+		case "referer":
+			v = log.Referer
+		case "userAgent":
+			v = log.UserAgent
+		case "tlsVersion":
+			v = log.TLSVersion
+		case "tlsCipher":
+			v = log.TLSCipher
+		case "tlsServerName":
+			v = log.TLSServerName
+		case "route":
+			v = log.Route
+		case "pipeline":
+			v = log.Pipeline
+		case "upstreamTimings":
+			timings := make(map[string]float64, len(log.UpstreamTimings))
+			for _, t := range log.UpstreamTimings {
+				timings[t.Filter] += durationMillis(t.Duration)
+			}
+			v = timings
+		case "tags":
+			v = log.Tags
+		case "reqHeaders":
+			v = log.ReqHeaders
+		case "respHeaders":
+			v = log.RespHeaders
+		}
+		data, _ := json.Marshal(v)
+		buf.Write(data)
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// formatCLF formats the access log in the Common Log Format, or the
+// Combined Log Format if combined is true.
+func formatCLF(log *accessLog, combined bool) string {
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	quote := func(s string) string {
+		return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+	}
+
+	size := "-"
+	if log.RespSize > 0 {
+		size = strconv.FormatUint(log.RespSize, 10)
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteString(orDash(log.RealIP))
+	buf.WriteString(" - ")
+	buf.WriteString(orDash(log.User))
+	buf.WriteString(" [")
+	buf.WriteString(log.StartAt.Format(clfTimeLayout))
+	buf.WriteString("] ")
+	buf.WriteString(quote(log.Method + " " + log.URI + " " + log.Proto))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.Itoa(log.StatusCode))
+	buf.WriteByte(' ')
+	buf.WriteString(size)
+	if combined {
+		buf.WriteByte(' ')
+		buf.WriteString(quote(orDash(log.Referer)))
+		buf.WriteByte(' ')
+		buf.WriteString(quote(orDash(log.UserAgent)))
+	}
+	return buf.String()
+}
+
+// String formats the upstream timings for the template format.
+func (ut upstreamTimings) String() string {
+	ss := make([]string, 0, len(ut))
+	for _, t := range ut {
+		ss = append(ss, t.Filter+":"+t.Duration.String())
+	}
+	return strings.Join(ss, " ")
+}
+
+func newAccessLogFormatter(format string) *accessLogFormatter {
+	if format == "" {
+		format = defaultAccessLogFormat
+	}
+	varReg := regexp.MustCompile(`\{\{([a-zA-z]*)\}\}`)
+	expr := varReg.ReplaceAllString(format, "{{.$1}}")
+	escapeReg := regexp.MustCompile(`(\[|\])`)
+	expr = escapeReg.ReplaceAllString(expr, "{{`$1`}}")
+	tpl := template.Must(template.New("").Parse(expr))
+	return &accessLogFormatter{template: tpl}
+}
+
+func (formatter *accessLogFormatter) format(log *accessLog) string {
+	var buf bytes.Buffer
+	if err := formatter.template.Execute(&buf, log); err != nil {
+		logger.Errorf("format access log failed: %v", err)
+	}
+	return buf.String()
+}
+
+func printHeader(header http.Header) string {
+	buf := bytes.Buffer{}
+	i := 0
+	for key, values := range header {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(fmt.Sprintf("%v: %v", key, values))
+		i++
+	}
+	return buf.String()
+}
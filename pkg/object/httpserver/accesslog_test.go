@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAccessLog() *accessLog {
+	startAt := time.Date(2023, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600))
+	return &accessLog{
+		Time:          startAt.Format(time.RFC3339),
+		StartAt:       startAt,
+		RemoteAddr:    "127.0.0.1:34567",
+		RealIP:        "127.0.0.1",
+		User:          "frank",
+		Method:        "GET",
+		Host:          "www.megaease.com",
+		URI:           "/apache_pb.gif?a=1",
+		Proto:         "HTTP/1.0",
+		StatusCode:    200,
+		Duration:      1500 * time.Microsecond,
+		ReqSize:       100,
+		RespSize:      2326,
+		Referer:       "http://www.example.com/start.html",
+		UserAgent:     `Mozilla/4.08 "test"`,
+		TLSVersion:    "TLS 1.3",
+		TLSCipher:     "TLS_AES_128_GCM_SHA256",
+		TLSServerName: "www.megaease.com",
+		Route:         "/apache",
+		Pipeline:      "pipeline-demo",
+		UpstreamTimings: upstreamTimings{
+			{Filter: "proxy", Duration: time.Millisecond},
+			{Filter: "auth", Duration: 250 * time.Microsecond},
+		},
+		Tags:       "tag1",
+		ReqHeaders: "Accept: [*/*]",
+	}
+}
+
+func TestAccessLogSpecValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&AccessLogSpec{}).Validate())
+	assert.NoError((&AccessLogSpec{
+		Format: AccessLogFormatJSON,
+		Fields: []string{"time", "tlsVersion", "upstreamTimings"},
+		Paths:  []*AccessLogPathSpec{{Path: "/healthz"}, {PathRegexp: "^/api/.*", SampleRate: 0.1}},
+	}).Validate())
+
+	assert.Error((&AccessLogSpec{Format: "xml"}).Validate())
+	assert.Error((&AccessLogSpec{Fields: []string{"unknown"}}).Validate())
+	assert.Error((&AccessLogSpec{Paths: []*AccessLogPathSpec{{SampleRate: 0.5}}}).Validate())
+	assert.Error((&AccessLogSpec{Paths: []*AccessLogPathSpec{{PathRegexp: "("}}}).Validate())
+	assert.Error((&AccessLogSpec{Paths: []*AccessLogPathSpec{{Path: "/", SampleRate: 2}}}).Validate())
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	assert := assert.New(t)
+	log := newTestAccessLog()
+
+	al := newAccessLogger(nil, "{{Method}} {{URI}} {{Route}} {{Pipeline}} [{{UpstreamTimings}}] {{TLSVersion}}")
+	assert.Equal("GET /apache_pb.gif?a=1 /apache pipeline-demo [proxy:1ms auth:250µs] TLS 1.3", al.format(log))
+
+	al = newAccessLogger(&AccessLogSpec{Template: "{{Host}}"}, "{{Method}}")
+	assert.Equal("www.megaease.com", al.format(log))
+
+	al = newAccessLogger(&AccessLogSpec{Format: AccessLogFormatCommon}, "")
+	assert.Equal(`127.0.0.1 - frank [10/Oct/2023:13:55:36 -0700] "GET /apache_pb.gif?a=1 HTTP/1.0" 200 2326`, al.format(log))
+
+	al = newAccessLogger(&AccessLogSpec{Format: AccessLogFormatCombined}, "")
+	assert.Equal(`127.0.0.1 - frank [10/Oct/2023:13:55:36 -0700] "GET /apache_pb.gif?a=1 HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 \"test\""`, al.format(log))
+
+	empty := &accessLog{StartAt: log.StartAt, Method: "GET", URI: "/", Proto: "HTTP/1.1", StatusCode: 404}
+	assert.Equal(`- - - [10/Oct/2023:13:55:36 -0700] "GET / HTTP/1.1" 404 - "-" "-"`, al.format(empty))
+
+	al = newAccessLogger(&AccessLogSpec{Format: AccessLogFormatJSON, Fields: []string{"statusCode", "duration", "upstreamTimings", "tlsCipher"}}, "")
+	assert.Equal(`{"statusCode":200,"duration":1.5,"upstreamTimings":{"auth":0.25,"proxy":1},"tlsCipher":"TLS_AES_128_GCM_SHA256"}`, al.format(log))
+
+	al = newAccessLogger(&AccessLogSpec{Format: AccessLogFormatJSON}, "")
+	fields := map[string]interface{}{}
+	assert.NoError(json.Unmarshal([]byte(al.format(log)), &fields))
+	assert.Len(fields, len(defaultJSONFields))
+	assert.Equal("pipeline-demo", fields["pipeline"])
+	assert.NotContains(fields, "reqHeaders")
+}
+
+func TestAccessLogSample(t *testing.T) {
+	assert := assert.New(t)
+
+	al := newAccessLogger(&AccessLogSpec{Paths: []*AccessLogPathSpec{
+		{Path: "/healthz"},
+		{PathPrefix: "/api/", SampleRate: 0.5},
+		{PathRegexp: "^/static/.*\\.js$", SampleRate: 1},
+	}}, "")
+
+	assert.False(al.sample("/healthz"))
+	assert.True(al.sample("/healthz/detail"))
+	assert.True(al.sample("/static/app.js"))
+
+	sampled := 0
+	for i := 0; i < 100; i++ {
+		if al.sample("/api/users") {
+			sampled++
+		}
+	}
+	assert.Equal(50, sampled)
+}
+
+func TestUpstreamTimings(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx := context.New(nil)
+	ctx.AddUpstreamTiming("proxy", time.Second)
+	assert.Equal("proxy:1s", upstreamTimings(ctx.UpstreamTimings()).String())
+}
@@ -18,17 +18,14 @@
 package httpserver
 
 import (
-	"bytes"
-	"fmt"
+	stdcontext "context"
+	"crypto/tls"
 	"io"
 	"mime"
 	"net/http"
 	"reflect"
-	"regexp"
 	"strings"
 	"sync/atomic"
-	"text/template"
-	"time"
 
 	"github.com/megaease/easegress/v2/pkg/object/httpserver/routers"
 
@@ -49,9 +46,9 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-const (
-	defaultAccessLogFormat = "[{{Time}}] [{{RemoteAddr}} {{RealIP}} {{Method}} {{URI}} {{Proto}} {{StatusCode}}] [{{Duration}} rx:{{ReqSize}}B tx:{{RespSize}}B] [{{Tags}}]"
-)
+// maxConcurrentMirrors is the max number of mirrored requests being handled
+// by an HTTPServer, requests are not mirrored when it is exceeded.
+const maxConcurrentMirrors = 1024
 
 type (
 	mux struct {
@@ -62,12 +59,12 @@ type (
 	}
 
 	muxInstance struct {
-		superSpec          *supervisor.Spec
-		spec               *Spec
-		httpStat           *httpstat.HTTPStat
-		topN               *httpstat.TopN
-		metrics            *metrics
-		accessLogFormatter *accessLogFormatter
+		superSpec    *supervisor.Spec
+		spec         *Spec
+		httpStat     *httpstat.HTTPStat
+		topN         *httpstat.TopN
+		metrics      *metrics
+		accessLogger *accessLogger
 
 		muxMapper context.MuxMapper
 
@@ -77,32 +74,14 @@ type (
 		ipFilter *ipfilter.IPFilter
 
 		router routers.Router
+
+		mirrors chan struct{}
 	}
 
 	cachedRoute struct {
 		code  int
 		route routers.Route
 	}
-
-	accessLogFormatter struct {
-		template *template.Template
-	}
-
-	accessLog struct {
-		Time        string
-		RemoteAddr  string
-		RealIP      string
-		Method      string
-		URI         string
-		Proto       string
-		StatusCode  int
-		Duration    time.Duration
-		ReqSize     uint64
-		RespSize    uint64
-		ReqHeaders  string
-		RespHeaders string
-		Tags        string
-	}
 )
 
 var (
@@ -138,12 +117,13 @@ func newMux(httpStat *httpstat.HTTPStat, topN *httpstat.TopN,
 	}
 
 	m.inst.Store(&muxInstance{
-		spec:      &Spec{},
-		tracer:    tracing.NoopTracer,
-		muxMapper: mapper,
-		httpStat:  httpStat,
-		topN:      topN,
-		metrics:   metrics,
+		spec:         &Spec{},
+		tracer:       tracing.NoopTracer,
+		muxMapper:    mapper,
+		httpStat:     httpStat,
+		topN:         topN,
+		metrics:      metrics,
+		accessLogger: newAccessLogger(nil, ""),
 	})
 
 	return m
@@ -177,15 +157,16 @@ func (m *mux) reload(superSpec *supervisor.Spec, muxMapper context.MuxMapper) {
 	}
 
 	inst := &muxInstance{
-		superSpec:          superSpec,
-		spec:               spec,
-		muxMapper:          muxMapper,
-		httpStat:           m.httpStat,
-		topN:               m.topN,
-		metrics:            oldInst.metrics,
-		ipFilter:           ipfilter.New(spec.IPFilter),
-		tracer:             tracer,
-		accessLogFormatter: newAccessLogFormatter(spec.AccessLogFormat),
+		superSpec:    superSpec,
+		spec:         spec,
+		muxMapper:    muxMapper,
+		httpStat:     m.httpStat,
+		topN:         m.topN,
+		metrics:      oldInst.metrics,
+		ipFilter:     ipfilter.New(spec.IPFilter),
+		tracer:       tracer,
+		accessLogger: newAccessLogger(spec.AccessLog, spec.AccessLogFormat),
+		mirrors:      make(chan struct{}, maxConcurrentMirrors),
 	}
 	spec.Rules.Init()
 	inst.router = routers.Create(routerKind, spec.Rules)
@@ -306,6 +287,8 @@ func (mi *muxInstance) serveHTTP(stdw http.ResponseWriter, stdr *http.Request) {
 	stdr.Body = body
 
 	startAt := fasttime.Now()
+	// get the path for access log sampling here, as it could be rewritten.
+	logPath := stdr.URL.Path
 
 	span := mi.tracer.NewSpanForHTTP(stdr.Context(), mi.superSpec.Name(), stdr)
 
@@ -327,6 +310,7 @@ func (mi *muxInstance) serveHTTP(stdw http.ResponseWriter, stdr *http.Request) {
 	ctx.SetRoute(route.route)
 
 	var respHeader http.Header
+	var backend string
 
 	defer func() {
 		metric, _ := ctx.GetData("HTTP_METRIC").(*httpstat.Metric)
@@ -353,29 +337,49 @@ func (mi *muxInstance) serveHTTP(stdw http.ResponseWriter, stdr *http.Request) {
 		topN.Stat(metric)
 		mi.httpStat.Stat(metric)
 		if route.code == 0 {
-			mi.exportPrometheusMetrics(metric, route.route.GetBackend())
+			mi.exportPrometheusMetrics(metric, backend)
 		}
 
 		span.End()
 
 		// Write access log.
+		if !mi.accessLogger.sample(logPath) {
+			return
+		}
 		logger.LazyHTTPAccess(func() string {
 			log := &accessLog{
-				Time:        fasttime.Format(startAt, fasttime.RFC3339Milli),
-				RemoteAddr:  stdr.RemoteAddr,
-				RealIP:      req.RealIP(),
-				Method:      stdr.Method,
-				URI:         stdr.RequestURI,
-				Proto:       stdr.Proto,
-				StatusCode:  metric.StatusCode,
-				Duration:    metric.Duration,
-				ReqSize:     metric.ReqSize,
-				RespSize:    metric.RespSize,
-				Tags:        ctx.Tags(),
-				ReqHeaders:  printHeader(stdr.Header),
-				RespHeaders: printHeader(respHeader),
+				Time:            fasttime.Format(startAt, fasttime.RFC3339Milli),
+				StartAt:         startAt,
+				RemoteAddr:      stdr.RemoteAddr,
+				RealIP:          req.RealIP(),
+				Method:          stdr.Method,
+				Host:            stdr.Host,
+				URI:             stdr.RequestURI,
+				Proto:           stdr.Proto,
+				StatusCode:      metric.StatusCode,
+				Duration:        metric.Duration,
+				ReqSize:         metric.ReqSize,
+				RespSize:        metric.RespSize,
+				Referer:         stdr.Referer(),
+				UserAgent:       stdr.UserAgent(),
+				UpstreamTimings: ctx.UpstreamTimings(),
+				Tags:            ctx.Tags(),
+				ReqHeaders:      printHeader(stdr.Header),
+				RespHeaders:     printHeader(respHeader),
+			}
+			if user, _, ok := stdr.BasicAuth(); ok {
+				log.User = user
 			}
-			return mi.accessLogFormatter.format(log)
+			if stdr.TLS != nil {
+				log.TLSVersion = tls.VersionName(stdr.TLS.Version)
+				log.TLSCipher = tls.CipherSuiteName(stdr.TLS.CipherSuite)
+				log.TLSServerName = stdr.TLS.ServerName
+			}
+			if route.code == 0 {
+				log.Route = routePattern(route.route)
+				log.Pipeline = backend
+			}
+			return mi.accessLogger.format(log)
 		})
 	}()
 
@@ -385,7 +389,7 @@ func (mi *muxInstance) serveHTTP(stdw http.ResponseWriter, stdr *http.Request) {
 		return
 	}
 
-	backend := route.route.GetBackend()
+	backend = route.route.SelectBackend(routeCtx)
 	handler, ok := mi.muxMapper.GetHandler(backend)
 	if !ok {
 		logger.Errorf("%s: backend(Pipeline) %q for [%s %s] not found", mi.superSpec.Name(), req.Method(), req.RequestURI, backend)
@@ -415,13 +419,59 @@ func (mi *muxInstance) serveHTTP(stdw http.ResponseWriter, stdr *http.Request) {
 		return
 	}
 
+	// the request is mirrored only if it passes the global filter.
+	var onPipeline func()
+	if mirror := route.route.GetMirrorBackend(); mirror != "" {
+		onPipeline = func() { mi.mirror(req, mirror) }
+	}
+
 	// global filter
 	globalFilter := mi.getGlobalFilter()
 	if globalFilter == nil {
+		if onPipeline != nil {
+			onPipeline()
+		}
 		handler.Handle(ctx)
 	} else {
-		globalFilter.Handle(ctx, handler)
+		globalFilter.HandleWithOnPipeline(ctx, handler, onPipeline)
+	}
+}
+
+// mirror sends a copy of the request to the mirror backend in the
+// background, the response of the mirror backend is discarded. Requests
+// with a stream body are not mirrored, as the body could only be read once.
+func (mi *muxInstance) mirror(req *httpprot.Request, backend string) {
+	if req.IsStream() {
+		logger.Debugf("%s: request [%s %s] with a stream body is not mirrored", mi.superSpec.Name(), req.Method(), req.RequestURI)
+		return
 	}
+	handler, ok := mi.muxMapper.GetHandler(backend)
+	if !ok {
+		logger.Errorf("%s: mirror backend(Pipeline) %q for [%s %s] not found", mi.superSpec.Name(), backend, req.Method(), req.RequestURI)
+		return
+	}
+
+	select {
+	case mi.mirrors <- struct{}{}:
+	default:
+		logger.Warnf("%s: too many mirrored requests, [%s %s] is not mirrored", mi.superSpec.Name(), req.Method(), req.RequestURI)
+		return
+	}
+
+	// the mirrored request must not be canceled with the original one.
+	stdr := req.Std().Clone(stdcontext.Background())
+	stdr.Body = http.NoBody
+	mreq, _ := httpprot.NewRequest(stdr)
+	mreq.SetPayload(req.RawPayload())
+
+	go func() {
+		defer func() { <-mi.mirrors }()
+
+		ctx := context.New(tracing.NoopSpan)
+		ctx.SetRequest(context.DefaultNamespace, mreq)
+		defer ctx.Finish()
+		handler.Handle(ctx)
+	}()
 }
 
 func (mi *muxInstance) search(context *routers.RouteContext) *cachedRoute {
@@ -527,35 +577,13 @@ func (mi *muxInstance) exportPrometheusMetrics(stat *httpstat.Metric, backend st
 	mi.metrics.ResponseSizeBytesPercentage.With(labels).Observe(float64(stat.RespSize))
 }
 
-func newAccessLogFormatter(format string) *accessLogFormatter {
-	if format == "" {
-		format = defaultAccessLogFormat
+// routePattern returns the path pattern of the route.
+func routePattern(route routers.Route) string {
+	if p := route.GetExactPath(); p != "" {
+		return p
 	}
-	varReg := regexp.MustCompile(`\{\{([a-zA-z]*)\}\}`)
-	expr := varReg.ReplaceAllString(format, "{{.$1}}")
-	escapeReg := regexp.MustCompile(`(\[|\])`)
-	expr = escapeReg.ReplaceAllString(expr, "{{`$1`}}")
-	tpl := template.Must(template.New("").Parse(expr))
-	return &accessLogFormatter{template: tpl}
-}
-
-func (formatter *accessLogFormatter) format(log *accessLog) string {
-	var buf bytes.Buffer
-	if err := formatter.template.Execute(&buf, log); err != nil {
-		logger.Errorf("format access log failed: %v", err)
-	}
-	return buf.String()
-}
-
-func printHeader(header http.Header) string {
-	buf := bytes.Buffer{}
-	i := 0
-	for key, values := range header {
-		if i > 0 {
-			buf.WriteString(", ")
-		}
-		buf.WriteString(fmt.Sprintf("%v: %v", key, values))
-		i++
+	if p := route.GetPathPrefix(); p != "" {
+		return p
 	}
-	return buf.String()
+	return route.GetPathRegexp()
 }
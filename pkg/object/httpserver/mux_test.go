@@ -227,6 +227,63 @@ rules:
 	assert.Equal(http.StatusBadRequest, stdw.Code)
 }
 
+func TestServeHTTPMirror(t *testing.T) {
+	assert := assert.New(t)
+
+	mm := &contexttest.MockedMuxMapper{}
+	m := newMux(httpstat.New(), httpstat.NewTopN(10), newMockMetrics(), mm)
+	defer m.close()
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+rules:
+- paths:
+  - path: /abc
+    backends:
+    - name: stable-pipeline
+      weight: 1
+    - name: canary-pipeline
+      weight: 0
+    mirror: shadow-pipeline
+`
+	superSpec, err := supervisor.NewSpec(yamlConfig)
+	assert.NoError(err)
+	assert.NotPanics(func() { m.reload(superSpec, mm) })
+
+	handled := make(chan string, 10)
+	mirrored := make(chan string, 10)
+	mm.MockedGetHandler = func(name string) (context.Handler, bool) {
+		if name == "shadow-pipeline" {
+			return &contexttest.MockedHandler{MockedHandle: func(ctx *context.Context) string {
+				req := ctx.GetInputRequest().(*httpprot.Request)
+				mirrored <- req.Method() + " " + req.Path() + " " + string(req.RawPayload())
+				return ""
+			}}, true
+		}
+		return &contexttest.MockedHandler{MockedHandle: func(ctx *context.Context) string {
+			handled <- name
+			return ""
+		}}, true
+	}
+
+	stdr, _ := http.NewRequest(http.MethodPost, "http://www.megaease.com/abc", strings.NewReader("hello"))
+	m.ServeHTTP(httptest.NewRecorder(), stdr)
+	assert.Equal("stable-pipeline", <-handled)
+	assert.Equal("POST /abc hello", <-mirrored)
+
+	// requests are not mirrored if there are too many mirrored requests.
+	inst := m.inst.Load().(*muxInstance)
+	for i := 0; i < maxConcurrentMirrors; i++ {
+		inst.mirrors <- struct{}{}
+	}
+	stdr, _ = http.NewRequest(http.MethodGet, "http://www.megaease.com/abc", http.NoBody)
+	m.ServeHTTP(httptest.NewRecorder(), stdr)
+	assert.Equal("stable-pipeline", <-handled)
+	assert.Empty(mirrored)
+}
+
 func TestMuxInstanceSearch(t *testing.T) {
 	assert := assert.New(t)
 
@@ -963,3 +963,41 @@ func TestRouteRewrite(t *testing.T) {
 
 	}
 }
+
+func TestWeightedBackends(t *testing.T) {
+	assert := assert.New(t)
+
+	rules := routers.Rules{
+		&routers.Rule{
+			Paths: []*routers.Path{
+				{
+					Path: "/api/{resource}",
+					Backends: []*routers.WeightedBackend{
+						{Name: "stable", Weight: 90},
+						{Name: "canary", Weight: 10},
+					},
+					Sticky: &routers.Sticky{Header: "X-User"},
+					Mirror: "shadow",
+				},
+			},
+		},
+	}
+
+	rules.Init()
+	router := kind.CreateInstance(rules).(*radixTreeRouter)
+
+	stdr, _ := http.NewRequest(http.MethodGet, "/api/users", nil)
+	stdr.Header.Set("X-User", "frank")
+	req, _ := httpprot.NewRequest(stdr)
+	ctx := routers.NewContext(req)
+	router.Search(ctx)
+
+	assert.NotNil(ctx.Route)
+	backend := ctx.Route.SelectBackend(ctx)
+	assert.Contains([]string{"stable", "canary"}, backend)
+	for i := 0; i < 10; i++ {
+		assert.Equal(backend, ctx.Route.SelectBackend(ctx))
+	}
+	assert.Equal("stable", ctx.Route.GetBackend())
+	assert.Equal("shadow", ctx.Route.GetMirrorBackend())
+}
@@ -56,6 +56,12 @@ type (
 		Rewrite(context *RouteContext)
 		// GetBackend is used to get the backend corresponding to the route.
 		GetBackend() string
+		// SelectBackend selects the backend of the request, it differs
+		// from GetBackend when the route splits traffic across backends.
+		SelectBackend(context *RouteContext) string
+		// GetMirrorBackend returns the backend the requests are mirrored
+		// to, or an empty string if the requests are not mirrored.
+		GetMirrorBackend() string
 		// GetClientMaxBodySize is used to get the clientMaxBodySize corresponding to the route.
 		GetClientMaxBodySize() int64
 
@@ -19,6 +19,8 @@ package routers
 
 import (
 	"fmt"
+	"hash/fnv"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -70,16 +72,40 @@ type Path struct {
 	PathRegexp        string         `json:"pathRegexp,omitempty" jsonschema:"format=regexp"`
 	RewriteTarget     string         `json:"rewriteTarget,omitempty"`
 	Methods           []string       `json:"methods,omitempty" jsonschema:"uniqueItems=true,format=httpmethod-array"`
-	Backend           string         `json:"backend" jsonschema:"required"`
+	Backend           string         `json:"backend,omitempty"`
 	ClientMaxBodySize int64          `json:"clientMaxBodySize,omitempty"`
 	Headers           Headers        `json:"headers,omitempty"`
 	Queries           Queries        `json:"queries,omitempty"`
 	MatchAllHeader    bool           `json:"matchAllHeader,omitempty"`
 	MatchAllQuery     bool           `json:"matchAllQuery,omitempty"`
 
+	// Backends splits the traffic across weighted backends, Backend is
+	// ignored if Backends is not empty.
+	Backends []*WeightedBackend `json:"backends,omitempty"`
+	// Sticky sends requests with the same header or cookie value to the
+	// same weighted backend.
+	Sticky *Sticky `json:"sticky,omitempty"`
+	// Mirror is the backend the requests are mirrored to, the responses
+	// of the mirror backend are discarded.
+	Mirror string `json:"mirror,omitempty"`
+
 	ipFilter             *ipfilter.IPFilter
 	method               MethodType
 	cacheable, matchable bool
+	totalWeight          int
+}
+
+// WeightedBackend is a backend with a weight.
+type WeightedBackend struct {
+	Name   string `json:"name" jsonschema:"required"`
+	Weight int    `json:"weight" jsonschema:"required,minimum=0"`
+}
+
+// Sticky describes the header or the cookie whose value decides the
+// weighted backend of requests.
+type Sticky struct {
+	Header string `json:"header,omitempty"`
+	Cookie string `json:"cookie,omitempty"`
 }
 
 // Headers represents the set of headers.
@@ -206,6 +232,11 @@ func (p *Path) Init(parentIPFilter *ipfilter.IPFilter) {
 	p.method = method
 	p.matchable = true
 
+	p.totalWeight = 0
+	for _, b := range p.Backends {
+		p.totalWeight += b.Weight
+	}
+
 	if len(p.Headers) == 0 && len(p.Queries) == 0 && p.ipFilter == nil {
 		if parentIPFilter == nil {
 			p.cacheable = true
@@ -222,6 +253,31 @@ func (p *Path) Validate() error {
 		return fmt.Errorf("rewriteTarget is specified but path is empty")
 	}
 
+	if p.Backend == "" && len(p.Backends) == 0 {
+		return fmt.Errorf("one of backend and backends is required")
+	}
+
+	if len(p.Backends) > 0 {
+		total := 0
+		for _, b := range p.Backends {
+			if b.Weight < 0 {
+				return fmt.Errorf("weight of backend %s is negative", b.Name)
+			}
+			total += b.Weight
+		}
+		if total == 0 {
+			return fmt.Errorf("total weight of backends is 0")
+		}
+	}
+	if p.Sticky != nil {
+		if len(p.Backends) == 0 {
+			return fmt.Errorf("sticky is specified but backends is empty")
+		}
+		if p.Sticky.Header == "" && p.Sticky.Cookie == "" {
+			return fmt.Errorf("one of header and cookie of sticky is required")
+		}
+	}
+
 	return nil
 }
 
@@ -265,11 +321,63 @@ func (p *Path) Match(context *RouteContext) bool {
 	return true
 }
 
-// GetBackend is used to get the backend corresponding to the route.
+// GetBackend is used to get the backend corresponding to the route, it is
+// the first weighted backend if the route splits traffic.
 func (p *Path) GetBackend() string {
+	if len(p.Backends) > 0 {
+		return p.Backends[0].Name
+	}
 	return p.Backend
 }
 
+// SelectBackend selects the backend of the request. If the route splits
+// traffic, a weighted backend is chosen randomly, or by the hash of the
+// sticky header or cookie if the request has one.
+func (p *Path) SelectBackend(context *RouteContext) string {
+	if len(p.Backends) == 0 || p.totalWeight == 0 {
+		return p.GetBackend()
+	}
+
+	var n int
+	if key := p.stickyKey(context); key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		n = int(h.Sum32() % uint32(p.totalWeight))
+	} else {
+		n = rand.Intn(p.totalWeight)
+	}
+
+	for _, b := range p.Backends {
+		if n < b.Weight {
+			return b.Name
+		}
+		n -= b.Weight
+	}
+	return p.GetBackend()
+}
+
+func (p *Path) stickyKey(context *RouteContext) string {
+	if p.Sticky == nil {
+		return ""
+	}
+	if p.Sticky.Header != "" {
+		if v := context.GetHeader().Get(p.Sticky.Header); v != "" {
+			return v
+		}
+	}
+	if p.Sticky.Cookie != "" {
+		if c, err := context.Request.Cookie(p.Sticky.Cookie); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// GetMirrorBackend returns the backend the requests are mirrored to.
+func (p *Path) GetMirrorBackend() string {
+	return p.Mirror
+}
+
 // GetClientMaxBodySize is used to get the clientMaxBodySize corresponding to the route.
 func (p *Path) GetClientMaxBodySize() int64 {
 	return p.ClientMaxBodySize
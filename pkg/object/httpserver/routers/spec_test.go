@@ -20,6 +20,7 @@ package routers
 import (
 	"net/http"
 	"os"
+	"strconv"
 	"testing"
 
 	"github.com/megaease/easegress/v2/pkg/logger"
@@ -218,7 +219,7 @@ func TestPathInit(t *testing.T) {
 }
 
 func TestPathValidate(t *testing.T) {
-	p := &Path{RewriteTarget: "abc"}
+	p := &Path{Backend: "a", RewriteTarget: "abc"}
 	assert.Error(t, p.Validate())
 
 	p.Path = "foo"
@@ -235,6 +236,80 @@ func TestPathValidate(t *testing.T) {
 	p.PathRegexp = ""
 	p.RewriteTarget = ""
 	assert.NoError(t, p.Validate())
+
+	p.Backend = ""
+	assert.Error(t, p.Validate())
+}
+
+func TestPathValidateBackends(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Path{Backends: []*WeightedBackend{{Name: "a", Weight: 90}, {Name: "b", Weight: 10}}}
+	assert.NoError(p.Validate())
+
+	p.Sticky = &Sticky{}
+	assert.Error(p.Validate())
+	p.Sticky.Cookie = "session"
+	assert.NoError(p.Validate())
+
+	p.Backends[0].Weight = -1
+	assert.Error(p.Validate())
+	p.Backends[0].Weight = 0
+	p.Backends[1].Weight = 0
+	assert.Error(p.Validate())
+
+	p = &Path{Backend: "a", Sticky: &Sticky{Header: "X-User"}}
+	assert.Error(p.Validate())
+}
+
+func TestPathSelectBackend(t *testing.T) {
+	assert := assert.New(t)
+
+	newContext := func(header, cookie string) *RouteContext {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/", nil)
+		if header != "" {
+			stdr.Header.Set("X-User", header)
+		}
+		if cookie != "" {
+			stdr.AddCookie(&http.Cookie{Name: "session", Value: cookie})
+		}
+		req, _ := httpprot.NewRequest(stdr)
+		return NewContext(req)
+	}
+
+	p := &Path{Backend: "a", Mirror: "shadow"}
+	p.Init(nil)
+	assert.Equal("a", p.GetBackend())
+	assert.Equal("a", p.SelectBackend(newContext("", "")))
+	assert.Equal("shadow", p.GetMirrorBackend())
+
+	p = &Path{
+		Backend:  "ignored",
+		Backends: []*WeightedBackend{{Name: "a", Weight: 90}, {Name: "b", Weight: 10}, {Name: "c", Weight: 0}},
+	}
+	p.Init(nil)
+	assert.Equal("a", p.GetBackend())
+	assert.Equal("", p.GetMirrorBackend())
+
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		counts[p.SelectBackend(newContext("", ""))]++
+	}
+	assert.InDelta(9000, counts["a"], 500)
+	assert.InDelta(1000, counts["b"], 500)
+	assert.Equal(0, counts["c"])
+
+	p.Sticky = &Sticky{Header: "X-User", Cookie: "session"}
+	counts = map[string]int{}
+	for i := 0; i < 1000; i++ {
+		user := strconv.Itoa(i)
+		backend := p.SelectBackend(newContext(user, ""))
+		assert.Equal(backend, p.SelectBackend(newContext(user, "")))
+		assert.Equal(backend, p.SelectBackend(newContext("", user)))
+		counts[backend]++
+	}
+	assert.InDelta(900, counts["a"], 100)
+	assert.InDelta(100, counts["b"], 100)
 }
 
 func TestPathInit2(t *testing.T) {
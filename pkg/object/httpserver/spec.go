@@ -63,12 +63,19 @@ type (
 
 		GlobalFilter string `json:"globalFilter,omitempty"`
 
-		AccessLogFormat string `json:"accessLogFormat,omitempty"`
+		AccessLogFormat string         `json:"accessLogFormat,omitempty"`
+		AccessLog       *AccessLogSpec `json:"accessLog,omitempty"`
 	}
 )
 
 // Validate validates HTTPServerSpec.
 func (spec *Spec) Validate() error {
+	if spec.AccessLog != nil {
+		if err := spec.AccessLog.Validate(); err != nil {
+			return err
+		}
+	}
+
 	if !spec.HTTPS {
 		if spec.HTTP3 {
 			return fmt.Errorf("https is disabled when http3 enabled")
@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kafkaconsumer
+
+import (
+	stdcontext "context"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/megaease/easegress/v2/pkg/logger"
+)
+
+type (
+	// groupHandler implements sarama.ConsumerGroupHandler.
+	groupHandler struct {
+		kc     *KafkaConsumer
+		pauser partitionPauser
+	}
+
+	// partitionPauser is the subset of sarama.ConsumerGroup used to pause
+	// the partition of a failed message.
+	partitionPauser interface {
+		Pause(partitions map[string][]int32)
+	}
+
+	// offsetTracker tracks the messages of a partition which are being
+	// processed, so that an offset is committed only after the message and
+	// all messages before it are processed successfully.
+	offsetTracker struct {
+		lock    sync.Mutex
+		pending []int64
+		done    map[int64]bool
+		next    int64
+	}
+)
+
+var _ sarama.ConsumerGroupHandler = (*groupHandler)(nil)
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{done: map[int64]bool{}, next: -1}
+}
+
+// add adds an offset, offsets must be added in increasing order.
+func (t *offsetTracker) add(offset int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pending = append(t.pending, offset)
+}
+
+// complete marks an offset as processed successfully, it returns the next
+// offset to consume and true if the offset could be committed is advanced.
+func (t *offsetTracker) complete(offset int64) (int64, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.done[offset] = true
+	advanced := false
+	for len(t.pending) > 0 && t.done[t.pending[0]] {
+		delete(t.done, t.pending[0])
+		t.next = t.pending[0] + 1
+		t.pending = t.pending[1:]
+		advanced = true
+	}
+	return t.next, advanced
+}
+
+// Setup implements sarama.ConsumerGroupHandler.
+func (h *groupHandler) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// Cleanup implements sarama.ConsumerGroupHandler.
+func (h *groupHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim implements sarama.ConsumerGroupHandler, messages of the claim
+// are processed concurrently, the concurrency of all claims is limited by
+// maxConcurrency.
+//
+// The offset of a failed message is never committed, so the partition is
+// paused once a message fails, otherwise the offsets after it are kept in
+// memory without bound. ConsumeClaim must not return then, because sarama
+// cancels the whole session when any claim returns, so it keeps the claim
+// until the session ends, that's, the next rebalance or restart, and the
+// failed message will be consumed again then. Other claims are not affected.
+func (h *groupHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	kc := h.kc
+	ctx := sess.Context()
+	tracker := newOffsetTracker()
+
+	paused := make(chan struct{})
+	var pauseOnce sync.Once
+	pause := func(msg *sarama.ConsumerMessage) {
+		pauseOnce.Do(func() {
+			logger.Errorf("%s: partition %s/%d is paused until the next rebalance, because message at offset %d failed",
+				kc.superSpec.Name(), msg.Topic, msg.Partition, msg.Offset)
+			if h.pauser != nil {
+				h.pauser.Pause(map[string][]int32{msg.Topic: {msg.Partition}})
+			}
+			close(paused)
+		})
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		var msg *sarama.ConsumerMessage
+		select {
+		case m, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			msg = m
+		case <-paused:
+			h.waitSessionEnd(ctx, claim)
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+
+		select {
+		case kc.sem <- struct{}{}:
+		case <-paused:
+			h.waitSessionEnd(ctx, claim)
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+
+		// the claim may be paused while waiting for the semaphore.
+		select {
+		case <-paused:
+			<-kc.sem
+			h.waitSessionEnd(ctx, claim)
+			return nil
+		default:
+		}
+
+		tracker.add(msg.Offset)
+		wg.Add(1)
+		go func(msg *sarama.ConsumerMessage) {
+			defer func() {
+				<-kc.sem
+				wg.Done()
+			}()
+
+			if !kc.process(ctx, msg) {
+				if ctx.Err() == nil {
+					pause(msg)
+				}
+				return
+			}
+			if next, ok := tracker.complete(msg.Offset); ok {
+				sess.MarkOffset(msg.Topic, msg.Partition, next, "")
+			}
+		}(msg)
+	}
+}
+
+// waitSessionEnd waits until the session ends or the claim is closed. The
+// messages fetched before the partition is paused are discarded, they will
+// be consumed again in the next session as their offsets are not committed.
+func (h *groupHandler) waitSessionEnd(ctx stdcontext.Context, claim sarama.ConsumerGroupClaim) {
+	for {
+		select {
+		case _, ok := <-claim.Messages():
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,361 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package kafkaconsumer implements the KafkaConsumer, which consumes messages
+// from Kafka and dispatches them to a pipeline.
+package kafkaconsumer
+
+import (
+	stdcontext "context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/megaease/easegress/v2/pkg/api"
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/supervisor"
+	"github.com/megaease/easegress/v2/pkg/tracing"
+)
+
+const (
+	// Category is the category of KafkaConsumer.
+	Category = supervisor.CategoryTrafficGate
+
+	// Kind is the kind of KafkaConsumer.
+	Kind = "KafkaConsumer"
+
+	// headers set to the request, besides the headers of the message
+	headerTopic     = "X-Kafka-Topic"
+	headerPartition = "X-Kafka-Partition"
+	headerOffset    = "X-Kafka-Offset"
+	headerKey       = "X-Kafka-Key"
+	headerTimestamp = "X-Kafka-Timestamp"
+
+	// headers added to messages sent to the dead letter topic
+	headerErrorResult = "x-easegress-error-result"
+	headerOrigin      = "x-easegress-origin"
+
+	resultPipelineNotFound = "pipelineNotFound"
+)
+
+var _ supervisor.TrafficObject = (*KafkaConsumer)(nil)
+
+func init() {
+	supervisor.Register(&KafkaConsumer{})
+	api.RegisterObject(&api.APIResource{
+		Category: Category,
+		Kind:     Kind,
+		Name:     strings.ToLower(Kind),
+		Aliases:  []string{"kafkaconsumers", "kc"},
+	})
+}
+
+type (
+	// KafkaConsumer consumes messages from Kafka with a consumer group, and
+	// dispatches every message to a pipeline as an HTTP request.
+	KafkaConsumer struct {
+		superSpec *supervisor.Spec
+		spec      *Spec
+		muxMapper context.MuxMapper
+
+		group    sarama.ConsumerGroup
+		producer syncProducer
+		sem      chan struct{}
+		cancel   stdcontext.CancelFunc
+		wg       sync.WaitGroup
+
+		connected        int32
+		numOfMessages    int64
+		numOfFailures    int64
+		numOfDeadLetters int64
+	}
+
+	// syncProducer is the subset of sarama.SyncProducer used to send
+	// messages to the dead letter topic.
+	syncProducer interface {
+		SendMessage(msg *sarama.ProducerMessage) (partition int32, offset int64, err error)
+		Close() error
+	}
+
+	// Status is the status of KafkaConsumer.
+	Status struct {
+		Health           string `json:"health"`
+		NumOfMessages    int64  `json:"numOfMessages"`
+		NumOfFailures    int64  `json:"numOfFailures"`
+		NumOfDeadLetters int64  `json:"numOfDeadLetters"`
+	}
+)
+
+// Category returns the category of KafkaConsumer.
+func (kc *KafkaConsumer) Category() supervisor.ObjectCategory {
+	return Category
+}
+
+// Kind returns the kind of KafkaConsumer.
+func (kc *KafkaConsumer) Kind() string {
+	return Kind
+}
+
+// DefaultSpec returns the default spec of KafkaConsumer.
+func (kc *KafkaConsumer) DefaultSpec() interface{} {
+	return &Spec{
+		InitialOffset:  offsetNewest,
+		MaxConcurrency: 10,
+		RetryInterval:  "1s",
+	}
+}
+
+// Init initializes KafkaConsumer.
+func (kc *KafkaConsumer) Init(superSpec *supervisor.Spec, muxMapper context.MuxMapper) {
+	kc.superSpec = superSpec
+	kc.spec = superSpec.ObjectSpec().(*Spec)
+	kc.muxMapper = muxMapper
+	kc.sem = make(chan struct{}, kc.maxConcurrency())
+
+	ctx, cancel := stdcontext.WithCancel(stdcontext.Background())
+	kc.cancel = cancel
+
+	kc.wg.Add(1)
+	go kc.run(ctx)
+}
+
+// Inherit inherits previous generation of KafkaConsumer.
+func (kc *KafkaConsumer) Inherit(superSpec *supervisor.Spec, previousGeneration supervisor.Object, muxMapper context.MuxMapper) {
+	// the previous generation must leave the consumer group before the new
+	// one joins, to make sure a message is not processed by both of them.
+	previousGeneration.Close()
+	kc.Init(superSpec, muxMapper)
+}
+
+// Status returns the status of KafkaConsumer.
+func (kc *KafkaConsumer) Status() *supervisor.Status {
+	s := &Status{
+		NumOfMessages:    atomic.LoadInt64(&kc.numOfMessages),
+		NumOfFailures:    atomic.LoadInt64(&kc.numOfFailures),
+		NumOfDeadLetters: atomic.LoadInt64(&kc.numOfDeadLetters),
+	}
+	if atomic.LoadInt32(&kc.connected) == 0 {
+		s.Health = "connecting"
+	} else {
+		s.Health = "ready"
+	}
+	return &supervisor.Status{ObjectStatus: s}
+}
+
+// Close closes KafkaConsumer.
+func (kc *KafkaConsumer) Close() {
+	kc.cancel()
+	kc.wg.Wait()
+}
+
+func (kc *KafkaConsumer) maxConcurrency() int {
+	if kc.spec.MaxConcurrency <= 0 {
+		return 10
+	}
+	return kc.spec.MaxConcurrency
+}
+
+// connect creates the consumer group and the producer of the dead letter
+// topic, it retries until success or ctx is canceled.
+func (kc *KafkaConsumer) connect(ctx stdcontext.Context) bool {
+	config := kc.spec.saramaConfig(kc.superSpec.Name())
+
+	for {
+		group, err := sarama.NewConsumerGroup(kc.spec.Backend, kc.spec.GroupID, config)
+		if err == nil && kc.spec.DeadLetterTopic != "" {
+			var producer sarama.SyncProducer
+			producer, err = sarama.NewSyncProducer(kc.spec.Backend, config)
+			if err == nil {
+				kc.producer = producer
+			} else {
+				group.Close()
+			}
+		}
+		if err == nil {
+			kc.group = group
+			atomic.StoreInt32(&kc.connected, 1)
+			return true
+		}
+
+		logger.Errorf("%s: failed to connect to kafka %v: %v", kc.superSpec.Name(), kc.spec.Backend, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+func (kc *KafkaConsumer) run(ctx stdcontext.Context) {
+	defer kc.wg.Done()
+
+	if !kc.connect(ctx) {
+		return
+	}
+	defer func() {
+		if err := kc.group.Close(); err != nil {
+			logger.Errorf("%s: failed to close consumer group: %v", kc.superSpec.Name(), err)
+		}
+		if kc.producer != nil {
+			kc.producer.Close()
+		}
+	}()
+
+	go func() {
+		for err := range kc.group.Errors() {
+			logger.Errorf("%s: consumer group error: %v", kc.superSpec.Name(), err)
+		}
+	}()
+
+	handler := &groupHandler{kc: kc, pauser: kc.group}
+	for {
+		// Consume returns when a rebalance happens, so it should be called
+		// in a loop to rejoin the consumer group.
+		err := kc.group.Consume(ctx, kc.spec.Topics, handler)
+		if err != nil {
+			logger.Errorf("%s: failed to consume: %v", kc.superSpec.Name(), err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// newRequest creates an HTTP request from a message: the method is POST,
+// the path is the topic, the message headers are the request headers, and
+// the value is the body.
+func newRequest(ctx stdcontext.Context, msg *sarama.ConsumerMessage) *httpprot.Request {
+	stdr, _ := http.NewRequestWithContext(ctx, http.MethodPost, "http://kafka/", http.NoBody)
+	stdr.URL.Path = "/" + msg.Topic
+
+	for _, h := range msg.Headers {
+		if h != nil {
+			stdr.Header.Add(string(h.Key), string(h.Value))
+		}
+	}
+	stdr.Header.Set(headerTopic, msg.Topic)
+	stdr.Header.Set(headerPartition, strconv.Itoa(int(msg.Partition)))
+	stdr.Header.Set(headerOffset, strconv.FormatInt(msg.Offset, 10))
+	if msg.Key != nil {
+		stdr.Header.Set(headerKey, string(msg.Key))
+	}
+	if !msg.Timestamp.IsZero() {
+		stdr.Header.Set(headerTimestamp, strconv.FormatInt(msg.Timestamp.UnixMilli(), 10))
+	}
+
+	// httpprot.NewRequest never returns an error.
+	req, _ := httpprot.NewRequest(stdr)
+	req.SetPayload(msg.Value)
+	return req
+}
+
+// handle dispatches the message to the pipeline, and returns the result of
+// the pipeline.
+func (kc *KafkaConsumer) handle(ctx stdcontext.Context, msg *sarama.ConsumerMessage) string {
+	handler, ok := kc.muxMapper.GetHandler(kc.spec.Pipeline)
+	if !ok {
+		logger.Errorf("%s: pipeline %s not found", kc.superSpec.Name(), kc.spec.Pipeline)
+		return resultPipelineNotFound
+	}
+
+	pctx := context.New(tracing.NoopSpan)
+	pctx.SetRequest(context.DefaultNamespace, newRequest(ctx, msg))
+	defer pctx.Finish()
+
+	return handler.Handle(pctx)
+}
+
+// process processes the message with retries, and sends it to the dead
+// letter topic if all attempts failed. It returns whether the offset of the
+// message could be committed.
+func (kc *KafkaConsumer) process(ctx stdcontext.Context, msg *sarama.ConsumerMessage) bool {
+	atomic.AddInt64(&kc.numOfMessages, 1)
+
+	result := kc.handle(ctx, msg)
+	for i := 0; result != "" && i < kc.spec.MaxRetries; i++ {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(kc.spec.retryInterval()):
+		}
+		result = kc.handle(ctx, msg)
+	}
+
+	if result == "" {
+		return true
+	}
+
+	atomic.AddInt64(&kc.numOfFailures, 1)
+	logger.Errorf("%s: failed to process message %s/%d/%d, pipeline result: %s",
+		kc.superSpec.Name(), msg.Topic, msg.Partition, msg.Offset, result)
+
+	if kc.producer == nil {
+		return false
+	}
+	if err := kc.sendToDeadLetterTopic(msg, result); err != nil {
+		logger.Errorf("%s: failed to send message %s/%d/%d to dead letter topic: %v",
+			kc.superSpec.Name(), msg.Topic, msg.Partition, msg.Offset, err)
+		return false
+	}
+
+	atomic.AddInt64(&kc.numOfDeadLetters, 1)
+	return true
+}
+
+func (kc *KafkaConsumer) sendToDeadLetterTopic(msg *sarama.ConsumerMessage, result string) error {
+	headers := make([]sarama.RecordHeader, 0, len(msg.Headers)+2)
+	for _, h := range msg.Headers {
+		if h != nil {
+			headers = append(headers, *h)
+		}
+	}
+	origin := fmt.Sprintf("%s/%d/%d", msg.Topic, msg.Partition, msg.Offset)
+	headers = append(headers,
+		sarama.RecordHeader{Key: []byte(headerErrorResult), Value: []byte(result)},
+		sarama.RecordHeader{Key: []byte(headerOrigin), Value: []byte(origin)},
+	)
+
+	pm := &sarama.ProducerMessage{
+		Topic:   kc.spec.DeadLetterTopic,
+		Value:   sarama.ByteEncoder(msg.Value),
+		Headers: headers,
+	}
+	if msg.Key != nil {
+		pm.Key = sarama.ByteEncoder(msg.Key)
+	}
+
+	_, _, err := kc.producer.SendMessage(pm)
+	return err
+}
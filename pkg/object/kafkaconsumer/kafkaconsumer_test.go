@@ -0,0 +1,384 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kafkaconsumer
+
+import (
+	stdcontext "context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/context/contexttest"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/option"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/supervisor"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+type mockSession struct {
+	ctx    stdcontext.Context
+	lock   sync.Mutex
+	marked int64
+}
+
+func (s *mockSession) Claims() map[string][]int32 { return nil }
+func (s *mockSession) MemberID() string           { return "" }
+func (s *mockSession) GenerationID() int32        { return 0 }
+func (s *mockSession) Commit()                    {}
+func (s *mockSession) Context() stdcontext.Context {
+	return s.ctx
+}
+
+func (s *mockSession) ResetOffset(topic string, partition int32, offset int64, metadata string) {}
+func (s *mockSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string)                 {}
+
+func (s *mockSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if offset > s.marked {
+		s.marked = offset
+	}
+}
+
+type mockClaim struct {
+	ch chan *sarama.ConsumerMessage
+}
+
+func (c *mockClaim) Topic() string                            { return "orders" }
+func (c *mockClaim) Partition() int32                         { return 0 }
+func (c *mockClaim) InitialOffset() int64                     { return 0 }
+func (c *mockClaim) HighWaterMarkOffset() int64               { return 0 }
+func (c *mockClaim) Messages() <-chan *sarama.ConsumerMessage { return c.ch }
+
+type mockProducer struct {
+	lock sync.Mutex
+	msgs []*sarama.ProducerMessage
+	err  error
+}
+
+func (p *mockProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.err != nil {
+		return 0, 0, p.err
+	}
+	p.msgs = append(p.msgs, msg)
+	return 0, 0, nil
+}
+
+func (p *mockProducer) Close() error { return nil }
+
+func newTestConsumer(t *testing.T, yamlConfig string, handle func(ctx *context.Context) string) *KafkaConsumer {
+	super := supervisor.NewMock(option.New(), nil, nil, nil, false, nil, nil)
+	superSpec, err := super.NewSpec(yamlConfig)
+	assert.NoError(t, err)
+
+	kc := &KafkaConsumer{
+		superSpec: superSpec,
+		spec:      superSpec.ObjectSpec().(*Spec),
+		muxMapper: &contexttest.MockedMuxMapper{
+			MockedGetHandler: func(name string) (context.Handler, bool) {
+				if name != "pipeline-orders" {
+					return nil, false
+				}
+				return &contexttest.MockedHandler{MockedHandle: handle}, true
+			},
+		},
+	}
+	kc.sem = make(chan struct{}, kc.maxConcurrency())
+	return kc
+}
+
+func consumeMessages(kc *KafkaConsumer, count int) *mockSession {
+	sess := &mockSession{ctx: stdcontext.Background()}
+	claim := &mockClaim{ch: make(chan *sarama.ConsumerMessage, count)}
+	for i := 0; i < count; i++ {
+		claim.ch <- &sarama.ConsumerMessage{
+			Topic:  "orders",
+			Offset: int64(i),
+			Key:    []byte(fmt.Sprintf("key-%d", i)),
+			Value:  []byte(fmt.Sprintf("value-%d", i)),
+		}
+	}
+	close(claim.ch)
+
+	h := &groupHandler{kc: kc}
+	h.ConsumeClaim(sess, claim)
+	return sess
+}
+
+const testConfig = `
+kind: KafkaConsumer
+name: kafka-consumer
+backend: ["127.0.0.1:9092"]
+topics: ["orders"]
+groupID: easegress
+pipeline: pipeline-orders
+maxConcurrency: 3
+retryInterval: 1ms
+`
+
+func TestSpec(t *testing.T) {
+	assert := assert.New(t)
+	super := supervisor.NewMock(option.New(), nil, nil, nil, false, nil, nil)
+
+	_, err := super.NewSpec(testConfig)
+	assert.NoError(err)
+
+	_, err = super.NewSpec(testConfig + "version: 2.8.0\n")
+	assert.NoError(err)
+
+	_, err = super.NewSpec(testConfig + "version: abc\n")
+	assert.Error(err)
+
+	_, err = super.NewSpec(testConfig + "deadLetterTopic: orders\n")
+	assert.Error(err)
+
+	spec := &Spec{InitialOffset: offsetOldest}
+	config := spec.saramaConfig("test")
+	assert.Equal(sarama.OffsetOldest, config.Consumer.Offsets.Initial)
+	assert.Equal(sarama.V1_0_0_0, config.Version)
+	assert.Equal(time.Second, spec.retryInterval())
+}
+
+func TestNewRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := &sarama.ConsumerMessage{
+		Topic:     "orders",
+		Partition: 2,
+		Offset:    100,
+		Key:       []byte("order-1"),
+		Value:     []byte(`{"id": 1}`),
+		Timestamp: time.UnixMilli(1700000000000),
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("Content-Type"), Value: []byte("application/json")},
+			{Key: []byte("X-Trace"), Value: []byte("a")},
+			{Key: []byte("X-Trace"), Value: []byte("b")},
+		},
+	}
+
+	req := newRequest(stdcontext.Background(), msg)
+	assert.Equal("POST", req.Method())
+	assert.Equal("/orders", req.Path())
+	assert.Equal("application/json", req.HTTPHeader().Get("Content-Type"))
+	assert.Equal([]string{"a", "b"}, req.HTTPHeader().Values("X-Trace"))
+	assert.Equal("orders", req.HTTPHeader().Get(headerTopic))
+	assert.Equal("2", req.HTTPHeader().Get(headerPartition))
+	assert.Equal("100", req.HTTPHeader().Get(headerOffset))
+	assert.Equal("order-1", req.HTTPHeader().Get(headerKey))
+	assert.Equal("1700000000000", req.HTTPHeader().Get(headerTimestamp))
+	assert.Equal(`{"id": 1}`, string(req.RawPayload()))
+}
+
+func TestOffsetTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	tracker := newOffsetTracker()
+	for i := int64(10); i < 15; i++ {
+		tracker.add(i)
+	}
+
+	_, ok := tracker.complete(11)
+	assert.False(ok)
+	next, ok := tracker.complete(10)
+	assert.True(ok)
+	assert.Equal(int64(12), next)
+
+	_, ok = tracker.complete(13)
+	assert.False(ok)
+	_, ok = tracker.complete(14)
+	assert.False(ok)
+	next, ok = tracker.complete(12)
+	assert.True(ok)
+	assert.Equal(int64(15), next)
+}
+
+func TestConsumeClaim(t *testing.T) {
+	assert := assert.New(t)
+
+	var lock sync.Mutex
+	bodies := map[string]int{}
+	kc := newTestConsumer(t, testConfig, func(ctx *context.Context) string {
+		req := ctx.GetInputRequest().(*httpprot.Request)
+		body, _ := io.ReadAll(req.GetPayload())
+		lock.Lock()
+		bodies[string(body)]++
+		lock.Unlock()
+		return ""
+	})
+
+	sess := consumeMessages(kc, 20)
+	assert.Equal(int64(20), sess.marked)
+	assert.Len(bodies, 20)
+	assert.Equal(1, bodies["value-7"])
+	assert.Equal(int64(20), kc.numOfMessages)
+	assert.Equal(int64(0), kc.numOfFailures)
+}
+
+func TestConsumeClaimFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	var lock sync.Mutex
+	attempts := 0
+	handle := func(ctx *context.Context) string {
+		req := ctx.GetInputRequest().(*httpprot.Request)
+		if req.HTTPHeader().Get(headerOffset) != "3" {
+			return ""
+		}
+		lock.Lock()
+		attempts++
+		lock.Unlock()
+		return "serverError"
+	}
+
+	// without a dead letter topic, offsets after the failed message are
+	// not committed.
+	kc := newTestConsumer(t, testConfig+"maxRetries: 2\n", handle)
+	sess := consumeMessages(kc, 10)
+	assert.Equal(int64(3), sess.marked)
+	assert.Equal(3, attempts)
+	assert.Equal(int64(1), kc.numOfFailures)
+
+	// with a dead letter topic, the failed message is sent to the topic and
+	// all offsets are committed.
+	attempts = 0
+	kc = newTestConsumer(t, testConfig+"deadLetterTopic: orders-dlq\n", handle)
+	producer := &mockProducer{}
+	kc.producer = producer
+	sess = consumeMessages(kc, 10)
+	assert.Equal(int64(10), sess.marked)
+	assert.Equal(1, attempts)
+	assert.Equal(int64(1), kc.numOfDeadLetters)
+	assert.Len(producer.msgs, 1)
+
+	pm := producer.msgs[0]
+	assert.Equal("orders-dlq", pm.Topic)
+	value, _ := pm.Value.Encode()
+	assert.Equal("value-3", string(value))
+	key, _ := pm.Key.Encode()
+	assert.Equal("key-3", string(key))
+	headers := map[string]string{}
+	for _, h := range pm.Headers {
+		headers[string(h.Key)] = string(h.Value)
+	}
+	assert.Equal("serverError", headers[headerErrorResult])
+	assert.Equal("orders/0/3", headers[headerOrigin])
+
+	// failed to send to the dead letter topic
+	kc = newTestConsumer(t, testConfig+"deadLetterTopic: orders-dlq\n", handle)
+	kc.producer = &mockProducer{err: fmt.Errorf("broker down")}
+	sess = consumeMessages(kc, 10)
+	assert.Equal(int64(3), sess.marked)
+	assert.Equal(int64(0), kc.numOfDeadLetters)
+}
+
+type mockPauser struct {
+	lock   sync.Mutex
+	paused map[string][]int32
+}
+
+func (p *mockPauser) Pause(partitions map[string][]int32) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.paused = partitions
+}
+
+func TestConsumeClaimPause(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(ctx *context.Context) string {
+		req := ctx.GetInputRequest().(*httpprot.Request)
+		if req.HTTPHeader().Get(headerOffset) == "3" {
+			return "serverError"
+		}
+		return ""
+	}
+	kc := newTestConsumer(t, testConfig, handle)
+	kc.spec.MaxConcurrency = 1
+	kc.sem = make(chan struct{}, 1)
+
+	ctx, cancel := stdcontext.WithCancel(stdcontext.Background())
+	sess := &mockSession{ctx: ctx}
+	claim := &mockClaim{ch: make(chan *sarama.ConsumerMessage)}
+	pauser := &mockPauser{}
+	h := &groupHandler{kc: kc, pauser: pauser}
+
+	done := make(chan struct{})
+	go func() {
+		h.ConsumeClaim(sess, claim)
+		close(done)
+	}()
+	for i := 0; i < 10; i++ {
+		claim.ch <- &sarama.ConsumerMessage{Topic: "orders", Offset: int64(i)}
+	}
+
+	// the partition is paused, but the claim is kept, as sarama cancels the
+	// session once a claim returns.
+	assert.Eventually(func() bool {
+		pauser.lock.Lock()
+		defer pauser.lock.Unlock()
+		return pauser.paused != nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(map[string][]int32{"orders": {0}}, pauser.paused)
+	select {
+	case <-done:
+		t.Fatal("the session is canceled by the paused claim")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// messages fetched before the partition is paused are discarded.
+	claim.ch <- &sarama.ConsumerMessage{Topic: "orders", Offset: 10}
+	assert.Equal(int64(3), sess.marked)
+	assert.Equal(int64(4), atomic.LoadInt64(&kc.numOfMessages))
+
+	// the claim returns when the session ends.
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the claim is not released after the session ends")
+	}
+}
+
+func TestPipelineNotFound(t *testing.T) {
+	assert := assert.New(t)
+
+	kc := newTestConsumer(t, testConfig, nil)
+	kc.spec.Pipeline = "not-exist"
+	sess := consumeMessages(kc, 3)
+	assert.Equal(int64(0), sess.marked)
+	assert.Equal(int64(3), kc.numOfFailures)
+
+	status := kc.Status().ObjectStatus.(*Status)
+	assert.Equal("connecting", status.Health)
+	assert.Equal(int64(3), status.NumOfMessages)
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kafkaconsumer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/megaease/easegress/v2/pkg/util/kafkatool"
+)
+
+const (
+	offsetNewest = "newest"
+	offsetOldest = "oldest"
+)
+
+type (
+	// Spec describes the KafkaConsumer.
+	Spec struct {
+		Backend  []string `json:"backend" jsonschema:"required,uniqueItems=true"`
+		Topics   []string `json:"topics" jsonschema:"required,uniqueItems=true"`
+		GroupID  string   `json:"groupID" jsonschema:"required"`
+		Pipeline string   `json:"pipeline" jsonschema:"required"`
+		// Version is the version of Kafka, default is 1.0.0.
+		Version string `json:"version,omitempty"`
+		// InitialOffset is the offset to start from when the consumer group
+		// has no committed offset, default is newest.
+		InitialOffset  string `json:"initialOffset,omitempty" jsonschema:"enum=,enum=newest,enum=oldest"`
+		MaxConcurrency int    `json:"maxConcurrency,omitempty" jsonschema:"minimum=1"`
+		MaxRetries     int    `json:"maxRetries,omitempty" jsonschema:"minimum=0"`
+		RetryInterval  string `json:"retryInterval,omitempty" jsonschema:"format=duration"`
+		// DeadLetterTopic is the topic for messages which failed to be
+		// processed by the pipeline.
+		DeadLetterTopic string `json:"deadLetterTopic,omitempty"`
+
+		TLS  *kafkatool.TLSSpec  `json:"tls,omitempty"`
+		SASL *kafkatool.SASLSpec `json:"sasl,omitempty"`
+	}
+)
+
+// Validate validates Spec.
+func (spec *Spec) Validate() error {
+	if spec.Version != "" {
+		if _, err := sarama.ParseKafkaVersion(spec.Version); err != nil {
+			return fmt.Errorf("invalid kafka version %s: %v", spec.Version, err)
+		}
+	}
+	for _, topic := range spec.Topics {
+		if topic == spec.DeadLetterTopic {
+			return fmt.Errorf("dead letter topic %s is also consumed", topic)
+		}
+	}
+	return nil
+}
+
+func (spec *Spec) saramaConfig(clientID string) *sarama.Config {
+	config := sarama.NewConfig()
+	config.ClientID = clientID
+	config.Version = sarama.V1_0_0_0
+	if spec.Version != "" {
+		config.Version, _ = sarama.ParseKafkaVersion(spec.Version)
+	}
+
+	config.Consumer.Return.Errors = true
+	config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	if spec.InitialOffset == offsetOldest {
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	}
+
+	// required by the sync producer of the dead letter topic
+	config.Producer.Return.Successes = true
+
+	// the TLS settings have been checked by TLSSpec.Validate
+	kafkatool.ApplySecurity(config, spec.TLS, spec.SASL)
+	return config
+}
+
+func (spec *Spec) retryInterval() time.Duration {
+	d, err := time.ParseDuration(spec.RetryInterval)
+	if err != nil || d <= 0 {
+		return time.Second
+	}
+	return d
+}
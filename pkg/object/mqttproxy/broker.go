@@ -31,6 +31,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	packets5 "github.com/eclipse/paho.golang/packets"
 	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/megaease/easegress/v2/pkg/api"
 	"github.com/megaease/easegress/v2/pkg/context"
@@ -59,6 +60,8 @@ type (
 		sessMgr           *SessionManager
 		topicMgr          TopicManager
 		sessionCacheMgr   SessionCacheManager
+		retainMgr         *retainManager
+		offlineMgr        *offlineManager
 		connectionLimiter *Limiter
 		memberURL         func(string, string) (map[string]string, error)
 
@@ -69,11 +72,25 @@ type (
 
 	// HTTPJsonData is json data received from http endpoint used to send back to clients
 	HTTPJsonData struct {
-		Topic       string `json:"topic"`
-		QoS         int    `json:"qos"`
-		Payload     string `json:"payload"`
-		Base64      bool   `json:"base64"`
-		Distributed bool   `json:"distributed"`
+		Topic          string         `json:"topic"`
+		QoS            int            `json:"qos"`
+		Payload        string         `json:"payload"`
+		Base64         bool           `json:"base64"`
+		Distributed    bool           `json:"distributed"`
+		UserProperties []UserProperty `json:"userProperties,omitempty"`
+		// Clients is the clients to send the message to, it is used by
+		// broker mode to transfer messages to certain clients of other
+		// instances, like the members of shared subscriptions.
+		Clients []string `json:"clients,omitempty"`
+		// Retain stores the message as the retained message of the topic
+		// in broker mode.
+		Retain bool `json:"retain,omitempty"`
+	}
+
+	// UserProperty is the user property of MQTT 5 messages.
+	UserProperty struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
 	}
 
 	// HTTPSessions is json data used for session related operations, like get all sessions and delete some sessions
@@ -115,6 +132,12 @@ func newBroker(spec *Spec, store storage, muxMapper context.MuxMapper, memberURL
 	if spec.RetryInterval <= 0 {
 		spec.RetryInterval = 30
 	}
+	if spec.TopicAliasMaximum == 0 {
+		spec.TopicAliasMaximum = defaultTopicAliasMaximum
+	}
+	if spec.MaxRetainedMessages <= 0 {
+		spec.MaxRetainedMessages = defaultMaxRetainedMessages
+	}
 
 	broker := &Broker{
 		egName:    spec.EGName,
@@ -140,13 +163,15 @@ func newBroker(spec *Spec, store storage, muxMapper context.MuxMapper, memberURL
 	if spec.TopicCacheSize <= 0 {
 		spec.TopicCacheSize = 100000
 	}
-	broker.topicMgr = newTopicManager(spec)
+	broker.topicMgr = newSharedTopicManager(newTopicManager(spec))
 	broker.sessMgr = newSessionManager(broker, store)
 	broker.connectionLimiter = newLimiter(spec.ConnectionLimit)
 	go broker.run()
 
 	if spec.BrokerMode {
 		broker.sessionCacheMgr = newSessionCacheManager(spec, broker.topicMgr)
+		broker.retainMgr = newRetainManager(spec, store)
+		broker.offlineMgr = newOfflineManager(spec, store)
 	}
 	broker.connectWatcher()
 	return broker
@@ -275,6 +300,7 @@ func (b *Broker) processWatcherEvent(event map[string]*string, sync bool) {
 
 			if b.spec.BrokerMode {
 				b.sessionCacheMgr.delete(clientID)
+				b.offlineMgr.discard(clientID)
 			}
 		}
 	}
@@ -282,14 +308,45 @@ func (b *Broker) processWatcherEvent(event map[string]*string, sync bool) {
 	if b.spec.BrokerMode && len(sessMap) > 0 {
 		if sync {
 			b.sessionCacheMgr.sync(sessMap)
+			b.restoreOfflineSessions(sessMap)
 			return
 		}
 		b.sessionCacheMgr.update(sessMap)
 	}
 }
 
+// restoreOfflineSessions restores the persistent sessions of offline
+// clients which connected to the current broker last time, so that
+// messages are queued for them again after the broker restarts.
+func (b *Broker) restoreOfflineSessions(sessMap map[string]*SessionInfo) {
+	for clientID, info := range sessMap {
+		if info.EGName != b.egName || info.CleanFlag || b.getClient(clientID) != nil {
+			continue
+		}
+
+		topics := make([]string, 0, len(info.Topics))
+		qoss := make([]byte, 0, len(info.Topics))
+		for t, qos := range info.Topics {
+			if !isSharedSubscription(t) {
+				topics = append(topics, t)
+				qoss = append(qoss, byte(qos))
+			}
+		}
+		if err := b.topicMgr.subscribe(topics, qoss, clientID); err != nil {
+			logger.SpanErrorf(nil, "offline client %v subscribe %v failed: %v", clientID, topics, err)
+		}
+		b.offlineMgr.register(clientID, nil)
+	}
+}
+
 // processNewSession
 func (b *Broker) handleNewSessionInCluster(clientID string, v *string, sessionInfo *SessionInfo) {
+	if sessionInfo != nil && sessionInfo.EGName != b.egName && b.offlineMgr != nil {
+		// the client reconnects to another broker, which takes the
+		// queued messages of the client.
+		b.offlineMgr.drop(clientID)
+	}
+
 	c := b.getClient(clientID)
 	if c == nil {
 		// The current broker doesn't contain the new session, just ignore it.
@@ -375,20 +432,53 @@ func (b *Broker) checkConnectPermission(connect *packets.ConnectPacket) bool {
 	return true
 }
 
-func (b *Broker) connectionValidation(connect *packets.ConnectPacket, conn net.Conn) (*Client, *packets.ConnackPacket, bool) {
+// writeConnack writes connack to conn in the protocol version of connect.
+func writeConnack(conn net.Conn, connect *packets.ConnectPacket, connack *packets.ConnackPacket, props *packets5.Properties) error {
+	if connect.ProtocolVersion == mqtt5 {
+		return toPacket5(connack, props).Write(conn)
+	}
+	return connack.Write(conn)
+}
+
+// connackProperties returns the properties of CONNACK packet to MQTT 5
+// clients, which tell clients the features supported by the broker.
+func (b *Broker) connackProperties(client *Client, connect5 *packets5.Connect) *packets5.Properties {
+	available, unavailable := byte(1), byte(0)
+	retainAvailable := unavailable
+	if b.retainMgr != nil {
+		retainAvailable = available
+	}
+	topicAliasMaximum := b.spec.TopicAliasMaximum
+	props := &packets5.Properties{
+		TopicAliasMaximum:  &topicAliasMaximum,
+		RetainAvailable:    &retainAvailable,
+		SubIDAvailable:     &unavailable,
+		SharedSubAvailable: &available,
+	}
+	if connect5.ClientID == "" {
+		props.AssignedClientID = client.info.cid
+	}
+	return props
+}
+
+func (b *Broker) connectionValidation(connect *packets.ConnectPacket, connect5 *packets5.Connect, conn net.Conn) (*Client, *packets.ConnackPacket, bool) {
 	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
-	connack.SessionPresent = connect.CleanSession
-	connack.ReturnCode = connect.Validate()
+	connack.ReturnCode = validateConnect(connect)
 	if connack.ReturnCode != packets.Accepted {
-		err := connack.Write(conn)
+		err := writeConnack(conn, connect, connack, nil)
 		logger.SpanErrorf(nil, "invalid connection %v, write connack failed: %s", connack.ReturnCode, err)
 		return nil, nil, false
 	}
+	// MQTT 5 clients could connect with empty client identifier, and the
+	// broker assigns one.
+	if connect.ProtocolVersion == mqtt5 && connect.ClientIdentifier == "" {
+		connect.ClientIdentifier = fmt.Sprintf("%s-%016x", b.name, rand.Uint64())
+	}
 	// check rate limiter and max allowed connection
 	if !b.checkConnectPermission(connect) {
 		logger.SpanDebugf(nil, "client %v not get connect permission from rate limiter", connect.ClientIdentifier)
 		connack.ReturnCode = packets.ErrRefusedServerUnavailable
-		err := connack.Write(conn)
+		err := writeConnack(conn, connect, connack, nil)
 		if err != nil {
 			logger.SpanErrorf(nil, "connack back to client %s failed: %s", connect.ClientIdentifier, err)
 		}
@@ -396,6 +486,9 @@ func (b *Broker) connectionValidation(connect *packets.ConnectPacket, conn net.C
 	}
 
 	client := newClient(connect, b, conn, b.spec.ClientPublishLimit)
+	if connect5 != nil {
+		client.setConnect5(connect5)
+	}
 	// check auth
 	authFail := false
 
@@ -406,7 +499,11 @@ func (b *Broker) connectionValidation(connect *packets.ConnectPacket, conn net.C
 			logger.SpanErrorf(nil, "get pipeline %v failed", authPipeline)
 			authFail = true
 		} else {
-			ctx := newContext(connect, client)
+			var props *packets5.Properties
+			if connect5 != nil {
+				props = connect5.Properties
+			}
+			ctx := newContext(connect, props, client)
 			pipe.Handle(ctx)
 			res := ctx.GetResponse(context.DefaultNamespace).(*mqttprot.Response)
 			if res.Disconnect() {
@@ -417,7 +514,7 @@ func (b *Broker) connectionValidation(connect *packets.ConnectPacket, conn net.C
 	}
 	if authFail {
 		connack.ReturnCode = packets.ErrRefusedNotAuthorised
-		err := connack.Write(conn)
+		err := writeConnack(conn, connect, connack, nil)
 		if err != nil {
 			logger.SpanErrorf(nil, "connack back to client %s failed: %s", connect.ClientIdentifier, err)
 		}
@@ -429,7 +526,7 @@ func (b *Broker) connectionValidation(connect *packets.ConnectPacket, conn net.C
 
 func (b *Broker) handleConn(conn net.Conn) {
 	defer conn.Close()
-	packet, err := packets.ReadPacket(conn)
+	packet, connect5, err := readConnect(conn)
 	if err != nil {
 		logger.SpanErrorf(nil, "read connect packet failed: %s", err)
 		return
@@ -441,7 +538,7 @@ func (b *Broker) handleConn(conn net.Conn) {
 	}
 	logger.SpanDebugf(nil, "connection from client %s", connect.ClientIdentifier)
 
-	client, connack, valid := b.connectionValidation(connect, conn)
+	client, connack, valid := b.connectionValidation(connect, connect5, conn)
 	if !valid {
 		return
 	}
@@ -460,7 +557,7 @@ func (b *Broker) handleConn(conn net.Conn) {
 			if len(b.clients) >= b.spec.MaxAllowedConnection {
 				logger.Errorf("client %v not get connect permission from rate limiter", connect.ClientIdentifier)
 				connack.ReturnCode = packets.ErrRefusedServerUnavailable
-				err = connack.Write(conn)
+				err = writeConnack(conn, connect, connack, nil)
 				if err != nil {
 					logger.Errorf("connack back to client %s failed: %s", connect.ClientIdentifier, err)
 				}
@@ -478,12 +575,30 @@ func (b *Broker) handleConn(conn net.Conn) {
 
 	if oldClient != nil {
 		// delete old client
-		go oldClient.close()
+		go func() {
+			oldClient.sendDisconnect(packets5.DisconnectSessionTakenOver)
+			oldClient.close()
+		}()
 	}
 
-	b.setSession(client, connect)
+	connack.SessionPresent = b.setSession(client, connect)
 
-	err = connack.Write(conn)
+	// in broker mode, messages queued when the client was offline are
+	// sent to the client which resumes its session.
+	var offline []*Message
+	if b.offlineMgr != nil {
+		if connect.CleanSession {
+			b.offlineMgr.discard(client.info.cid)
+		} else {
+			offline = b.offlineMgr.take(client.info.cid)
+		}
+	}
+
+	var props *packets5.Properties
+	if connect5 != nil {
+		props = b.connackProperties(client, connect5)
+	}
+	err = writeConnack(conn, connect, connack, props)
 	if err != nil {
 		logger.SpanErrorf(nil, "send connack to client %s failed: %s", connect.ClientIdentifier, err)
 		// Don't clean client, dely to writeLoop or readLoop when error
@@ -498,22 +613,38 @@ func (b *Broker) handleConn(conn net.Conn) {
 			logger.SpanErrorf(nil, "client %v use previous session topics %v to subscribe failed: %v", client.info.cid, topics, err)
 		}
 	}
+	if len(offline) > 0 {
+		go client.session.publishMessages(client, offline, false)
+	}
 	go client.writeLoop()
 	client.readLoop()
 }
 
-func (b *Broker) setSession(client *Client, connect *packets.ConnectPacket) {
+// setSession sets the session of the client, and returns whether the
+// previous session is resumed.
+func (b *Broker) setSession(client *Client, connect *packets.ConnectPacket) bool {
 	// when clean session is false, previous session exist and previous session not clean session,
 	// then we use previous session, otherwise use new session
 	prevSess := b.sessMgr.get(connect.ClientIdentifier)
-	if !connect.CleanSession && (prevSess != nil) && !prevSess.cleanSession() {
+	present := !connect.CleanSession && (prevSess != nil) && !prevSess.cleanSession()
+	if present {
 		client.session = prevSess
 	} else {
 		if prevSess != nil {
 			prevSess.close()
+			// in broker mode, topics of offline sessions are still
+			// subscribed, and need to be cleaned.
+			if b.offlineMgr != nil {
+				topics, _, _ := prevSess.allSubscribes()
+				b.topicMgr.unsubscribe(topics, connect.ClientIdentifier)
+			}
 		}
 		client.session = b.sessMgr.newSessionFromConn(connect)
 	}
+	if client.info.version == mqtt5 {
+		client.session.setExpiryInterval(client.info.sessionExpiry)
+	}
+	return present
 }
 
 func (b *Broker) requestTransfer(span *model.SpanContext, egName, name string, data HTTPJsonData, header http.Header) {
@@ -544,7 +675,7 @@ func (b *Broker) requestTransfer(span *model.SpanContext, egName, name string, d
 	logger.SpanDebugf(span, "eg %v http transfer data %v to %v", b.egName, data, urls)
 }
 
-func (b *Broker) sendMsgToClient(span *model.SpanContext, topic string, payload []byte, qos byte) {
+func (b *Broker) sendMsgToClient(span *model.SpanContext, topic string, payload []byte, qos byte, props *packets5.Properties) {
 	subscribers, _ := b.topicMgr.findSubscribers(topic)
 	logger.SpanDebugf(span, "eg %v send topic %v to client %v", b.egName, topic, subscribers)
 	if subscribers == nil {
@@ -553,99 +684,131 @@ func (b *Broker) sendMsgToClient(span *model.SpanContext, topic string, payload
 	}
 
 	for clientID, subQoS := range subscribers {
-		if subQoS < qos {
-			continue
-		}
 		if b.spec.BrokerMode {
 			egName := b.sessionCacheMgr.getEGName(clientID)
 			if egName != b.egName {
 				continue
 			}
 		}
-		client := b.getClient(clientID)
-		if client == nil {
-			logger.SpanDebugf(span, "client %v not on broker %v in eg %v", clientID, b.name, b.egName)
-		} else {
-			client.session.publish(span, client, topic, payload, qos)
-		}
+		b.publishToClient(span, clientID, topic, payload, minQoS(qos, subQoS), props)
+	}
+}
+
+// minQoS returns the QoS of the message delivered to the subscriber, which
+// is the minimum of the QoS of the message and the subscription.
+func minQoS(qos, subQoS byte) byte {
+	if subQoS < qos {
+		return subQoS
 	}
+	return qos
+}
+
+// publishToClient publishes the message to the client connected to the
+// current broker. In broker mode, the message of QoS 1 or 2 is queued if
+// the client of a persistent session is offline.
+func (b *Broker) publishToClient(span *model.SpanContext, clientID string, topic string, payload []byte, qos byte, props *packets5.Properties) {
+	client := b.getClient(clientID)
+	if client != nil && !client.disconnected() {
+		client.session.publish(span, client, topic, payload, qos, props)
+		return
+	}
+	if qos > QoS0 && b.offlineMgr != nil && b.offlineMgr.enqueue(clientID, newMsg(topic, payload, qos, props)) {
+		logger.SpanDebugf(span, "client %v is offline, message of topic %v is queued", clientID, topic)
+		return
+	}
+	logger.SpanDebugf(span, "client %v not on broker %v in eg %v", clientID, b.name, b.egName)
 }
 
 // splitSubscribers split subscribers to local and remote on broker mode and return
-// client ids of local subscribers and eg names of remote subscribers
-func (b *Broker) splitSubscribers(publish *packets.PublishPacket) ([]string, map[string]struct{}) {
-	egNames := make(map[string]struct{})
-	clients := []string{}
+// client ids of local subscribers and client ids of remote subscribers grouped by eg names,
+// with the QoS of the message delivered to each subscriber.
+func (b *Broker) splitSubscribers(publish *packets.PublishPacket) (map[string]byte, map[string]map[string]byte) {
+	egNames := make(map[string]map[string]byte)
+	clients := make(map[string]byte)
 
 	subscribers, _ := b.topicMgr.findSubscribers(publish.TopicName)
 	for clientID, subQos := range subscribers {
-		if subQos < publish.Qos {
-			continue
-		}
+		qos := minQoS(publish.Qos, subQos)
 		egName := b.sessionCacheMgr.getEGName(clientID)
 		if egName != b.egName {
-			egNames[egName] = struct{}{}
+			if egNames[egName] == nil {
+				egNames[egName] = make(map[string]byte)
+			}
+			egNames[egName][clientID] = qos
 			continue
 		}
-		clients = append(clients, clientID)
+		clients[clientID] = qos
 	}
 	return clients, egNames
 }
 
-func (b *Broker) sendMsgToLocalClient(span *model.SpanContext, publish *packets.PublishPacket, clients []string) {
-	for _, clientID := range clients {
-		client := b.getClient(clientID)
-		if client == nil {
-			logger.SpanDebugf(span, "client %v not on broker %v in eg %v", clientID, b.name, b.egName)
-		} else {
-			client.session.publish(span, client, publish.TopicName, publish.Payload, publish.Qos)
-		}
+func (b *Broker) sendMsgToLocalClient(span *model.SpanContext, topic string, payload []byte, props *packets5.Properties, clients map[string]byte) {
+	for clientID, qos := range clients {
+		b.publishToClient(span, clientID, topic, payload, qos, props)
 	}
 }
 
-func (b *Broker) requestTransferToCertainInstances(span *model.SpanContext, publish *packets.PublishPacket, remoteEgs map[string]struct{}) {
-	data := &HTTPJsonData{}
-	data.init(publish)
+func (b *Broker) requestTransferToCertainInstances(span *model.SpanContext, publish *packets.PublishPacket, props *packets5.Properties, remoteEgs map[string]map[string]byte) {
 	urls, err := b.memberURL(b.egName, b.name)
 	if err != nil {
 		logger.SpanErrorf(span, "eg %v find urls for other egs failed: %v", b.egName, err)
 		return
 	}
-	jsonData, err := codectool.MarshalJSON(data)
-	if err != nil {
-		logger.SpanErrorf(span, "json data marshal failed: %v", err)
-		return
-	}
-	for egName := range remoteEgs {
+	for egName, clients := range remoteEgs {
 		url, ok := urls[egName]
 		if !ok {
 			logger.SpanErrorf(span, "eg %s not find url for eg %s", b.egName, egName)
 			continue
 		}
-		req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(jsonData))
-		if err != nil {
-			logger.SpanErrorf(span, "make new request failed: %v", err)
-			continue
-		}
-		err = b3.InjectHTTP(req, b3.WithSingleHeaderOnly())(*span)
-		if err != nil {
-			logger.SpanErrorf(span, "inject span failed: %v", err)
-			continue
+
+		// clients are grouped by the QoS of the message delivered to them.
+		qosClients := make(map[byte][]string)
+		for clientID, qos := range clients {
+			qosClients[qos] = append(qosClients[qos], clientID)
 		}
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			logger.SpanErrorf(span, "http client send msg failed:%v", err)
-		} else {
-			resp.Body.Close()
+		for qos, ids := range qosClients {
+			data := &HTTPJsonData{}
+			data.init(publish, props)
+			data.QoS = int(qos)
+			data.Clients = ids
+			b.transferToInstance(span, url, data)
 		}
 	}
+}
 
+func (b *Broker) transferToInstance(span *model.SpanContext, url string, data *HTTPJsonData) {
+	jsonData, err := codectool.MarshalJSON(data)
+	if err != nil {
+		logger.SpanErrorf(span, "json data marshal failed: %v", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		logger.SpanErrorf(span, "make new request failed: %v", err)
+		return
+	}
+	err = b3.InjectHTTP(req, b3.WithSingleHeaderOnly())(*span)
+	if err != nil {
+		logger.SpanErrorf(span, "inject span failed: %v", err)
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.SpanErrorf(span, "http client send msg failed:%v", err)
+	} else {
+		resp.Body.Close()
+	}
 }
 
-func (b *Broker) processBrokerModePublish(clientID string, publish *packets.PublishPacket) {
+func (b *Broker) processBrokerModePublish(clientID string, publish *packets.PublishPacket, props *packets5.Properties) {
 	if !b.spec.BrokerMode {
 		return
 	}
+	if publish.Retain {
+		if err := b.retainMgr.retain(publish.TopicName, publish.Payload, publish.Qos, props); err != nil {
+			logger.SpanErrorf(nil, "client %v retain message of topic %v failed: %v", clientID, publish.TopicName, err)
+		}
+	}
 	localClients, remoteEgs := b.splitSubscribers(publish)
 	if len(localClients) == 0 && len(remoteEgs) == 0 {
 		return
@@ -653,10 +816,10 @@ func (b *Broker) processBrokerModePublish(clientID string, publish *packets.Publ
 
 	span := generateNewSpanContext(clientID, publish.TopicName)
 	if len(localClients) > 0 {
-		b.sendMsgToLocalClient(span, publish, localClients)
+		b.sendMsgToLocalClient(span, publish.TopicName, publish.Payload, props, localClients)
 	}
 	if len(remoteEgs) > 0 {
-		b.requestTransferToCertainInstances(span, publish, remoteEgs)
+		b.requestTransferToCertainInstances(span, publish, props, remoteEgs)
 	}
 }
 
@@ -707,12 +870,26 @@ func (b *Broker) httpTopicsPublishHandler(w http.ResponseWriter, r *http.Request
 
 	span, _ := b3.ExtractHTTP(r)()
 	logger.SpanDebugf(span, "http endpoint received json data: %v", data)
+	props := data.properties()
+	if !data.Distributed && data.Retain && b.retainMgr != nil {
+		if err := b.retainMgr.retain(data.Topic, payload, byte(data.QoS), props); err != nil {
+			logger.SpanErrorf(span, "retain message of topic %v failed: %v", data.Topic, err)
+		}
+	}
 	if !data.Distributed {
 		data.Distributed = true
 		headers := r.Header.Clone()
 		b.requestTransfer(span, b.egName, b.name, data, headers)
 	}
-	go b.sendMsgToClient(span, data.Topic, payload, byte(data.QoS))
+	if len(data.Clients) > 0 {
+		clients := make(map[string]byte, len(data.Clients))
+		for _, clientID := range data.Clients {
+			clients[clientID] = byte(data.QoS)
+		}
+		go b.sendMsgToLocalClient(span, data.Topic, payload, props, clients)
+		return
+	}
+	go b.sendMsgToClient(span, data.Topic, payload, byte(data.QoS), props)
 }
 
 func (b *Broker) mqttAPIPrefix(path string) string {
@@ -876,6 +1053,7 @@ func (b *Broker) close() {
 	b.topicMgr.close()
 	if b.spec.BrokerMode {
 		b.sessionCacheMgr.close()
+		b.retainMgr.close()
 	}
 
 	b.Lock()
@@ -886,9 +1064,9 @@ func (b *Broker) close() {
 	b.clients = nil
 }
 
-func newContext(packet packets.ControlPacket, client mqttprot.Client) *context.Context {
+func newContext(packet packets.ControlPacket, props *packets5.Properties, client mqttprot.Client) *context.Context {
 	ctx := context.New(tracing.NoopSpan)
-	req := mqttprot.NewRequest(packet, client)
+	req := mqttprot.NewRequestWithProperties(packet, client, props)
 	ctx.SetRequest(context.DefaultNamespace, req)
 	resp := mqttprot.NewResponse()
 	ctx.SetResponse(context.DefaultNamespace, resp)
@@ -904,10 +1082,27 @@ func generateNewSpanContext(clientID string, topic string) *model.SpanContext {
 	return span
 }
 
-func (d *HTTPJsonData) init(packet *packets.PublishPacket) {
+func (d *HTTPJsonData) init(packet *packets.PublishPacket, props *packets5.Properties) {
 	d.Topic = packet.TopicName
 	d.QoS = int(packet.Qos)
 	d.Payload = base64.StdEncoding.EncodeToString(packet.Payload)
 	d.Base64 = true
 	d.Distributed = true
+	if props != nil {
+		for _, u := range props.User {
+			d.UserProperties = append(d.UserProperties, UserProperty{Key: u.Key, Value: u.Value})
+		}
+	}
+}
+
+// properties returns the MQTT 5 properties of the message.
+func (d *HTTPJsonData) properties() *packets5.Properties {
+	if len(d.UserProperties) == 0 {
+		return nil
+	}
+	props := &packets5.Properties{}
+	for _, u := range d.UserProperties {
+		props.User = append(props.User, packets5.User{Key: u.Key, Value: u.Value})
+	}
+	return props
 }
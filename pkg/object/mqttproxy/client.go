@@ -19,12 +19,14 @@ package mqttproxy
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"reflect"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	packets5 "github.com/eclipse/paho.golang/packets"
 	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/megaease/easegress/v2/pkg/context"
 	"github.com/megaease/easegress/v2/pkg/logger"
@@ -45,15 +47,15 @@ const (
 	QoS2 byte = 2
 )
 
-type processFn func(*Client, packets.ControlPacket)
-type processFnWithErr func(*Client, packets.ControlPacket) error
+type processFn func(*Client, packets.ControlPacket, *packets5.Properties)
+type processFnWithErr func(*Client, packets.ControlPacket, *packets5.Properties) error
 
 var processPacketMap = map[string]processFnWithErr{
 	"*packets.ConnectPacket":     errorWrapper("double connect"),
 	"*packets.ConnackPacket":     errorWrapper("client should not send connack"),
-	"*packets.PubrecPacket":      errorWrapper("qos2 not support now"),
-	"*packets.PubrelPacket":      errorWrapper("qos2 not support now"),
-	"*packets.PubcompPacket":     errorWrapper("qos2 not support now"),
+	"*packets.PubrecPacket":      nilErrWrapper(processPubrec),
+	"*packets.PubrelPacket":      nilErrWrapper(processPubrel),
+	"*packets.PubcompPacket":     nilErrWrapper(processPubcomp),
 	"*packets.SubackPacket":      errorWrapper("broker not subscribe"),
 	"*packets.UnsubackPacket":    errorWrapper("broker not unsubscribe"),
 	"*packets.PingrespPacket":    errorWrapper("broker not ping"),
@@ -61,14 +63,20 @@ var processPacketMap = map[string]processFnWithErr{
 	"*packets.UnsubscribePacket": pipelineWrapper(processUnsubscribe, Unsubscribe),
 	"*packets.PingreqPacket":     nilErrWrapper(processPingreq),
 	"*packets.PubackPacket":      nilErrWrapper(processPuback),
-	"*packets.PublishPacket": func(c *Client, packet packets.ControlPacket) error {
+	"*packets.PublishPacket": func(c *Client, packet packets.ControlPacket, props *packets5.Properties) error {
 		publish := packet.(*packets.PublishPacket)
 		logger.SpanDebugf(nil, "client %s process publish %v", c.info.cid, publish.TopicName)
 		if !c.checkPublishLimit(publish) {
 			logger.SpanErrorf(nil, "client %v publish limiter drop packet %v", c.info.cid, publish.TopicName)
 			return nil
 		}
-		return pipelineWrapper(processPublish, Publish)(c, packet)
+		// the duplicated QoS 2 message has been processed, just
+		// acknowledge it again.
+		if publish.Qos == QoS2 && c.session.receivedQoS2(publish.MessageID) {
+			c.writePubrec(publish.MessageID)
+			return nil
+		}
+		return pipelineWrapper(processPublish, Publish)(c, packet, props)
 	},
 }
 
@@ -80,6 +88,10 @@ type (
 		password  string
 		keepalive uint16
 		will      *packets.PublishPacket
+		// fields below are for MQTT 5 clients only.
+		version       byte
+		sessionExpiry uint32
+		willProps     *packets5.Properties
 	}
 
 	// Client represents a MQTT client connection in Broker
@@ -94,8 +106,12 @@ type (
 		info       ClientInfo
 		statusFlag int32
 		writeCh    chan packets.ControlPacket
+		writeMu    sync.Mutex
 		done       chan struct{}
 
+		// topicAliases maps topic aliases of MQTT 5 clients to topics.
+		topicAliases map[uint16]string
+
 		// kv map is used for pipeline to share messages among filters during whole connection
 		kvMap sync.Map
 	}
@@ -145,6 +161,7 @@ func newClient(connect *packets.ConnectPacket, broker *Broker, conn net.Conn, li
 		password:  string(connect.Password),
 		keepalive: connect.Keepalive,
 		will:      will,
+		version:   connect.ProtocolVersion,
 	}
 	client := &Client{
 		broker:       broker,
@@ -158,10 +175,21 @@ func newClient(connect *packets.ConnectPacket, broker *Broker, conn net.Conn, li
 	return client
 }
 
+// setConnect5 sets the properties in the CONNECT packet of MQTT 5 client.
+func (c *Client) setConnect5(connect *packets5.Connect) {
+	if connect.Properties != nil && connect.Properties.SessionExpiryInterval != nil {
+		c.info.sessionExpiry = *connect.Properties.SessionExpiryInterval
+	}
+	if c.info.will != nil {
+		c.info.willProps = forwardProperties(connect.WillProperties)
+	}
+	c.topicAliases = make(map[uint16]string)
+}
+
 func (c *Client) readLoop() {
 	defer func() {
 		if c.info.will != nil {
-			c.runPipeline(c.info.will, Publish)
+			c.runPipeline(c.info.will, c.info.willProps, Publish)
 		}
 		c.closeAndDelSession()
 		c.broker.removeClient(c.info.cid)
@@ -182,16 +210,23 @@ func (c *Client) readLoop() {
 		}
 
 		logger.SpanDebugf(nil, "client %s readLoop read packet", c.info.cid)
-		packet, err := packets.ReadPacket(c.conn)
+		packet, props, err := c.readPacket()
 		if err != nil {
 			logger.SpanErrorf(nil, "client %s read packet failed: %v", c.info.cid, err)
+			if e, ok := err.(*reasonError); ok {
+				c.sendDisconnect(e.code)
+			}
 			return
 		}
 		if _, ok := packet.(*packets.DisconnectPacket); ok {
-			c.info.will = nil
+			// the will of MQTT 5 clients depends on the reason code,
+			// which is processed by processDisconnect5.
+			if c.info.version != mqtt5 {
+				c.info.will = nil
+			}
 			return
 		}
-		err = c.processPacket(packet)
+		err = c.processPacket(packet, props)
 		if err != nil {
 			logger.SpanErrorf(nil, "client %s process packet failed: %v", c.info.cid, err)
 			return
@@ -199,13 +234,78 @@ func (c *Client) readLoop() {
 	}
 }
 
-func (c *Client) processPacket(packet packets.ControlPacket) error {
+// readPacket reads a packet from client, MQTT 5 packets are converted to
+// MQTT 3.1.1 packets and their properties.
+func (c *Client) readPacket() (packets.ControlPacket, *packets5.Properties, error) {
+	if c.info.version != mqtt5 {
+		packet, err := packets.ReadPacket(c.conn)
+		return packet, nil, err
+	}
+
+	cp, err := packets5.ReadPacket(c.conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch p := cp.Content.(type) {
+	case *packets5.Publish:
+		if err := c.resolveTopicAlias(p); err != nil {
+			return nil, nil, err
+		}
+	case *packets5.Disconnect:
+		c.processDisconnect5(p)
+	}
+	return fromPacket5(cp)
+}
+
+// resolveTopicAlias sets the topic of the PUBLISH packet by its topic
+// alias, and removes the topic alias from its properties.
+func (c *Client) resolveTopicAlias(publish *packets5.Publish) error {
+	if publish.Properties == nil || publish.Properties.TopicAlias == nil {
+		if publish.Topic == "" {
+			return &reasonError{code: packets5.DisconnectProtocolError, msg: "publish without topic name and topic alias"}
+		}
+		return nil
+	}
+
+	alias := *publish.Properties.TopicAlias
+	publish.Properties.TopicAlias = nil
+	if alias == 0 || alias > c.broker.spec.TopicAliasMaximum {
+		return &reasonError{code: packets5.DisconnectTopicAliasInvalid, msg: fmt.Sprintf("topic alias %d is invalid", alias)}
+	}
+	if publish.Topic != "" {
+		c.topicAliases[alias] = publish.Topic
+		return nil
+	}
+	topic, ok := c.topicAliases[alias]
+	if !ok {
+		return &reasonError{code: packets5.DisconnectProtocolError, msg: fmt.Sprintf("topic alias %d is not set", alias)}
+	}
+	publish.Topic = topic
+	return nil
+}
+
+// processDisconnect5 processes the reason code and the session expiry
+// interval of the DISCONNECT packet from MQTT 5 clients.
+func (c *Client) processDisconnect5(disconnect *packets5.Disconnect) {
+	if disconnect.ReasonCode != packets5.DisconnectDisconnectWithWillMessage {
+		c.info.will = nil
+	}
+	props := disconnect.Properties
+	// it is a protocol error to change the interval from zero to non-zero,
+	// and we just ignore it.
+	if props != nil && props.SessionExpiryInterval != nil && c.info.sessionExpiry != 0 {
+		c.info.sessionExpiry = *props.SessionExpiryInterval
+		c.session.setExpiryInterval(c.info.sessionExpiry)
+	}
+}
+
+func (c *Client) processPacket(packet packets.ControlPacket, props *packets5.Properties) error {
 	packetType := reflect.TypeOf(packet).String()
 	fn, ok := processPacketMap[packetType]
 	if !ok {
 		return errors.New("unknown packet")
 	}
-	return fn(c, packet)
+	return fn(c, packet, props)
 }
 
 func (c *Client) checkPublishLimit(publish *packets.PublishPacket) bool {
@@ -215,7 +315,7 @@ func (c *Client) checkPublishLimit(publish *packets.PublishPacket) bool {
 
 // runPipeline will run MQTT pipeline by using packet.
 // it will return an error if MQTT pipline set MQTTContext to Disconnect or Drop.
-func (c *Client) runPipeline(packet packets.ControlPacket, packetType PacketType) error {
+func (c *Client) runPipeline(packet packets.ControlPacket, props *packets5.Properties, packetType PacketType) error {
 	pipelineName, ok := c.broker.pipelines[packetType]
 	if !ok {
 		return nil
@@ -227,7 +327,7 @@ func (c *Client) runPipeline(packet packets.ControlPacket, packetType PacketType
 		return nil
 	}
 
-	ctx := newContext(packet, c)
+	ctx := newContext(packet, props, c)
 	pipe.Handle(ctx)
 	resp := ctx.GetResponse(context.DefaultNamespace).(*mqttprot.Response)
 	if resp.Disconnect() {
@@ -241,6 +341,15 @@ func (c *Client) runPipeline(packet packets.ControlPacket, packetType PacketType
 }
 
 func (c *Client) writePacket(packet packets.ControlPacket) {
+	c.writePacketWithProperties(packet, nil)
+}
+
+// writePacketWithProperties writes packet with MQTT 5 properties to
+// client, props is ignored for MQTT 3.1.1 clients.
+func (c *Client) writePacketWithProperties(packet packets.ControlPacket, props *packets5.Properties) {
+	if c.info.version == mqtt5 {
+		packet = toPacket5(packet, props)
+	}
 	select {
 	case c.writeCh <- packet:
 	default:
@@ -248,11 +357,34 @@ func (c *Client) writePacket(packet packets.ControlPacket) {
 	}
 }
 
+// writePacketWait is like writePacketWithProperties, but it waits until
+// the packet is put into the write channel, it returns false if the client
+// is closed.
+func (c *Client) writePacketWait(packet packets.ControlPacket, props *packets5.Properties) bool {
+	if c.info.version == mqtt5 {
+		packet = toPacket5(packet, props)
+	}
+	select {
+	case c.writeCh <- packet:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+func (c *Client) writePubrec(messageID uint16) {
+	pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+	pubrec.MessageID = messageID
+	c.writePacket(pubrec)
+}
+
 func (c *Client) writeLoop() {
 	for {
 		select {
 		case p := <-c.writeCh:
+			c.writeMu.Lock()
 			err := p.Write(c.conn)
+			c.writeMu.Unlock()
 			if err != nil {
 				logger.SpanErrorf(nil, "write packet %v to client %s failed: %s", p.String(), c.info.cid, err)
 				c.closeAndDelSession()
@@ -263,6 +395,23 @@ func (c *Client) writeLoop() {
 	}
 }
 
+// sendDisconnect sends DISCONNECT packet with the reason code to MQTT 5
+// clients before closing the connection, MQTT 3.1.1 doesn't allow the
+// broker to send DISCONNECT packet.
+func (c *Client) sendDisconnect(reasonCode byte) {
+	if c.info.version != mqtt5 {
+		return
+	}
+	disconnect := newPacket5(&packets5.Disconnect{ReasonCode: reasonCode, Properties: &packets5.Properties{}})
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if err := disconnect.Write(c.conn); err != nil {
+		logger.SpanDebugf(nil, "send disconnect to client %s failed: %v", c.info.cid, err)
+	}
+}
+
 func (c *Client) close() {
 	c.Lock()
 	if c.disconnected() {
@@ -285,7 +434,7 @@ func (c *Client) close() {
 		logger.SpanErrorf(nil, "get pipeline %v failed", pipelineName)
 	} else {
 		disconnect := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
-		ctx := newContext(disconnect, c)
+		ctx := newContext(disconnect, nil, c)
 		pipe.Handle(ctx)
 	}
 }
@@ -303,6 +452,27 @@ func (c *Client) closeAndDelSession() {
 	deleted := c.broker.sessMgr.delLocal(c.info.cid)
 	if c.session.cleanSession() && deleted {
 		c.broker.sessMgr.delDB(c.info.cid)
+	} else if deleted && c.broker.getClient(c.info.cid) == c {
+		// the session of MQTT 5 client expires after its expiry interval,
+		// unless the client reconnects before that.
+		if expireAt, ok := c.session.startExpiry(); ok {
+			cid := c.info.cid
+			time.AfterFunc(time.Until(expireAt), func() {
+				c.broker.sessMgr.delExpired(cid, expireAt.Unix())
+			})
+		}
+
+		// in broker mode, the persistent session keeps its subscriptions
+		// and queues messages until the client reconnects. members of
+		// shared subscriptions are removed, so that messages go to other
+		// members.
+		if c.broker.offlineMgr != nil {
+			c.broker.offlineMgr.register(c.info.cid, c.session.pendingMessages())
+			topics, _, _ := c.session.allSubscribes()
+			c.broker.topicMgr.unsubscribe(sharedTopics(topics), c.info.cid)
+			c.close()
+			return
+		}
 	}
 
 	topics, _, _ := c.session.allSubscribes()
@@ -310,34 +480,77 @@ func (c *Client) closeAndDelSession() {
 	c.close()
 }
 
+// sharedTopics returns the shared subscriptions in topics.
+func sharedTopics(topics []string) []string {
+	var shared []string
+	for _, t := range topics {
+		if isSharedSubscription(t) {
+			shared = append(shared, t)
+		}
+	}
+	return shared
+}
+
 func errorWrapper(errMsg string) processFnWithErr {
-	return func(c *Client, p packets.ControlPacket) error {
+	return func(c *Client, p packets.ControlPacket, props *packets5.Properties) error {
 		return errors.New(errMsg)
 	}
 }
 
 func nilErrWrapper(fn processFn) processFnWithErr {
-	return func(c *Client, p packets.ControlPacket) error {
-		fn(c, p)
+	return func(c *Client, p packets.ControlPacket, props *packets5.Properties) error {
+		fn(c, p, props)
 		return nil
 	}
 }
 
 func pipelineWrapper(fn processFn, packetType PacketType) processFnWithErr {
-	return func(c *Client, p packets.ControlPacket) error {
-		err := c.runPipeline(p, packetType)
+	return func(c *Client, p packets.ControlPacket, props *packets5.Properties) error {
+		err := c.runPipeline(p, props, packetType)
 		if err != nil {
 			logger.SpanDebugf(nil, "client process pipeline failed, %v", c.info.cid, err)
+			c.rejectPacket(p)
 			return nil
 		}
-		fn(c, p)
+		fn(c, p, props)
 		return nil
 	}
 }
 
-func processPublish(c *Client, packet packets.ControlPacket) {
+// rejectPacket responds the packet rejected by pipeline to MQTT 5 clients
+// with reason code NotAuthorized, MQTT 3.1.1 has no way to do this.
+func (c *Client) rejectPacket(packet packets.ControlPacket) {
+	if c.info.version != mqtt5 {
+		return
+	}
+
+	props := &packets5.Properties{}
+	switch p := packet.(type) {
+	case *packets.PublishPacket:
+		switch p.Qos {
+		case QoS1:
+			c.writePacket(newPacket5(&packets5.Puback{PacketID: p.MessageID, ReasonCode: packets5.PubackNotAuthorized, Properties: props}))
+		case QoS2:
+			c.writePacket(newPacket5(&packets5.Pubrec{PacketID: p.MessageID, ReasonCode: packets5.PubrecNotAuthorized, Properties: props}))
+		}
+	case *packets.SubscribePacket:
+		c.writePacket(newPacket5(&packets5.Suback{PacketID: p.MessageID, Reasons: reasonCodes(len(p.Topics), packets5.SubackNotauthorized), Properties: props}))
+	case *packets.UnsubscribePacket:
+		c.writePacket(newPacket5(&packets5.Unsuback{PacketID: p.MessageID, Reasons: reasonCodes(len(p.Topics), packets5.UnsubackNotAuthorized), Properties: props}))
+	}
+}
+
+func reasonCodes(n int, code byte) []byte {
+	codes := make([]byte, n)
+	for i := range codes {
+		codes[i] = code
+	}
+	return codes
+}
+
+func processPublish(c *Client, packet packets.ControlPacket, props *packets5.Properties) {
 	publish := packet.(*packets.PublishPacket)
-	go c.broker.processBrokerModePublish(c.info.cid, publish)
+	go c.broker.processBrokerModePublish(c.info.cid, publish, forwardProperties(props))
 	switch publish.Qos {
 	case QoS0:
 		// do nothing
@@ -346,22 +559,47 @@ func processPublish(c *Client, packet packets.ControlPacket) {
 		puback.MessageID = publish.MessageID
 		c.writePacket(puback)
 	case QoS2:
-		// not support yet
+		c.session.receiveQoS2(publish.MessageID)
+		c.writePubrec(publish.MessageID)
 	}
 }
 
-func processPuback(c *Client, packet packets.ControlPacket) {
+func processPuback(c *Client, packet packets.ControlPacket, props *packets5.Properties) {
 	puback := packet.(*packets.PubackPacket)
 	c.session.puback(puback)
 }
 
-func processSubscribe(c *Client, p packets.ControlPacket) {
+func processPubrec(c *Client, packet packets.ControlPacket, props *packets5.Properties) {
+	pubrec := packet.(*packets.PubrecPacket)
+	c.session.pubrec(pubrec)
+	pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	pubrel.MessageID = pubrec.MessageID
+	c.writePacket(pubrel)
+}
+
+func processPubrel(c *Client, packet packets.ControlPacket, props *packets5.Properties) {
+	pubrel := packet.(*packets.PubrelPacket)
+	c.session.releaseQoS2(pubrel.MessageID)
+	pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+	pubcomp.MessageID = pubrel.MessageID
+	c.writePacket(pubcomp)
+}
+
+func processPubcomp(c *Client, packet packets.ControlPacket, props *packets5.Properties) {
+	pubcomp := packet.(*packets.PubcompPacket)
+	c.session.pubcomp(pubcomp)
+}
+
+func processSubscribe(c *Client, p packets.ControlPacket, props *packets5.Properties) {
 	packet := p.(*packets.SubscribePacket)
 	logger.SpanDebugf(nil, "client %s subscribe %v with qos %v", c.info.cid, packet.Topics, packet.Qoss)
 
 	err := c.broker.topicMgr.subscribe(packet.Topics, packet.Qoss, c.info.cid)
 	if err != nil {
 		logger.SpanErrorf(nil, "client %v subscribe %v failed: %v", c.info.cid, packet.Topics, err)
+		if c.info.version == mqtt5 {
+			c.writePacket(newPacket5(&packets5.Suback{PacketID: packet.MessageID, Reasons: reasonCodes(len(packet.Topics), packets5.SubackTopicFilterinvalid), Properties: &packets5.Properties{}}))
+		}
 		return
 	}
 	c.session.subscribe(packet.Topics, packet.Qoss)
@@ -370,12 +608,41 @@ func processSubscribe(c *Client, p packets.ControlPacket) {
 	suback.MessageID = packet.MessageID
 	suback.ReturnCodes = make([]byte, len(packet.Topics))
 	for i := range packet.Topics {
-		suback.ReturnCodes[i] = packet.Qos
+		suback.ReturnCodes[i] = packet.Qoss[i]
+		if suback.ReturnCodes[i] > QoS2 {
+			suback.ReturnCodes[i] = QoS2
+		}
 	}
 	c.writePacket(suback)
+	c.sendRetained(packet.Topics, packet.Qoss)
+}
+
+// sendRetained sends the retained messages matching the new subscriptions
+// to the client in broker mode, shared subscriptions don't receive
+// retained messages.
+func (c *Client) sendRetained(topics []string, qoss []byte) {
+	if c.broker.retainMgr == nil {
+		return
+	}
+
+	var msgs []*Message
+	for i, t := range topics {
+		if isSharedSubscription(t) {
+			continue
+		}
+		for _, msg := range c.broker.retainMgr.match(t) {
+			if msg.QoS > int(qoss[i]) {
+				msg.QoS = int(qoss[i])
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+	if len(msgs) > 0 {
+		go c.session.publishMessages(c, msgs, true)
+	}
 }
 
-func processUnsubscribe(c *Client, p packets.ControlPacket) {
+func processUnsubscribe(c *Client, p packets.ControlPacket, props *packets5.Properties) {
 	packet := p.(*packets.UnsubscribePacket)
 
 	logger.SpanDebugf(nil, "client %s processUnsubscribe %v", c.info.cid, packet.Topics)
@@ -386,12 +653,16 @@ func processUnsubscribe(c *Client, p packets.ControlPacket) {
 	}
 	c.session.unsubscribe(packet.Topics)
 
+	if c.info.version == mqtt5 {
+		c.writePacket(newPacket5(&packets5.Unsuback{PacketID: packet.MessageID, Reasons: reasonCodes(len(packet.Topics), packets5.UnsubackSuccess), Properties: &packets5.Properties{}}))
+		return
+	}
 	unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
 	unsuback.MessageID = packet.MessageID
 	c.writePacket(unsuback)
 }
 
-func processPingreq(c *Client, packet packets.ControlPacket) {
+func processPingreq(c *Client, packet packets.ControlPacket, props *packets5.Properties) {
 	resp := packets.NewControlPacket(packets.Pingresp).(*packets.PingrespPacket)
 	c.writePacket(resp)
 }
@@ -408,6 +679,7 @@ func (c *Client) kickOut() {
 	c.sessionCleanLocal()
 
 	// close connection, but don't schedule Disconnect Pipeline
+	c.sendDisconnect(packets5.DisconnectSessionTakenOver)
 	c.Lock()
 	defer c.Unlock()
 	// Change the client status to Disconnected
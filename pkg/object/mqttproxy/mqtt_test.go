@@ -617,7 +617,7 @@ func TestSendMsgBack(t *testing.T) {
 			for j := 0; j < msgNum; j++ {
 				topic := r.ClientID()
 				text := fmt.Sprintf("sub %d", j)
-				broker.sendMsgToClient(nil, topic, []byte(text), QoS1)
+				broker.sendMsgToClient(nil, topic, []byte(text), QoS1, nil)
 			}
 		}(clients[i])
 	}
@@ -1241,40 +1241,42 @@ func TestClient(t *testing.T) {
 		t.Error("produce wrong will msg")
 	}
 
-	err := client.processPacket(connect)
+	err := client.processPacket(connect, nil)
 	if err == nil {
 		t.Errorf("double connect should return error")
 	}
 	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
-	err = client.processPacket(connack)
+	err = client.processPacket(connack, nil)
 	if err == nil {
 		t.Errorf("client should not send connack")
 	}
 
+	client.session = &Session{info: &SessionInfo{}, pending: make(map[uint16]*Message)}
 	pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
-	err = client.processPacket(pubrec)
-	if err == nil {
-		t.Errorf("qos2 not support now")
-	}
+	pubrec.MessageID = 10
+	err = client.processPacket(pubrec, nil)
+	assert.Nil(err)
+	pubrel := (<-client.writeCh).(*packets.PubrelPacket)
+	assert.Equal(uint16(10), pubrel.MessageID)
 
 	suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
-	err = client.processPacket(suback)
+	err = client.processPacket(suback, nil)
 	if err == nil {
 		t.Errorf("server not subscribe")
 	}
 	unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
-	err = client.processPacket(unsuback)
+	err = client.processPacket(unsuback, nil)
 	if err == nil {
 		t.Errorf("server not subscribe")
 	}
 
 	pingreq := packets.NewControlPacket(packets.Pingreq).(*packets.PingreqPacket)
-	err = client.processPacket(pingreq)
+	err = client.processPacket(pingreq, nil)
 	if err != nil {
 		t.Errorf("ping should success")
 	}
 	pingresp := packets.NewControlPacket(packets.Pingresp).(*packets.PingrespPacket)
-	err = client.processPacket(pingresp)
+	err = client.processPacket(pingresp, nil)
 	if err == nil {
 		t.Errorf("broker not ping")
 	}
@@ -1960,7 +1962,7 @@ func TestSingleNodeBrokerMode(t *testing.T) {
 		return map[string]string{}, nil
 	})
 	defer broker.close()
-	topicMgr := broker.topicMgr.(*cachedTopicManager)
+	topicMgr := broker.topicMgr.(*sharedTopicManager).TopicManager.(*cachedTopicManager)
 
 	client1 := getMQTTClient(t, "client1", "test1", "test1", true)
 	defer client1.Disconnect(200)
@@ -2040,7 +2042,7 @@ func TestBrokerModeWatch(t *testing.T) {
 	mockStorage := broker.sessMgr.store.(*mockStorage)
 	assert.True(mockStorage.watched())
 	assert.True(mockStorage.watched())
-	topicMgr := broker.topicMgr.(*cachedTopicManager)
+	topicMgr := broker.topicMgr.(*sharedTopicManager).TopicManager.(*cachedTopicManager)
 	sessCacheMgr := broker.sessionCacheMgr
 
 	// test SessionCacheManager watch put event of storage
@@ -2101,7 +2103,7 @@ func TestBrokerModeWatch(t *testing.T) {
 	publish.TopicName = topicOnEg2
 	publish.Payload = []byte("hello")
 	publish.Qos = 1
-	broker.processBrokerModePublish("clientOnEg1", publish)
+	broker.processBrokerModePublish("clientOnEg1", publish, nil)
 
 	var res *httpRes
 	select {
@@ -2119,3 +2121,106 @@ func TestBrokerModeWatch(t *testing.T) {
 	assert.True(data.Distributed)
 	assert.Equal(1, data.QoS)
 }
+
+func TestBrokerModeRetainAndOffline(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := getDefaultSpec()
+	spec.BrokerMode = true
+	store := newStorage(nil)
+	mapper := &mockMuxMapper{}
+	broker := newBroker(spec, store, mapper, func(s, ss string) (map[string]string, error) {
+		return map[string]string{}, nil
+	})
+	defer broker.close()
+
+	pub := getMQTTClient(t, "retainPub", "test", "test", true)
+	defer pub.Disconnect(200)
+	token := pub.Publish("retain/a", QoS2, true, "retained")
+	token.Wait()
+	assert.Nil(token.Error())
+	for i := 0; i < 100 && len(broker.retainMgr.match("retain/a")) == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// retained message is sent to new subscription with the qos of the subscription.
+	ch := make(chan paho.Message, 100)
+	opts := paho.NewClientOptions().AddBroker("tcp://0.0.0.0:1883").SetClientID("retainSub").SetCleanSession(false)
+	opts.SetDefaultPublishHandler(func(client paho.Client, message paho.Message) {
+		ch <- message
+	})
+	sub := paho.NewClient(opts)
+	token = sub.Connect()
+	token.Wait()
+	assert.Nil(token.Error())
+	token = sub.Subscribe("retain/+", QoS2, nil)
+	token.Wait()
+	assert.Nil(token.Error())
+	select {
+	case msg := <-ch:
+		assert.Equal("retain/a", msg.Topic())
+		assert.Equal("retained", string(msg.Payload()))
+		assert.Equal(QoS2, msg.Qos())
+		assert.True(msg.Retained())
+	case <-time.After(5 * time.Second):
+		assert.Fail("retained message not received")
+	}
+	assert.Nil(checkSessionStore(broker, "retainSub", "retain/+"))
+
+	// messages are queued when the client of persistent session is offline.
+	sub.Disconnect(200)
+	for i := 0; i < 100 && broker.getClient("retainSub") != nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		token = pub.Publish("retain/b", QoS2, false, strconv.Itoa(i))
+		token.Wait()
+		assert.Nil(token.Error())
+	}
+	queued := func() int {
+		broker.offlineMgr.Lock()
+		q := broker.offlineMgr.queues["retainSub"]
+		broker.offlineMgr.Unlock()
+		if q == nil {
+			return 0
+		}
+		q.Lock()
+		defer q.Unlock()
+		return len(q.entries)
+	}
+	for i := 0; i < 100 && queued() != 3; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(3, queued())
+
+	token = sub.Connect()
+	token.Wait()
+	assert.Nil(token.Error())
+	defer sub.Disconnect(200)
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-ch:
+			assert.Equal("retain/b", msg.Topic())
+			assert.Equal(strconv.Itoa(i), string(msg.Payload()))
+			assert.Equal(QoS2, msg.Qos())
+			assert.False(msg.Retained())
+		case <-time.After(5 * time.Second):
+			assert.Fail("offline message not received")
+		}
+	}
+
+	// QoS 2 flow completes, and no message is pending.
+	for i := 0; i < 100; i++ {
+		c := broker.getClient("retainSub")
+		if c != nil && len(c.session.pendingMessages()) == 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	c := broker.getClient("retainSub")
+	assert.NotNil(c)
+	assert.Empty(c.session.pendingMessages())
+	c.session.Lock()
+	assert.Empty(c.session.pending)
+	c.session.Unlock()
+}
@@ -0,0 +1,246 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"encoding/base64"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+type (
+	// offlineManager queues messages for offline clients of persistent
+	// sessions in broker mode. The queue of a client is kept by the member
+	// which the client connected to last time, and every message of it is
+	// put into the storage in its own key, so that the queue survives
+	// restarts, and is taken by the member which the client reconnects to.
+	offlineManager struct {
+		sync.Mutex
+		name        string
+		store       storage
+		maxMessages int
+		maxBytes    int
+		queues      map[string]*offlineQueue
+	}
+
+	offlineQueue struct {
+		sync.Mutex
+		entries []*offlineEntry
+		bytes   int
+		next    uint64
+		closed  bool
+	}
+
+	offlineEntry struct {
+		seq uint64
+		msg *Message
+	}
+)
+
+func newOfflineManager(spec *Spec, store storage) *offlineManager {
+	om := &offlineManager{
+		name:        spec.Name,
+		store:       store,
+		maxMessages: spec.MaxOfflineMessages,
+		maxBytes:    spec.MaxOfflineBytes,
+		queues:      make(map[string]*offlineQueue),
+	}
+	if om.maxMessages <= 0 {
+		om.maxMessages = defaultMaxOfflineMessages
+	}
+	if om.maxBytes <= 0 {
+		om.maxBytes = defaultMaxOfflineBytes
+	}
+	return om
+}
+
+func messageSize(msg *Message) int {
+	return base64.StdEncoding.DecodedLen(len(msg.B64Payload))
+}
+
+// load loads the queue of the client from the storage.
+func (om *offlineManager) load(clientID string) *offlineQueue {
+	q := &offlineQueue{}
+	prefix := offlineStoreKey(om.name, clientID)
+	kvs, err := om.store.getPrefix(prefix, false)
+	if err != nil {
+		logger.SpanErrorf(nil, "get offline messages of client %s failed: %v", clientID, err)
+		return q
+	}
+
+	for k, v := range kvs {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(k, prefix), 10, 64)
+		if err != nil {
+			logger.Warnf("ignored offline message of client %s with invalid key %s", clientID, k)
+			continue
+		}
+		msg := &Message{}
+		if err = codectool.UnmarshalJSON([]byte(v), msg); err != nil {
+			logger.Warnf("ignored decode offline message of client %s failed: %v", clientID, err)
+			continue
+		}
+		q.entries = append(q.entries, &offlineEntry{seq: seq, msg: msg})
+		q.bytes += messageSize(msg)
+	}
+	sort.Slice(q.entries, func(i, j int) bool {
+		return q.entries[i].seq < q.entries[j].seq
+	})
+	if len(q.entries) > 0 {
+		q.next = q.entries[len(q.entries)-1].seq + 1
+	}
+	return q
+}
+
+// push appends the message to the queue and drops the oldest messages if
+// the limits are exceeded, the changes are put into the storage. The caller
+// must hold the lock of the queue.
+func (om *offlineManager) push(clientID string, q *offlineQueue, msg *Message) {
+	size := messageSize(msg)
+	if size > om.maxBytes {
+		logger.Warnf("message of topic %s is dropped for offline client %s, its size %d exceeds the limit", msg.Topic, clientID, size)
+		return
+	}
+
+	data, err := codectool.MarshalJSON(msg)
+	if err != nil {
+		logger.SpanErrorf(nil, "encode offline message of client %s failed: %v", clientID, err)
+		return
+	}
+	entry := &offlineEntry{seq: q.next, msg: msg}
+	q.next++
+	if err = om.store.put(offlineMessageKey(om.name, clientID, entry.seq), string(data)); err != nil {
+		logger.SpanErrorf(nil, "put offline message of client %s failed: %v", clientID, err)
+	}
+
+	q.entries = append(q.entries, entry)
+	q.bytes += size
+	dropped := 0
+	for len(q.entries) > om.maxMessages || q.bytes > om.maxBytes {
+		oldest := q.entries[0]
+		if err = om.store.delete(offlineMessageKey(om.name, clientID, oldest.seq)); err != nil {
+			logger.SpanErrorf(nil, "delete offline message of client %s failed: %v", clientID, err)
+		}
+		q.bytes -= messageSize(oldest.msg)
+		q.entries[0] = nil
+		q.entries = q.entries[1:]
+		dropped++
+	}
+	if dropped > 0 {
+		logger.Warnf("%d oldest messages are dropped for offline client %s, the queue is full", dropped, clientID)
+	}
+}
+
+// register starts queueing messages for the client which goes offline,
+// pending is the messages not acknowledged by the client.
+func (om *offlineManager) register(clientID string, pending []*Message) {
+	om.Lock()
+	q, ok := om.queues[clientID]
+	if !ok {
+		q = om.load(clientID)
+		om.queues[clientID] = q
+	}
+	om.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	for _, msg := range pending {
+		om.push(clientID, q, msg)
+	}
+}
+
+// enqueue queues the message for the client, it returns false if the
+// client is not offline.
+func (om *offlineManager) enqueue(clientID string, msg *Message) bool {
+	om.Lock()
+	q, ok := om.queues[clientID]
+	om.Unlock()
+	if !ok {
+		return false
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	if q.closed {
+		return false
+	}
+	om.push(clientID, q, msg)
+	return true
+}
+
+// take removes and returns the queued messages of the client which
+// reconnects.
+func (om *offlineManager) take(clientID string) []*Message {
+	om.Lock()
+	q, ok := om.queues[clientID]
+	delete(om.queues, clientID)
+	om.Unlock()
+	if !ok {
+		q = om.load(clientID)
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	q.closed = true
+	if len(q.entries) == 0 {
+		return nil
+	}
+
+	msgs := make([]*Message, 0, len(q.entries))
+	for _, entry := range q.entries {
+		msgs = append(msgs, entry.msg)
+	}
+	q.entries = nil
+	om.deleteAll(clientID)
+	return msgs
+}
+
+// drop stops queueing messages for the client whose session is taken over
+// by another member, the messages in the storage are left to that member.
+func (om *offlineManager) drop(clientID string) {
+	om.Lock()
+	q, ok := om.queues[clientID]
+	delete(om.queues, clientID)
+	om.Unlock()
+
+	if ok {
+		q.Lock()
+		q.closed = true
+		q.Unlock()
+	}
+}
+
+// discard removes the queued messages of the client whose session ends.
+func (om *offlineManager) discard(clientID string) {
+	om.drop(clientID)
+	om.deleteAll(clientID)
+}
+
+// deleteAll deletes all offline messages of the client in the storage.
+func (om *offlineManager) deleteAll(clientID string) {
+	if err := om.store.deletePrefix(offlineStoreKey(om.name, clientID)); err != nil {
+		logger.SpanErrorf(nil, "delete offline messages of client %s failed: %v", clientID, err)
+	}
+}
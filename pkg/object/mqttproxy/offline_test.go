@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineManager(t *testing.T) {
+	assert := assert.New(t)
+
+	store := newStorage(nil)
+	spec := &Spec{Name: "test", MaxOfflineMessages: 2, MaxOfflineBytes: 10}
+	om := newOfflineManager(spec, store)
+
+	// messages are not queued for clients which are not offline.
+	assert.False(om.enqueue("c1", newMsg("t", []byte("1"), QoS1, nil)))
+
+	om.register("c1", []*Message{newMsg("t", []byte("1"), QoS1, nil)})
+	assert.True(om.enqueue("c1", newMsg("t", []byte("2"), QoS1, nil)))
+	// the oldest message is dropped when the queue is full.
+	assert.True(om.enqueue("c1", newMsg("t", []byte("3"), QoS2, nil)))
+	// the message exceeds the bytes limit is dropped.
+	assert.True(om.enqueue("c1", newMsg("t", []byte("0123456789a"), QoS1, nil)))
+
+	// the queue is taken by the member which the client reconnects to.
+	om2 := newOfflineManager(spec, store)
+	msgs := om2.take("c1")
+	assert.Equal(2, len(msgs))
+	assert.Equal("Mg==", msgs[0].B64Payload)
+	assert.Equal("Mw==", msgs[1].B64Payload)
+	assert.Equal(int(QoS2), msgs[1].QoS)
+	kvs, _ := store.getPrefix(offlineStoreKey("test", "c1"), false)
+	assert.Empty(kvs)
+
+	// the bytes limit drops the oldest messages too.
+	om.drop("c1")
+	om.register("c2", nil)
+	assert.True(om.enqueue("c2", newMsg("t", []byte("01234"), QoS1, nil)))
+	assert.True(om.enqueue("c2", newMsg("t", []byte("56789a"), QoS1, nil)))
+	msgs = om.take("c2")
+	assert.Equal(1, len(msgs))
+	assert.Equal(int(QoS1), msgs[0].QoS)
+	assert.False(om.enqueue("c2", newMsg("t", []byte("1"), QoS1, nil)))
+
+	// discard removes queued messages in the storage.
+	om.register("c3", nil)
+	assert.True(om.enqueue("c3", newMsg("t", []byte("1"), QoS1, nil)))
+	kvs, _ = store.getPrefix(offlineStoreKey("test", "c3"), false)
+	assert.Len(kvs, 1)
+	om.discard("c3")
+	kvs, _ = store.getPrefix(offlineStoreKey("test", "c3"), false)
+	assert.Empty(kvs)
+	assert.Empty(om.take("c3"))
+}
+
+func TestOfflineMessageKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	// the limits default without changing the spec.
+	store := newStorage(nil)
+	spec := &Spec{Name: "test"}
+	om := newOfflineManager(spec, store)
+	assert.Equal(defaultMaxOfflineMessages, om.maxMessages)
+	assert.Equal(defaultMaxOfflineBytes, om.maxBytes)
+	assert.Equal(0, spec.MaxOfflineMessages)
+	assert.Equal(0, spec.MaxOfflineBytes)
+
+	// every message is stored in its own key, and the client ID which is
+	// a prefix of another one doesn't share its messages.
+	om.register("c1", nil)
+	om.register("c1/x", nil)
+	for i := 0; i < 12; i++ {
+		assert.True(om.enqueue("c1", newMsg("t", []byte{byte(i)}, QoS1, nil)))
+	}
+	assert.True(om.enqueue("c1/x", newMsg("t", []byte("x"), QoS1, nil)))
+	kvs, _ := store.getPrefix(offlineStoreKey("test", "c1"), false)
+	assert.Len(kvs, 12)
+	_, err := store.get(offlineMessageKey("test", "c1", 11))
+	assert.Nil(err)
+
+	// the queue is loaded in order by another member.
+	om2 := newOfflineManager(spec, store)
+	om2.register("c1", nil)
+	assert.True(om2.enqueue("c1", newMsg("t", []byte{12}, QoS1, nil)))
+	msgs := om2.take("c1")
+	assert.Equal(13, len(msgs))
+	for i, msg := range msgs {
+		assert.Equal(newMsg("t", []byte{byte(i)}, QoS1, nil).B64Payload, msg.B64Payload)
+	}
+	kvs, _ = store.getPrefix(offlineStoreKey("test", "c1"), false)
+	assert.Empty(kvs)
+	assert.Equal(1, len(om2.take("c1/x")))
+}
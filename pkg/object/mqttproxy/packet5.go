@@ -0,0 +1,373 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+const (
+	// mqtt5 is the protocol level of MQTT 5.0, the broker converts MQTT 5
+	// packets to MQTT 3.1.1 packets and their properties, so that packets
+	// of both versions are processed in the same way.
+	mqtt5 byte = 5
+
+	// maxRemainingLength is the max remaining length of MQTT packets.
+	maxRemainingLength = 268435455
+)
+
+type (
+	// packet5 wraps a MQTT 5 control packet as packets.ControlPacket, so
+	// that it could be written to clients in the same way as MQTT 3.1.1
+	// packets.
+	packet5 struct {
+		cp *packets5.ControlPacket
+	}
+
+	// reasonError is an error which closes the network connection of a
+	// MQTT 5 client with a DISCONNECT packet of the reason code.
+	reasonError struct {
+		code byte
+		msg  string
+	}
+)
+
+var _ packets.ControlPacket = (*packet5)(nil)
+
+func newPacket5(content packets5.Packet) *packet5 {
+	var t byte
+	switch content.(type) {
+	case *packets5.Connack:
+		t = packets5.CONNACK
+	case *packets5.Publish:
+		t = packets5.PUBLISH
+	case *packets5.Puback:
+		t = packets5.PUBACK
+	case *packets5.Pubrec:
+		t = packets5.PUBREC
+	case *packets5.Pubrel:
+		t = packets5.PUBREL
+	case *packets5.Pubcomp:
+		t = packets5.PUBCOMP
+	case *packets5.Suback:
+		t = packets5.SUBACK
+	case *packets5.Unsuback:
+		t = packets5.UNSUBACK
+	case *packets5.Pingresp:
+		t = packets5.PINGRESP
+	case *packets5.Disconnect:
+		t = packets5.DISCONNECT
+	}
+	cp := packets5.NewControlPacket(t)
+	cp.Content = content
+	return &packet5{cp: cp}
+}
+
+// Write implements packets.ControlPacket.
+func (p *packet5) Write(w io.Writer) error {
+	_, err := p.cp.WriteTo(w)
+	return err
+}
+
+// Unpack implements packets.ControlPacket.
+func (p *packet5) Unpack(r io.Reader) error {
+	return errors.New("unpack MQTT 5 packet is not supported")
+}
+
+// String implements packets.ControlPacket.
+func (p *packet5) String() string {
+	return p.cp.String()
+}
+
+// Details implements packets.ControlPacket.
+func (p *packet5) Details() packets.Details {
+	details := packets.Details{MessageID: p.cp.PacketID()}
+	if publish, ok := p.cp.Content.(*packets5.Publish); ok {
+		details.Qos = publish.QoS
+	}
+	return details
+}
+
+func (e *reasonError) Error() string {
+	return fmt.Sprintf("%s (reason code 0x%02X)", e.msg, e.code)
+}
+
+// readRawPacket reads a whole packet from r without decoding it.
+func readRawPacket(r io.Reader) ([]byte, error) {
+	raw := make([]byte, 1, 5)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errors.New("malformed remaining length")
+		}
+		var b [1]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		raw = append(raw, b[0])
+		length += int(b[0]&127) * multiplier
+		multiplier *= 128
+		if b[0]&128 == 0 {
+			break
+		}
+	}
+	if length > maxRemainingLength {
+		return nil, errors.New("malformed remaining length")
+	}
+
+	header := len(raw)
+	raw = append(raw, make([]byte, length)...)
+	if _, err := io.ReadFull(r, raw[header:]); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// connectProtocolLevel returns the protocol level of the raw CONNECT
+// packet, it returns 0 if the packet is not a valid CONNECT packet.
+func connectProtocolLevel(raw []byte) byte {
+	if len(raw) == 0 || raw[0]>>4 != packets.Connect {
+		return 0
+	}
+	i := 1
+	for i < len(raw) && raw[i]&128 != 0 {
+		i++
+	}
+	// the variable header starts with the protocol name.
+	i++
+	if i+2 > len(raw) {
+		return 0
+	}
+	i += 2 + (int(raw[i])<<8 | int(raw[i+1]))
+	if i >= len(raw) {
+		return 0
+	}
+	return raw[i]
+}
+
+// readConnect reads the first packet of a connection, MQTT 5 CONNECT
+// packets are converted to MQTT 3.1.1 CONNECT packets with protocol
+// version 5, and the original packets are returned as connect5.
+func readConnect(r io.Reader) (packet packets.ControlPacket, connect5 *packets5.Connect, err error) {
+	raw, err := readRawPacket(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if connectProtocolLevel(raw) != mqtt5 {
+		packet, err = packets.ReadPacket(bytes.NewReader(raw))
+		return packet, nil, err
+	}
+
+	cp, err := packets5.ReadPacket(bytes.NewReader(raw))
+	if err != nil {
+		return nil, nil, err
+	}
+	connect5 = cp.Content.(*packets5.Connect)
+
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.RemainingLength = len(raw)
+	connect.ProtocolName = connect5.ProtocolName
+	connect.ProtocolVersion = connect5.ProtocolVersion
+	connect.CleanSession = connect5.CleanStart
+	connect.WillFlag = connect5.WillFlag
+	connect.WillQos = connect5.WillQOS
+	connect.WillRetain = connect5.WillRetain
+	connect.UsernameFlag = connect5.UsernameFlag
+	connect.PasswordFlag = connect5.PasswordFlag
+	connect.Keepalive = connect5.KeepAlive
+	connect.ClientIdentifier = connect5.ClientID
+	connect.WillTopic = connect5.WillTopic
+	connect.WillMessage = connect5.WillMessage
+	connect.Username = connect5.Username
+	connect.Password = connect5.Password
+	return connect, connect5, nil
+}
+
+// validateConnect validates the CONNECT packet and returns the return
+// code of MQTT 3.1.1 CONNACK packet.
+func validateConnect(connect *packets.ConnectPacket) byte {
+	if connect.ProtocolVersion != mqtt5 {
+		return connect.Validate()
+	}
+	// MQTT 5 allows empty client identifier without clean start, the
+	// broker assigns one for the client.
+	c := *connect
+	c.ProtocolVersion = 4
+	c.CleanSession = true
+	return c.Validate()
+}
+
+// fromPacket5 converts a MQTT 5 packet received from clients to a MQTT
+// 3.1.1 packet and its properties.
+func fromPacket5(cp *packets5.ControlPacket) (packets.ControlPacket, *packets5.Properties, error) {
+	switch p := cp.Content.(type) {
+	case *packets5.Publish:
+		publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		publish.Qos = p.QoS
+		publish.Dup = p.Duplicate
+		publish.Retain = p.Retain
+		publish.TopicName = p.Topic
+		publish.MessageID = p.PacketID
+		publish.Payload = p.Payload
+		publish.RemainingLength = len(p.Topic) + len(p.Payload) + 4
+		return publish, p.Properties, nil
+	case *packets5.Puback:
+		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID = p.PacketID
+		return puback, p.Properties, nil
+	case *packets5.Pubrec:
+		// the client refuses the QoS 2 message by reason code, and the
+		// flow ends like QoS 1.
+		if p.ReasonCode >= 0x80 {
+			puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			puback.MessageID = p.PacketID
+			return puback, p.Properties, nil
+		}
+		pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pubrec.MessageID = p.PacketID
+		return pubrec, p.Properties, nil
+	case *packets5.Pubrel:
+		pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+		pubrel.MessageID = p.PacketID
+		return pubrel, p.Properties, nil
+	case *packets5.Pubcomp:
+		pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+		pubcomp.MessageID = p.PacketID
+		return pubcomp, p.Properties, nil
+	case *packets5.Subscribe:
+		subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		subscribe.MessageID = p.PacketID
+		for _, s := range p.Subscriptions {
+			subscribe.Topics = append(subscribe.Topics, s.Topic)
+			subscribe.Qoss = append(subscribe.Qoss, s.QoS)
+		}
+		return subscribe, p.Properties, nil
+	case *packets5.Unsubscribe:
+		unsubscribe := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+		unsubscribe.MessageID = p.PacketID
+		unsubscribe.Topics = p.Topics
+		return unsubscribe, p.Properties, nil
+	case *packets5.Disconnect:
+		return packets.NewControlPacket(packets.Disconnect), p.Properties, nil
+	case *packets5.Auth:
+		return nil, nil, &reasonError{code: packets5.DisconnectProtocolError, msg: "enhanced authentication is not supported"}
+	}
+
+	// packets which are not allowed to be sent by clients, they are
+	// converted to packets of the same type to be rejected later.
+	packet := packets.NewControlPacket(cp.Type)
+	if packet == nil {
+		return nil, nil, fmt.Errorf("unknown packet type %d", cp.Type)
+	}
+	return packet, nil, nil
+}
+
+// connackReasonCode converts the return code of MQTT 3.1.1 CONNACK packet
+// to the reason code of MQTT 5 CONNACK packet.
+func connackReasonCode(returnCode byte) byte {
+	switch returnCode {
+	case packets.Accepted:
+		return packets5.ConnackSuccess
+	case packets.ErrRefusedBadProtocolVersion:
+		return packets5.ConnackUnsupportedProtocolVersion
+	case packets.ErrRefusedIDRejected:
+		return packets5.ConnackInvalidClientID
+	case packets.ErrRefusedServerUnavailable:
+		return packets5.ConnackServerUnavailable
+	case packets.ErrRefusedBadUsernameOrPassword:
+		return packets5.ConnackBadUsernameOrPassword
+	case packets.ErrRefusedNotAuthorised:
+		return packets5.ConnackNotAuthorized
+	case packets.ErrProtocolViolation:
+		return packets5.ConnackProtocolError
+	default:
+		return packets5.ConnackUnspecifiedError
+	}
+}
+
+// toPacket5 converts a MQTT 3.1.1 packet to be sent to clients to a MQTT
+// 5 packet with props.
+func toPacket5(packet packets.ControlPacket, props *packets5.Properties) packets.ControlPacket {
+	if props == nil {
+		props = &packets5.Properties{}
+	}
+
+	switch p := packet.(type) {
+	case *packets.ConnackPacket:
+		return newPacket5(&packets5.Connack{
+			SessionPresent: p.SessionPresent,
+			ReasonCode:     connackReasonCode(p.ReturnCode),
+			Properties:     props,
+		})
+	case *packets.PublishPacket:
+		return newPacket5(&packets5.Publish{
+			Payload:    p.Payload,
+			Topic:      p.TopicName,
+			Properties: props,
+			PacketID:   p.MessageID,
+			QoS:        p.Qos,
+			Duplicate:  p.Dup,
+			Retain:     p.Retain,
+		})
+	case *packets.PubackPacket:
+		return newPacket5(&packets5.Puback{PacketID: p.MessageID, Properties: props})
+	case *packets.PubrecPacket:
+		return newPacket5(&packets5.Pubrec{PacketID: p.MessageID, Properties: props})
+	case *packets.PubrelPacket:
+		return newPacket5(&packets5.Pubrel{PacketID: p.MessageID, Properties: props})
+	case *packets.PubcompPacket:
+		return newPacket5(&packets5.Pubcomp{PacketID: p.MessageID, Properties: props})
+	case *packets.SubackPacket:
+		return newPacket5(&packets5.Suback{PacketID: p.MessageID, Reasons: p.ReturnCodes, Properties: props})
+	case *packets.UnsubackPacket:
+		return newPacket5(&packets5.Unsuback{PacketID: p.MessageID, Properties: props})
+	case *packets.PingrespPacket:
+		return newPacket5(&packets5.Pingresp{})
+	case *packets.DisconnectPacket:
+		return newPacket5(&packets5.Disconnect{Properties: props})
+	}
+	return packet
+}
+
+// forwardProperties returns the properties of a PUBLISH packet which are
+// forwarded to subscribers, the properties only make sense between a
+// client and the broker, like topic alias, are removed.
+func forwardProperties(props *packets5.Properties) *packets5.Properties {
+	if props == nil {
+		return nil
+	}
+	return &packets5.Properties{
+		PayloadFormat:   props.PayloadFormat,
+		MessageExpiry:   props.MessageExpiry,
+		ContentType:     props.ContentType,
+		ResponseTopic:   props.ResponseTopic,
+		CorrelationData: props.CorrelationData,
+		User:            props.User,
+	}
+}
@@ -0,0 +1,254 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/context/contexttest"
+	"github.com/megaease/easegress/v2/pkg/protocols/mqttprot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadConnect(t *testing.T) {
+	assert := assert.New(t)
+
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.ClientIdentifier = "client3"
+	buf := &bytes.Buffer{}
+	assert.NoError(connect.Write(buf))
+	packet, connect5, err := readConnect(buf)
+	assert.NoError(err)
+	assert.Nil(connect5)
+	assert.Equal("client3", packet.(*packets.ConnectPacket).ClientIdentifier)
+
+	expiry := uint32(60)
+	cp := packets5.NewControlPacket(packets5.CONNECT)
+	c := cp.Content.(*packets5.Connect)
+	c.ClientID = "client5"
+	c.UsernameFlag, c.Username = true, "user"
+	c.Properties.SessionExpiryInterval = &expiry
+	buf.Reset()
+	_, err = cp.WriteTo(buf)
+	assert.NoError(err)
+	assert.Equal(mqtt5, connectProtocolLevel(buf.Bytes()))
+	packet, connect5, err = readConnect(buf)
+	assert.NoError(err)
+	assert.Equal(expiry, *connect5.Properties.SessionExpiryInterval)
+	connect = packet.(*packets.ConnectPacket)
+	assert.Equal("client5", connect.ClientIdentifier)
+	assert.Equal("user", connect.Username)
+	assert.Equal(mqtt5, connect.ProtocolVersion)
+	assert.Equal(byte(packets.Accepted), validateConnect(connect))
+
+	connect.ClientIdentifier = ""
+	assert.Equal(byte(packets.Accepted), validateConnect(connect))
+
+	_, _, err = readConnect(bytes.NewReader([]byte{0x10, 0xff, 0xff, 0xff, 0xff}))
+	assert.Error(err)
+	assert.Equal(byte(0), connectProtocolLevel([]byte{0x30, 0x00}))
+}
+
+func TestPacket5Conversion(t *testing.T) {
+	assert := assert.New(t)
+
+	cp := packets5.NewControlPacket(packets5.SUBSCRIBE)
+	cp.Content.(*packets5.Subscribe).PacketID = 10
+	cp.Content.(*packets5.Subscribe).Subscriptions = []packets5.SubOptions{{Topic: "a/b", QoS: 1}, {Topic: "$share/g/c", QoS: 0}}
+	packet, props, err := fromPacket5(cp)
+	assert.NoError(err)
+	assert.NotNil(props)
+	subscribe := packet.(*packets.SubscribePacket)
+	assert.Equal(uint16(10), subscribe.MessageID)
+	assert.Equal([]string{"a/b", "$share/g/c"}, subscribe.Topics)
+	assert.Equal([]byte{1, 0}, subscribe.Qoss)
+
+	_, _, err = fromPacket5(packets5.NewControlPacket(packets5.AUTH))
+	assert.Equal(byte(packets5.DisconnectProtocolError), err.(*reasonError).code)
+
+	packet, _, err = fromPacket5(packets5.NewControlPacket(packets5.PUBREC))
+	assert.NoError(err)
+	assert.IsType(&packets.PubrecPacket{}, packet)
+
+	// PUBREC with failure reason code ends the QoS 2 flow like PUBACK.
+	cp = packets5.NewControlPacket(packets5.PUBREC)
+	cp.Content.(*packets5.Pubrec).PacketID = 11
+	cp.Content.(*packets5.Pubrec).ReasonCode = packets5.PubrecNotAuthorized
+	packet, _, err = fromPacket5(cp)
+	assert.NoError(err)
+	assert.Equal(uint16(11), packet.(*packets.PubackPacket).MessageID)
+
+	pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	pubrel.MessageID = 12
+	buf := &bytes.Buffer{}
+	assert.NoError(toPacket5(pubrel, nil).Write(buf))
+	cp, err = packets5.ReadPacket(buf)
+	assert.NoError(err)
+	assert.Equal(uint16(12), cp.Content.(*packets5.Pubrel).PacketID)
+
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = packets.ErrRefusedNotAuthorised
+	buf = &bytes.Buffer{}
+	assert.NoError(toPacket5(connack, nil).Write(buf))
+	cp, err = packets5.ReadPacket(buf)
+	assert.NoError(err)
+	assert.Equal(byte(packets5.ConnackNotAuthorized), cp.Content.(*packets5.Connack).ReasonCode)
+
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = "a/b"
+	publish.Qos = 1
+	publish.MessageID = 3
+	publish.Payload = []byte("hello")
+	buf.Reset()
+	p := toPacket5(publish, &packets5.Properties{User: []packets5.User{{Key: "k", Value: "v"}}})
+	assert.Equal(packets.Details{Qos: 1, MessageID: 3}, p.Details())
+	assert.NoError(p.Write(buf))
+	cp, err = packets5.ReadPacket(buf)
+	assert.NoError(err)
+	publish5 := cp.Content.(*packets5.Publish)
+	assert.Equal("a/b", publish5.Topic)
+	assert.Equal([]byte("hello"), publish5.Payload)
+	assert.Equal([]packets5.User{{Key: "k", Value: "v"}}, publish5.Properties.User)
+
+	alias := uint16(1)
+	forwarded := forwardProperties(&packets5.Properties{TopicAlias: &alias, ContentType: "text/plain"})
+	assert.Nil(forwarded.TopicAlias)
+	assert.Equal("text/plain", forwarded.ContentType)
+}
+
+func dialMQTT5(t *testing.T, clientID string) (net.Conn, *packets5.Connack) {
+	conn, err := net.Dial("tcp", "localhost:1883")
+	require.NoError(t, err)
+
+	cp := packets5.NewControlPacket(packets5.CONNECT)
+	connect := cp.Content.(*packets5.Connect)
+	connect.ClientID = clientID
+	connect.CleanStart = true
+	connect.KeepAlive = 30
+	_, err = cp.WriteTo(conn)
+	require.NoError(t, err)
+	return conn, readPacket5(t, conn).Content.(*packets5.Connack)
+}
+
+func readPacket5(t *testing.T, conn net.Conn) *packets5.ControlPacket {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	cp, err := packets5.ReadPacket(conn)
+	require.NoError(t, err)
+	return cp
+}
+
+func writePacket5(t *testing.T, conn net.Conn, packetType byte, content packets5.Packet) {
+	cp := packets5.NewControlPacket(packetType)
+	cp.Content = content
+	_, err := cp.WriteTo(conn)
+	require.NoError(t, err)
+}
+
+func TestMQTT5(t *testing.T) {
+	assert := assert.New(t)
+
+	headers := make(chan string, 10)
+	mapper := &contexttest.MockedMuxMapper{
+		MockedGetHandler: func(name string) (context.Handler, bool) {
+			return &contexttest.MockedHandler{
+				MockedHandle: func(ctx *context.Context) string {
+					req := ctx.GetInputRequest().(*mqttprot.Request)
+					headers <- req.Header().Get("k").(string)
+					return ""
+				},
+			}, true
+		},
+	}
+	broker := getDefaultBroker(mapper)
+	require.NotNil(t, broker)
+	defer broker.close()
+
+	// connect with empty client identifier.
+	pub, connack := dialMQTT5(t, "")
+	defer pub.Close()
+	assert.Equal(byte(packets5.ConnackSuccess), connack.ReasonCode)
+	assert.NotEmpty(connack.Properties.AssignedClientID)
+	assert.Equal(uint16(defaultTopicAliasMaximum), *connack.Properties.TopicAliasMaximum)
+	assert.Equal(byte(1), *connack.Properties.SharedSubAvailable)
+
+	// shared subscription.
+	var subs []net.Conn
+	for _, id := range []string{"sub1", "sub2"} {
+		conn, _ := dialMQTT5(t, id)
+		defer conn.Close()
+		writePacket5(t, conn, packets5.SUBSCRIBE, &packets5.Subscribe{
+			PacketID:      1,
+			Subscriptions: []packets5.SubOptions{{Topic: "$share/group/a/+", QoS: 1}},
+			Properties:    &packets5.Properties{},
+		})
+		suback := readPacket5(t, conn).Content.(*packets5.Suback)
+		assert.Equal(uint16(1), suback.PacketID)
+		assert.Len(suback.Reasons, 1)
+		subs = append(subs, conn)
+	}
+
+	// publish with topic alias and user properties.
+	alias := uint16(1)
+	for i, topic := range []string{"a/b", ""} {
+		writePacket5(t, pub, packets5.PUBLISH, &packets5.Publish{
+			Topic:      topic,
+			QoS:        1,
+			PacketID:   uint16(i + 1),
+			Payload:    []byte("hello"),
+			Properties: &packets5.Properties{TopicAlias: &alias, User: []packets5.User{{Key: "k", Value: "v"}}},
+		})
+		puback := readPacket5(t, pub).Content.(*packets5.Puback)
+		assert.Equal(uint16(i+1), puback.PacketID)
+		assert.Equal(byte(packets5.PubackSuccess), puback.ReasonCode)
+		assert.Equal("v", <-headers)
+	}
+
+	// messages of shared subscription are delivered to members in turn.
+	props := &packets5.Properties{User: []packets5.User{{Key: "k", Value: "v"}}}
+	broker.sendMsgToClient(nil, "a/b", []byte("m1"), QoS1, props)
+	broker.sendMsgToClient(nil, "a/b", []byte("m2"), QoS1, props)
+	payloads := map[string]bool{}
+	for _, conn := range subs {
+		publish := readPacket5(t, conn).Content.(*packets5.Publish)
+		assert.Equal("a/b", publish.Topic)
+		assert.Equal(props.User, publish.Properties.User)
+		payloads[string(publish.Payload)] = true
+	}
+	assert.Equal(map[string]bool{"m1": true, "m2": true}, payloads)
+
+	// invalid topic alias.
+	invalid := uint16(defaultTopicAliasMaximum + 1)
+	writePacket5(t, pub, packets5.PUBLISH, &packets5.Publish{Topic: "a/b", Properties: &packets5.Properties{TopicAlias: &invalid}})
+	disconnect := readPacket5(t, pub).Content.(*packets5.Disconnect)
+	assert.Equal(byte(packets5.DisconnectTopicAliasInvalid), disconnect.ReasonCode)
+
+	// session taken over.
+	conn, _ := dialMQTT5(t, "sub1")
+	defer conn.Close()
+	disconnect = readPacket5(t, subs[0]).Content.(*packets5.Disconnect)
+	assert.Equal(byte(packets5.DisconnectSessionTakenOver), disconnect.ReasonCode)
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+type (
+	// retainManager manages retained messages in broker mode. Retained
+	// messages are put into the storage, and cached by all members of the
+	// cluster by watching the storage, so that they are looked up locally
+	// when clients subscribe.
+	retainManager struct {
+		sync.RWMutex
+		name        string
+		store       storage
+		maxMessages int
+		messages    map[string]*retainedMessage
+		done        chan struct{}
+	}
+
+	retainedMessage struct {
+		levels []string
+		msg    *Message
+	}
+)
+
+func newRetainManager(spec *Spec, store storage) *retainManager {
+	rm := &retainManager{
+		name:        spec.Name,
+		store:       store,
+		maxMessages: spec.MaxRetainedMessages,
+		messages:    make(map[string]*retainedMessage),
+		done:        make(chan struct{}),
+	}
+	go rm.connectWatcher()
+	return rm
+}
+
+func (rm *retainManager) closed() bool {
+	select {
+	case <-rm.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (rm *retainManager) connectWatcher() {
+	prefix := retainStoreKey(rm.name, "")
+	var ch <-chan map[string]*string
+	var cancelFunc func()
+	var err error
+	for {
+		if rm.closed() {
+			return
+		}
+
+		ch, cancelFunc, err = rm.store.watch(prefix)
+		if err == nil {
+			break
+		}
+		logger.SpanErrorf(nil, "get watcher for retained messages failed, %v", err)
+		time.Sleep(10 * time.Second)
+	}
+
+	kvs, err := rm.store.getPrefix(prefix, false)
+	if err != nil {
+		logger.SpanErrorf(nil, "get all retained messages failed, %v", err)
+	} else {
+		event := make(map[string]*string)
+		for k, v := range kvs {
+			v := v
+			event[k] = &v
+		}
+		rm.sync(event)
+	}
+
+	go rm.watch(ch, cancelFunc)
+}
+
+func (rm *retainManager) watch(ch <-chan map[string]*string, closeFunc func()) {
+	defer closeFunc()
+	for {
+		select {
+		case <-rm.done:
+			return
+		case m := <-ch:
+			if m == nil {
+				go rm.connectWatcher()
+				return
+			}
+			rm.update(m)
+		}
+	}
+}
+
+// sync replaces the cache with retained messages in the storage.
+func (rm *retainManager) sync(event map[string]*string) {
+	rm.Lock()
+	rm.messages = make(map[string]*retainedMessage)
+	rm.Unlock()
+	rm.update(event)
+}
+
+func (rm *retainManager) update(event map[string]*string) {
+	prefix := retainStoreKey(rm.name, "")
+	rm.Lock()
+	defer rm.Unlock()
+	for k, v := range event {
+		topic := strings.TrimPrefix(k, prefix)
+		if v == nil {
+			delete(rm.messages, topic)
+			continue
+		}
+		msg := &Message{}
+		if err := codectool.UnmarshalJSON([]byte(*v), msg); err != nil {
+			logger.Warnf("ignored decode retained message %s failed: %v", *v, err)
+			continue
+		}
+		rm.messages[topic] = &retainedMessage{levels: strings.Split(topic, "/"), msg: msg}
+	}
+}
+
+// retain stores the message as the retained message of the topic, the
+// retained message of the topic is deleted if the payload is empty.
+func (rm *retainManager) retain(topic string, payload []byte, qos byte, props *packets5.Properties) error {
+	key := retainStoreKey(rm.name, topic)
+	if len(payload) == 0 {
+		rm.Lock()
+		delete(rm.messages, topic)
+		rm.Unlock()
+		return rm.store.delete(key)
+	}
+
+	msg := newMsg(topic, payload, qos, props)
+	data, err := codectool.MarshalJSON(msg)
+	if err != nil {
+		return err
+	}
+
+	rm.Lock()
+	if _, ok := rm.messages[topic]; !ok && len(rm.messages) >= rm.maxMessages {
+		rm.Unlock()
+		return fmt.Errorf("retained messages exceed the limit %d", rm.maxMessages)
+	}
+	rm.messages[topic] = &retainedMessage{levels: strings.Split(topic, "/"), msg: msg}
+	rm.Unlock()
+	return rm.store.put(key, string(data))
+}
+
+// match returns copies of the retained messages whose topics match the
+// topic filter.
+func (rm *retainManager) match(filter string) []*Message {
+	filterLevels, valid := splitTopic(filter)
+	if !valid {
+		return nil
+	}
+	// in MQTT version 3.1.1 section 4.7.1.2, "sport/#" also matches "sport".
+	var parentLevels []string
+	if n := len(filterLevels); n > 1 && filterLevels[n-1] == "#" {
+		parentLevels = filterLevels[:n-1]
+	}
+	wildcard := filterLevels[0] == "+" || filterLevels[0] == "#"
+
+	rm.RLock()
+	defer rm.RUnlock()
+	var msgs []*Message
+	for topic, m := range rm.messages {
+		// topics beginning with $ are not matched by wildcards of the first level.
+		if wildcard && strings.HasPrefix(topic, "$") {
+			continue
+		}
+		if isTopicMatch(m.levels, filterLevels) || (parentLevels != nil && isTopicMatch(m.levels, parentLevels)) {
+			msg := *m.msg
+			msgs = append(msgs, &msg)
+		}
+	}
+	return msgs
+}
+
+func (rm *retainManager) close() {
+	close(rm.done)
+}
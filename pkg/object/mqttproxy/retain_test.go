@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func retainedTopics(msgs []*Message) []string {
+	topics := []string{}
+	for _, m := range msgs {
+		topics = append(topics, m.Topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// matchEventually waits for the retained messages synced by the storage.
+func matchEventually(rm *retainManager, filter string, n int) []string {
+	var got []string
+	for i := 0; i < 100; i++ {
+		got = retainedTopics(rm.match(filter))
+		if len(got) == n {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return got
+}
+
+func TestRetainManager(t *testing.T) {
+	assert := assert.New(t)
+
+	store := newStorage(nil)
+	spec := &Spec{Name: "test", MaxRetainedMessages: 4}
+	rm := newRetainManager(spec, store)
+	defer rm.close()
+
+	for _, topic := range []string{"a", "a/b", "a/c/d", "$SYS/x"} {
+		assert.NoError(rm.retain(topic, []byte(topic), QoS1, nil))
+	}
+	assert.Error(rm.retain("e", []byte("e"), QoS1, nil))
+	// update of existing topic is not limited.
+	assert.NoError(rm.retain("a/b", []byte("new"), QoS2, nil))
+
+	assert.Equal([]string{"a/b"}, retainedTopics(rm.match("a/+")))
+	assert.Equal([]string{"a", "a/b", "a/c/d"}, retainedTopics(rm.match("a/#")))
+	assert.Equal([]string{"a", "a/b", "a/c/d"}, retainedTopics(rm.match("#")))
+	assert.Equal([]string{"$SYS/x"}, retainedTopics(rm.match("$SYS/#")))
+	assert.Equal([]string{"a/c/d"}, retainedTopics(rm.match("+/+/d")))
+	assert.Empty(rm.match("a/b/c"))
+	assert.Empty(rm.match("a/#/c"))
+
+	msgs := rm.match("a/b")
+	assert.Equal(1, len(msgs))
+	assert.Equal(int(QoS2), msgs[0].QoS)
+	assert.Equal("bmV3", msgs[0].B64Payload)
+
+	// match returns copies of retained messages.
+	msgs[0].QoS = int(QoS0)
+	assert.Equal(int(QoS2), rm.match("a/b")[0].QoS)
+
+	// retained messages are synced to other members by the storage.
+	rm2 := newRetainManager(spec, store)
+	defer rm2.close()
+	assert.Equal([]string{"a", "a/b", "a/c/d"}, matchEventually(rm2, "#", 3))
+
+	// empty payload deletes the retained message.
+	assert.NoError(rm.retain("a/b", nil, QoS1, nil))
+	assert.Equal([]string{"a", "a/c/d"}, retainedTopics(rm.match("#")))
+	assert.Equal([]string{"a", "a/c/d"}, matchEventually(rm2, "#", 2))
+}
@@ -23,6 +23,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	packets5 "github.com/eclipse/paho.golang/packets"
 	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/megaease/easegress/v2/pkg/logger"
 	"github.com/megaease/easegress/v2/pkg/util/codectool"
@@ -30,7 +31,13 @@ import (
 	"github.com/openzipkin/zipkin-go/model"
 )
 
-const defaultRetryInterval = 30 * time.Second
+const (
+	defaultRetryInterval = 30 * time.Second
+
+	// sessionNeverExpire is the session expiry interval of MQTT 5 sessions
+	// which never expire.
+	sessionNeverExpire = 0xFFFFFFFF
+)
 
 type (
 	// SessionInfo is info about session that will be put into etcd for persistency
@@ -41,6 +48,14 @@ type (
 		Topics    map[string]int `json:"topics"`
 		ClientID  string         `json:"clientID"`
 		CleanFlag bool           `json:"cleanFlag"`
+		// ExpiryInterval is the session expiry interval in seconds of MQTT 5
+		// sessions, and ExpireAt is the unix time when the session expires
+		// after the network connection closes.
+		ExpiryInterval uint32 `json:"expiryInterval,omitempty"`
+		ExpireAt       int64  `json:"expireAt,omitempty"`
+		// Received is the packet identifiers of QoS 2 messages received
+		// from the client but not released by PUBREL yet.
+		Received map[uint16]bool `json:"received,omitempty"`
 	}
 
 	// Session includes the information about the connect between client and broker,
@@ -54,28 +69,52 @@ type (
 		pending      map[uint16]*Message
 		pendingQueue []uint16
 		nextID       uint16
-		// retry Qos1 packet
+		// retry Qos1 and Qos2 packet
 		retryInterval time.Duration
 		refreshStore  atomic.Value
 	}
 
 	// Message is the message send from broker to client
 	Message struct {
-		Topic      string `json:"topic"`
-		B64Payload string `json:"b64Payload"`
-		QoS        int    `json:"qos"`
+		Topic          string         `json:"topic"`
+		B64Payload     string         `json:"b64Payload"`
+		QoS            int            `json:"qos"`
+		UserProperties []UserProperty `json:"userProperties,omitempty"`
+		props          *packets5.Properties
+		// released is true if the client has received the QoS 2 message,
+		// and PUBREL is waiting for PUBCOMP.
+		released bool
 	}
 )
 
-func newMsg(topic string, payload []byte, qos byte) *Message {
+func newMsg(topic string, payload []byte, qos byte, props *packets5.Properties) *Message {
 	m := &Message{
 		Topic:      topic,
 		B64Payload: base64.StdEncoding.EncodeToString(payload),
 		QoS:        int(qos),
+		props:      props,
+	}
+	if props != nil {
+		for _, u := range props.User {
+			m.UserProperties = append(m.UserProperties, UserProperty{Key: u.Key, Value: u.Value})
+		}
 	}
 	return m
 }
 
+// properties returns the MQTT 5 properties of the message, the properties
+// of messages decoded from JSON are built from their user properties.
+func (m *Message) properties() *packets5.Properties {
+	if m.props != nil || len(m.UserProperties) == 0 {
+		return m.props
+	}
+	props := &packets5.Properties{}
+	for _, u := range m.UserProperties {
+		props.User = append(props.User, packets5.User{Key: u.Key, Value: u.Value})
+	}
+	return props
+}
+
 func (s *Session) store() {
 	if swapped := s.refreshStore.CompareAndSwap(true, false); !swapped {
 		return
@@ -153,6 +192,39 @@ func (s *Session) updateEGName(egName, name string) {
 	s.Unlock()
 }
 
+// setExpiryInterval sets the session expiry interval of MQTT 5 clients,
+// the session with zero expiry interval ends when the connection closes.
+func (s *Session) setExpiryInterval(interval uint32) {
+	s.Lock()
+	s.info.CleanFlag = interval == 0
+	s.info.ExpiryInterval = interval
+	s.info.ExpireAt = 0
+	s.refreshStore.Store(true)
+	s.Unlock()
+}
+
+// startExpiry stores the expiry time of the session after the connection
+// closes, it returns false if the session never expires.
+func (s *Session) startExpiry() (time.Time, bool) {
+	s.Lock()
+	interval := s.info.ExpiryInterval
+	if interval == 0 || interval == sessionNeverExpire {
+		s.Unlock()
+		return time.Time{}, false
+	}
+	expireAt := time.Now().Add(time.Duration(interval) * time.Second)
+	s.info.ExpireAt = expireAt.Unix()
+	s.refreshStore.Store(true)
+	s.Unlock()
+
+	s.store()
+	return expireAt, true
+}
+
+func (s *Session) expired() bool {
+	return s.info.ExpireAt != 0 && time.Now().Unix() >= s.info.ExpireAt
+}
+
 func (s *Session) subscribe(topics []string, qoss []byte) error {
 	logger.SpanDebugf(nil, "session %s sub %v", s.info.ClientID, topics)
 	s.Lock()
@@ -190,37 +262,85 @@ func (s *Session) allSubscribes() ([]string, []byte, error) {
 	return sub, qos, nil
 }
 
+// nextMessageID returns the next packet identifier which is not used by
+// pending messages, the caller must hold the lock.
+func (s *Session) nextMessageID() uint16 {
+	for i := 0; i < 65535; i++ {
+		// the overflow is okay here, and 0 is not a valid packet identifier.
+		s.nextID++
+		if s.nextID == 0 {
+			s.nextID++
+		}
+		if _, ok := s.pending[s.nextID]; !ok {
+			break
+		}
+	}
+	return s.nextID
+}
+
 func (s *Session) getPacketFromMsg(topic string, payload []byte, qos byte) *packets.PublishPacket {
 	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
 	p.Qos = qos
 	p.TopicName = topic
 	p.Payload = payload
-	p.MessageID = s.nextID
-	// the overflow is okay here
-	// the session will give unique id from 0 to 65535 and do this again and again
-	s.nextID++
+	if qos > QoS0 {
+		p.MessageID = s.nextMessageID()
+	}
 	return p
 }
 
-func (s *Session) publish(span *model.SpanContext, client *Client, topic string, payload []byte, qos byte) {
+// addPending adds the message to pending messages which wait for the
+// acknowledgement of the client, the caller must hold the lock.
+func (s *Session) addPending(id uint16, msg *Message) {
+	s.pending[id] = msg
+	s.pendingQueue = append(s.pendingQueue, id)
+}
+
+func (s *Session) publish(span *model.SpanContext, client *Client, topic string, payload []byte, qos byte, props *packets5.Properties) {
 	p := func() packets.ControlPacket {
 		s.Lock()
 		defer s.Unlock()
 		logger.SpanDebugf(span, "session %v publish %v", s.info.ClientID, topic)
 		p := s.getPacketFromMsg(topic, payload, qos)
-		if qos == QoS1 {
-			msg := newMsg(topic, payload, qos)
-			s.pending[p.MessageID] = msg
-			s.pendingQueue = append(s.pendingQueue, p.MessageID)
+		if qos > QoS0 {
+			s.addPending(p.MessageID, newMsg(topic, payload, qos, props))
 		}
 		return p
 	}()
+	client.writePacketWithProperties(p, props)
+}
 
-	if qos == QoS2 {
-		logger.SpanErrorf(span, "publish message with qos=2 is not supported currently")
-		return
+// publishMessages publishes the messages queued when the client was
+// offline, or the retained messages matching new subscriptions. Unlike
+// publish, it waits for the write channel of the client, so that no
+// message is dropped by a burst.
+func (s *Session) publishMessages(client *Client, msgs []*Message, retain bool) {
+	pkts := make([]*packets.PublishPacket, 0, len(msgs))
+	props := make([]*packets5.Properties, 0, len(msgs))
+	s.Lock()
+	for _, msg := range msgs {
+		payload, err := base64.StdEncoding.DecodeString(msg.B64Payload)
+		if err != nil {
+			logger.Errorf("client:%s, base64 decode error for Message B64Payload %s ", s.info.ClientID, err)
+			continue
+		}
+		p := s.getPacketFromMsg(msg.Topic, payload, byte(msg.QoS))
+		p.Retain = retain
+		if p.Qos > QoS0 {
+			m := *msg
+			m.released = false
+			s.addPending(p.MessageID, &m)
+		}
+		pkts = append(pkts, p)
+		props = append(props, msg.properties())
+	}
+	s.Unlock()
+
+	for i, p := range pkts {
+		if !client.writePacketWait(p, props[i]) {
+			return
+		}
 	}
-	client.writePacket(p)
 }
 
 func (s *Session) puback(p *packets.PubackPacket) {
@@ -229,6 +349,76 @@ func (s *Session) puback(p *packets.PubackPacket) {
 	s.Unlock()
 }
 
+// pubrec marks the QoS 2 message as received by the client, the message
+// is not resent any more, but PUBREL is resent until PUBCOMP arrives.
+func (s *Session) pubrec(p *packets.PubrecPacket) {
+	s.Lock()
+	if msg, ok := s.pending[p.MessageID]; ok {
+		msg.released = true
+	}
+	s.Unlock()
+}
+
+func (s *Session) pubcomp(p *packets.PubcompPacket) {
+	s.Lock()
+	delete(s.pending, p.MessageID)
+	s.Unlock()
+}
+
+// receiveQoS2 records the packet identifier of the QoS 2 message from the
+// client, it returns false if the message has been received before.
+func (s *Session) receiveQoS2(id uint16) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.info.Received[id] {
+		return false
+	}
+	if s.info.Received == nil {
+		s.info.Received = make(map[uint16]bool)
+	}
+	s.info.Received[id] = true
+	s.refreshStore.Store(true)
+	return true
+}
+
+// receivedQoS2 returns true if the QoS 2 message from the client has been
+// received and not released yet.
+func (s *Session) receivedQoS2(id uint16) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.info.Received[id]
+}
+
+// releaseQoS2 removes the packet identifier of the QoS 2 message released
+// by the client, so that it can be reused by the client.
+func (s *Session) releaseQoS2(id uint16) {
+	s.Lock()
+	defer s.Unlock()
+	if !s.info.Received[id] {
+		return
+	}
+	delete(s.info.Received, id)
+	s.refreshStore.Store(true)
+}
+
+// pendingMessages returns the messages which are not received by the
+// client yet, in the order they were published.
+func (s *Session) pendingMessages() []*Message {
+	s.Lock()
+	defer s.Unlock()
+	var msgs []*Message
+	seen := make(map[uint16]bool)
+	for _, id := range s.pendingQueue {
+		msg, ok := s.pending[id]
+		if !ok || seen[id] || msg.released {
+			continue
+		}
+		seen[id] = true
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
 func (s *Session) cleanSession() bool {
 	return s.info.CleanFlag
 }
@@ -239,7 +429,7 @@ func (s *Session) close() {
 
 func (s *Session) doResend() {
 	client := s.broker.getClient(s.info.ClientID)
-	msg, messageID := func() (msg *Message, messageID uint16) {
+	msg, messageID, released := func() (msg *Message, messageID uint16, released bool) {
 		s.Lock()
 		defer s.Unlock()
 		if len(s.pending) == 0 {
@@ -252,6 +442,7 @@ func (s *Session) doResend() {
 				s.pendingQueue = s.pendingQueue[i:]
 				msg = val
 				messageID = idx
+				released = val.released
 				break
 			}
 		}
@@ -262,6 +453,18 @@ func (s *Session) doResend() {
 		return
 	}
 
+	if client == nil {
+		logger.Warnf("client %v do resend but client is nil, ignored", s.info.ClientID)
+		return
+	}
+
+	if released {
+		pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+		pubrel.MessageID = messageID
+		client.writePacket(pubrel)
+		return
+	}
+
 	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
 	p.Qos = byte(msg.QoS)
 	p.TopicName = msg.Topic
@@ -272,11 +475,8 @@ func (s *Session) doResend() {
 	}
 	p.Payload = payload
 	p.MessageID = messageID
-	if client != nil {
-		client.writePacket(p)
-	} else {
-		logger.Warnf("client %v do resend but client is nil, ignored", s.info.ClientID)
-	}
+	p.Dup = true
+	client.writePacketWithProperties(p, msg.properties())
 }
 
 // backgroundSessionTask process two tasks peroidly:
@@ -22,6 +22,7 @@ import (
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
 )
 
 type (
@@ -107,12 +108,32 @@ func (sm *SessionManager) get(clientID string) *Session {
 	}
 
 	sess := sm.newSessionFromJSON(str)
+	if sess != nil && sess.expired() {
+		sess.close()
+		sm.delDB(clientID)
+		return nil
+	}
 	if sess != nil {
 		sm.sessionMap.Store(sess.info.ClientID, sess)
 	}
 	return sess
 }
 
+// delExpired deletes the session expired at expireAt from the store,
+// unless the session is resumed after that.
+func (sm *SessionManager) delExpired(clientID string, expireAt int64) {
+	str, err := sm.store.get(sessionStoreKey(clientID))
+	if err != nil || str == nil {
+		return
+	}
+	info := &SessionInfo{}
+	if err := codectool.UnmarshalJSON([]byte(*str), info); err != nil || info.ExpireAt != expireAt {
+		return
+	}
+	logger.SpanDebugf(nil, "session %v expired", clientID)
+	sm.delDB(clientID)
+}
+
 func (sm *SessionManager) delLocal(clientID string) bool {
 	if val, ok := sm.sessionMap.LoadAndDelete(clientID); ok {
 		sess := val.(*Session)
@@ -53,7 +53,7 @@ func TestSessionDoResend(t *testing.T) {
 
 	// publish packet and recevie it
 	go func() {
-		sess.publish(nil, client, "topic1", []byte("payload1"), 1)
+		sess.publish(nil, client, "topic1", []byte("payload1"), 1, nil)
 	}()
 	p, err := packets.ReadPacket(testConn)
 	assert.Nil(err)
@@ -74,3 +74,89 @@ func TestSessionDoResend(t *testing.T) {
 	assert.Equal("topic1", pub.TopicName)
 	assert.Equal([]byte("payload1"), pub.Payload)
 }
+
+func TestSessionExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	mapper := &mockMuxMapper{}
+	broker := getDefaultBroker(mapper)
+	defer broker.close()
+
+	connect := &packets.ConnectPacket{ClientIdentifier: "client5", ProtocolVersion: mqtt5}
+	clientConn, _ := net.Pipe()
+	client := newClient(connect, broker, clientConn, nil)
+	client.info.sessionExpiry = 60
+	broker.setSession(client, connect)
+	sess := client.session
+	assert.False(sess.cleanSession())
+
+	expireAt, ok := sess.startExpiry()
+	assert.True(ok)
+	assert.False(sess.expired())
+	assert.Equal(expireAt.Unix(), sess.info.ExpireAt)
+
+	// the session is not deleted if it is resumed.
+	str, err := sess.encode()
+	assert.NoError(err)
+	assert.NoError(broker.sessMgr.store.put(sessionStoreKey("client5"), str))
+	broker.sessMgr.delExpired("client5", expireAt.Unix()-1)
+	value, _ := broker.sessMgr.store.get(sessionStoreKey("client5"))
+	assert.NotNil(value)
+	broker.sessMgr.delExpired("client5", expireAt.Unix())
+	value, _ = broker.sessMgr.store.get(sessionStoreKey("client5"))
+	assert.Nil(value)
+
+	sess.setExpiryInterval(0)
+	assert.True(sess.cleanSession())
+	_, ok = sess.startExpiry()
+	assert.False(ok)
+	sess.setExpiryInterval(sessionNeverExpire)
+	_, ok = sess.startExpiry()
+	assert.False(ok)
+}
+
+func TestSessionQoS2(t *testing.T) {
+	assert := assert.New(t)
+
+	mapper := &mockMuxMapper{}
+	broker := getDefaultBroker(mapper)
+	defer broker.close()
+
+	connect := &packets.ConnectPacket{ClientIdentifier: "client2"}
+	clientConn, testConn := net.Pipe()
+	client := newClient(connect, broker, clientConn, nil)
+	go client.writeLoop()
+	broker.Lock()
+	broker.clients[connect.ClientIdentifier] = client
+	broker.Unlock()
+	broker.setSession(client, connect)
+	sess := client.session
+
+	// outbound: PUBLISH, PUBREC, PUBREL, PUBCOMP.
+	go sess.publish(nil, client, "topic2", []byte("payload2"), QoS2, nil)
+	p, err := packets.ReadPacket(testConn)
+	assert.Nil(err)
+	pub := p.(*packets.PublishPacket)
+	assert.Equal(QoS2, pub.Qos)
+	assert.NotEqual(uint16(0), pub.MessageID)
+
+	sess.pubrec(&packets.PubrecPacket{MessageID: pub.MessageID})
+	assert.Empty(sess.pendingMessages())
+	// PUBREL is resent instead of PUBLISH after PUBREC.
+	go sess.doResend()
+	p, err = packets.ReadPacket(testConn)
+	assert.Nil(err)
+	assert.Equal(pub.MessageID, p.(*packets.PubrelPacket).MessageID)
+	sess.pubcomp(&packets.PubcompPacket{MessageID: pub.MessageID})
+	sess.Lock()
+	assert.Empty(sess.pending)
+	sess.Unlock()
+
+	// inbound: duplicated messages are detected until PUBREL.
+	assert.True(sess.receiveQoS2(1))
+	assert.False(sess.receiveQoS2(1))
+	assert.True(sess.receivedQoS2(1))
+	sess.releaseQoS2(1)
+	assert.False(sess.receivedQoS2(1))
+	assert.True(sess.receiveQoS2(1))
+}
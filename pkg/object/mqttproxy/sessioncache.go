@@ -116,10 +116,13 @@ func (c *sessionCacheManager) processSingleUpdate(clientID string, session *Sess
 		return
 	}
 
+	// the session moves from the current broker to another one, topics of
+	// the session may have been unsubscribed when its client disconnected.
+	moved := oldSession.EGName == c.egName
 	subTopics := []string{}
 	subQoss := []byte{}
 	for k, v := range session.Topics {
-		if _, ok := oldSession.Topics[k]; !ok {
+		if _, ok := oldSession.Topics[k]; !ok || moved {
 			subTopics = append(subTopics, k)
 			subQoss = append(subQoss, byte(v))
 		}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const sharedSubscriptionPrefix = "$share/"
+
+type (
+	// sharedTopicManager wraps a TopicManager to support MQTT 5 shared
+	// subscriptions. A shared subscription "$share/{group}/{filter}" is
+	// subscribed to the wrapped manager by a virtual client whose ID is
+	// the shared subscription itself, and the messages of the virtual
+	// client are delivered to the members of the group in turn.
+	sharedTopicManager struct {
+		TopicManager
+
+		sync.Mutex
+		groups map[string]*sharedGroup
+	}
+
+	sharedGroup struct {
+		members map[string]byte
+		// clients is the sorted client IDs of members.
+		clients []string
+		next    int
+	}
+)
+
+var _ TopicManager = (*sharedTopicManager)(nil)
+
+func newSharedTopicManager(mgr TopicManager) *sharedTopicManager {
+	return &sharedTopicManager{
+		TopicManager: mgr,
+		groups:       make(map[string]*sharedGroup),
+	}
+}
+
+func isSharedSubscription(topic string) bool {
+	return strings.HasPrefix(topic, sharedSubscriptionPrefix)
+}
+
+// parseSharedSubscription returns the topic filter of shared subscription.
+func parseSharedSubscription(topic string) (string, error) {
+	group, filter, found := strings.Cut(strings.TrimPrefix(topic, sharedSubscriptionPrefix), "/")
+	if !found || group == "" || filter == "" || strings.ContainsAny(group, "+#") {
+		return "", fmt.Errorf("shared subscription %v is invalid", topic)
+	}
+	return filter, nil
+}
+
+func splitSharedTopics(topics []string) (normal []string, shared []string) {
+	for _, t := range topics {
+		if isSharedSubscription(t) {
+			shared = append(shared, t)
+		} else {
+			normal = append(normal, t)
+		}
+	}
+	return normal, shared
+}
+
+func (mgr *sharedTopicManager) subscribe(topics []string, qoss []byte, clientID string) error {
+	var normalTopics, sharedTopics []string
+	var normalQoss, sharedQoss []byte
+	for i, t := range topics {
+		if !isSharedSubscription(t) {
+			normalTopics = append(normalTopics, t)
+			normalQoss = append(normalQoss, qoss[i])
+			continue
+		}
+		if _, err := parseSharedSubscription(t); err != nil {
+			return err
+		}
+		sharedTopics = append(sharedTopics, t)
+		sharedQoss = append(sharedQoss, qoss[i])
+	}
+
+	if len(normalTopics) > 0 {
+		if err := mgr.TopicManager.subscribe(normalTopics, normalQoss, clientID); err != nil {
+			return err
+		}
+	}
+
+	mgr.Lock()
+	defer mgr.Unlock()
+	for i, t := range sharedTopics {
+		group, ok := mgr.groups[t]
+		if !ok {
+			filter, _ := parseSharedSubscription(t)
+			// the QoS of members are checked when delivering messages.
+			if err := mgr.TopicManager.subscribe([]string{filter}, []byte{QoS2}, t); err != nil {
+				return err
+			}
+			group = &sharedGroup{members: make(map[string]byte)}
+			mgr.groups[t] = group
+		}
+		group.members[clientID] = sharedQoss[i]
+		group.updateClients()
+	}
+	return nil
+}
+
+func (mgr *sharedTopicManager) unsubscribe(topics []string, clientID string) error {
+	normalTopics, sharedTopics := splitSharedTopics(topics)
+	mgr.leave(sharedTopics, clientID)
+	if len(normalTopics) == 0 {
+		return nil
+	}
+	return mgr.TopicManager.unsubscribe(normalTopics, clientID)
+}
+
+func (mgr *sharedTopicManager) disconnect(topics []string, clientID string) error {
+	normalTopics, sharedTopics := splitSharedTopics(topics)
+	mgr.leave(sharedTopics, clientID)
+	return mgr.TopicManager.disconnect(normalTopics, clientID)
+}
+
+// leave removes the client from shared subscriptions, and unsubscribes
+// the shared subscriptions without members.
+func (mgr *sharedTopicManager) leave(topics []string, clientID string) {
+	mgr.Lock()
+	defer mgr.Unlock()
+	for _, t := range topics {
+		group, ok := mgr.groups[t]
+		if !ok {
+			continue
+		}
+		delete(group.members, clientID)
+		group.updateClients()
+		if len(group.members) == 0 {
+			delete(mgr.groups, t)
+			filter, _ := parseSharedSubscription(t)
+			mgr.TopicManager.unsubscribe([]string{filter}, t)
+		}
+	}
+}
+
+func (mgr *sharedTopicManager) findSubscribers(topic string) (map[string]byte, error) {
+	subscribers, err := mgr.TopicManager.findSubscribers(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	mgr.Lock()
+	defer mgr.Unlock()
+	for clientID := range subscribers {
+		if !isSharedSubscription(clientID) {
+			continue
+		}
+		delete(subscribers, clientID)
+		group, ok := mgr.groups[clientID]
+		if !ok {
+			continue
+		}
+		member, qos := group.pick()
+		if old, ok := subscribers[member]; !ok || old < qos {
+			subscribers[member] = qos
+		}
+	}
+	return subscribers, nil
+}
+
+func (g *sharedGroup) updateClients() {
+	g.clients = g.clients[:0]
+	for clientID := range g.members {
+		g.clients = append(g.clients, clientID)
+	}
+	sort.Strings(g.clients)
+}
+
+// pick picks members of the group in turn.
+func (g *sharedGroup) pick() (string, byte) {
+	g.next = g.next % len(g.clients)
+	clientID := g.clients[g.next]
+	g.next++
+	return clientID, g.members[clientID]
+}
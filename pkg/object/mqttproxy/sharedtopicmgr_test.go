@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharedTopicManager(t *testing.T) {
+	assert := assert.New(t)
+
+	mgr := newSharedTopicManager(newNoCacheTopicManager(100))
+	assert.NoError(mgr.subscribe([]string{"$share/g1/a/+", "a/b"}, []byte{1, 0}, "c1"))
+	assert.NoError(mgr.subscribe([]string{"$share/g1/a/+"}, []byte{1}, "c2"))
+	assert.NoError(mgr.subscribe([]string{"$share/g2/a/#"}, []byte{0}, "c3"))
+
+	// c1 subscribes a/b directly and in group g1, it gets the higher qos.
+	got, err := mgr.findSubscribers("a/b")
+	assert.NoError(err)
+	assert.Equal(map[string]byte{"c1": 1, "c3": 0}, got)
+	got, err = mgr.findSubscribers("a/b")
+	assert.NoError(err)
+	assert.Equal(map[string]byte{"c1": 0, "c2": 1, "c3": 0}, got)
+
+	got, _ = mgr.findSubscribers("a/c/d")
+	assert.Equal(map[string]byte{"c3": 0}, got)
+
+	assert.NoError(mgr.unsubscribe([]string{"$share/g1/a/+"}, "c1"))
+	for i := 0; i < 2; i++ {
+		got, _ = mgr.findSubscribers("a/c")
+		assert.Equal(map[string]byte{"c2": 1, "c3": 0}, got)
+	}
+
+	assert.NoError(mgr.disconnect([]string{"$share/g1/a/+"}, "c2"))
+	assert.NoError(mgr.disconnect([]string{"$share/g2/a/#"}, "c3"))
+	got, _ = mgr.findSubscribers("a/c")
+	assert.Empty(got)
+	assert.Empty(mgr.groups)
+
+	for _, topic := range []string{"$share/g1", "$share//a", "$share/g+/a"} {
+		assert.Error(mgr.subscribe([]string{topic}, []byte{0}, "c1"), topic)
+	}
+}
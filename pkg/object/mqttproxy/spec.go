@@ -20,14 +20,26 @@ package mqttproxy
 import (
 	"crypto/tls"
 	"fmt"
+	"net/url"
 )
 
 const (
 	sessionPrefix              = "/mqtt/sessionMgr/clientID/%s"
 	topicPrefix                = "/mqtt/topicMgr/topic/%s"
+	retainPrefix               = "/mqtt/retainMgr/%s/topic/"
+	offlinePrefix              = "/mqtt/offlineMgr/%s/clientID/%s/"
 	mqttAPITopicPublishPrefix  = "/mqttproxy/%s/topics/publish"
 	mqttAPISessionQueryPrefix  = "/mqttproxy/%s/session/query"
 	mqttAPISessionDeletePrefix = "/mqttproxy/%s/sessions"
+
+	defaultTopicAliasMaximum = 100
+
+	defaultMaxRetainedMessages = 10000
+	defaultMaxOfflineMessages  = 1000
+	// every offline message is stored in one key of the cluster storage,
+	// so it must be under the etcd request limit (1.5MiB by default) after
+	// the base64 and JSON encoding.
+	defaultMaxOfflineBytes = 1024 * 1024
 )
 
 // PacketType is mqtt packet type
@@ -72,8 +84,21 @@ type (
 		ClientPublishLimit   *RateLimit    `json:"clientPublishLimit,omitempty"`
 		Rules                []*Rule       `json:"rules,omitempty"`
 		BrokerMode           bool          `json:"brokerMode,omitempty"`
+		// TopicAliasMaximum is the max topic alias of MQTT 5 clients,
+		// default is 100.
+		TopicAliasMaximum uint16 `json:"topicAliasMaximum,omitempty"`
 		// unit is second, default is 30s
 		RetryInterval int `yaml:"retryInterval,omitempty"`
+		// MaxRetainedMessages is the max number of retained messages in
+		// broker mode, default is 10000.
+		MaxRetainedMessages int `json:"maxRetainedMessages,omitempty"`
+		// MaxOfflineMessages is the max number of messages queued for an
+		// offline client with persistent session in broker mode, the
+		// oldest messages are dropped when it is exceeded, default is 1000.
+		MaxOfflineMessages int `json:"maxOfflineMessages,omitempty"`
+		// MaxOfflineBytes is the max total payload size of messages queued
+		// for an offline client, default is 1048576.
+		MaxOfflineBytes int `json:"maxOfflineBytes,omitempty"`
 	}
 
 	// Rule used to route MQTT packets to different pipelines
@@ -125,3 +150,19 @@ func (spec *Spec) tlsConfig() (*tls.Config, error) {
 func sessionStoreKey(clientID string) string {
 	return fmt.Sprintf(sessionPrefix, clientID)
 }
+
+func retainStoreKey(name, topic string) string {
+	return fmt.Sprintf(retainPrefix, name) + topic
+}
+
+// offlineStoreKey returns the prefix of the offline messages of the client,
+// the client ID is escaped, so that it is not a prefix of other client IDs.
+func offlineStoreKey(name, clientID string) string {
+	return fmt.Sprintf(offlinePrefix, name, url.PathEscape(clientID))
+}
+
+// offlineMessageKey returns the key of the offline message of the client,
+// the sequence is padded, so that the keys are sorted in order.
+func offlineMessageKey(name, clientID string, seq uint64) string {
+	return offlineStoreKey(name, clientID) + fmt.Sprintf("%020d", seq)
+}
@@ -20,7 +20,6 @@ package mqttproxy
 import (
 	"strings"
 	"sync"
-	"sync/atomic"
 
 	"github.com/megaease/easegress/v2/pkg/cluster"
 	etcderror "go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
@@ -32,14 +31,15 @@ type (
 		getPrefix(prefix string, keysOnly bool) (map[string]string, error)
 		put(key, value string) error
 		delete(key string) error
+		deletePrefix(prefix string) error
 		watch(prefix string) (<-chan map[string]*string, func(), error)
 	}
 
 	mockStorage struct {
-		mu        sync.RWMutex
-		store     map[string]string
-		watchCh   chan map[string]*string
-		watchFlag int32
+		mu    sync.RWMutex
+		store map[string]string
+		// watchers maps watch channels to their prefixes.
+		watchers map[chan map[string]*string]string
 	}
 
 	clusterStorage struct {
@@ -57,8 +57,8 @@ func newStorage(cls cluster.Cluster) storage {
 		}
 	}
 	return &mockStorage{
-		store:   make(map[string]string),
-		watchCh: make(chan map[string]*string),
+		store:    make(map[string]string),
+		watchers: make(map[chan map[string]*string]string),
 	}
 }
 
@@ -90,13 +90,7 @@ func (m *mockStorage) getPrefix(prefix string, keysOnly bool) (map[string]string
 func (m *mockStorage) put(key, value string) error {
 	m.mu.Lock()
 	m.store[key] = value
-	if m.watched() {
-		go func() {
-			res := make(map[string]*string)
-			res[key] = &value
-			m.watchCh <- res
-		}()
-	}
+	m.notify(key, &value)
 	m.mu.Unlock()
 	return nil
 }
@@ -104,24 +98,53 @@ func (m *mockStorage) put(key, value string) error {
 func (m *mockStorage) delete(key string) error {
 	m.mu.Lock()
 	delete(m.store, key)
-	if m.watched() {
-		go func() {
-			ans := make(map[string]*string)
-			ans[key] = nil
-			m.watchCh <- ans
-		}()
+	m.notify(key, nil)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *mockStorage) deletePrefix(prefix string) error {
+	m.mu.Lock()
+	for k := range m.store {
+		if strings.HasPrefix(k, prefix) {
+			delete(m.store, k)
+			m.notify(k, nil)
+		}
 	}
 	m.mu.Unlock()
 	return nil
 }
 
+// notify sends the change of key to watchers of its prefixes, the caller
+// must hold the lock.
+func (m *mockStorage) notify(key string, value *string) {
+	for ch, prefix := range m.watchers {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		go func(ch chan map[string]*string) {
+			ch <- map[string]*string{key: value}
+		}(ch)
+	}
+}
+
 func (m *mockStorage) watched() bool {
-	return atomic.LoadInt32(&m.watchFlag) != 0
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.watchers) != 0
 }
 
 func (m *mockStorage) watch(prefix string) (<-chan map[string]*string, func(), error) {
-	atomic.StoreInt32(&m.watchFlag, 1)
-	return m.watchCh, func() {}, nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch := make(chan map[string]*string)
+	m.watchers[ch] = prefix
+	cancel := func() {
+		m.mu.Lock()
+		delete(m.watchers, ch)
+		m.mu.Unlock()
+	}
+	return ch, cancel, nil
 }
 
 func (cs *clusterStorage) get(key string) (*string, error) {
@@ -143,6 +166,10 @@ func (cs *clusterStorage) delete(key string) error {
 	return cs.cls.Delete(key)
 }
 
+func (cs *clusterStorage) deletePrefix(prefix string) error {
+	return cs.cls.DeletePrefix(prefix)
+}
+
 func (cs *clusterStorage) watch(prefix string) (<-chan map[string]*string, func(), error) {
 	watcher, err := cs.cls.Watcher()
 	if err != nil {
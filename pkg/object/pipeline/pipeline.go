@@ -313,9 +313,11 @@ func (p *Pipeline) getFilter(name string) filters.Filter {
 // HandleWithBeforeAfterOption is the option of HandleWithBeforeAfter.
 // FallthroughBefore: if true, the pipeline will be executed even if the before pipeline ends.
 // FallthroughPipeline: if true, the after pipeline will be executed even if the pipeline ends.
+// OnPipeline: if not nil, it is called right before the pipeline is executed.
 type HandleWithBeforeAfterOption struct {
 	FallthroughBefore   bool
 	FallthroughPipeline bool
+	OnPipeline          func()
 }
 
 // HandleWithBeforeAfter handles the request, with additional flow defined by
@@ -340,6 +342,9 @@ func (p *Pipeline) HandleWithBeforeAfter(ctx *context.Context, before, after *Pi
 	}
 
 	if !sawEnd || option.FallthroughBefore {
+		if option.OnPipeline != nil {
+			option.OnPipeline()
+		}
 		result, stats, sawEnd = p.doHandle(ctx, p.flow, stats)
 	}
 
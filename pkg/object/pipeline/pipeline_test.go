@@ -465,9 +465,13 @@ filters:
 	after.Init(spec, nil)
 	defer after.Close()
 
+	onPipeline := 0
+	option := HandleWithBeforeAfterOption{OnPipeline: func() { onPipeline++ }}
+
 	ctx = context.New(tracing.NoopSpan)
 	ctx.SetRequest(context.DefaultNamespace, req)
-	pipeline.HandleWithBeforeAfter(ctx, nil, after, HandleWithBeforeAfterOption{})
+	pipeline.HandleWithBeforeAfter(ctx, nil, after, option)
+	assert.Equal(1, onPipeline)
 	tags = ctx.Tags()
 	assert.NotContains(tags, "filter1")
 	assert.Contains(tags, "filter2")
@@ -492,7 +496,8 @@ filters:
 
 	ctx = context.New(tracing.NoopSpan)
 	ctx.SetRequest(context.DefaultNamespace, req)
-	pipeline.HandleWithBeforeAfter(ctx, before, after, HandleWithBeforeAfterOption{})
+	pipeline.HandleWithBeforeAfter(ctx, before, after, option)
+	assert.Equal(1, onPipeline)
 	tags = ctx.Tags()
 	assert.Contains(tags, "filter1")
 	assert.NotContains(tags, "filter2")
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttprot
+
+import (
+	"fmt"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+	"github.com/megaease/easegress/v2/pkg/protocols"
+)
+
+// Header wraps the user properties of MQTT 5 packets, a key could have
+// multiple values and the order of the properties is kept.
+type Header struct {
+	props *packets5.Properties
+}
+
+var _ protocols.Header = (*Header)(nil)
+
+// NewHeader returns a new Header of the user properties in props,
+// modifications to the Header are applied to props.
+func NewHeader(props *packets5.Properties) *Header {
+	return &Header{props: props}
+}
+
+func toStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	default:
+		panic(fmt.Sprintf("mqtt user property value type %T is not string or []string", value))
+	}
+}
+
+// Add adds the key value pair to the header.
+func (h *Header) Add(key string, value interface{}) {
+	for _, v := range toStrings(value) {
+		h.props.User = append(h.props.User, packets5.User{Key: key, Value: v})
+	}
+}
+
+// Set sets the header entries associated with key to value.
+func (h *Header) Set(key string, value interface{}) {
+	h.Del(key)
+	h.Add(key, value)
+}
+
+// Get gets the first value associated with the given key.
+func (h *Header) Get(key string) interface{} {
+	for _, u := range h.props.User {
+		if u.Key == key {
+			return u.Value
+		}
+	}
+	return ""
+}
+
+// GetAll gets all values associated with the given key.
+func (h *Header) GetAll(key string) []string {
+	var values []string
+	for _, u := range h.props.User {
+		if u.Key == key {
+			values = append(values, u.Value)
+		}
+	}
+	return values
+}
+
+// Del deletes the values associated with key.
+func (h *Header) Del(key string) {
+	var user []packets5.User
+	for _, u := range h.props.User {
+		if u.Key != key {
+			user = append(user, u)
+		}
+	}
+	h.props.User = user
+}
+
+// Walk calls fn for each key value pair of the header.
+func (h *Header) Walk(fn func(key string, value interface{}) bool) {
+	for _, u := range h.props.User {
+		if !fn(u.Key, u.Value) {
+			break
+		}
+	}
+}
+
+// Clone returns a copy of h.
+func (h *Header) Clone() protocols.Header {
+	user := make([]packets5.User, len(h.props.User))
+	copy(user, h.props.User)
+	return &Header{props: &packets5.Properties{User: user}}
+}
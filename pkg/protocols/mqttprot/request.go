@@ -23,6 +23,7 @@ import (
 
 	"github.com/megaease/easegress/v2/pkg/protocols"
 
+	packets5 "github.com/eclipse/paho.golang/packets"
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
@@ -33,6 +34,8 @@ type (
 		packet     packets.ControlPacket
 		packetType PacketType
 		payload    []byte
+		props      *packets5.Properties
+		header     *Header
 	}
 
 	// Client contains MQTT client info that send this packet
@@ -72,9 +75,20 @@ var _ protocols.Request = (*Request)(nil)
 
 // NewRequest create new MQTT Request
 func NewRequest(packet packets.ControlPacket, client Client) *Request {
+	return NewRequestWithProperties(packet, client, nil)
+}
+
+// NewRequestWithProperties create new MQTT Request with the MQTT 5
+// properties of the packet, props is nil for MQTT 3.1.1 packets.
+func NewRequestWithProperties(packet packets.ControlPacket, client Client, props *packets5.Properties) *Request {
+	if props == nil {
+		props = &packets5.Properties{}
+	}
 	req := &Request{
 		client: client,
 		packet: packet,
+		props:  props,
+		header: NewHeader(props),
 	}
 	switch p := packet.(type) {
 	case *packets.ConnectPacket:
@@ -134,10 +148,16 @@ func (r *Request) UnsubscribePacket() *packets.UnsubscribePacket {
 	return r.packet.(*packets.UnsubscribePacket)
 }
 
-// Header return MQTT request header
+// Properties return the MQTT 5 properties of the packet, the properties
+// are empty for MQTT 3.1.1 packets.
+func (r *Request) Properties() *packets5.Properties {
+	return r.props
+}
+
+// Header return MQTT request header, which is the user properties of
+// MQTT 5 packets.
 func (r *Request) Header() protocols.Header {
-	// TODO: what header to return?
-	return nil
+	return r.header
 }
 
 // RealIP returns the real IP of the request.
@@ -37,6 +37,7 @@ import (
 	_ "github.com/megaease/easegress/v2/pkg/filters/proxies/grpcproxy"
 	_ "github.com/megaease/easegress/v2/pkg/filters/proxies/httpproxy"
 	_ "github.com/megaease/easegress/v2/pkg/filters/proxies/providerproxy"
+	_ "github.com/megaease/easegress/v2/pkg/filters/proxies/providerproxy/mockprovider"
 	_ "github.com/megaease/easegress/v2/pkg/filters/ratelimiter"
 	_ "github.com/megaease/easegress/v2/pkg/filters/redirector"
 	_ "github.com/megaease/easegress/v2/pkg/filters/remotefilter"
@@ -56,6 +57,7 @@ import (
 	_ "github.com/megaease/easegress/v2/pkg/object/grpcserver"
 	_ "github.com/megaease/easegress/v2/pkg/object/httpserver"
 	_ "github.com/megaease/easegress/v2/pkg/object/ingresscontroller"
+	_ "github.com/megaease/easegress/v2/pkg/object/kafkaconsumer"
 	_ "github.com/megaease/easegress/v2/pkg/object/meshcontroller"
 	_ "github.com/megaease/easegress/v2/pkg/object/mock"
 	_ "github.com/megaease/easegress/v2/pkg/object/mqttproxy"
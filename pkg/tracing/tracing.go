@@ -555,8 +555,18 @@ func (s *Span) NewChildWithStart(name string, startAt time.Time) *Span {
 	return s.newChildWithStart(name, startAt)
 }
 
-func (s *Span) newChildWithStart(name string, startAt time.Time) *Span {
-	ctx, child := s.tracer.Start(s.ctx, name, trace.WithTimestamp(startAt))
+// NewClientChild creates a new child span of client kind, which describes
+// a request to a remote service.
+func (s *Span) NewClientChild(name string) *Span {
+	if s.IsNoop() {
+		return s
+	}
+	return s.newChildWithStart(name, fasttime.Now(), trace.WithSpanKind(trace.SpanKindClient))
+}
+
+func (s *Span) newChildWithStart(name string, startAt time.Time, opts ...trace.SpanStartOption) *Span {
+	opts = append(opts, trace.WithTimestamp(startAt))
+	ctx, child := s.tracer.Start(s.ctx, name, opts...)
 	return &Span{
 		Span:   child,
 		tracer: s.tracer,
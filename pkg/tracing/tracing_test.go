@@ -361,3 +361,30 @@ func TestEdgeCases(t *testing.T) {
 		childSpan.End()
 	}
 }
+
+func TestNewClientChild(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(NoopSpan, NoopSpan.NewClientChild("child"))
+
+	tracer, err := New(&Spec{
+		ServiceName: "test",
+		SampleRate:  1,
+		Exporter: &ExporterSpec{
+			Zipkin: &ZipkinSpec{Endpoint: "http://localhost:2181"},
+		},
+	})
+	assert.Nil(err)
+	defer tracer.Close()
+
+	span := tracer.NewSpan(context.Background(), "parent")
+	child := span.NewClientChild("child")
+	assert.NotEqual(span, child)
+	assert.Equal(span.SpanContext().TraceID(), child.SpanContext().TraceID())
+
+	stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com", http.NoBody)
+	child.InjectHTTP(stdr)
+	assert.NotEmpty(stdr.Header.Get("Traceparent"))
+	child.End()
+	span.End()
+}
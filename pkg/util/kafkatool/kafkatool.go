@@ -0,0 +1,221 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package kafkatool provides the security and producer settings shared by
+// the Kafka clients of Easegress.
+package kafkatool
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+const (
+	// SASLPlain is the SASL/PLAIN mechanism.
+	SASLPlain = "PLAIN"
+	// SASLSCRAMSHA256 is the SASL/SCRAM-SHA-256 mechanism.
+	SASLSCRAMSHA256 = "SCRAM-SHA-256"
+	// SASLSCRAMSHA512 is the SASL/SCRAM-SHA-512 mechanism.
+	SASLSCRAMSHA512 = "SCRAM-SHA-512"
+)
+
+type (
+	// TLSSpec is the TLS settings to connect to Kafka brokers, certificates
+	// and keys are in PEM format.
+	TLSSpec struct {
+		CACert             string `json:"caCert,omitempty"`
+		Cert               string `json:"cert,omitempty"`
+		Key                string `json:"key,omitempty"`
+		ServerName         string `json:"serverName,omitempty"`
+		InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+	}
+
+	// SASLSpec is the SASL settings to authenticate with Kafka brokers.
+	SASLSpec struct {
+		Mechanism string `json:"mechanism" jsonschema:"required,enum=PLAIN,enum=SCRAM-SHA-256,enum=SCRAM-SHA-512"`
+		Username  string `json:"username" jsonschema:"required"`
+		Password  string `json:"password" jsonschema:"required"`
+	}
+
+	// ProducerSpec is the settings of Kafka producers.
+	ProducerSpec struct {
+		// RequiredAcks is the acks required from brokers, default is leader.
+		RequiredAcks    string `json:"requiredAcks,omitempty" jsonschema:"enum=,enum=none,enum=leader,enum=all"`
+		Idempotent      bool   `json:"idempotent,omitempty"`
+		Compression     string `json:"compression,omitempty" jsonschema:"enum=,enum=none,enum=gzip,enum=snappy,enum=lz4,enum=zstd"`
+		MaxMessageBytes int    `json:"maxMessageBytes,omitempty" jsonschema:"minimum=1"`
+		// MaxRetries is the max retries to send a message, default is 3,
+		// it is a pointer to tell 0, which disables retries, from unset.
+		MaxRetries     *int   `json:"maxRetries,omitempty" jsonschema:"minimum=0"`
+		Timeout        string `json:"timeout,omitempty" jsonschema:"format=duration"`
+		FlushMessages  int    `json:"flushMessages,omitempty" jsonschema:"minimum=0"`
+		FlushBytes     int    `json:"flushBytes,omitempty" jsonschema:"minimum=0"`
+		FlushFrequency string `json:"flushFrequency,omitempty" jsonschema:"format=duration"`
+	}
+)
+
+// Validate validates TLSSpec.
+func (spec *TLSSpec) Validate() error {
+	_, err := spec.TLSConfig()
+	return err
+}
+
+// TLSConfig returns the tls.Config of the spec.
+func (spec *TLSSpec) TLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         spec.ServerName,
+		InsecureSkipVerify: spec.InsecureSkipVerify,
+	}
+
+	if spec.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(spec.CACert)) {
+			return nil, fmt.Errorf("invalid CA certificate")
+		}
+		config.RootCAs = pool
+	}
+
+	if spec.Cert != "" || spec.Key != "" {
+		cert, err := tls.X509KeyPair([]byte(spec.Cert), []byte(spec.Key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// Apply applies the TLS settings to config.
+func (spec *TLSSpec) Apply(config *sarama.Config) error {
+	tlsConfig, err := spec.TLSConfig()
+	if err != nil {
+		return err
+	}
+	config.Net.TLS.Enable = true
+	config.Net.TLS.Config = tlsConfig
+	return nil
+}
+
+// Apply applies the SASL settings to config.
+func (spec *SASLSpec) Apply(config *sarama.Config) {
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Handshake = true
+	config.Net.SASL.User = spec.Username
+	config.Net.SASL.Password = spec.Password
+
+	switch spec.Mechanism {
+	case SASLSCRAMSHA256:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return newSCRAMClient(sha256.New)
+		}
+	case SASLSCRAMSHA512:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return newSCRAMClient(sha512.New)
+		}
+	default:
+		config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	}
+}
+
+// ApplySecurity applies the TLS and SASL settings to config, both of them
+// are optional.
+func ApplySecurity(config *sarama.Config, tlsSpec *TLSSpec, saslSpec *SASLSpec) error {
+	if tlsSpec != nil {
+		if err := tlsSpec.Apply(config); err != nil {
+			return err
+		}
+	}
+	if saslSpec != nil {
+		saslSpec.Apply(config)
+	}
+	return nil
+}
+
+// Validate validates ProducerSpec.
+func (spec *ProducerSpec) Validate() error {
+	if spec.Idempotent && spec.RequiredAcks != "" && spec.RequiredAcks != "all" {
+		return fmt.Errorf("idempotent producer requires requiredAcks to be all")
+	}
+	if spec.Idempotent && spec.MaxRetries != nil && *spec.MaxRetries == 0 {
+		return fmt.Errorf("idempotent producer requires maxRetries to be at least 1")
+	}
+	return nil
+}
+
+// Apply applies the producer settings to config.
+func (spec *ProducerSpec) Apply(config *sarama.Config) {
+	switch spec.RequiredAcks {
+	case "none":
+		config.Producer.RequiredAcks = sarama.NoResponse
+	case "leader":
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	case "all":
+		config.Producer.RequiredAcks = sarama.WaitForAll
+	}
+
+	switch spec.Compression {
+	case "none":
+		config.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		config.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		config.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		config.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		// zstd is supported since Kafka 2.1.0
+		config.Producer.Compression = sarama.CompressionZSTD
+		if !config.Version.IsAtLeast(sarama.V2_1_0_0) {
+			config.Version = sarama.V2_1_0_0
+		}
+	}
+
+	if spec.Idempotent {
+		// these are required by sarama for an idempotent producer
+		config.Producer.Idempotent = true
+		config.Producer.RequiredAcks = sarama.WaitForAll
+		config.Net.MaxOpenRequests = 1
+		if !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+			config.Version = sarama.V0_11_0_0
+		}
+	}
+
+	if spec.MaxMessageBytes > 0 {
+		config.Producer.MaxMessageBytes = spec.MaxMessageBytes
+	}
+	if spec.MaxRetries != nil {
+		config.Producer.Retry.Max = *spec.MaxRetries
+	}
+	if d, err := time.ParseDuration(spec.Timeout); err == nil && d > 0 {
+		config.Producer.Timeout = d
+	}
+
+	config.Producer.Flush.Messages = spec.FlushMessages
+	config.Producer.Flush.Bytes = spec.FlushBytes
+	if d, err := time.ParseDuration(spec.FlushFrequency); err == nil && d > 0 {
+		config.Producer.Flush.Frequency = d
+	}
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kafkatool
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func TestSCRAMClient(t *testing.T) {
+	assert := assert.New(t)
+
+	// test vector from RFC 7677
+	c := newSCRAMClient(sha256.New)
+	c.nonce = "rOprNGfwEbeRWgbNEkqO"
+	assert.NoError(c.Begin("user", "pencil", ""))
+
+	msg, err := c.Step("")
+	assert.NoError(err)
+	assert.Equal("n,,n=user,r=rOprNGfwEbeRWgbNEkqO", msg)
+	assert.False(c.Done())
+
+	msg, err = c.Step("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	assert.NoError(err)
+	assert.Equal("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", msg)
+	assert.False(c.Done())
+
+	msg, err = c.Step("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")
+	assert.NoError(err)
+	assert.Empty(msg)
+	assert.True(c.Done())
+	assert.True(c.conv.Valid())
+
+	// bad server signature
+	c = newSCRAMClient(sha256.New)
+	c.nonce = "rOprNGfwEbeRWgbNEkqO"
+	assert.NoError(c.Begin("user", "pencil", ""))
+	c.Step("")
+	c.Step("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	_, err = c.Step("v=AAAA")
+	assert.Error(err)
+	assert.False(c.conv.Valid())
+
+	// bad server nonce
+	c = newSCRAMClient(sha256.New)
+	c.nonce = "rOprNGfwEbeRWgbNEkqO"
+	assert.NoError(c.Begin("user", "pencil", ""))
+	c.Step("")
+	_, err = c.Step("r=abc,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	assert.Error(err)
+
+	// server error
+	c = newSCRAMClient(sha256.New)
+	assert.NoError(c.Begin("user", "pencil", ""))
+	c.Step("")
+	_, err = c.Step("e=unknown-user")
+	assert.Error(err)
+
+	// names are escaped
+	c = newSCRAMClient(sha256.New)
+	c.nonce = "rOprNGfwEbeRWgbNEkqO"
+	assert.NoError(c.Begin("a=b,c", "pencil", ""))
+	msg, err = c.Step("")
+	assert.NoError(err)
+	assert.Equal("n,,n=a=3Db=2Cc,r=rOprNGfwEbeRWgbNEkqO", msg)
+}
+
+func TestSASLSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	config := sarama.NewConfig()
+	spec := &SASLSpec{Mechanism: SASLPlain, Username: "user", Password: "pass"}
+	spec.Apply(config)
+	assert.True(config.Net.SASL.Enable)
+	assert.Equal(sarama.SASLMechanism(sarama.SASLTypePlaintext), config.Net.SASL.Mechanism)
+	assert.Equal("user", config.Net.SASL.User)
+	assert.Nil(config.Net.SASL.SCRAMClientGeneratorFunc)
+
+	for _, m := range []string{SASLSCRAMSHA256, SASLSCRAMSHA512} {
+		config = sarama.NewConfig()
+		spec = &SASLSpec{Mechanism: m, Username: "user", Password: "pass"}
+		assert.NoError(ApplySecurity(config, nil, spec))
+		assert.Equal(sarama.SASLMechanism(m), config.Net.SASL.Mechanism)
+		assert.NotNil(config.Net.SASL.SCRAMClientGeneratorFunc())
+		assert.False(config.Net.TLS.Enable)
+		assert.NoError(config.Validate())
+	}
+}
+
+func generateCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kafka"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return string(cert), string(keyPEM)
+}
+
+func TestTLSSpec(t *testing.T) {
+	assert := assert.New(t)
+	cert, key := generateCert(t)
+
+	spec := &TLSSpec{CACert: cert, Cert: cert, Key: key, ServerName: "kafka"}
+	assert.NoError(spec.Validate())
+
+	config := sarama.NewConfig()
+	assert.NoError(ApplySecurity(config, spec, nil))
+	assert.True(config.Net.TLS.Enable)
+	assert.Equal("kafka", config.Net.TLS.Config.ServerName)
+	assert.NotNil(config.Net.TLS.Config.RootCAs)
+	assert.Len(config.Net.TLS.Config.Certificates, 1)
+	assert.False(config.Net.SASL.Enable)
+
+	spec = &TLSSpec{CACert: "invalid"}
+	assert.Error(spec.Validate())
+	assert.Error(ApplySecurity(sarama.NewConfig(), spec, nil))
+
+	spec = &TLSSpec{Cert: cert}
+	assert.Error(spec.Validate())
+
+	spec = &TLSSpec{InsecureSkipVerify: true}
+	assert.NoError(spec.Validate())
+}
+
+func TestProducerSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &ProducerSpec{Idempotent: true, RequiredAcks: "leader"}
+	assert.Error(spec.Validate())
+
+	zero := 0
+	spec = &ProducerSpec{Idempotent: true, MaxRetries: &zero}
+	assert.Error(spec.Validate())
+
+	retries := 5
+	spec = &ProducerSpec{
+		Idempotent:      true,
+		Compression:     "zstd",
+		MaxMessageBytes: 1024,
+		MaxRetries:      &retries,
+		Timeout:         "3s",
+		FlushMessages:   100,
+		FlushBytes:      4096,
+		FlushFrequency:  "100ms",
+	}
+	assert.NoError(spec.Validate())
+
+	config := sarama.NewConfig()
+	config.Version = sarama.V1_0_0_0
+	spec.Apply(config)
+	assert.True(config.Producer.Idempotent)
+	assert.Equal(sarama.WaitForAll, config.Producer.RequiredAcks)
+	assert.Equal(1, config.Net.MaxOpenRequests)
+	assert.Equal(sarama.CompressionZSTD, config.Producer.Compression)
+	assert.Equal(sarama.V2_1_0_0, config.Version)
+	assert.Equal(1024, config.Producer.MaxMessageBytes)
+	assert.Equal(5, config.Producer.Retry.Max)
+	assert.Equal(3*time.Second, config.Producer.Timeout)
+	assert.Equal(100, config.Producer.Flush.Messages)
+	assert.Equal(4096, config.Producer.Flush.Bytes)
+	assert.Equal(100*time.Millisecond, config.Producer.Flush.Frequency)
+	assert.NoError(config.Validate())
+
+	config = sarama.NewConfig()
+	spec = &ProducerSpec{RequiredAcks: "none", Compression: "gzip"}
+	spec.Apply(config)
+	assert.Equal(sarama.NoResponse, config.Producer.RequiredAcks)
+	assert.Equal(sarama.CompressionGZIP, config.Producer.Compression)
+	assert.False(config.Producer.Idempotent)
+	assert.Equal(3, config.Producer.Retry.Max)
+
+	// retries are disabled by 0.
+	config = sarama.NewConfig()
+	spec = &ProducerSpec{MaxRetries: &zero}
+	spec.Apply(config)
+	assert.Equal(0, config.Producer.Retry.Max)
+	assert.NoError(config.Validate())
+}
+
+func TestProducerMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	var nilMetrics *ProducerMetrics
+	msg := &sarama.ProducerMessage{Topic: "topic", Value: sarama.StringEncoder("text")}
+	assert.NotPanics(func() { nilMetrics.Observe(msg, nil) })
+
+	m := NewProducerMetrics("Kafka", "pipeline", "kafka")
+	Start(msg)
+	assert.IsType(time.Time{}, msg.Metadata)
+	assert.NotPanics(func() {
+		m.Observe(msg, nil)
+		m.Observe(msg, sarama.ErrOutOfBrokers)
+		m.Observe(nil, sarama.ErrOutOfBrokers)
+	})
+}
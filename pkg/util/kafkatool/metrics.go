@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kafkatool
+
+import (
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/megaease/easegress/v2/pkg/util/prometheushelper"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ProducerMetrics is the Prometheus metrics of a Kafka producer.
+type ProducerMetrics struct {
+	Messages *prometheus.CounterVec
+	Bytes    *prometheus.CounterVec
+	Latency  prometheus.ObserverVec
+}
+
+// NewProducerMetrics creates the metrics of the producer of a filter.
+func NewProducerMetrics(kind, pipeline, filter string) *ProducerMetrics {
+	commonLabels := prometheus.Labels{
+		"kind":         kind,
+		"pipelineName": pipeline,
+		"filterName":   filter,
+	}
+	labels := []string{"kind", "pipelineName", "filterName", "topic", "result"}
+
+	return &ProducerMetrics{
+		Messages: prometheushelper.NewCounter(
+			"kafka_producer_messages_total",
+			"the total count of messages sent to kafka",
+			labels).MustCurryWith(commonLabels),
+		Bytes: prometheushelper.NewCounter(
+			"kafka_producer_message_bytes_total",
+			"the total bytes of message values sent to kafka",
+			labels).MustCurryWith(commonLabels),
+		Latency: prometheushelper.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "kafka_producer_latency",
+				Help:    "a histogram of the latency of sending messages to kafka in milliseconds",
+				Buckets: prometheushelper.DefaultDurationBuckets(),
+			},
+			labels).MustCurryWith(commonLabels),
+	}
+}
+
+// Start records the start time of sending the message, it uses the Metadata
+// field of the message, so the field must not be used by others.
+func Start(msg *sarama.ProducerMessage) {
+	msg.Metadata = time.Now()
+}
+
+// Observe records the result of sending the message. It is safe to call
+// Observe on a nil ProducerMetrics or with a nil message.
+func (m *ProducerMetrics) Observe(msg *sarama.ProducerMessage, err error) {
+	if m == nil || msg == nil {
+		return
+	}
+
+	labels := prometheus.Labels{"topic": msg.Topic, "result": "success"}
+	if err != nil {
+		labels["result"] = "failure"
+	}
+
+	m.Messages.With(labels).Inc()
+	if msg.Value != nil {
+		m.Bytes.With(labels).Add(float64(msg.Value.Length()))
+	}
+	if start, ok := msg.Metadata.(time.Time); ok {
+		m.Latency.With(labels).Observe(float64(time.Since(start).Milliseconds()))
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kafkatool
+
+import (
+	"github.com/xdg-go/scram"
+)
+
+// scramClient implements sarama.SCRAMClient with github.com/xdg-go/scram.
+type scramClient struct {
+	hash scram.HashGeneratorFcn
+	conv *scram.ClientConversation
+
+	// nonce overrides the random client nonce, it is used by tests only.
+	nonce string
+}
+
+func newSCRAMClient(hash scram.HashGeneratorFcn) *scramClient {
+	return &scramClient{hash: hash}
+}
+
+// Begin prepares the client for the SCRAM exchange.
+func (c *scramClient) Begin(username, password, authzID string) error {
+	client, err := c.hash.NewClient(username, password, authzID)
+	if err != nil {
+		return err
+	}
+	if c.nonce != "" {
+		client = client.WithNonceGenerator(func() string { return c.nonce })
+	}
+	c.conv = client.NewConversation()
+	return nil
+}
+
+// Step steps the client through the SCRAM exchange, challenge is the message
+// from the server, and is empty for the first step.
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conv.Step(challenge)
+}
+
+// Done returns true if the SCRAM exchange is completed or has failed.
+func (c *scramClient) Done() bool {
+	return c.conv.Done()
+}
@@ -142,3 +142,35 @@ func (ds *DurationSampler) Percentiles() []float64 {
 
 	return result
 }
+
+// RateSampler is a deterministic sampler which selects a fixed fraction of
+// the events it sees, for example, 1 out of every 10 events for rate 0.1.
+type RateSampler struct {
+	rate  float64
+	count uint64
+}
+
+// NewRateSampler creates a RateSampler, rate is clamped into [0, 1].
+func NewRateSampler(rate float64) *RateSampler {
+	if rate < 0 {
+		rate = 0
+	} else if rate > 1 {
+		rate = 1
+	}
+	return &RateSampler{rate: rate}
+}
+
+// Sample reports whether the current event should be sampled. This function
+// could be called concurrently.
+func (rs *RateSampler) Sample() bool {
+	switch rs.rate {
+	case 0:
+		return false
+	case 1:
+		return true
+	}
+	n := atomic.AddUint64(&rs.count, 1)
+	// an event is sampled when it moves the expected number of sampled
+	// events to the next integer.
+	return uint64(float64(n)*rs.rate) != uint64(float64(n-1)*rs.rate)
+}
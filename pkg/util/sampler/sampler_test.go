@@ -53,3 +53,24 @@ func TestSampler(t *testing.T) {
 	assert.Equal(t, 0.0, p[1])
 	assert.Equal(t, 0.0, p[2])
 }
+
+func TestRateSampler(t *testing.T) {
+	s := NewRateSampler(0)
+	for i := 0; i < 100; i++ {
+		assert.False(t, s.Sample())
+	}
+
+	s = NewRateSampler(2)
+	for i := 0; i < 100; i++ {
+		assert.True(t, s.Sample())
+	}
+
+	s = NewRateSampler(0.1)
+	count := 0
+	for i := 0; i < 1000; i++ {
+		if s.Sample() {
+			count++
+		}
+	}
+	assert.Equal(t, 100, count)
+}